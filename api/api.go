@@ -1,5 +1,83 @@
 package api
 
+import "time"
+
+// ErrorResp is the response of errors. Code is machine-readable while Error is for human.
 type ErrorResp struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// Problem is the RFC 7807 form of ErrorResp. Type is always "about:blank", so Title is the status text.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code,omitempty"`
+}
+
+// CacheEntryResp is a stored cache entry. TTL is the remaining seconds in the cache, or -1 if it never expires.
+// Body is the stored response, which is a string if it's not JSON.
+type CacheEntryResp struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"statusCode"`
+	TTL        int64       `json:"ttl"`
+	StoredAt   *time.Time  `json:"storedAt,omitempty"`
+	FreshUntil *time.Time  `json:"freshUntil,omitempty"`
+	Body       interface{} `json:"body"`
 }
+
+// MetaConfigResp is the cache policy and the quota costs of the YouTube apis for the clients to configure themselves.
+// The ttls are in seconds.
+type MetaConfigResp struct {
+	CacheEnabled         bool                     `json:"cacheEnabled"`
+	StaleWhileRevalidate int                      `json:"staleWhileRevalidate"`
+	APIs                 map[string]MetaAPIConfig `json:"apis"`
+}
+
+// MetaAPIConfig is the cache policy and the quota cost of an api path. The ttls are without Cache-Set-TTL, and they're
+// 0 if the responses aren't cached.
+type MetaAPIConfig struct {
+	Cached    bool  `json:"cached"`
+	TTL       int   `json:"ttl"`
+	ErrorTTL  int   `json:"errorTtl"`
+	QuotaCost int64 `json:"quotaCost"`
+}
+
+// The codes of ErrorResp
+const (
+	// CodeInvalidParameter is for the parameters failing to be parsed, e.g. maxResults out of range
+	CodeInvalidParameter = "ERR_INVALID_PARAMETER"
+	CodeEmptyPart        = "ERR_EMPTY_PART"
+	CodeEmptyID          = "ERR_EMPTY_ID"
+	// CodeChannelNotWhitelisted is for the requested channel, or the channel of a requested video
+	CodeChannelNotWhitelisted  = "ERR_CHANNEL_NOT_WHITELISTED"
+	CodePlaylistNotWhitelisted = "ERR_PLAYLIST_NOT_WHITELISTED"
+	CodeInvalidPageToken       = "ERR_INVALID_PAGE_TOKEN"
+	CodeUpstreamQuota          = "ERR_UPSTREAM_QUOTA"
+	// CodePartNotAllowed is for the parts out of the allowedParts of the api
+	CodePartNotAllowed = "ERR_PART_NOT_ALLOWED"
+	// CodeVideoNotFound is for none of the requested videos being found with strictVideoLookup
+	CodeVideoNotFound = "ERR_VIDEO_NOT_FOUND"
+	// CodeQuotaBudget is for the requests rejected as the quota budget of the day runs low
+	CodeQuotaBudget = "ERR_QUOTA_BUDGET"
+	// CodeUpstreamRejected is for the other requests rejected by YouTube with 4xx
+	CodeUpstreamRejected = "ERR_UPSTREAM_REJECTED"
+	// CodeUpstreamFailure is for YouTube failing with 5xx
+	CodeUpstreamFailure = "ERR_UPSTREAM_FAILURE"
+	// CodeUpstreamUnavailable is for the calls short-circuited by the circuit breaker
+	CodeUpstreamUnavailable = "ERR_UPSTREAM_UNAVAILABLE"
+	// CodeReadOnly is for the cache misses in the read-only mode, which never call YouTube
+	CodeReadOnly = "ERR_READ_ONLY"
+	// CodeTooManyConcurrent is for the requests beyond the concurrency limit of the api
+	CodeTooManyConcurrent  = "ERR_TOO_MANY_CONCURRENT"
+	CodeResponseTooLarge   = "ERR_RESPONSE_TOO_LARGE"
+	CodeInvalidCallback    = "ERR_INVALID_CALLBACK"
+	CodeWhitelistRefresh   = "ERR_WHITELIST_REFRESH"
+	CodeCacheDisabled      = "ERR_CACHE_DISABLED"
+	CodeCacheEntryNotFound = "ERR_CACHE_ENTRY_NOT_FOUND"
+	CodeMissingToken       = "ERR_MISSING_TOKEN"
+	CodeInvalidToken       = "ERR_INVALID_TOKEN"
+	CodeInternal           = "ERR_INTERNAL"
+)
@@ -4,6 +4,7 @@ package cache
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,6 +16,47 @@ import (
 type HTTP struct {
 	StatusCode int    `json:"code"`
 	Response   []byte `json:"response"`
+	// FreshUntil is the unix time after which the entry is stale. Zero means the entry never turns stale.
+	FreshUntil int64 `json:"freshUntil,omitempty"`
+	// ExpireAt is the unix time when the entry is removed from the cache
+	ExpireAt int64 `json:"expireAt,omitempty"`
+	// StoredAt is the unix time when the entry is written. Zero for the entries written before it's introduced.
+	StoredAt int64 `json:"storedAt,omitempty"`
+}
+
+// Age is how long the entry has been stored, or false if it's unknown
+func (h HTTP) Age(now time.Time) (time.Duration, bool) {
+	if h.StoredAt == 0 {
+		return 0, false
+	}
+	age := now.Sub(time.Unix(h.StoredAt, 0))
+	if age < 0 {
+		age = 0
+	}
+	return age, true
+}
+
+// IsExpired reports whether the entry has passed ExpireAt, after which it's only kept for the upstream failures
+func (h HTTP) IsExpired(now time.Time) bool {
+	return h.ExpireAt != 0 && now.Unix() >= h.ExpireAt
+}
+
+// IsStale reports whether the entry has passed its freshness deadline
+func (h HTTP) IsStale(now time.Time) bool {
+	return h.FreshUntil != 0 && now.Unix() >= h.FreshUntil
+}
+
+type revalidationKey struct{}
+
+// WithRevalidation marks the context as a background revalidation of a stale cache entry
+func WithRevalidation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, revalidationKey{}, true)
+}
+
+// IsRevalidation reports whether the context belongs to a background revalidation
+func IsRevalidation(ctx context.Context) bool {
+	isRevalidation, _ := ctx.Value(revalidationKey{}).(bool)
+	return isRevalidation
 }
 
 type Rediser interface {
@@ -23,11 +65,39 @@ type Rediser interface {
 	SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd
 
 	Get(ctx context.Context, key string) *redis.StringCmd
+	IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+
+	Ping(ctx context.Context) *redis.StatusCmd
 }
 
-func GetCacheKey(namespace string, name string) (string, error) {
-	if namespace == "" {
+const DefaultKeySeparator = ":"
+
+// KeyBuilder builds the cache keys like "namespace:cache:name", or "namespace:version:cache:name" when the version is
+// set. Bumping the version logically invalidates all the entries of the previous version.
+type KeyBuilder struct {
+	Namespace string
+	Version   string
+	// Separator defaults to DefaultKeySeparator
+	Separator string
+}
+
+// NewKeyBuilder creates the KeyBuilder of namespace with the version and the separator in cacheConf
+func NewKeyBuilder(namespace string, cacheConf config.Cache) KeyBuilder {
+	return KeyBuilder{
+		Namespace: namespace,
+		Version:   cacheConf.Version,
+		Separator: cacheConf.KeySeparator,
+	}
+}
+
+func (b KeyBuilder) Key(name string) (string, error) {
+	if b.Namespace == "" {
 		err := errors.New("namespace cannot be empty")
 		return "", err
 	}
@@ -37,7 +107,64 @@ func GetCacheKey(namespace string, name string) (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("%s:cache:%s", namespace, name), nil
+	return b.build("cache", name)
+}
+
+func (b KeyBuilder) build(segments ...string) (string, error) {
+	separator := b.Separator
+	if separator == "" {
+		separator = DefaultKeySeparator
+	}
+
+	prefix := []string{b.Namespace}
+	if b.Version != "" {
+		prefix = append(prefix, b.Version)
+	}
+	return strings.Join(append(prefix, segments...), separator), nil
+}
+
+// QuotaKey builds the key of the quota used on the day, e.g. "namespace:quota:2006-01-02". It isn't versioned as the
+// quota is shared by the versions.
+func (b KeyBuilder) QuotaKey(day string) (string, error) {
+	return KeyBuilder{Namespace: b.Namespace, Separator: b.Separator}.build("quota", day)
+}
+
+// IndexKey builds the key of the set indexing the cache keys of the id of kind, e.g. "namespace:version:index:channel:id"
+func (b KeyBuilder) IndexKey(kind IndexKind, id string) (string, error) {
+	return b.build("index", string(kind), id)
+}
+
+func GetCacheKey(namespace string, name string) (string, error) {
+	return KeyBuilder{Namespace: namespace}.Key(name)
+}
+
+// defaultPool is the pool of cluster, sentinel, and replica before it's configurable
+var defaultPool = config.RedisPool{
+	PoolSize:     20,
+	DialTimeout:  1000,
+	ReadTimeout:  1000,
+	WriteTimeout: 1000,
+}
+
+// withPoolDefaults fills the zero values of pool with defaultPool
+func withPoolDefaults(pool config.RedisPool) config.RedisPool {
+	if pool.PoolSize == 0 {
+		pool.PoolSize = defaultPool.PoolSize
+	}
+	if pool.DialTimeout == 0 {
+		pool.DialTimeout = defaultPool.DialTimeout
+	}
+	if pool.ReadTimeout == 0 {
+		pool.ReadTimeout = defaultPool.ReadTimeout
+	}
+	if pool.WriteTimeout == 0 {
+		pool.WriteTimeout = defaultPool.WriteTimeout
+	}
+	return pool
+}
+
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
 }
 
 func NewRedis(c config.Conf) (rdb Rediser, err error) {
@@ -49,17 +176,19 @@ func NewRedis(c config.Conf) (rdb Rediser, err error) {
 		}
 		addrs := make([]string, 0, len(cluster.Addrs))
 		for _, a := range cluster.Addrs {
-			addrs = append(addrs, fmt.Sprintf("%s:%d", a.Addr, a.Port))
+			addrs = append(addrs, a.String())
 		}
+		pool := withPoolDefaults(c.Redis.Pool)
 		rdb = redis.NewClusterClient(&redis.ClusterOptions{
 			Addrs:        addrs,
 			Password:     cluster.Password,
-			PoolSize:     20,
-			MaxRetries:   0,
-			DialTimeout:  time.Second,
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			MaxRetries:   pool.MaxRetries,
+			DialTimeout:  millis(pool.DialTimeout),
 			IdleTimeout:  10 * time.Second,
-			ReadTimeout:  time.Second,
-			WriteTimeout: time.Second,
+			ReadTimeout:  millis(pool.ReadTimeout),
+			WriteTimeout: millis(pool.WriteTimeout),
 		})
 	case config.Single:
 		single := c.Redis.SingleInstance
@@ -67,11 +196,19 @@ func NewRedis(c config.Conf) (rdb Rediser, err error) {
 			return nil, errors.New("there's no single instance redis address provided")
 		}
 
-		addr := fmt.Sprintf("%s:%d", single.Instance.Addr, single.Instance.Port)
+		addr := single.Instance.String()
 
+		// single has used the go-redis defaults, which are kept by the zero values
+		pool := c.Redis.Pool
 		rdb = redis.NewClient(&redis.Options{
-			Addr:     addr,
-			Password: single.Password,
+			Addr:         addr,
+			Password:     single.Password,
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			MaxRetries:   pool.MaxRetries,
+			DialTimeout:  millis(pool.DialTimeout),
+			ReadTimeout:  millis(pool.ReadTimeout),
+			WriteTimeout: millis(pool.WriteTimeout),
 		})
 	case config.Sentinel:
 		sentinel := c.Redis.Sentinel
@@ -81,17 +218,21 @@ func NewRedis(c config.Conf) (rdb Rediser, err error) {
 
 		addrs := make([]string, 0, len(sentinel.Addrs))
 		for _, a := range sentinel.Addrs {
-			addrs = append(addrs, fmt.Sprintf("%s:%d", a.Addr, a.Port))
+			addrs = append(addrs, a.String())
 		}
+		pool := withPoolDefaults(c.Redis.Pool)
 		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
-			SentinelAddrs: addrs,
-			Password:      sentinel.Password,
-			PoolSize:      20,
-			MaxRetries:    0,
-			DialTimeout:   time.Second,
-			IdleTimeout:   10 * time.Second,
-			ReadTimeout:   time.Second,
-			WriteTimeout:  time.Second,
+			MasterName:       sentinel.MasterName,
+			SentinelAddrs:    addrs,
+			SentinelPassword: sentinel.SentinelPassword,
+			Password:         sentinel.Password,
+			PoolSize:         pool.PoolSize,
+			MinIdleConns:     pool.MinIdleConns,
+			MaxRetries:       pool.MaxRetries,
+			DialTimeout:      millis(pool.DialTimeout),
+			IdleTimeout:      10 * time.Second,
+			ReadTimeout:      millis(pool.ReadTimeout),
+			WriteTimeout:     millis(pool.WriteTimeout),
 		})
 	case config.Replica:
 		replica := c.Redis.Replica
@@ -101,10 +242,17 @@ func NewRedis(c config.Conf) (rdb Rediser, err error) {
 		if len(replica.SlaveAddrs) == 0 {
 			return nil, errors.New("there's no slave redis address provided")
 		}
-		if rdb, err = NewReplicaRedisService(replica.MasterAddrs, replica.SlaveAddrs, replica.Password); err != nil {
+		if rdb, err = NewReplicaRedisService(replica.MasterAddrs, replica.SlaveAddrs, replica.Password, replica.Routing, withPoolDefaults(c.Redis.Pool)); err != nil {
 			err = errors.Wrap(err, "Cannot create Replica type Redis service")
 			return nil, err
 		}
+	case config.Memory:
+		var maxEntries, sweepInterval int
+		if memory := c.Redis.Memory; memory != nil {
+			maxEntries = memory.MaxEntries
+			sweepInterval = memory.SweepInterval
+		}
+		rdb = NewMemory(maxEntries, time.Duration(sweepInterval)*time.Second)
 	default:
 		return nil, fmt.Errorf("unsupported redis type(%s)", c.Redis.Type)
 	}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func TestKeyBuilder(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		cacheConf config.Cache
+		want      string
+		wantErr   bool
+	}{
+		{name: "unversioned key", namespace: "yt-relay", want: "yt-relay:cache:/youtube/v3/videos?id=video1"},
+		{name: "versioned key", namespace: "yt-relay", cacheConf: config.Cache{Version: "v2"}, want: "yt-relay:v2:cache:/youtube/v3/videos?id=video1"},
+		{name: "custom separator", namespace: "yt-relay", cacheConf: config.Cache{KeySeparator: "|"}, want: "yt-relay|cache|/youtube/v3/videos?id=video1"},
+		{name: "versioned key with custom separator", namespace: "yt-relay", cacheConf: config.Cache{Version: "v2", KeySeparator: "::"}, want: "yt-relay::v2::cache::/youtube/v3/videos?id=video1"},
+		{name: "empty namespace", cacheConf: config.Cache{Version: "v2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewKeyBuilder(tt.namespace, tt.cacheConf).Key("/youtube/v3/videos?id=video1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyBuilderOfEmptyName(t *testing.T) {
+	if _, err := NewKeyBuilder("yt-relay", config.Cache{}).Key(""); err == nil {
+		t.Error("Key() of empty name succeeded")
+	}
+}
+
+func TestGetCacheKeyIsUnversioned(t *testing.T) {
+	got, err := GetCacheKey("yt-relay", "/youtube/v3/search?q=news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "yt-relay:cache:/youtube/v3/search?q=news"; got != want {
+		t.Errorf("GetCacheKey() = %q, want %q", got, want)
+	}
+}
+
+func TestKeysOfOtherKinds(t *testing.T) {
+	b := NewKeyBuilder("yt-relay", config.Cache{Version: "v2", KeySeparator: "|"})
+
+	quotaKey, err := b.QuotaKey("2006-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the quota is shared by the versions
+	if want := "yt-relay|quota|2006-01-02"; quotaKey != want {
+		t.Errorf("QuotaKey() = %q, want %q", quotaKey, want)
+	}
+
+	indexKey, err := b.IndexKey(IndexChannel, "channel1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "yt-relay|v2|index|channel|channel1"; indexKey != want {
+		t.Errorf("IndexKey() = %q, want %q", indexKey, want)
+	}
+}
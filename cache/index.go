@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IndexKind is the kind of ids the cache keys are indexed by
+type IndexKind string
+
+const (
+	IndexChannel  IndexKind = "channel"
+	IndexPlaylist IndexKind = "playlist"
+)
+
+// Index adds key to the index of the id so that it can be invalidated by the id. The index lives for at least ttl.
+func Index(ctx context.Context, rdb Rediser, keyBuilder KeyBuilder, kind IndexKind, id string, key string, ttl time.Duration) error {
+	indexKey, err := keyBuilder.IndexKey(kind, id)
+	if err != nil {
+		return err
+	}
+	if err = rdb.SAdd(ctx, indexKey, key).Err(); err != nil {
+		return errors.Wrapf(err, "indexing %s by %s(%s) encountered error", key, kind, id)
+	}
+	if err = rdb.Expire(ctx, indexKey, ttl).Err(); err != nil {
+		return errors.Wrapf(err, "setting ttl of index of %s(%s) encountered error", kind, id)
+	}
+	return nil
+}
+
+// Invalidate deletes the cache entries indexed by the id and the index itself. It returns the number of deleted entries.
+func Invalidate(ctx context.Context, rdb Rediser, keyBuilder KeyBuilder, kind IndexKind, id string) (deleted int64, err error) {
+	indexKey, err := keyBuilder.IndexKey(kind, id)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting index of %s(%s) encountered error", kind, id)
+	}
+
+	// keys are deleted one by one as they may be in different slots of a cluster
+	for _, key := range keys {
+		n, err := rdb.Del(ctx, key).Result()
+		if err != nil {
+			return deleted, errors.Wrapf(err, "deleting cache(%s) encountered error", key)
+		}
+		deleted += n
+	}
+	if err = rdb.Del(ctx, indexKey).Err(); err != nil {
+		return deleted, errors.Wrapf(err, "deleting index of %s(%s) encountered error", kind, id)
+	}
+	return deleted, nil
+}
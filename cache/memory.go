@@ -0,0 +1,286 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultMemoryMaxEntries    = 10000
+	defaultMemorySweepInterval = time.Minute
+)
+
+type memoryEntry struct {
+	key   string
+	value string
+	// members is the content of a set, which is nil for a string
+	members  map[string]bool
+	expireAt time.Time
+}
+
+// errNotInteger is what redis responds for INCRBY against a key not holding an integer
+var errNotInteger = errors.New("ERR value is not an integer or out of range")
+
+// errWrongType is what redis responds for the commands against a key holding the other type
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (e *memoryEntry) isExpired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// memoryCache implements Rediser with an in-process LRU. It's safe for concurrent use by gin handlers as all
+// operations are serialized by a mutex. Expired entries are never returned and are removed by a background sweeper.
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru keeps the most recently used entry at the front
+	lru *list.List
+}
+
+// NewMemory creates an in-memory LRU cache holding at most maxEntries, sweeping expired entries every sweepInterval
+func NewMemory(maxEntries int, sweepInterval time.Duration) Rediser {
+	if maxEntries <= 0 {
+		maxEntries = defaultMemoryMaxEntries
+	}
+	if sweepInterval <= 0 {
+		sweepInterval = defaultMemorySweepInterval
+	}
+	m := &memoryCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	go m.sweep(sweepInterval)
+	return m
+}
+
+func (m *memoryCache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.mu.Lock()
+		for e := m.lru.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(*memoryEntry).isExpired(now) {
+				m.remove(e)
+			}
+			e = next
+		}
+		m.mu.Unlock()
+	}
+}
+
+// lookup returns the live element of key and removes the expired one. The caller must hold the lock.
+func (m *memoryCache) lookup(key string, now time.Time) *list.Element {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.Value.(*memoryEntry).isExpired(now) {
+		m.remove(e)
+		return nil
+	}
+	return e
+}
+
+// store inserts or replaces the value of key and evicts the least recently used entries. The caller must hold the lock.
+func (m *memoryCache) store(key string, value interface{}, ttl time.Duration, now time.Time) {
+	entry := &memoryEntry{key: key, value: toString(value)}
+	if ttl > 0 {
+		entry.expireAt = now.Add(ttl)
+	}
+	if e, ok := m.entries[key]; ok {
+		e.Value = entry
+		m.lru.MoveToFront(e)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(entry)
+	for m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memoryCache) remove(e *list.Element) {
+	m.lru.Remove(e)
+	delete(m.entries, e.Value.(*memoryEntry).key)
+}
+
+func (m *memoryCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(key, value, ttl, time.Now())
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (m *memoryCache) SetXX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.lookup(key, now) == nil {
+		return redis.NewBoolResult(false, nil)
+	}
+	m.store(key, value, ttl, now)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (m *memoryCache) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.lookup(key, now) != nil {
+		return redis.NewBoolResult(false, nil)
+	}
+	m.store(key, value, ttl, now)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (m *memoryCache) Get(ctx context.Context, key string) *redis.StringCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.lookup(key, time.Now())
+	if e == nil {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	if e.Value.(*memoryEntry).members != nil {
+		return redis.NewStringResult("", errWrongType)
+	}
+	m.lru.MoveToFront(e)
+	return redis.NewStringResult(e.Value.(*memoryEntry).value, nil)
+}
+
+// IncrBy keeps the ttl of the key like redis, and the key created by it never expires
+func (m *memoryCache) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e := m.lookup(key, now)
+	if e == nil {
+		m.store(key, "0", 0, now)
+		e = m.entries[key]
+	}
+	entry := e.Value.(*memoryEntry)
+	if entry.members != nil {
+		return redis.NewIntResult(0, errWrongType)
+	}
+	n, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return redis.NewIntResult(0, errNotInteger)
+	}
+	n += value
+	entry.value = strconv.FormatInt(n, 10)
+	m.lru.MoveToFront(e)
+	return redis.NewIntResult(n, nil)
+}
+
+func (m *memoryCache) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	now := time.Now()
+	for _, key := range keys {
+		if e := m.lookup(key, now); e != nil {
+			m.remove(e)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (m *memoryCache) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e := m.lookup(key, now)
+	if e == nil {
+		return redis.NewBoolResult(false, nil)
+	}
+	if ttl <= 0 {
+		m.remove(e)
+	} else {
+		e.Value.(*memoryEntry).expireAt = now.Add(ttl)
+	}
+	return redis.NewBoolResult(true, nil)
+}
+
+// TTL responds like redis: -2 if the key doesn't exist and -1 if it never expires
+func (m *memoryCache) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e := m.lookup(key, now)
+	if e == nil {
+		return redis.NewDurationResult(-2, nil)
+	}
+	expireAt := e.Value.(*memoryEntry).expireAt
+	if expireAt.IsZero() {
+		return redis.NewDurationResult(-1, nil)
+	}
+	return redis.NewDurationResult(expireAt.Sub(now), nil)
+}
+
+func (m *memoryCache) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.lookup(key, time.Now())
+	if e == nil {
+		m.store(key, "", 0, time.Now())
+		e = m.entries[key]
+		e.Value.(*memoryEntry).members = make(map[string]bool)
+	}
+	entry := e.Value.(*memoryEntry)
+	if entry.members == nil {
+		return redis.NewIntResult(0, errWrongType)
+	}
+	m.lru.MoveToFront(e)
+
+	var n int64
+	for _, member := range members {
+		if s := toString(member); !entry.members[s] {
+			entry.members[s] = true
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (m *memoryCache) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.lookup(key, time.Now())
+	if e == nil {
+		return redis.NewStringSliceResult([]string{}, nil)
+	}
+	entry := e.Value.(*memoryEntry)
+	if entry.members == nil {
+		return redis.NewStringSliceResult(nil, errWrongType)
+	}
+	members := make([]string, 0, len(entry.members))
+	for member := range entry.members {
+		members = append(members, member)
+	}
+	return redis.NewStringSliceResult(members, nil)
+}
+
+func (m *memoryCache) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
+
+// toString converts the value like redis does when it's stored
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
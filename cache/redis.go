@@ -2,7 +2,8 @@ package cache
 
 import (
 	"context"
-	"fmt"
+	"math"
+	"math/rand"
 	"sync/atomic"
 	"time"
 
@@ -10,12 +11,50 @@ import (
 	"github.com/mirror-media/yt-relay/config"
 )
 
-// replicaTypeRedis implements Rediser
+// latencyProbeInterval is the interval to measure the latencies of the readers for config.RouteByLatency
+const latencyProbeInterval = 10 * time.Second
+
+// replicaTypeRedis implements Rediser. Writes are sent to the writers in turn, and reads are sent to the readers
+// according to the routing.
 type replicaTypeRedis struct {
 	writeCount uint32
 	readCount  uint32
 	writers    []*redis.Client
 	readers    []*redis.Client
+	routing    config.RedisRouting
+	// latencies are the latest ping latencies in nanoseconds of the readers for config.RouteByLatency
+	latencies []int64
+}
+
+// reader picks the reader of the next read
+func (r *replicaTypeRedis) reader() *redis.Client {
+	switch r.routing {
+	case config.RouteRandomly:
+		return r.readers[rand.Intn(len(r.readers))]
+	case config.RouteByLatency:
+		fastest := 0
+		for i := range r.latencies {
+			if atomic.LoadInt64(&r.latencies[i]) < atomic.LoadInt64(&r.latencies[fastest]) {
+				fastest = i
+			}
+		}
+		return r.readers[fastest]
+	default:
+		rc := atomic.AddUint32(&r.readCount, 1)
+		return r.readers[int(rc)%len(r.readers)]
+	}
+}
+
+// probeLatencies measures the latencies of the readers by pings. Unreachable readers are considered the slowest.
+func (r *replicaTypeRedis) probeLatencies() {
+	for i, c := range r.readers {
+		start := time.Now()
+		latency := int64(math.MaxInt64)
+		if err := c.Ping(context.Background()).Err(); err == nil {
+			latency = int64(time.Since(start))
+		}
+		atomic.StoreInt64(&r.latencies[i], latency)
+	}
 }
 
 func (r *replicaTypeRedis) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
@@ -37,45 +76,93 @@ func (r *replicaTypeRedis) SetNX(ctx context.Context, key string, value interfac
 }
 
 func (r *replicaTypeRedis) Get(ctx context.Context, key string) *redis.StringCmd {
-	rc := atomic.AddUint32(&r.readCount, 1)
-	i := int(rc) % len(r.writers)
-	return r.readers[i].Get(ctx, key)
+	return r.reader().Get(ctx, key)
 }
+func (r *replicaTypeRedis) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	wc := atomic.AddUint32(&r.writeCount, 1)
+	i := int(wc) % len(r.writers)
+	return r.writers[i].IncrBy(ctx, key, value)
+}
+
 func (r *replicaTypeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
 	wc := atomic.AddUint32(&r.writeCount, 1)
 	i := int(wc) % len(r.writers)
 	return r.writers[i].Del(ctx, keys...)
 }
 
-func NewReplicaRedisService(MasterAddrs []config.RedisAddress, SlaveAddrs []config.RedisAddress, Password string) (Rediser, error) {
-	instance := replicaTypeRedis{}
+func (r *replicaTypeRedis) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	wc := atomic.AddUint32(&r.writeCount, 1)
+	i := int(wc) % len(r.writers)
+	return r.writers[i].Expire(ctx, key, ttl)
+}
+
+func (r *replicaTypeRedis) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	return r.reader().TTL(ctx, key)
+}
+
+func (r *replicaTypeRedis) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	wc := atomic.AddUint32(&r.writeCount, 1)
+	i := int(wc) % len(r.writers)
+	return r.writers[i].SAdd(ctx, key, members...)
+}
+
+func (r *replicaTypeRedis) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return r.reader().SMembers(ctx, key)
+}
+
+// Ping pings all the writers and readers since any of them may serve the requests
+func (r *replicaTypeRedis) Ping(ctx context.Context) *redis.StatusCmd {
+	for _, c := range append(append([]*redis.Client{}, r.writers...), r.readers...) {
+		if cmd := c.Ping(ctx); cmd.Err() != nil {
+			return cmd
+		}
+	}
+	return redis.NewStatusResult("PONG", nil)
+}
+
+func NewReplicaRedisService(MasterAddrs []config.RedisAddress, SlaveAddrs []config.RedisAddress, Password string, routing config.RedisRouting, pool config.RedisPool) (Rediser, error) {
+	instance := replicaTypeRedis{routing: routing}
 	writers := make([]*redis.Client, 0, len(MasterAddrs))
 	for _, a := range MasterAddrs {
 		writers = append(writers, redis.NewClient(&redis.Options{
-			Addr:         fmt.Sprintf("%s:%d", a.Addr, a.Port),
+			Addr:         a.String(),
 			Password:     Password,
-			PoolSize:     20,
-			MaxRetries:   0,
-			DialTimeout:  time.Second,
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			MaxRetries:   pool.MaxRetries,
+			DialTimeout:  millis(pool.DialTimeout),
 			IdleTimeout:  10 * time.Second,
-			ReadTimeout:  time.Second,
-			WriteTimeout: time.Second,
+			ReadTimeout:  millis(pool.ReadTimeout),
+			WriteTimeout: millis(pool.WriteTimeout),
 		}))
 	}
 	instance.writers = writers
 	readers := make([]*redis.Client, 0, len(SlaveAddrs))
 	for _, a := range SlaveAddrs {
 		readers = append(readers, redis.NewClient(&redis.Options{
-			Addr:         fmt.Sprintf("%s:%d", a.Addr, a.Port),
+			Addr:         a.String(),
 			Password:     Password,
-			PoolSize:     20,
-			MaxRetries:   0,
-			DialTimeout:  time.Second,
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			MaxRetries:   pool.MaxRetries,
+			DialTimeout:  millis(pool.DialTimeout),
 			IdleTimeout:  10 * time.Second,
-			ReadTimeout:  time.Second,
-			WriteTimeout: time.Second,
+			ReadTimeout:  millis(pool.ReadTimeout),
+			WriteTimeout: millis(pool.WriteTimeout),
 		}))
 	}
 	instance.readers = readers
+
+	if routing == config.RouteByLatency {
+		instance.latencies = make([]int64, len(readers))
+		instance.probeLatencies()
+		go func() {
+			ticker := time.NewTicker(latencyProbeInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				instance.probeLatencies()
+			}
+		}()
+	}
 	return &instance, nil
 }
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+var errDispatched = errors.New("command is dispatched without being sent")
+
+// dispatchRecorder records the nodes the commands are dispatched to, and stops the commands before they're sent
+type dispatchRecorder struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+type recordingHook struct {
+	recorder *dispatchRecorder
+	node     string
+}
+
+func (h recordingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.recorder.mu.Lock()
+	defer h.recorder.mu.Unlock()
+	h.recorder.nodes = append(h.recorder.nodes, h.node)
+	return ctx, errDispatched
+}
+
+func (h recordingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h recordingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, errDispatched
+}
+
+func (h recordingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// take returns the recorded nodes and clears them
+func (r *dispatchRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := r.nodes
+	r.nodes = nil
+	return nodes
+}
+
+// newRecordedReplica creates the replica redis of the nodes, whose commands are recorded rather than sent
+func newRecordedReplica(routing config.RedisRouting, writers, readers []string) (*replicaTypeRedis, *dispatchRecorder) {
+	recorder := &dispatchRecorder{}
+	newClients := func(nodes []string) []*redis.Client {
+		clients := make([]*redis.Client, 0, len(nodes))
+		for _, node := range nodes {
+			c := redis.NewClient(&redis.Options{Addr: node})
+			c.AddHook(recordingHook{recorder: recorder, node: node})
+			clients = append(clients, c)
+		}
+		return clients
+	}
+	r := &replicaTypeRedis{routing: routing, writers: newClients(writers), readers: newClients(readers)}
+	if routing == config.RouteByLatency {
+		r.latencies = make([]int64, len(readers))
+	}
+	return r, recorder
+}
+
+func TestReplicaDispatch(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		command    func(r Rediser) error
+		wantWriter bool
+	}{
+		{name: "Get", command: func(r Rediser) error { return r.Get(ctx, "key").Err() }},
+		{name: "TTL", command: func(r Rediser) error { return r.TTL(ctx, "key").Err() }},
+		{name: "SMembers", command: func(r Rediser) error { return r.SMembers(ctx, "key").Err() }},
+		{name: "Set", command: func(r Rediser) error { return r.Set(ctx, "key", "value", time.Minute).Err() }, wantWriter: true},
+		{name: "SetNX", command: func(r Rediser) error { return r.SetNX(ctx, "key", "value", time.Minute).Err() }, wantWriter: true},
+		{name: "SetXX", command: func(r Rediser) error { return r.SetXX(ctx, "key", "value", time.Minute).Err() }, wantWriter: true},
+		{name: "IncrBy", command: func(r Rediser) error { return r.IncrBy(ctx, "key", 1).Err() }, wantWriter: true},
+		{name: "Del", command: func(r Rediser) error { return r.Del(ctx, "key").Err() }, wantWriter: true},
+		{name: "Expire", command: func(r Rediser) error { return r.Expire(ctx, "key", time.Minute).Err() }, wantWriter: true},
+		{name: "SAdd", command: func(r Rediser) error { return r.SAdd(ctx, "key", "member").Err() }, wantWriter: true},
+	}
+	writers := map[string]bool{"writer1:6379": true, "writer2:6379": true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, recorder := newRecordedReplica(config.RouteRoundRobin, []string{"writer1:6379", "writer2:6379"}, []string{"reader1:6379", "reader2:6379"})
+			for i := 0; i < 4; i++ {
+				if err := tt.command(r); err != errDispatched {
+					t.Fatalf("err = %v, want %v", err, errDispatched)
+				}
+			}
+			for _, node := range recorder.take() {
+				if writers[node] != tt.wantWriter {
+					t.Errorf("%s is dispatched to %s, want a writer %v", tt.name, node, tt.wantWriter)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicaReadRouting(t *testing.T) {
+	ctx := context.Background()
+	readers := []string{"reader1:6379", "reader2:6379", "reader3:6379"}
+	tests := []struct {
+		name    string
+		routing config.RedisRouting
+		// latencies of the readers in nanoseconds for config.RouteByLatency
+		latencies []int64
+		check     func(t *testing.T, nodes []string)
+	}{
+		{
+			name:    "round robin takes turns",
+			routing: config.RouteRoundRobin,
+			check: func(t *testing.T, nodes []string) {
+				for i, node := range nodes {
+					if want := readers[(i+1)%len(readers)]; node != want {
+						t.Errorf("read %d is dispatched to %s, want %s", i, node, want)
+					}
+				}
+			},
+		},
+		{
+			name:    "default routing is round robin",
+			routing: "",
+			check: func(t *testing.T, nodes []string) {
+				if nodes[0] == nodes[1] {
+					t.Errorf("reads are dispatched to %v, want them taking turns", nodes)
+				}
+			},
+		},
+		{
+			name:    "random routing stays in the readers",
+			routing: config.RouteRandomly,
+			check: func(t *testing.T, nodes []string) {
+				for _, node := range nodes {
+					if node != readers[0] && node != readers[1] && node != readers[2] {
+						t.Errorf("read is dispatched to %s, want a reader", node)
+					}
+				}
+			},
+		},
+		{
+			name:      "latency routing takes the fastest reader",
+			routing:   config.RouteByLatency,
+			latencies: []int64{int64(3 * time.Millisecond), int64(time.Millisecond), int64(2 * time.Millisecond)},
+			check: func(t *testing.T, nodes []string) {
+				for _, node := range nodes {
+					if node != readers[1] {
+						t.Errorf("read is dispatched to %s, want %s", node, readers[1])
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, recorder := newRecordedReplica(tt.routing, []string{"writer1:6379"}, readers)
+			copy(r.latencies, tt.latencies)
+			for i := 0; i < 6; i++ {
+				_ = r.Get(ctx, "key").Err()
+			}
+			tt.check(t, recorder.take())
+		})
+	}
+}
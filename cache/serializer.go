@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackHandle writes []byte as msgpack bin instead of raw strings
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// Serializer encodes and decodes the HTTP entries stored in redis
+type Serializer interface {
+	Marshal(h HTTP) ([]byte, error)
+	Unmarshal(data []byte, h *HTTP) error
+}
+
+// NewSerializer creates the Serializer of the format. Unknown formats fall back to JSON.
+func NewSerializer(format config.CacheSerializer) Serializer {
+	if format == config.SerializeMsgpack {
+		return msgpackSerializer{}
+	}
+	return jsonSerializer{}
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(h HTTP) ([]byte, error) {
+	return json.Marshal(h)
+}
+
+// Unmarshal detects the format so that the entries written in the other format during a rollout are still readable
+func (jsonSerializer) Unmarshal(data []byte, h *HTTP) error {
+	return Unmarshal(data, h)
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Marshal(h HTTP) (b []byte, err error) {
+	err = codec.NewEncoderBytes(&b, msgpackHandle).Encode(h)
+	return b, err
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, h *HTTP) error {
+	return Unmarshal(data, h)
+}
+
+// gzipMagic starts every gzip stream, and it's neither "{" of JSON nor the first byte of a msgpack map
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipWriters reuses the writers, whose buffers are costly to allocate per entry
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+type gzipSerializer struct {
+	Serializer
+	minBytes int
+}
+
+// Compress gzips the entries encoded by serializer unless they're smaller than minBytes
+func Compress(serializer Serializer, minBytes int) Serializer {
+	return gzipSerializer{Serializer: serializer, minBytes: minBytes}
+}
+
+func (s gzipSerializer) Marshal(h HTTP) ([]byte, error) {
+	b, err := s.Serializer.Marshal(h)
+	if err != nil || len(b) < s.minBytes {
+		return b, err
+	}
+
+	var compressed bytes.Buffer
+	writer := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(writer)
+	writer.Reset(&compressed)
+	if _, err = writer.Write(b); err != nil {
+		return nil, errors.Wrap(err, "compressing cache entry encountered error")
+	}
+	if err = writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "compressing cache entry encountered error")
+	}
+	return compressed.Bytes(), nil
+}
+
+// Unmarshal decodes the entry in either format, compressed or not. JSON entries always start with "{", which is never
+// the first byte of a msgpack map, and compressed entries start with gzipMagic.
+func Unmarshal(data []byte, h *HTTP) error {
+	if len(data) == 0 {
+		return errors.New("cache entry is empty")
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return errors.Wrap(err, "decompressing cache entry encountered error")
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return errors.Wrap(err, "decompressing cache entry encountered error")
+		}
+		return Unmarshal(data, h)
+	}
+	if data[0] == '{' {
+		return json.Unmarshal(data, h)
+	}
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(h)
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func newTestEntry(responseBytes int) HTTP {
+	return HTTP{
+		StatusCode: 200,
+		Response:   []byte(`{"kind":"youtube#videoListResponse","items":[` + strings.Repeat(`{"kind":"youtube#video","id":"video1"},`, responseBytes/40) + `{}]}`),
+		FreshUntil: 1600000060,
+		ExpireAt:   1600000600,
+		StoredAt:   1600000000,
+	}
+}
+
+func TestSerializers(t *testing.T) {
+	entry := newTestEntry(1024)
+	tests := []struct {
+		name     string
+		writer   config.CacheSerializer
+		reader   config.CacheSerializer
+		wantJSON bool
+	}{
+		{name: "json", writer: config.SerializeJSON, reader: config.SerializeJSON, wantJSON: true},
+		{name: "msgpack", writer: config.SerializeMsgpack, reader: config.SerializeMsgpack},
+		{name: "json read by msgpack", writer: config.SerializeJSON, reader: config.SerializeMsgpack, wantJSON: true},
+		{name: "msgpack read by json", writer: config.SerializeMsgpack, reader: config.SerializeJSON},
+		{name: "unknown format falls back to json", writer: config.CacheSerializer("xml"), reader: config.SerializeJSON, wantJSON: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewSerializer(tt.writer).Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isJSON := b[0] == '{'; isJSON != tt.wantJSON {
+				t.Errorf("entry is JSON = %v, want %v", isJSON, tt.wantJSON)
+			}
+
+			var got HTTP
+			if err = NewSerializer(tt.reader).Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != entry.StatusCode || got.FreshUntil != entry.FreshUntil || got.ExpireAt != entry.ExpireAt || got.StoredAt != entry.StoredAt {
+				t.Errorf("entry = %+v, want %+v", got, entry)
+			}
+			if !bytes.Equal(got.Response, entry.Response) {
+				t.Errorf("response = %s, want %s", got.Response, entry.Response)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEmptyEntry(t *testing.T) {
+	var h HTTP
+	if err := Unmarshal(nil, &h); err == nil {
+		t.Error("empty entry is decoded without error")
+	}
+}
+
+func BenchmarkSerializers(b *testing.B) {
+	entry := newTestEntry(16 * 1024)
+	for _, format := range []config.CacheSerializer{config.SerializeJSON, config.SerializeMsgpack} {
+		serializer := NewSerializer(format)
+		encoded, err := serializer.Marshal(entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(string(format)+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := serializer.Marshal(entry); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(string(format)+"/unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var h HTTP
+				if err := serializer.Unmarshal(encoded, &h); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         config.CacheSerializer
+		responseBytes  int
+		wantCompressed bool
+	}{
+		{name: "small json entry is kept", format: config.SerializeJSON, responseBytes: 64},
+		{name: "large json entry is compressed", format: config.SerializeJSON, responseBytes: 4096, wantCompressed: true},
+		{name: "small msgpack entry is kept", format: config.SerializeMsgpack, responseBytes: 64},
+		{name: "large msgpack entry is compressed", format: config.SerializeMsgpack, responseBytes: 4096, wantCompressed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := newTestEntry(tt.responseBytes)
+			serializer := NewSerializer(tt.format)
+			uncompressed, err := serializer.Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := Compress(serializer, 1024).Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := bytes.HasPrefix(b, gzipMagic); compressed != tt.wantCompressed {
+				t.Fatalf("entry is compressed = %v, want %v", compressed, tt.wantCompressed)
+			}
+			if tt.wantCompressed && len(b) >= len(uncompressed) {
+				t.Errorf("compressed entry has %d bytes, not smaller than %d", len(b), len(uncompressed))
+			}
+
+			// the entries are readable by the serializers without compression during a rollout
+			var got HTTP
+			if err = serializer.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != entry.StatusCode || !bytes.Equal(got.Response, entry.Response) {
+				t.Errorf("entry = %+v, want %+v", got, entry)
+			}
+		})
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	entry := newTestEntry(16 * 1024)
+	for _, format := range []config.CacheSerializer{config.SerializeJSON, config.SerializeMsgpack} {
+		serializer := Compress(NewSerializer(format), 1024)
+		encoded, err := serializer.Marshal(entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(string(format)+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := serializer.Marshal(entry); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(string(format)+"/unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var h HTTP
+				if err := serializer.Unmarshal(encoded, &h); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/yt-relay/metrics"
+)
+
+// tieredRediser checks an in-process LRU(l1) before the shared cache(l2). The hits of l2 are promoted into l1, and the
+// writes go to both. The entries are kept in l1 for at most maxTTL as the writes of the other instances only reach l2.
+type tieredRediser struct {
+	l1     Rediser
+	l2     Rediser
+	maxTTL time.Duration
+}
+
+// NewTiered puts an in-process LRU of maxEntries in front of l2, keeping each entry in it for at most maxTTL. The
+// commands other than the string ones only go to l2.
+func NewTiered(l2 Rediser, maxEntries int, maxTTL time.Duration) Rediser {
+	return &tieredRediser{
+		l1:     NewMemory(maxEntries, maxTTL),
+		l2:     l2,
+		maxTTL: maxTTL,
+	}
+}
+
+// l1TTL caps ttl by maxTTL. Zero ttl, which never expires in l2, is capped as well.
+func (t *tieredRediser) l1TTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > t.maxTTL {
+		return t.maxTTL
+	}
+	return ttl
+}
+
+func countLookup(tier string, err error) {
+	result := "hit"
+	if err != nil {
+		result = "miss"
+	}
+	metrics.CacheTierLookups.WithLabelValues(tier, result).Inc()
+}
+
+func (t *tieredRediser) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
+	cmd := t.l2.Set(ctx, key, value, ttl)
+	if cmd.Err() == nil {
+		t.l1.Set(ctx, key, value, t.l1TTL(ttl))
+	} else {
+		t.l1.Del(ctx, key)
+	}
+	return cmd
+}
+
+func (t *tieredRediser) SetXX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	cmd := t.l2.SetXX(ctx, key, value, ttl)
+	if isSet, err := cmd.Result(); err == nil && isSet {
+		t.l1.Set(ctx, key, value, t.l1TTL(ttl))
+	} else {
+		t.l1.Del(ctx, key)
+	}
+	return cmd
+}
+
+// SetNX only goes to l2, which decides whether the key exists, e.g. for the locks
+func (t *tieredRediser) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	cmd := t.l2.SetNX(ctx, key, value, ttl)
+	if isSet, err := cmd.Result(); err == nil && isSet {
+		t.l1.Del(ctx, key)
+	}
+	return cmd
+}
+
+func (t *tieredRediser) Get(ctx context.Context, key string) *redis.StringCmd {
+	cmd := t.l1.Get(ctx, key)
+	countLookup("l1", cmd.Err())
+	if cmd.Err() == nil {
+		return cmd
+	}
+
+	cmd = t.l2.Get(ctx, key)
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		return cmd
+	}
+	countLookup("l2", cmd.Err())
+	if cmd.Err() == nil {
+		t.l1.Set(ctx, key, cmd.Val(), t.maxTTL)
+	}
+	return cmd
+}
+
+func (t *tieredRediser) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	t.l1.Del(ctx, key)
+	return t.l2.IncrBy(ctx, key, value)
+}
+
+func (t *tieredRediser) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	t.l1.Del(ctx, keys...)
+	return t.l2.Del(ctx, keys...)
+}
+
+func (t *tieredRediser) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	t.l1.Del(ctx, key)
+	return t.l2.Expire(ctx, key, ttl)
+}
+
+func (t *tieredRediser) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	return t.l2.TTL(ctx, key)
+}
+
+func (t *tieredRediser) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return t.l2.SAdd(ctx, key, members...)
+}
+
+func (t *tieredRediser) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return t.l2.SMembers(ctx, key)
+}
+
+func (t *tieredRediser) Ping(ctx context.Context) *redis.StatusCmd {
+	return t.l2.Ping(ctx)
+}
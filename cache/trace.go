@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/yt-relay/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedRediser wraps a Rediser with a child span around each command
+type tracedRediser struct {
+	rdb Rediser
+}
+
+// NewTraced wraps rdb so that each command is traced as a child span of the context
+func NewTraced(rdb Rediser) Rediser {
+	return &tracedRediser{rdb: rdb}
+}
+
+func startSpan(ctx context.Context, command string, key string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "redis."+command, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "redis"),
+		attribute.String("db.operation", command),
+		attribute.String("cache.key", key),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *tracedRediser) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
+	ctx, span := startSpan(ctx, "set", key)
+	cmd := t.rdb.Set(ctx, key, value, ttl)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) SetXX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	ctx, span := startSpan(ctx, "setxx", key)
+	cmd := t.rdb.SetXX(ctx, key, value, ttl)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	ctx, span := startSpan(ctx, "setnx", key)
+	cmd := t.rdb.SetNX(ctx, key, value, ttl)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) Get(ctx context.Context, key string) *redis.StringCmd {
+	ctx, span := startSpan(ctx, "get", key)
+	cmd := t.rdb.Get(ctx, key)
+	span.SetAttributes(attribute.Bool("cache.hit", cmd.Err() == nil))
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	ctx, span := startSpan(ctx, "incrby", key)
+	cmd := t.rdb.IncrBy(ctx, key, value)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	var key string
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	ctx, span := startSpan(ctx, "del", key)
+	cmd := t.rdb.Del(ctx, keys...)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	ctx, span := startSpan(ctx, "expire", key)
+	cmd := t.rdb.Expire(ctx, key, ttl)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	ctx, span := startSpan(ctx, "ttl", key)
+	cmd := t.rdb.TTL(ctx, key)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	ctx, span := startSpan(ctx, "sadd", key)
+	cmd := t.rdb.SAdd(ctx, key, members...)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	ctx, span := startSpan(ctx, "smembers", key)
+	cmd := t.rdb.SMembers(ctx, key)
+	endSpan(span, cmd.Err())
+	return cmd
+}
+
+func (t *tracedRediser) Ping(ctx context.Context) *redis.StatusCmd {
+	ctx, span := startSpan(ctx, "ping", "")
+	cmd := t.rdb.Ping(ctx)
+	endSpan(span, cmd.Err())
+	return cmd
+}
@@ -50,8 +50,17 @@ func Start(cmds map[string]*Command) error {
 		log.Printf("Failed to load config: %v", err)
 		return errors.New("failed to load config")
 	}
-	cfg.Address = c.Address
-	cfg.Port = c.Port
+	// only the flags set explicitly override the config, so that the address can be a unix socket in the config
+	ytrelayFlagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "address":
+			cfg.Address = c.Address
+		case "port":
+			cfg.Port = c.Port
+		}
+	})
+	c.Address = cfg.Address
+	c.Port = cfg.Port
 	c.CFG = cfg
 
 	if err := cmd.Main(args, c); err != nil {
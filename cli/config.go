@@ -7,14 +7,23 @@ import (
 )
 
 type Conf struct {
-	Address    string
-	ConfigFile string
-	Port       int
-	CFG        *config.Conf
+	Address     string
+	ConfigFile  string
+	Port        int
+	CFG         *config.Conf
+	Concurrency int
+	MaxResults  int64
+	Part        string
+	// WhitelistFile is the playlist whitelist snapshot written by whitelist-dump and loaded by serve
+	WhitelistFile string
 }
 
 func registerFlags(c *Conf, f *flag.FlagSet) {
 	f.StringVar(&c.Address, "address", "0.0.0.0", "Address to bind")
 	f.StringVar(&c.ConfigFile, "config", "", "path to the configuration file")
 	f.IntVar(&c.Port, "port", 8080, "Port to bind")
+	f.IntVar(&c.Concurrency, "concurrency", 4, "Maximum number of concurrent requests to warm the cache")
+	f.Int64Var(&c.MaxResults, "maxResults", 50, "maxResults of the requests to warm the cache")
+	f.StringVar(&c.Part, "part", "snippet", "part of the requests to warm the cache")
+	f.StringVar(&c.WhitelistFile, "whitelist-file", "", "path to the playlist whitelist snapshot to dump to or to serve with")
 }
@@ -0,0 +1,43 @@
+package dump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mirror-media/yt-relay/cli"
+	"github.com/mirror-media/yt-relay/cms"
+	"github.com/mirror-media/yt-relay/whitelist"
+)
+
+var dumpFlags = []string{"config", "whitelist-file"}
+
+// dumpMain fetches the playlist whitelist from the CMS and writes it to the snapshot file, which serve can load with
+// the same flag
+func dumpMain(args []string, c cli.Conf) error {
+	cfg := c.CFG
+	if c.CFG == nil {
+		return errors.New("config file is nil")
+	}
+	if c.WhitelistFile == "" {
+		return errors.New("whitelist-file is required")
+	}
+
+	fetchedAt := time.Now()
+	playlistIDs, err := cms.FetchPlaylistIDs(context.Background(), cfg.CMSURLs(), cfg.CMS)
+	if err != nil {
+		return fmt.Errorf("failed to fetch playlist whitelist from CMS: %v", err)
+	}
+	if len(playlistIDs) == 0 {
+		return errors.New("no playlist IDs fetched from CMS")
+	}
+
+	if err = whitelist.WriteSnapshot(c.WhitelistFile, playlistIDs, fetchedAt); err != nil {
+		return err
+	}
+	fmt.Printf("dumped %d playlist IDs to %s\n", len(playlistIDs), c.WhitelistFile)
+	return nil
+}
+
+var Command = &cli.Command{Flags: dumpFlags, Main: dumpMain}
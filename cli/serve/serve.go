@@ -1,17 +1,23 @@
 package serve
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/mirror-media/yt-relay/cli"
 	"github.com/mirror-media/yt-relay/cms"
+	"github.com/mirror-media/yt-relay/config"
 	"github.com/mirror-media/yt-relay/relay"
 	"github.com/mirror-media/yt-relay/server"
 	"github.com/mirror-media/yt-relay/server/route"
+	"github.com/mirror-media/yt-relay/tracing"
+	"github.com/mirror-media/yt-relay/whitelist"
+	log "github.com/sirupsen/logrus"
 )
 
-var serveFlags = []string{"address", "port", "config"}
+var serveFlags = []string{"address", "port", "config", "whitelist-file"}
 
 func serveMain(args []string, c cli.Conf) error {
 	cfg := c.CFG
@@ -19,28 +25,87 @@ func serveMain(args []string, c cli.Conf) error {
 		return errors.New("config file is nil")
 	}
 
-	playlistIDs, err := cms.FetchPlaylistIDs(cfg.CmsURL)
+	playlistIDs, err := loadPlaylistIDs(c.WhitelistFile, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to fetch playlist whitelist from CMS: %v", err)
+		return err
 	}
 	if len(playlistIDs) == 0 {
-		return errors.New("no playlist IDs fetched from CMS")
+		if !cfg.AllowEmptyPlaylistWhitelist {
+			return errors.New("no playlist IDs fetched from CMS")
+		}
+		// channel whitelisting still works, and the playlists are refreshed lazily once the CMS recovers
+		log.Warn("no playlist IDs fetched from CMS, all the playlists are rejected until the CMS responds with some")
 	}
 	cfg.Whitelists.PlaylistIDs = playlistIDs
 
+	if cfg.Tracing.IsEnabled {
+		shutdown, err := tracing.Init(context.Background(), cfg.AppName, cfg.Tracing)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := shutdown(context.Background()); err != nil {
+				log.Errorf("shutting down tracing encountered error: %v", err)
+			}
+		}()
+	}
+
 	server, err := server.New(*cfg)
 	if err != nil {
-		return nil
+		return err
 	}
+	// server.New applies the log format, so the config is logged in it
+	log.WithField("config", cfg.Redacted()).Info("effective configuration")
 
-	relayService, err := relay.New(cfg.ApiKey)
+	relayService, err := relay.New(cfg.APIKeys(), time.Duration(cfg.ApiKeyCooldown)*time.Second, cfg.UpstreamUserAgent, cfg.CircuitBreaker, cfg.Retry)
 	if err != nil {
 		return err
 	}
 
-	_ = route.Set(server.Engine, cfg.AppName, relayService, server.APIWhitelist, cfg.Cache, server.Cache)
+	// identical requests share the calls in flight regardless of the cache
+	coalesced := relay.Coalesce(relayService, time.Duration(cfg.UpstreamCoalesceWindow)*time.Millisecond)
+
+	if err = route.Set(server.Engine, *cfg, coalesced, server.APIWhitelist, server.Cache); err != nil {
+		return err
+	}
 
 	return server.Run()
 }
 
+// loadPlaylistIDs fetches the playlist IDs from the CMS together with the ones in the snapshot of whitelistFile if it's
+// given. Only the snapshot is used if the CMS refresh is disabled or the CMS fails.
+func loadPlaylistIDs(whitelistFile string, cfg *config.Conf) (map[string]bool, error) {
+	if whitelistFile == "" {
+		if cfg.Whitelists.DisableCMSRefresh {
+			return nil, errors.New("disableCmsRefresh requires the whitelist-file flag")
+		}
+		playlistIDs, err := cms.FetchPlaylistIDs(context.Background(), cfg.CMSURLs(), cfg.CMS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch playlist whitelist from CMS: %v", err)
+		}
+		return playlistIDs, nil
+	}
+
+	snapshotIDs, fetchedAt, err := whitelist.ReadSnapshot(whitelistFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%d playlist IDs fetched at %s are loaded from %s", len(snapshotIDs), fetchedAt.Format(time.RFC3339), whitelistFile)
+	if cfg.Whitelists.DisableCMSRefresh {
+		return snapshotIDs, nil
+	}
+
+	playlistIDs, err := cms.FetchPlaylistIDs(context.Background(), cfg.CMSURLs(), cfg.CMS)
+	if err != nil {
+		log.Warnf("failed to fetch playlist whitelist from CMS, only the snapshot is used: %v", err)
+		return snapshotIDs, nil
+	}
+	for id, effective := range snapshotIDs {
+		if effective {
+			playlistIDs[id] = true
+		}
+	}
+	return playlistIDs, nil
+}
+
 var Command = &cli.Command{Flags: serveFlags, Main: serveMain}
@@ -0,0 +1,63 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/whitelist"
+)
+
+func TestLoadPlaylistIDs(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"shows":[{"playList01":"https://youtube.com/playlist?list=CMS"}]}}`))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer down.Close()
+
+	snapshot := filepath.Join(t.TempDir(), "whitelist.json")
+	if err := whitelist.WriteSnapshot(snapshot, map[string]bool{"SNAPSHOT": true}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		whitelistFile     string
+		cmsURL            string
+		disableCMSRefresh bool
+		want              map[string]bool
+		wantErr           bool
+	}{
+		{name: "CMS", cmsURL: up.URL, want: map[string]bool{"CMS": true}},
+		{name: "CMS failure", cmsURL: down.URL, wantErr: true},
+		{name: "frozen without snapshot", cmsURL: up.URL, disableCMSRefresh: true, wantErr: true},
+		{name: "snapshot merged into CMS", whitelistFile: snapshot, cmsURL: up.URL, want: map[string]bool{"CMS": true, "SNAPSHOT": true}},
+		{name: "snapshot on CMS failure", whitelistFile: snapshot, cmsURL: down.URL, want: map[string]bool{"SNAPSHOT": true}},
+		{name: "frozen snapshot", whitelistFile: snapshot, cmsURL: up.URL, disableCMSRefresh: true, want: map[string]bool{"SNAPSHOT": true}},
+		{name: "missing snapshot", whitelistFile: snapshot + ".missing", cmsURL: up.URL, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Conf{
+				CmsURL:     tt.cmsURL,
+				CMS:        config.CMS{Timeout: 1},
+				Whitelists: config.Whitelists{DisableCMSRefresh: tt.disableCMSRefresh},
+			}
+			playlistIDs, err := loadPlaylistIDs(tt.whitelistFile, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(playlistIDs, tt.want) {
+				t.Errorf("playlist IDs = %v, want %v", playlistIDs, tt.want)
+			}
+		})
+	}
+}
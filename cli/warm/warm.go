@@ -0,0 +1,123 @@
+package warm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirror-media/yt-relay/cli"
+	"github.com/mirror-media/yt-relay/cms"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/mirror-media/yt-relay/server"
+	"github.com/mirror-media/yt-relay/server/route"
+	log "github.com/sirupsen/logrus"
+)
+
+var warmFlags = []string{"config", "concurrency", "maxResults", "part"}
+
+// warmMain populates the cache by sending the common requests of every whitelisted channel and playlist through the
+// same routes the server uses. It fails if any of the requests fails.
+func warmMain(args []string, c cli.Conf) error {
+	cfg := c.CFG
+	if c.CFG == nil {
+		return errors.New("config file is nil")
+	}
+	if !cfg.Cache.IsEnabled {
+		return errors.New("cache is not enabled")
+	}
+	if c.Concurrency <= 0 {
+		return fmt.Errorf("concurrency(%d) has to be positive", c.Concurrency)
+	}
+
+	playlistIDs, err := cms.FetchPlaylistIDs(context.Background(), cfg.CMSURLs(), cfg.CMS)
+	if err != nil {
+		return fmt.Errorf("failed to fetch playlist whitelist from CMS: %v", err)
+	}
+	cfg.Whitelists.PlaylistIDs = playlistIDs
+
+	server, err := server.New(*cfg)
+	if err != nil {
+		return err
+	}
+
+	relayService, err := relay.New(cfg.APIKeys(), time.Duration(cfg.ApiKeyCooldown)*time.Second, cfg.UpstreamUserAgent, cfg.CircuitBreaker, cfg.Retry)
+	if err != nil {
+		return err
+	}
+
+	if err = route.Set(server.Engine, *cfg, relayService, server.APIWhitelist, server.Cache); err != nil {
+		return err
+	}
+
+	uris := warmingURIs(cfg.Whitelists, c.Part, c.MaxResults)
+
+	var warmed, failed uint32
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, c.Concurrency)
+	for _, uri := range uris {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(uri string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			req, err := http.NewRequest(http.MethodGet, uri, nil)
+			if err != nil {
+				log.Errorf("creating warming request for %s encountered error: %v", uri, err)
+				atomic.AddUint32(&failed, 1)
+				return
+			}
+			recorder := httptest.NewRecorder()
+			server.Engine.ServeHTTP(recorder, req)
+			if recorder.Code != http.StatusOK {
+				log.Errorf("warming %s failed with status %d: %s", uri, recorder.Code, recorder.Body.String())
+				atomic.AddUint32(&failed, 1)
+				return
+			}
+			atomic.AddUint32(&warmed, 1)
+		}(uri)
+	}
+	wg.Wait()
+
+	log.Infof("warmed %d entries, %d failed", warmed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d warming requests failed", failed, len(uris))
+	}
+	return nil
+}
+
+// warmingURIs builds the search uri of effective channels and the playlistItems uri of effective playlists
+func warmingURIs(whitelists config.Whitelists, part string, maxResults int64) []string {
+	uris := make([]string, 0, len(whitelists.ChannelIDs)+len(whitelists.PlaylistIDs))
+	for channelID, effective := range whitelists.ChannelIDs {
+		if !effective {
+			continue
+		}
+		query := url.Values{}
+		query.Set("channelId", channelID)
+		query.Set("maxResults", strconv.FormatInt(maxResults, 10))
+		query.Set("part", part)
+		uris = append(uris, "/youtube/v3/search?"+query.Encode())
+	}
+	for playlistID, effective := range whitelists.PlaylistIDs {
+		if !effective {
+			continue
+		}
+		query := url.Values{}
+		query.Set("maxResults", strconv.FormatInt(maxResults, 10))
+		query.Set("part", part)
+		query.Set("playlistId", playlistID)
+		uris = append(uris, "/youtube/v3/playlistItems?"+query.Encode())
+	}
+	return uris
+}
+
+var Command = &cli.Command{Flags: warmFlags, Main: warmMain}
@@ -4,13 +4,17 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mirror-media/yt-relay/cli"
+	"github.com/mirror-media/yt-relay/cli/dump"
 	"github.com/mirror-media/yt-relay/cli/serve"
+	"github.com/mirror-media/yt-relay/cli/warm"
 )
 
 func main() {
 
 	cmds := map[string]*cli.Command{
-		"serve": serve.Command,
+		"serve":          serve.Command,
+		"warm":           warm.Command,
+		"whitelist-dump": dump.Command,
 	}
 
 	err := cli.Start(cmds)
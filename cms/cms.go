@@ -2,19 +2,31 @@ package cms
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/mirror-media/yt-relay/config"
 	log "github.com/sirupsen/logrus"
 )
 
 var playlistIDRegex = regexp.MustCompile(`[?&]list=([A-Za-z0-9_-]+)`)
 
+// bodySnippetLength is the max number of bytes of an unexpected CMS response to report in the error
+const bodySnippetLength = 300
+
 type graphQLRequest struct {
-	Query string `json:"query"`
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
 }
 
 type showFields struct {
@@ -32,32 +44,147 @@ type showsResponse struct {
 	} `json:"errors"`
 }
 
-const showsQuery = `{
-  shows {
+const showsQuery = `query ($skip: Int!, $take: Int) {
+  shows(skip: $skip, take: $take) {
     playList01
     playList02
     trailerPlaylist
   }
 }`
 
-// FetchPlaylistIDs fetches all shows from the CMS and extracts playlist IDs
+// maxPages guards against a CMS ignoring skip, which would page forever
+const maxPages = 1000
+
+// retryableError is a transient failure worth another attempt
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// FetchPlaylistIDs fetches the playlist IDs from the CMS of cmsURLs in order until one of them succeeds
+func FetchPlaylistIDs(ctx context.Context, cmsURLs []string, cmsConf config.CMS) (playlistIDs map[string]bool, err error) {
+	if len(cmsURLs) == 0 {
+		return nil, errors.New("there is no cms url")
+	}
+	for i, cmsURL := range cmsURLs {
+		if playlistIDs, err = fetchPlaylistIDs(ctx, cmsURL, cmsConf); err == nil {
+			log.Infof("playlist IDs are served by CMS(%s)", cmsURL)
+			return playlistIDs, nil
+		}
+		if i < len(cmsURLs)-1 {
+			log.Warnf("fetching playlist IDs from CMS(%s) failed, failing over to the next one: %v", cmsURL, err)
+		}
+	}
+	return nil, err
+}
+
+// fetchPlaylistIDs fetches all shows from the CMS page by page and extracts playlist IDs
 // from playList01, playList02, and trailerPlaylist fields.
-func FetchPlaylistIDs(cmsURL string) (map[string]bool, error) {
-	reqBody, err := json.Marshal(graphQLRequest{Query: showsQuery})
+// Transient failures are retried with exponential backoff according to cmsConf until ctx is done.
+func fetchPlaylistIDs(ctx context.Context, cmsURL string, cmsConf config.CMS) (map[string]bool, error) {
+	client := &http.Client{Timeout: time.Duration(cmsConf.Timeout) * time.Second}
+
+	pageSize := cmsConf.PageSize
+	if pageSize < 1 {
+		pageSize = config.DefaultCMSPageSize
+	}
+
+	var shows []showFields
+	for page := 0; ; page++ {
+		if page == maxPages {
+			return nil, fmt.Errorf("CMS has more than %d pages of shows", maxPages)
+		}
+		skip := page * pageSize
+		pageShows, err := fetchShowsWithRetry(ctx, cmsConf, func() ([]showFields, error) {
+			return fetchShows(ctx, client, cmsURL, skip, pageSize)
+		})
+		if err != nil {
+			return nil, err
+		}
+		shows = append(shows, pageShows...)
+		if len(pageShows) < pageSize {
+			break
+		}
+	}
+
+	playlistIDs := make(map[string]bool)
+	for _, show := range shows {
+		for _, field := range []*string{show.PlayList01, show.PlayList02, show.TrailerPlaylist} {
+			if id := extractPlaylistID(field); id != "" {
+				playlistIDs[id] = true
+			}
+		}
+	}
+
+	log.Infof("fetched %d playlist IDs from CMS (%d shows)", len(playlistIDs), len(shows))
+
+	return playlistIDs, nil
+}
+
+// fetchShowsWithRetry retries fetch on retryableError with exponential backoff
+func fetchShowsWithRetry(ctx context.Context, cmsConf config.CMS, fetch func() ([]showFields, error)) (shows []showFields, err error) {
+	maxAttempts := cmsConf.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		shows, err = fetch()
+		if _, isRetryable := err.(*retryableError); !isRetryable || attempt == maxAttempts {
+			break
+		}
+
+		delay := time.Duration(cmsConf.RetryBaseDelay) * time.Millisecond << uint(attempt-1)
+		log.Warnf("attempt %d/%d to fetch shows from CMS failed, retrying in %s: %v", attempt, maxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("fetching shows from CMS is cancelled: %v", ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+	return shows, err
+}
+
+// fetchShows queries one page of shows once. Network failures and 5xx responses are returned as retryableError.
+func fetchShows(ctx context.Context, client *http.Client, cmsURL string, skip int, take int) ([]showFields, error) {
+	reqBody, err := json.Marshal(graphQLRequest{
+		Query: showsQuery,
+		Variables: map[string]interface{}{
+			"skip": skip,
+			"take": take,
+		},
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal GraphQL request: %v", err)
 	}
 
-	resp, err := http.Post(cmsURL, "application/json", bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cmsURL, bytes.NewReader(reqBody))
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch shows from CMS: %v", err)
+		return nil, fmt.Errorf("failed to create CMS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("failed to fetch shows from CMS: %v", err)}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &retryableError{err: fmt.Errorf("CMS returned status %d", resp.StatusCode)}
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("CMS returned status %d", resp.StatusCode)
 	}
 
+	if contentType := resp.Header.Get("Content-Type"); !isJSON(contentType) {
+		return nil, fmt.Errorf("CMS returned status %d with Content-Type(%s) instead of JSON, is cmsUrl correct? body: %s", resp.StatusCode, contentType, bodySnippet(resp.Body))
+	}
+
 	var result showsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to decode CMS response: %v", err)
@@ -67,23 +194,78 @@ func FetchPlaylistIDs(cmsURL string) (map[string]bool, error) {
 		return nil, fmt.Errorf("CMS GraphQL error: %s", result.Errors[0].Message)
 	}
 
-	playlistIDs := make(map[string]bool)
-	for _, show := range result.Data.Shows {
-		for _, field := range []*string{show.PlayList01, show.PlayList02, show.TrailerPlaylist} {
-			if id := extractPlaylistID(field); id != "" {
-				playlistIDs[id] = true
-			}
+	return result.Data.Shows, nil
+}
+
+// Ping checks if any of the CMS GraphQL endpoints of cmsURLs is reachable, as the others are the failovers
+func Ping(ctx context.Context, cmsURLs []string) (err error) {
+	if len(cmsURLs) == 0 {
+		return errors.New("there is no cms url")
+	}
+	for _, cmsURL := range cmsURLs {
+		if err = ping(ctx, cmsURL); err == nil {
+			return nil
 		}
 	}
+	return err
+}
 
-	log.Infof("fetched %d playlist IDs from CMS (%d shows)", len(playlistIDs), len(result.Data.Shows))
+// ping checks if the CMS GraphQL endpoint is reachable with a trivial query
+func ping(ctx context.Context, cmsURL string) error {
+	reqBody, err := json.Marshal(graphQLRequest{Query: "{ __typename }"})
+	if err != nil {
+		return fmt.Errorf("failed to marshal GraphQL request: %v", err)
+	}
 
-	return playlistIDs, nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cmsURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create CMS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach CMS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CMS returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// bodySnippet reads the beginning of body with control characters removed and whitespaces collapsed
+func bodySnippet(body io.Reader) string {
+	b, err := ioutil.ReadAll(io.LimitReader(body, bodySnippetLength))
+	if err != nil {
+		return fmt.Sprintf("(failed to read body: %v)", err)
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, string(bytes.ToValidUTF8(b, nil)))
+	return strings.Join(strings.Fields(sanitized), " ")
 }
 
 // extractPlaylistID extracts the YouTube playlist ID from a field value.
 // The field may contain a full URL like:
-//   https://www.youtube.com/playlist?list=PL1jBQxu5Eklci：《宵夜鏡來講》
+//
+//	https://www.youtube.com/playlist?list=PL1jBQxu5Eklci：《宵夜鏡來講》
+//
 // or just the URL without a description. Returns empty string if no valid ID found.
 func extractPlaylistID(field *string) string {
 	if field == nil {
@@ -0,0 +1,233 @@
+package cms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/config"
+)
+
+const showsBody = `{"data":{"shows":[{"playList01":"https://www.youtube.com/playlist?list=PL1：《宵夜鏡來講》","playList02":null,"trailerPlaylist":"https://youtube.com/playlist?list=PL2&si=share"}]}}`
+
+func TestFetchPlaylistIDsResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCode  int
+		contentType string
+		body        string
+		wantIDs     []string
+		wantErr     string
+	}{
+		{name: "shows", statusCode: http.StatusOK, contentType: "application/json; charset=utf-8", body: showsBody, wantIDs: []string{"PL1", "PL2"}},
+		{name: "json suffix", statusCode: http.StatusOK, contentType: "application/graphql-response+json", body: showsBody, wantIDs: []string{"PL1", "PL2"}},
+		{name: "html is reported with its snippet", statusCode: http.StatusOK, contentType: "text/html", body: "<html>\n\t<body>Not the\x00 CMS</body>\n</html>", wantErr: "CMS returned status 200 with Content-Type(text/html) instead of JSON, is cmsUrl correct? body: <html> <body>Not the CMS</body> </html>"},
+		{name: "graphql error", statusCode: http.StatusOK, contentType: "application/json", body: `{"errors":[{"message":"unknown field"}]}`, wantErr: "CMS GraphQL error: unknown field"},
+		{name: "client error", statusCode: http.StatusNotFound, contentType: "application/json", body: `{}`, wantErr: "CMS returned status 404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			playlistIDs, err := FetchPlaylistIDs(context.Background(), []string{server.URL}, config.CMS{Timeout: 1})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(playlistIDs) != len(tt.wantIDs) {
+				t.Errorf("playlist IDs = %v, want %v", playlistIDs, tt.wantIDs)
+			}
+			for _, id := range tt.wantIDs {
+				if !playlistIDs[id] {
+					t.Errorf("playlist IDs = %v, want %s in them", playlistIDs, id)
+				}
+			}
+		})
+	}
+}
+
+func TestBodySnippet(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "whitespaces are collapsed", body: " a\r\n\tb  c ", want: "a b c"},
+		{name: "control characters are removed", body: "a\x00\x1bb", want: "ab"},
+		{name: "invalid utf-8 is removed", body: "a\xffb", want: "ab"},
+		{name: "long body is truncated", body: strings.Repeat("a", bodySnippetLength+10), want: strings.Repeat("a", bodySnippetLength)},
+	}
+	for _, tt := range tests {
+		if got := bodySnippet(strings.NewReader(tt.body)); got != tt.want {
+			t.Errorf("%s: bodySnippet(%q) = %q, want %q", tt.name, tt.body, got, tt.want)
+		}
+	}
+}
+
+// sequenceCMS responds the statuses in order, then the shows, and counts the requests
+func sequenceCMS(t *testing.T, statuses []int) (url string, requests *int32) {
+	t.Helper()
+	requests = new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(requests, 1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(showsBody))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requests
+}
+
+func TestFetchPlaylistIDsRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxAttempts  int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "server error is retried", statuses: []int{http.StatusInternalServerError}, maxAttempts: 3, wantRequests: 2},
+		{name: "rate limit is retried", statuses: []int{http.StatusTooManyRequests, http.StatusBadGateway}, maxAttempts: 3, wantRequests: 3},
+		{name: "retries stop at max attempts", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, maxAttempts: 3, wantErr: true, wantRequests: 3},
+		{name: "client error isn't retried", statuses: []int{http.StatusUnauthorized}, maxAttempts: 3, wantErr: true, wantRequests: 1},
+		{name: "zero max attempts tries once", statuses: []int{http.StatusInternalServerError}, maxAttempts: 0, wantErr: true, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmsURL, requests := sequenceCMS(t, tt.statuses)
+			_, err := FetchPlaylistIDs(context.Background(), []string{cmsURL}, config.CMS{Timeout: 1, MaxAttempts: tt.maxAttempts, RetryBaseDelay: 1})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(requests); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestFetchPlaylistIDsRetriesUntilCanceled(t *testing.T) {
+	cmsURL, requests := sequenceCMS(t, []int{http.StatusInternalServerError, http.StatusInternalServerError})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := FetchPlaylistIDs(ctx, []string{cmsURL}, config.CMS{Timeout: 1, MaxAttempts: 3, RetryBaseDelay: 1000})
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("err = %v, want the cancellation", err)
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+// pagedCMS responds the page of skip and take of the shows, each of which has a playlist, and counts the requests
+func pagedCMS(t *testing.T, shows int) (url string, requests *int32) {
+	t.Helper()
+	requests = new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var req struct {
+			Variables struct {
+				Skip int `json:"skip"`
+				Take int `json:"take"`
+			} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		var resp showsResponse
+		for i := req.Variables.Skip; i < shows && i < req.Variables.Skip+req.Variables.Take; i++ {
+			playlist := fmt.Sprintf("https://youtube.com/playlist?list=PL%d", i)
+			resp.Data.Shows = append(resp.Data.Shows, showFields{PlayList01: &playlist})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requests
+}
+
+func TestFetchPlaylistIDsPages(t *testing.T) {
+	tests := []struct {
+		name         string
+		shows        int
+		pageSize     int
+		wantRequests int32
+	}{
+		{name: "no shows", shows: 0, pageSize: 2, wantRequests: 1},
+		{name: "partial page", shows: 1, pageSize: 2, wantRequests: 1},
+		{name: "full pages end with an empty page", shows: 4, pageSize: 2, wantRequests: 3},
+		{name: "last partial page", shows: 5, pageSize: 2, wantRequests: 3},
+		{name: "default page size", shows: 150, pageSize: 0, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmsURL, requests := pagedCMS(t, tt.shows)
+			playlistIDs, err := FetchPlaylistIDs(context.Background(), []string{cmsURL}, config.CMS{Timeout: 1, PageSize: tt.pageSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(playlistIDs) != tt.shows {
+				t.Errorf("playlist IDs = %d, want %d", len(playlistIDs), tt.shows)
+			}
+			if got := atomic.LoadInt32(requests); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up, _ := sequenceCMS(t, nil)
+
+	tests := []struct {
+		name    string
+		cmsURLs []string
+		wantErr bool
+	}{
+		{name: "first endpoint up", cmsURLs: []string{up, down.URL}},
+		{name: "fail over to the next endpoint", cmsURLs: []string{down.URL, up}},
+		{name: "all endpoints down", cmsURLs: []string{down.URL, down.URL}, wantErr: true},
+		{name: "no endpoint", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlistIDs, err := FetchPlaylistIDs(context.Background(), tt.cmsURLs, config.CMS{Timeout: 1})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FetchPlaylistIDs err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !playlistIDs["PL1"] {
+				t.Errorf("playlist IDs = %v, want PL1 in them", playlistIDs)
+			}
+			if err = Ping(context.Background(), tt.cmsURLs); (err != nil) != tt.wantErr {
+				t.Errorf("Ping err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
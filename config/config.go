@@ -1,33 +1,167 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// UnixSocketPrefix makes the Address a path of unix domain socket to listen on, e.g. unix:/var/run/ytrelay.sock
+const UnixSocketPrefix = "unix:"
+
 type Conf struct {
 	// AppName is only allowed to have alphanumeric, dash, and dot.
-	AppName    string        `mapstructure:"appName"`
-	Address    string        `mapstructure:"address"`
-	ApiKey     string        `mapstructure:"apiKey"`
-	Cache      Cache         `mapstructure:"cache"`
-	CmsURL     string        `mapstructure:"cmsUrl"`
-	Port       int           `mapstructure:"port"`
-	Redis      *RedisService `mapstructure:"redis"`
-	Whitelists Whitelists    `mapstructure:"whitelists"`
+	AppName    string `mapstructure:"appName"`
+	Address    string `mapstructure:"address"`
+	AdminToken string `mapstructure:"adminToken"`
+	// AllowedParts maps the api paths to the comma-separated parts their requests can ask for, e.g.
+	// "/youtube/v3/videos": "snippet,contentDetails". The paths not in it allow any part.
+	AllowedParts AllowedParts `mapstructure:"allowedParts"`
+	// AllowEmptyPlaylistWhitelist starts the server even if the CMS responds with no playlist
+	AllowEmptyPlaylistWhitelist bool   `mapstructure:"allowEmptyPlaylistWhitelist"`
+	ApiKey                      string `mapstructure:"apiKey"`
+	// ApiKeys are rotated round-robin together with ApiKey
+	ApiKeys []string `mapstructure:"apiKeys"`
+	// ApiKeyCooldown is the time in seconds a key is skipped after YouTube responds it exceeds the daily quota
+	ApiKeyCooldown int `mapstructure:"apiKeyCooldown"`
+	// AutoPaginateMaxPages caps the pages playlistItems streams for autoPaginate, which is rejected if it's 0
+	AutoPaginateMaxPages int            `mapstructure:"autoPaginateMaxPages"`
+	Cache                Cache          `mapstructure:"cache"`
+	ClampMaxResults      bool           `mapstructure:"clampMaxResults"`
+	CircuitBreaker       CircuitBreaker `mapstructure:"circuitBreaker"`
+	CMS                  CMS            `mapstructure:"cms"`
+	CmsURL               string         `mapstructure:"cmsUrl"`
+	// CmsURLs are tried in order after CmsURL when it fails, e.g. during a CMS migration
+	CmsURLs     []string    `mapstructure:"cmsUrls"`
+	Compression Compression `mapstructure:"compression"`
+	Concurrency Concurrency `mapstructure:"concurrency"`
+	CORS        CORS        `mapstructure:"cors"`
+	// DebugHeaders adds the headers for debugging to the responses, e.g. X-Whitelist-Source
+	DebugHeaders bool         `mapstructure:"debugHeaders"`
+	DefaultParts DefaultParts `mapstructure:"defaultParts"`
+	// DefaultMaxResults maps the api paths to the maxResults used when a request omits it, e.g. "/youtube/v3/search": 20,
+	// instead of the 5 of YouTube
+	DefaultMaxResults map[string]int `mapstructure:"defaultMaxResults"`
+	// ErrorFormat is the format of the error responses, ErrorFormatLegacy or ErrorFormatProblem
+	ErrorFormat string `mapstructure:"errorFormat"`
+	Health      Health `mapstructure:"health"`
+	// LegacyPathMode is how /api/youtube/* is served, LegacyPathRewrite or LegacyPathRedirect
+	LegacyPathMode string `mapstructure:"legacyPathMode"`
+	Log            Log    `mapstructure:"log"`
+	// MaxIDsPerRequest caps the comma-separated ids of a request, e.g. the videos of videos and the playlists of
+	// playlistItems, so a request can't fan out to many YouTube calls. 0 is unlimited.
+	MaxIDsPerRequest int `mapstructure:"maxIdsPerRequest"`
+	// MaxPlaylistsPerRequest caps the playlists of playlistItems, each of which costs a YouTube call. 0 is unlimited.
+	MaxPlaylistsPerRequest int           `mapstructure:"maxPlaylistsPerRequest"`
+	MaxResponseBytes       int           `mapstructure:"maxResponseBytes"`
+	Port                   int           `mapstructure:"port"`
+	QuotaBudget            QuotaBudget   `mapstructure:"quotaBudget"`
+	Redis                  *RedisService `mapstructure:"redis"`
+	// ResponseTransforms maps the api paths to the comma-separated response transforms applied in order after a
+	// successful relay call, e.g. "/youtube/v3/search": "fields,envelope". The paths not in it apply all of them.
+	ResponseTransforms ResponseTransforms `mapstructure:"responseTransforms"`
+	Retry              Retry              `mapstructure:"retry"`
+	// SearchVideoOnly restricts the type of search to video, which is also the default
+	SearchVideoOnly bool `mapstructure:"searchVideoOnly"`
+	// SlowRequestThreshold logs the requests taking longer than it in milliseconds at warn level, 0 disables it
+	SlowRequestThreshold int    `mapstructure:"slowRequestThreshold"`
+	SocketMode           string `mapstructure:"socketMode"`
+	// StrictVideoLookup responds 404 to videos when none of the requested videos is found instead of an empty list
+	StrictVideoLookup bool `mapstructure:"strictVideoLookup"`
+	TLS               TLS  `mapstructure:"tls"`
+	// ThumbnailProxyBase points the thumbnails in the responses to the image proxy, e.g. https://img.example.com
+	ThumbnailProxyBase string   `mapstructure:"thumbnailProxyBase"`
+	Tracing            Tracing  `mapstructure:"tracing"`
+	TrustedProxies     []string `mapstructure:"trustedProxies"`
+	// UpstreamCoalesceWindow shares a YouTube call among the identical requests while it's in flight and for the
+	// milliseconds after it succeeds, 0 disables it
+	UpstreamCoalesceWindow int `mapstructure:"upstreamCoalesceWindow"`
+	// UpstreamQuotaUser attributes the YouTube calls to the clients by quotaUser, which is QuotaUserClientIP or
+	// QuotaUserHeaderPrefix followed by the header, e.g. "header:X-Client-ID". It's not set if it's empty.
+	UpstreamQuotaUser string `mapstructure:"upstreamQuotaUser"`
+	// UpstreamUserAgent is appended to the User-Agent of the YouTube calls to identify the application
+	UpstreamUserAgent string `mapstructure:"upstreamUserAgent"`
+	// Versions serve the YouTube apis under /<version>/youtube/v3 with their behaviors, e.g. "v2", while /youtube/v3
+	// and /api/youtube keep the behaviors of the other options
+	Versions   map[string]APIVersion `mapstructure:"versions"`
+	Whitelists Whitelists            `mapstructure:"whitelists"`
+}
+
+// APIVersion is the behavior of the YouTube apis under a version prefix
+type APIVersion struct {
+	// Envelope wraps the list responses in the envelope unless the request sets envelope itself
+	Envelope bool `mapstructure:"envelope"`
+	// ErrorFormat overrides the ErrorFormat of the version if it's not empty
+	ErrorFormat string `mapstructure:"errorFormat"`
+}
+
+// DefaultParts maps the api paths to the part used when a request omits it, e.g. "/youtube/v3/search": "snippet"
+type DefaultParts map[string]string
+
+// AllowedParts maps the api paths to the comma-separated parts allowed in their requests
+type AllowedParts map[string]string
+
+// Disallowed returns the parts in the comma-separated part which aren't allowed for the path. The paths are matched
+// case-insensitively as viper lowercases the keys of maps in the config file.
+func (a AllowedParts) Disallowed(path string, part string) []string {
+	for allowedPath, allowed := range a {
+		if !strings.EqualFold(allowedPath, path) {
+			continue
+		}
+		allowedSet := parseCSVBoolMap(allowed)
+		var disallowed []string
+		for _, p := range parseCSVList(part) {
+			if !allowedSet[p] {
+				disallowed = append(disallowed, p)
+			}
+		}
+		return disallowed
+	}
+	return nil
 }
 
+// ResponseTransforms maps the api paths to the comma-separated names of their response transforms
+type ResponseTransforms map[string]string
+
 // Whitelists are maps, key is the whitelist string, value determines if it should be effective
 type Whitelists struct {
 	ChannelIDs  map[string]bool `mapstructure:"channelIDs"`
 	PlaylistIDs map[string]bool `mapstructure:"playlistIDs"`
+	// Windows further limits the effective channel and playlist IDs to their time windows. An ID with multiple windows
+	// is effective in any of them. It's a list as viper lowercases the keys of maps.
+	Windows []WhitelistWindow `mapstructure:"windows"`
+	// DisableCMSRefresh freezes the playlist whitelist to the snapshot file given to serve, which is neither refreshed
+	// from the CMS at startup nor lazily
+	DisableCMSRefresh bool `mapstructure:"disableCmsRefresh"`
+	// RefreshInterval refreshes the playlist whitelist from the CMS every interval in seconds in the background besides
+	// the lazy refresh. It's disabled if it's 0.
+	RefreshInterval int `mapstructure:"refreshInterval"`
+	// RejectionTTL is the time in seconds a rejected playlist ID is rejected again without refreshing the whitelist.
+	// It's disabled if it's 0.
+	RejectionTTL int `mapstructure:"rejectionTtl"`
+}
+
+// WhitelistWindow is the time window an ID is effective in. A zero Start or End means the window is unbounded.
+type WhitelistWindow struct {
+	ID    string    `mapstructure:"id"`
+	Start time.Time `mapstructure:"start"`
+	End   time.Time `mapstructure:"end"`
+}
+
+// Contains reports if t is within [Start, End)
+func (w WhitelistWindow) Contains(t time.Time) bool {
+	return (w.Start.IsZero() || !t.Before(w.Start)) && (w.End.IsZero() || t.Before(w.End))
 }
 
 type Cache struct {
@@ -36,8 +170,172 @@ type Cache struct {
 	TTL          int             `mapstructure:"ttl"`
 	ErrorTTL     int             `mapstructure:"errorTtl"`
 	OverwriteTTL map[string]int  `mapstructure:"overwriteTtl"`
+	// MaxTTL caps the ttl in seconds of every entry, including the ones requested by Cache-Set-TTL. It's unlimited if
+	// it's zero.
+	MaxTTL int `mapstructure:"maxTtl"`
+	// Version is part of every cache key so that bumping it invalidates all the previous entries
+	Version string `mapstructure:"version"`
+	// KeySeparator separates the segments of the cache keys, ":" by default
+	KeySeparator string `mapstructure:"keySeparator"`
+	// KeyHeaders are the request headers whose values segment the cache keys, e.g. X-Partner-ID for the variants of the
+	// partners. The absent headers contribute nothing.
+	KeyHeaders []string `mapstructure:"keyHeaders"`
+	// VideoCategoriesTTL is the default ttl in seconds of videoCategories, which rarely change. overwriteTtl takes precedence.
+	VideoCategoriesTTL int `mapstructure:"videoCategoriesTtl"`
+	// MaxBodyBytes skips caching larger responses. It's unlimited if it's zero.
+	MaxBodyBytes int `mapstructure:"maxBodyBytes"`
+	// StaleWhileRevalidate is the grace period in seconds during which an expired response is still served while it's being refreshed
+	StaleWhileRevalidate int `mapstructure:"staleWhileRevalidate"`
+	// Serializer is the format of the new entries, SerializeJSON by default. Entries of either format are readable.
+	Serializer CacheSerializer `mapstructure:"serializer"`
+	// CompressEntries gzips the entries of at least CompressMinBytes. Entries compressed or not are readable.
+	CompressEntries  bool `mapstructure:"compressEntries"`
+	CompressMinBytes int  `mapstructure:"compressMinBytes"`
+	// ServeStaleOnError serves the expired successful responses when the upstream fails. They're kept in the cache for
+	// another StaleOnErrorTTL in seconds after they expire.
+	ServeStaleOnError bool `mapstructure:"serveStaleOnError"`
+	StaleOnErrorTTL   int  `mapstructure:"staleOnErrorTtl"`
+	// L1MaxEntries keeps the hot entries in an in-process LRU in front of redis, which is disabled if it's zero. The
+	// entries are kept in it for at most L1MaxTTL seconds as the other instances can't invalidate them.
+	L1MaxEntries int `mapstructure:"l1MaxEntries"`
+	L1MaxTTL     int `mapstructure:"l1MaxTtl"`
+	// SkipEmptyResults doesn't cache the successful list responses without items, which YouTube responds transiently,
+	// or caches them for EmptyResultsTTL seconds instead if it's positive
+	SkipEmptyResults bool `mapstructure:"skipEmptyResults"`
+	EmptyResultsTTL  int  `mapstructure:"emptyResultsTtl"`
+	// ReadOnly serves the cached responses only and responds 503 to the misses instead of calling YouTube, e.g. during
+	// a quota outage. It can be switched at runtime by /admin/cache/readonly.
+	ReadOnly bool `mapstructure:"readOnly"`
+	// StatusTTL maps the status families, e.g. "4xx", and the status codes overriding them, e.g. "404", to the ttls in
+	// seconds of the responses instead of ttl and errorTtl. overwriteTtl of the api still takes precedence for the
+	// successful responses. The responses whose ttl is 0 aren't cached, e.g. the 400s of the invalid requests.
+	StatusTTL map[string]int `mapstructure:"statusTtl"`
+}
+
+// CacheSerializer is the format of the cache entries stored in redis
+type CacheSerializer string
+
+const (
+	SerializeJSON CacheSerializer = "json"
+	// SerializeMsgpack stores the response bytes as they are instead of base64 encoding them in JSON
+	SerializeMsgpack CacheSerializer = "msgpack"
+)
+
+// Log configures logrus. Invalid values fall back to the defaults with a warning.
+type Log struct {
+	// Level is one of debug, info, warn, and error
+	Level string `mapstructure:"level"`
+	// Format is either json or text
+	Format string `mapstructure:"format"`
+	// ReportCaller adds the calling function to the logs, which is costly under load
+	ReportCaller bool `mapstructure:"reportCaller"`
+}
+
+// CircuitBreaker short-circuits the YouTube calls with 503 after consecutive upstream failures
+type CircuitBreaker struct {
+	IsEnabled           bool `mapstructure:"isEnabled"`
+	ConsecutiveFailures int  `mapstructure:"consecutiveFailures"`
+	// Cooldown is the time in seconds the breaker stays open before letting probes through
+	Cooldown int `mapstructure:"cooldown"`
+	// HalfOpenRequests is the number of probes allowed while the breaker is half-open
+	HalfOpenRequests int `mapstructure:"halfOpenRequests"`
+}
+
+// Retry retries the YouTube calls failed with 5xx or connection errors with exponential backoff
+type Retry struct {
+	// MaxAttempts includes the first attempt, so 1 disables retrying
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// BaseDelay is the delay in milliseconds before the first retry, and it doubles for each following retry
+	BaseDelay int `mapstructure:"baseDelay"`
 }
 
+// CMS configures the requests to fetch the playlist whitelist from the CMS
+type CMS struct {
+	// Timeout is the timeout in seconds of each request
+	Timeout     int `mapstructure:"timeout"`
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// RetryBaseDelay is the delay in milliseconds before the first retry, and it doubles for each following retry
+	RetryBaseDelay int `mapstructure:"retryBaseDelay"`
+	// PageSize is the number of shows to fetch per query
+	PageSize int `mapstructure:"pageSize"`
+}
+
+const DefaultCMSPageSize = 100
+
+// Compression compresses the responses with gzip or deflate according to the Accept-Encoding of the request
+type Compression struct {
+	IsEnabled bool `mapstructure:"isEnabled"`
+	// MinSize is the minimum body size in bytes to compress, so that tiny error bodies are sent as is
+	MinSize int `mapstructure:"minSize"`
+}
+
+// Concurrency limits the concurrent requests of the api paths
+type Concurrency struct {
+	// MaxConcurrent maps the api paths to the max number of their concurrent requests, e.g. "/youtube/v3/search": 10
+	MaxConcurrent map[string]int `mapstructure:"maxConcurrent"`
+	// QueueTimeout is the time in milliseconds a request beyond the limit waits for a slot before it's rejected with 503.
+	// Zero rejects the request immediately.
+	QueueTimeout int `mapstructure:"queueTimeout"`
+	// RetryAfter is the Retry-After in seconds of the rejected requests
+	RetryAfter int `mapstructure:"retryAfter"`
+}
+
+// QuotaBudget rejects the requests with 429 when the YouTube quota they're estimated to cost would leave less than
+// Reserve of DailyQuota. The quota used is counted in the cache redis and is reset at midnight Pacific Time like
+// YouTube. The background revalidations aren't rejected, so Reserve is kept for them.
+type QuotaBudget struct {
+	IsEnabled  bool  `mapstructure:"isEnabled"`
+	DailyQuota int64 `mapstructure:"dailyQuota"`
+	Reserve    int64 `mapstructure:"reserve"`
+}
+
+// Health configures the readiness check
+type Health struct {
+	// Checks are the dependencies the readiness check probes, which are HealthCheckRedis and HealthCheckCMS. An empty
+	// list only checks the liveness. If it's not set, redis is checked if it's configured and the CMS by CheckCMS.
+	Checks []string `mapstructure:"checks"`
+	// CheckCMS also checks if the CMS is reachable when Checks isn't set
+	CheckCMS bool `mapstructure:"checkCms"`
+	// Timeout is the time in milliseconds all the dependency checks have to finish in
+	Timeout int `mapstructure:"timeout"`
+}
+
+// The dependencies of Health.Checks
+const (
+	HealthCheckRedis = "redis"
+	HealthCheckCMS   = "cms"
+)
+
+// TLS terminates TLS with HTTP/2 when both CertFile and KeyFile are set. The files are reloaded on SIGHUP.
+type TLS struct {
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+}
+
+// IsEnabled reports if both the files are set
+func (t TLS) IsEnabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// Tracing exports OpenTelemetry traces to the OTLP gRPC endpoint
+type Tracing struct {
+	IsEnabled bool   `mapstructure:"isEnabled"`
+	Endpoint  string `mapstructure:"endpoint"`
+	Insecure  bool   `mapstructure:"insecure"`
+}
+
+// CORS controls the cross-origin access. Origins support an exact origin, "*", or a wildcard subdomain like "*.mirrormedia.mg".
+type CORS struct {
+	AllowedOrigins   []string `mapstructure:"allowedOrigins"`
+	AllowedMethods   []string `mapstructure:"allowedMethods"`
+	AllowedHeaders   []string `mapstructure:"allowedHeaders"`
+	AllowCredentials bool     `mapstructure:"allowCredentials"`
+	// MaxAge is how long in seconds the preflight result can be cached by browsers
+	MaxAge int `mapstructure:"maxAge"`
+}
+
+var originPatternRegex = regexp.MustCompile(`^(https?://)?(\*\.)?[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*(:[0-9]+)?$`)
+
 type OverwriteTTL struct {
 	TTL       int    `mapstructure:"ttl"`
 	PrefixAPI string `mapstructure:"apiPrefix"`
@@ -50,6 +348,22 @@ type RedisService struct {
 	SingleInstance *RedisSingleInstance   `mapstructure:"single"`
 	Sentinel       *RedisSentinel         `mapstructure:"sentinel"`
 	Replica        *RedisReplicaInstances `mapstructure:"replica"`
+	Memory         *RedisMemory           `mapstructure:"memory"`
+	Pool           RedisPool              `mapstructure:"pool"`
+}
+
+// RedisPool tunes the connections of the redis clients. Zero values fall back to the defaults before they're
+// configurable, which are 20 connections and 1000ms timeouts for cluster, sentinel, and replica, and the go-redis
+// defaults for single.
+type RedisPool struct {
+	PoolSize     int `mapstructure:"poolSize"`
+	MinIdleConns int `mapstructure:"minIdleConns"`
+	// MaxRetries is the number of retries of a failed command, 3 when it's 0
+	MaxRetries int `mapstructure:"maxRetries"`
+	// DialTimeout, ReadTimeout, and WriteTimeout are in milliseconds
+	DialTimeout  int `mapstructure:"dialTimeout"`
+	ReadTimeout  int `mapstructure:"readTimeout"`
+	WriteTimeout int `mapstructure:"writeTimeout"`
 }
 
 type RedisType string
@@ -59,6 +373,8 @@ const (
 	Single   RedisType = "single"
 	Sentinel RedisType = "sentinel"
 	Replica  RedisType = "replica"
+	// Memory is an in-process LRU cache rather than a redis, mostly for local development and small deployments
+	Memory RedisType = "memory"
 )
 
 type RedisCluster struct {
@@ -72,14 +388,36 @@ type RedisSingleInstance struct {
 }
 
 type RedisSentinel struct {
-	Addrs    []RedisAddress `mapstructure:"addresses"`
-	Password string         `mapstructure:"password"`
+	Addrs      []RedisAddress `mapstructure:"addresses"`
+	MasterName string         `mapstructure:"masterName"`
+	Password   string         `mapstructure:"password"`
+	// SentinelPassword authenticates with the sentinels, which can differ from the Password of the data nodes
+	SentinelPassword string `mapstructure:"sentinelPassword"`
 }
 
 type RedisReplicaInstances struct {
 	MasterAddrs []RedisAddress `mapstructure:"writers"`
 	SlaveAddrs  []RedisAddress `mapstructure:"readers"`
 	Password    string         `mapstructure:"password"`
+	// Routing decides the reader of each read, RouteRoundRobin by default
+	Routing RedisRouting `mapstructure:"routing"`
+}
+
+// RedisRouting is how the reads are distributed to the readers of the replica redis
+type RedisRouting string
+
+const (
+	RouteRoundRobin RedisRouting = "roundRobin"
+	RouteRandomly   RedisRouting = "random"
+	// RouteByLatency sends the reads to the reader with the lowest ping latency, which is measured periodically
+	RouteByLatency RedisRouting = "latency"
+)
+
+// RedisMemory configures the in-memory cache. Zero values fall back to the defaults.
+type RedisMemory struct {
+	MaxEntries int `mapstructure:"maxEntries"`
+	// SweepInterval is the interval in seconds to remove expired entries
+	SweepInterval int `mapstructure:"sweepInterval"`
 }
 
 type RedisAddress struct {
@@ -87,6 +425,152 @@ type RedisAddress struct {
 	Port int    `mapstructure:"port"`
 }
 
+// String joins the address and the port, bracketing IPv6 addresses
+func (a RedisAddress) String() string {
+	return net.JoinHostPort(a.Addr, strconv.Itoa(a.Port))
+}
+
+// redactedMask replaces the secrets which are set in Redacted
+const redactedMask = "******"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedMask
+}
+
+// Redacted copies the config with the API keys, the redis passwords, and the admin token masked, so that it can be logged
+func (c Conf) Redacted() Conf {
+	c.AdminToken = redact(c.AdminToken)
+	c.ApiKey = redact(c.ApiKey)
+	if c.ApiKeys != nil {
+		apiKeys := make([]string, len(c.ApiKeys))
+		for i, key := range c.ApiKeys {
+			apiKeys[i] = redact(key)
+		}
+		c.ApiKeys = apiKeys
+	}
+	if c.Redis == nil {
+		return c
+	}
+
+	redis := *c.Redis
+	if redis.Cluster != nil {
+		cluster := *redis.Cluster
+		cluster.Password = redact(cluster.Password)
+		redis.Cluster = &cluster
+	}
+	if redis.SingleInstance != nil {
+		single := *redis.SingleInstance
+		single.Password = redact(single.Password)
+		redis.SingleInstance = &single
+	}
+	if redis.Sentinel != nil {
+		sentinel := *redis.Sentinel
+		sentinel.Password = redact(sentinel.Password)
+		sentinel.SentinelPassword = redact(sentinel.SentinelPassword)
+		redis.Sentinel = &sentinel
+	}
+	if redis.Replica != nil {
+		replica := *redis.Replica
+		replica.Password = redact(replica.Password)
+		redis.Replica = &replica
+	}
+	c.Redis = &redis
+	return c
+}
+
+// CMSURLs merges CmsURL and CmsURLs in the order of failover without the empty and the duplicated URLs
+func (c *Conf) CMSURLs() []string {
+	urls := make([]string, 0, len(c.CmsURLs)+1)
+	seen := make(map[string]bool, len(c.CmsURLs)+1)
+	for _, cmsURL := range append([]string{c.CmsURL}, c.CmsURLs...) {
+		cmsURL = strings.TrimSpace(cmsURL)
+		if cmsURL == "" || seen[cmsURL] {
+			continue
+		}
+		seen[cmsURL] = true
+		urls = append(urls, cmsURL)
+	}
+	return urls
+}
+
+// APIKeys merges ApiKey and ApiKeys without the empty and the duplicated keys
+func (c *Conf) APIKeys() []string {
+	keys := make([]string, 0, len(c.ApiKeys)+1)
+	seen := make(map[string]bool, len(c.ApiKeys)+1)
+	for _, key := range append([]string{c.ApiKey}, c.ApiKeys...) {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// versionNameRegex matches the names of Versions, which are lowercased by viper in the config file anyway
+var versionNameRegex = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// statusTTLKeyRegex matches the status families like 4xx and the status codes like 404 of statusTtl. The 1xx and 3xx
+// responses are never cached.
+var statusTTLKeyRegex = regexp.MustCompile(`^[245]([0-9]{2}|xx)$`)
+
+// The formats of the error responses
+const (
+	// ErrorFormatLegacy responds {"error", "code"}
+	ErrorFormatLegacy = "legacy"
+	// ErrorFormatProblem responds RFC 7807 application/problem+json
+	ErrorFormatProblem = "problem"
+)
+
+// The modes of serving the legacy /api/youtube/* paths
+const (
+	// LegacyPathRewrite serves them as /youtube/v3/* transparently
+	LegacyPathRewrite = "rewrite"
+	// LegacyPathRedirect redirects them to /youtube/v3/* with 308 so that the clients migrate
+	LegacyPathRedirect = "redirect"
+)
+
+const (
+	// QuotaUserClientIP sets quotaUser to the client IP
+	QuotaUserClientIP = "clientIP"
+	// QuotaUserHeaderPrefix sets quotaUser to the header following it
+	QuotaUserHeaderPrefix = "header:"
+)
+
+// QuotaUserHeader returns the header of UpstreamQuotaUser, which is empty for QuotaUserClientIP, and reports if
+// UpstreamQuotaUser is valid
+func (c *Conf) QuotaUserHeader() (header string, ok bool) {
+	if c.UpstreamQuotaUser == QuotaUserClientIP {
+		return "", true
+	}
+	if !strings.HasPrefix(c.UpstreamQuotaUser, QuotaUserHeaderPrefix) {
+		return "", false
+	}
+	header = strings.TrimPrefix(c.UpstreamQuotaUser, QuotaUserHeaderPrefix)
+	return header, header != ""
+}
+
+// UnixSocketPath returns the path of the unix socket and reports if the Address is a unix socket
+func (c *Conf) UnixSocketPath() (path string, isUnixSocket bool) {
+	if !strings.HasPrefix(c.Address, UnixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(c.Address, UnixSocketPrefix), true
+}
+
+// UnixSocketMode parses the octal SocketMode, e.g. 0660
+func (c *Conf) UnixSocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(mode), nil
+}
+
 func (c *Conf) Valid() bool {
 
 	isValidAppName, _ := regexp.MatchString("^[a-zA-Z0-9.-]+$", c.AppName)
@@ -95,18 +579,73 @@ func (c *Conf) Valid() bool {
 		return false
 	}
 
-	if c.ApiKey == "" {
-		log.Error("apiKey cannot be empty")
+	if len(c.APIKeys()) == 0 {
+		log.Error("apiKey and apiKeys cannot be both empty")
 		return false
 	}
 
+	if c.ApiKeyCooldown <= 0 {
+		log.Errorf("apiKeyCooldown(%d) has to be positive", c.ApiKeyCooldown)
+		return false
+	}
+
+	if socketPath, isUnixSocket := c.UnixSocketPath(); isUnixSocket {
+		if socketPath == "" {
+			log.Errorf("the path of the unix socket address(%s) cannot be empty", c.Address)
+			return false
+		}
+		if _, err := c.UnixSocketMode(); err != nil {
+			log.Errorf("socketMode(%s) has to be an octal file mode: %v", c.SocketMode, err)
+			return false
+		}
+	} else if c.Port <= 0 || c.Port > 65535 {
+		log.Errorf("port(%d) has to be between 1 and 65535", c.Port)
+		return false
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		log.Errorf("tls certFile(%s) and keyFile(%s) have to be set together", c.TLS.CertFile, c.TLS.KeyFile)
+		return false
+	}
+	if c.TLS.IsEnabled() {
+		if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			log.Errorf("tls certFile(%s) and keyFile(%s) are not a valid key pair: %v", c.TLS.CertFile, c.TLS.KeyFile, err)
+			return false
+		}
+	}
+
+	if c.Whitelists.RefreshInterval < 0 {
+		log.Errorf("whitelists refreshInterval(%d) cannot be negative", c.Whitelists.RefreshInterval)
+		return false
+	}
+	if c.Whitelists.RefreshInterval > 0 && c.Whitelists.DisableCMSRefresh {
+		log.Error("whitelists refreshInterval cannot be set with disableCmsRefresh")
+		return false
+	}
+
+	if c.Whitelists.RejectionTTL < 0 {
+		log.Errorf("whitelists rejectionTtl(%d) cannot be negative", c.Whitelists.RejectionTTL)
+		return false
+	}
+
+	for _, window := range c.Whitelists.Windows {
+		if window.ID == "" {
+			log.Error("the id of a whitelist window cannot be empty")
+			return false
+		}
+		if !window.Start.IsZero() && !window.End.IsZero() && !window.End.After(window.Start) {
+			log.Errorf("the end(%s) of the whitelist window of %s has to be after the start(%s)", window.End, window.ID, window.Start)
+			return false
+		}
+	}
+
 	if len(c.Whitelists.ChannelIDs) == 0 {
 		log.Error("whitelist's channel id cannot be empty")
 		return false
 	}
 
-	if c.CmsURL == "" {
-		log.Error("cmsUrl cannot be empty")
+	if len(c.CMSURLs()) == 0 {
+		log.Error("cmsUrl and cmsUrls cannot be both empty")
 		return false
 	}
 
@@ -121,20 +660,322 @@ func (c *Conf) Valid() bool {
 			return false
 		}
 
+		if isValidVersion, _ := regexp.MatchString("^[a-zA-Z0-9.-]*$", c.Cache.Version); !isValidVersion {
+			log.Errorf("cache version(%s) can only contains alphanumeric, dot, and hyphen", c.Cache.Version)
+			return false
+		}
+
+		if c.Cache.VideoCategoriesTTL <= 0 {
+			log.Errorf("enabled cache's videoCategoriesTtl(%d) cannot be zero or negative", c.Cache.VideoCategoriesTTL)
+			return false
+		}
+
+		if c.Cache.MaxBodyBytes < 0 {
+			log.Errorf("enabled cache's maxBodyBytes(%d) cannot be negative", c.Cache.MaxBodyBytes)
+			return false
+		}
+
+		if c.Cache.StaleWhileRevalidate < 0 {
+			log.Errorf("enabled cache's staleWhileRevalidate(%d) cannot be negative", c.Cache.StaleWhileRevalidate)
+			return false
+		}
+
+		if c.Cache.ServeStaleOnError && c.Cache.StaleOnErrorTTL <= 0 {
+			log.Errorf("enabled cache's staleOnErrorTtl(%d) has to be positive to serve stale on error", c.Cache.StaleOnErrorTTL)
+			return false
+		}
+
+		if c.Cache.MaxTTL < 0 {
+			log.Errorf("enabled cache's maxTtl(%d) cannot be negative", c.Cache.MaxTTL)
+			return false
+		}
+
+		if c.Cache.MaxTTL > 0 && c.Cache.MaxTTL < c.Cache.TTL {
+			log.Errorf("enabled cache's maxTtl(%d) cannot be less than ttl(%d)", c.Cache.MaxTTL, c.Cache.TTL)
+			return false
+		}
+
+		if c.Cache.L1MaxEntries < 0 {
+			log.Errorf("enabled cache's l1MaxEntries(%d) cannot be negative", c.Cache.L1MaxEntries)
+			return false
+		}
+
+		if c.Cache.EmptyResultsTTL < 0 {
+			log.Errorf("enabled cache's emptyResultsTtl(%d) cannot be negative", c.Cache.EmptyResultsTTL)
+			return false
+		}
+
+		if c.Cache.L1MaxEntries > 0 && c.Cache.L1MaxTTL <= 0 {
+			log.Errorf("enabled cache's l1MaxTtl(%d) has to be positive for l1", c.Cache.L1MaxTTL)
+			return false
+		}
+
+		if c.Cache.CompressMinBytes < 0 {
+			log.Errorf("enabled cache's compressMinBytes(%d) cannot be negative", c.Cache.CompressMinBytes)
+			return false
+		}
+
+		if c.Cache.Serializer != SerializeJSON && c.Cache.Serializer != SerializeMsgpack {
+			log.Errorf("enabled cache's serializer(%s) has to be either %s or %s", c.Cache.Serializer, SerializeJSON, SerializeMsgpack)
+			return false
+		}
+
 		for api, ttl := range c.Cache.OverwriteTTL {
 			if ttl <= 0 {
 				log.Errorf("enabled cache's ttl(%d) fot api(%s) cannot be zero or negative", ttl, api)
 				return false
 			}
+			if !isValidAPIPattern(api) {
+				log.Errorf("enabled cache's overwriteTtl api(%s) can only have * at the end", api)
+				return false
+			}
+		}
+
+		for status, ttl := range c.Cache.StatusTTL {
+			if !statusTTLKeyRegex.MatchString(status) {
+				log.Errorf("enabled cache's statusTtl status(%s) has to be a 2xx, 4xx, or 5xx status family or code, e.g. 4xx or 404", status)
+				return false
+			}
+			if ttl < 0 {
+				log.Errorf("enabled cache's statusTtl(%d) for status(%s) cannot be negative", ttl, status)
+				return false
+			}
+		}
+
+		for _, header := range c.Cache.KeyHeaders {
+			if strings.TrimSpace(header) == "" {
+				log.Error("enabled cache's keyHeaders cannot have an empty header")
+				return false
+			}
+		}
+
+		for api := range c.Cache.DisabledAPIs {
+			if !isValidAPIPattern(api) {
+				log.Errorf("enabled cache's disabledApis api(%s) can only have * at the end", api)
+				return false
+			}
+		}
+	} else if c.Cache.ReadOnly {
+		log.Error("cache's readOnly requires the cache to be enabled")
+		return false
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin != "*" && !originPatternRegex.MatchString(origin) {
+			log.Errorf("cors allowed origin(%s) is invalid", origin)
+			return false
+		}
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			log.Errorf("trusted proxy(%s) has to be an IP or a CIDR", proxy)
+			return false
+		}
+	}
+
+	if c.AutoPaginateMaxPages < 0 {
+		log.Errorf("autoPaginateMaxPages(%d) cannot be negative", c.AutoPaginateMaxPages)
+		return false
+	}
+
+	if c.MaxIDsPerRequest < 0 {
+		log.Errorf("maxIdsPerRequest(%d) cannot be negative", c.MaxIDsPerRequest)
+		return false
+	}
+
+	if c.MaxPlaylistsPerRequest < 0 {
+		log.Errorf("maxPlaylistsPerRequest(%d) cannot be negative", c.MaxPlaylistsPerRequest)
+		return false
+	}
+
+	if c.MaxResponseBytes < 0 {
+		log.Errorf("maxResponseBytes(%d) cannot be negative", c.MaxResponseBytes)
+		return false
+	}
+
+	for path, maxResults := range c.DefaultMaxResults {
+		// the range YouTube accepts
+		if maxResults < 1 || maxResults > 50 {
+			log.Errorf("defaultMaxResults(%d) of %s has to be between 1 and 50", maxResults, path)
+			return false
+		}
+	}
+
+	// the default parts are applied before the allowed parts are checked
+	for path, part := range c.DefaultParts {
+		if disallowed := c.AllowedParts.Disallowed(path, part); len(disallowed) > 0 {
+			log.Errorf("the default part(%s) of %s is not in its allowedParts", strings.Join(disallowed, ","), path)
+			return false
 		}
 	}
 
+	if c.LegacyPathMode != LegacyPathRewrite && c.LegacyPathMode != LegacyPathRedirect {
+		log.Errorf("legacyPathMode(%s) has to be %s or %s", c.LegacyPathMode, LegacyPathRewrite, LegacyPathRedirect)
+		return false
+	}
+
+	if c.ErrorFormat != ErrorFormatLegacy && c.ErrorFormat != ErrorFormatProblem {
+		log.Errorf("errorFormat(%s) has to be %s or %s", c.ErrorFormat, ErrorFormatLegacy, ErrorFormatProblem)
+		return false
+	}
+
+	for name, version := range c.Versions {
+		if !versionNameRegex.MatchString(name) || name == "api" || name == "youtube" {
+			log.Errorf("version(%s) has to be lowercase letters and digits other than api and youtube", name)
+			return false
+		}
+		if version.ErrorFormat != "" && version.ErrorFormat != ErrorFormatLegacy && version.ErrorFormat != ErrorFormatProblem {
+			log.Errorf("errorFormat(%s) of version(%s) has to be %s or %s", version.ErrorFormat, name, ErrorFormatLegacy, ErrorFormatProblem)
+			return false
+		}
+	}
+
+	if c.UpstreamCoalesceWindow < 0 {
+		log.Errorf("upstreamCoalesceWindow(%d) cannot be negative", c.UpstreamCoalesceWindow)
+		return false
+	}
+
+	if _, ok := c.QuotaUserHeader(); c.UpstreamQuotaUser != "" && !ok {
+		log.Errorf("upstreamQuotaUser(%s) has to be %s or %s followed by a header", c.UpstreamQuotaUser, QuotaUserClientIP, QuotaUserHeaderPrefix)
+		return false
+	}
+
+	if c.ThumbnailProxyBase != "" {
+		if u, err := url.Parse(c.ThumbnailProxyBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Errorf("thumbnailProxyBase(%s) has to be an http or https url", c.ThumbnailProxyBase)
+			return false
+		}
+	}
+
+	if c.SlowRequestThreshold < 0 {
+		log.Errorf("slowRequestThreshold(%d) cannot be negative", c.SlowRequestThreshold)
+		return false
+	}
+
+	if c.CORS.MaxAge < 0 {
+		log.Errorf("cors maxAge(%d) cannot be negative", c.CORS.MaxAge)
+		return false
+	}
+
+	if c.CircuitBreaker.IsEnabled {
+		if c.CircuitBreaker.ConsecutiveFailures <= 0 {
+			log.Errorf("circuit breaker's consecutiveFailures(%d) has to be positive", c.CircuitBreaker.ConsecutiveFailures)
+			return false
+		}
+
+		if c.CircuitBreaker.Cooldown <= 0 {
+			log.Errorf("circuit breaker's cooldown(%d) has to be positive", c.CircuitBreaker.Cooldown)
+			return false
+		}
+
+		if c.CircuitBreaker.HalfOpenRequests <= 0 {
+			log.Errorf("circuit breaker's halfOpenRequests(%d) has to be positive", c.CircuitBreaker.HalfOpenRequests)
+			return false
+		}
+	}
+
+	if c.Retry.MaxAttempts < 1 {
+		log.Errorf("retry maxAttempts(%d) has to be positive", c.Retry.MaxAttempts)
+		return false
+	}
+
+	if c.Retry.BaseDelay < 0 {
+		log.Errorf("retry baseDelay(%d) cannot be negative", c.Retry.BaseDelay)
+		return false
+	}
+
+	if c.CMS.Timeout <= 0 {
+		log.Errorf("cms timeout(%d) has to be positive", c.CMS.Timeout)
+		return false
+	}
+
+	if c.CMS.MaxAttempts < 1 {
+		log.Errorf("cms maxAttempts(%d) has to be at least 1", c.CMS.MaxAttempts)
+		return false
+	}
+
+	if c.CMS.RetryBaseDelay < 0 {
+		log.Errorf("cms retryBaseDelay(%d) cannot be negative", c.CMS.RetryBaseDelay)
+		return false
+	}
+
+	if c.CMS.PageSize < 1 {
+		log.Errorf("cms pageSize(%d) has to be at least 1", c.CMS.PageSize)
+		return false
+	}
+
+	if c.QuotaBudget.IsEnabled {
+		if !c.Cache.IsEnabled {
+			log.Error("quota budget requires the cache to be enabled to count the quota used")
+			return false
+		}
+		if c.QuotaBudget.DailyQuota <= 0 {
+			log.Errorf("quota budget's dailyQuota(%d) has to be positive", c.QuotaBudget.DailyQuota)
+			return false
+		}
+		if c.QuotaBudget.Reserve < 0 || c.QuotaBudget.Reserve >= c.QuotaBudget.DailyQuota {
+			log.Errorf("quota budget's reserve(%d) has to be between 0 and dailyQuota(%d)", c.QuotaBudget.Reserve, c.QuotaBudget.DailyQuota)
+			return false
+		}
+	}
+
+	if c.Health.Timeout <= 0 {
+		log.Errorf("health timeout(%d) has to be positive", c.Health.Timeout)
+		return false
+	}
+
+	for _, check := range c.Health.Checks {
+		switch check {
+		case HealthCheckRedis:
+			if !c.Cache.IsEnabled || c.Redis == nil {
+				log.Errorf("health check(%s) requires the cache in redis", check)
+				return false
+			}
+		case HealthCheckCMS:
+			if len(c.CMSURLs()) == 0 {
+				log.Errorf("health check(%s) requires cmsUrl", check)
+				return false
+			}
+		default:
+			log.Errorf("health check(%s) has to be one of %s, %s", check, HealthCheckRedis, HealthCheckCMS)
+			return false
+		}
+	}
+
+	if c.Tracing.IsEnabled && c.Tracing.Endpoint == "" {
+		log.Error("enabled tracing's endpoint cannot be empty")
+		return false
+	}
+
+	if c.Compression.MinSize < 0 {
+		log.Errorf("compression minSize(%d) cannot be negative", c.Compression.MinSize)
+		return false
+	}
+
+	for path, maxConcurrent := range c.Concurrency.MaxConcurrent {
+		if maxConcurrent <= 0 {
+			log.Errorf("concurrency maxConcurrent(%d) of %s has to be positive", maxConcurrent, path)
+			return false
+		}
+	}
+
+	if c.Concurrency.QueueTimeout < 0 {
+		log.Errorf("concurrency queueTimeout(%d) cannot be negative", c.Concurrency.QueueTimeout)
+		return false
+	}
+
+	if c.Concurrency.RetryAfter <= 0 {
+		log.Errorf("concurrency retryAfter(%d) has to be positive", c.Concurrency.RetryAfter)
+		return false
+	}
+
 	if c.Redis != nil {
 		redis := c.Redis
 		switch redis.Type {
 		case Cluster:
 			if redis.Cluster == nil {
-				log.Error("redis type is set to %s but there is no %s configuration", Cluster, Cluster)
+				log.Errorf("redis type is set to %s but there is no %s configuration", Cluster, Cluster)
 				return false
 			}
 
@@ -152,7 +993,7 @@ func (c *Conf) Valid() bool {
 			}
 		case Single:
 			if redis.SingleInstance == nil {
-				log.Error("redis type is set to %s but there is no %s configuration", Single, Single)
+				log.Errorf("redis type is set to %s but there is no %s configuration", Single, Single)
 				return false
 			}
 
@@ -164,12 +1005,17 @@ func (c *Conf) Valid() bool {
 			}
 		case Sentinel:
 			if redis.Sentinel == nil {
-				log.Error("redis type is set to %s but there is no %s configuration", Sentinel, Sentinel)
+				log.Errorf("redis type is set to %s but there is no %s configuration", Sentinel, Sentinel)
 				return false
 			}
 
 			sentinel := redis.Sentinel
 
+			if sentinel.MasterName == "" {
+				log.Errorf("%s master name cannot be empty", Sentinel)
+				return false
+			}
+
 			if len(sentinel.Addrs) == 0 {
 				log.Errorf("%s addresses cannot be empty", Sentinel)
 				return false
@@ -182,7 +1028,7 @@ func (c *Conf) Valid() bool {
 			}
 		case Replica:
 			if redis.Replica == nil {
-				log.Error("redis type is set to %s but there is no %s configuration", Replica, Replica)
+				log.Errorf("redis type is set to %s but there is no %s configuration", Replica, Replica)
 				return false
 			}
 
@@ -209,16 +1055,57 @@ func (c *Conf) Valid() bool {
 					return false
 				}
 			}
+
+			switch replica.Routing {
+			case "", RouteRoundRobin, RouteRandomly, RouteByLatency:
+			default:
+				log.Errorf("%s routing(%s) has to be one of %s, %s, and %s", Replica, replica.Routing, RouteRoundRobin, RouteRandomly, RouteByLatency)
+				return false
+			}
+		case Memory:
+			if memory := redis.Memory; memory != nil {
+				if memory.MaxEntries < 0 {
+					log.Errorf("%s maxEntries(%d) cannot be negative", Memory, memory.MaxEntries)
+					return false
+				}
+				if memory.SweepInterval < 0 {
+					log.Errorf("%s sweepInterval(%d) cannot be negative", Memory, memory.SweepInterval)
+					return false
+				}
+			}
 		default:
 			log.Errorf("redis type(%s) is not supported", redis.Type)
 			return false
 		}
+
+		pool := redis.Pool
+		for name, n := range map[string]int{
+			"poolSize":     pool.PoolSize,
+			"minIdleConns": pool.MinIdleConns,
+			"maxRetries":   pool.MaxRetries,
+		} {
+			if n < 0 {
+				log.Errorf("redis pool %s(%d) cannot be negative", name, n)
+				return false
+			}
+		}
+		for name, timeout := range map[string]int{
+			"dialTimeout":  pool.DialTimeout,
+			"readTimeout":  pool.ReadTimeout,
+			"writeTimeout": pool.WriteTimeout,
+		} {
+			if timeout < 0 {
+				log.Errorf("redis pool %s(%d) has to be positive, or 0 for the default", name, timeout)
+				return false
+			}
+		}
 	}
 
 	return true
 }
 
-// parseAddresses parses a comma-separated list of "host:port" into []RedisAddress.
+// parseAddresses parses a comma-separated list of "host:port" into []RedisAddress. IPv6 hosts have to be bracketed,
+// e.g. "[2001:db8::1]:6379".
 func parseAddresses(s string) ([]RedisAddress, error) {
 	var addrs []RedisAddress
 	for _, entry := range strings.Split(s, ",") {
@@ -226,15 +1113,15 @@ func parseAddresses(s string) ([]RedisAddress, error) {
 		if entry == "" {
 			continue
 		}
-		parts := strings.SplitN(entry, ":", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid address format %q, expected host:port", entry)
+		host, portString, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address format %q, expected host:port: %v", entry, err)
 		}
-		port, err := strconv.Atoi(parts[1])
+		port, err := strconv.Atoi(portString)
 		if err != nil {
 			return nil, fmt.Errorf("invalid port in address %q: %v", entry, err)
 		}
-		addrs = append(addrs, RedisAddress{Addr: parts[0], Port: port})
+		addrs = append(addrs, RedisAddress{Addr: host, Port: port})
 	}
 	return addrs, nil
 }
@@ -260,6 +1147,85 @@ func parseCSVMap(s string) (map[string]int, error) {
 	return m, nil
 }
 
+// isValidAPIPattern checks the api is an exact path, or a prefix followed by a single trailing *
+func isValidAPIPattern(api string) bool {
+	return !strings.Contains(strings.TrimSuffix(api, "*"), "*")
+}
+
+// parseDefaultParts parses "path1:part1,part2;path2:part3" into DefaultParts. Entries are separated by semicolons as
+// parts are separated by commas.
+func parseDefaultParts(s string) (DefaultParts, error) {
+	m := make(DefaultParts)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid format %q, expected path:part", entry)
+		}
+		m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return m, nil
+}
+
+// parseVersions parses "v2:envelope,problem;v3:legacy" into the versions. The flags are envelope and the error formats.
+func parseVersions(s string) (map[string]APIVersion, error) {
+	m, err := parseDefaultParts(s)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]APIVersion, len(m))
+	for name, flags := range m {
+		var version APIVersion
+		for _, flag := range parseCSVList(flags) {
+			switch flag {
+			case "envelope":
+				version.Envelope = true
+			case ErrorFormatLegacy, ErrorFormatProblem:
+				version.ErrorFormat = flag
+			default:
+				return nil, fmt.Errorf("invalid flag %q of version %s, expected envelope, %s, or %s", flag, name, ErrorFormatLegacy, ErrorFormatProblem)
+			}
+		}
+		versions[strings.ToLower(name)] = version
+	}
+	return versions, nil
+}
+
+// parseWhitelistWindows parses "id1=start/end,id2=start/" into []WhitelistWindow. The times are in RFC3339 and either
+// of them can be empty.
+func parseWhitelistWindows(s string) ([]WhitelistWindow, error) {
+	var windows []WhitelistWindow
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid format %q, expected id=start/end", entry)
+		}
+		times := strings.SplitN(parts[1], "/", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid format %q, expected id=start/end", entry)
+		}
+		window := WhitelistWindow{ID: strings.TrimSpace(parts[0])}
+		for i, t := range []*time.Time{&window.Start, &window.End} {
+			if value := strings.TrimSpace(times[i]); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid time in %q: %v", entry, err)
+				}
+				*t = parsed
+			}
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
 // parseCSVBoolMap parses "key1,key2" into map[string]bool with all values set to true.
 func parseCSVBoolMap(s string) map[string]bool {
 	m := make(map[string]bool)
@@ -273,18 +1239,98 @@ func parseCSVBoolMap(s string) map[string]bool {
 	return m
 }
 
+// parseCSVList parses "val1,val2" into []string.
+func parseCSVList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// loadSecretEnvVars overrides the secrets in the config file with env vars, so that they can be injected from secrets
+// rather than being written in the file
+func loadSecretEnvVars(cfg *Conf) {
+	if cfg.Redis == nil {
+		return
+	}
+
+	if password, isSet := os.LookupEnv("REDIS_PASSWORD"); isSet {
+		log.Println("redis password is overridden by REDIS_PASSWORD")
+		if cfg.Redis.Cluster != nil {
+			cfg.Redis.Cluster.Password = password
+		}
+		if cfg.Redis.SingleInstance != nil {
+			cfg.Redis.SingleInstance.Password = password
+		}
+		if cfg.Redis.Sentinel != nil {
+			cfg.Redis.Sentinel.Password = password
+		}
+		if cfg.Redis.Replica != nil {
+			cfg.Redis.Replica.Password = password
+		}
+	}
+
+	if password, isSet := os.LookupEnv("REDIS_SENTINEL_PASSWORD"); isSet && cfg.Redis.Sentinel != nil {
+		log.Println("redis sentinel password is overridden by REDIS_SENTINEL_PASSWORD")
+		cfg.Redis.Sentinel.SentinelPassword = password
+	}
+}
+
 // loadComplexEnvVars populates fields that cannot be directly bound via Viper
-// (CSV-formatted whitelists, redis addresses, cache overwrite TTLs).
+// (CSV-formatted whitelists, cors lists, redis addresses, cache overwrite TTLs).
 func loadComplexEnvVars(cfg *Conf) error {
 	// Whitelists
 	if s := os.Getenv("WHITELIST_CHANNEL_IDS"); s != "" {
 		cfg.Whitelists.ChannelIDs = parseCSVBoolMap(s)
 	}
+	if s := os.Getenv("WHITELIST_WINDOWS"); s != "" {
+		windows, err := parseWhitelistWindows(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse WHITELIST_WINDOWS: %v", err)
+		}
+		cfg.Whitelists.Windows = windows
+	}
+
+	if s := os.Getenv("API_KEYS"); s != "" {
+		cfg.ApiKeys = parseCSVList(s)
+	}
+
+	if s := os.Getenv("CMS_URLS"); s != "" {
+		cfg.CmsURLs = parseCSVList(s)
+	}
+
+	if s := os.Getenv("TRUSTED_PROXIES"); s != "" {
+		cfg.TrustedProxies = parseCSVList(s)
+	}
+
+	// an empty HEALTH_CHECKS only checks the liveness
+	if s, isPresenting := os.LookupEnv("HEALTH_CHECKS"); isPresenting {
+		cfg.Health.Checks = append([]string{}, parseCSVList(s)...)
+	}
+
+	// CORS
+	if s := os.Getenv("CORS_ALLOWED_ORIGINS"); s != "" {
+		cfg.CORS.AllowedOrigins = parseCSVList(s)
+	}
+	if s := os.Getenv("CORS_ALLOWED_METHODS"); s != "" {
+		cfg.CORS.AllowedMethods = parseCSVList(s)
+	}
+	if s := os.Getenv("CORS_ALLOWED_HEADERS"); s != "" {
+		cfg.CORS.AllowedHeaders = parseCSVList(s)
+	}
 
 	// Cache extras
 	if s := os.Getenv("CACHE_DISABLED_APIS"); s != "" {
 		cfg.Cache.DisabledAPIs = parseCSVBoolMap(s)
 	}
+	if s := os.Getenv("CACHE_KEY_HEADERS"); s != "" {
+		cfg.Cache.KeyHeaders = parseCSVList(s)
+	}
 	if s := os.Getenv("CACHE_OVERWRITE_TTL"); s != "" {
 		m, err := parseCSVMap(s)
 		if err != nil {
@@ -292,6 +1338,57 @@ func loadComplexEnvVars(cfg *Conf) error {
 		}
 		cfg.Cache.OverwriteTTL = m
 	}
+	if s := os.Getenv("CACHE_STATUS_TTL"); s != "" {
+		m, err := parseCSVMap(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse CACHE_STATUS_TTL: %v", err)
+		}
+		cfg.Cache.StatusTTL = m
+	}
+
+	if s := os.Getenv("CONCURRENCY_MAX_CONCURRENT"); s != "" {
+		m, err := parseCSVMap(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse CONCURRENCY_MAX_CONCURRENT: %v", err)
+		}
+		cfg.Concurrency.MaxConcurrent = m
+	}
+
+	if s := os.Getenv("DEFAULT_PARTS"); s != "" {
+		m, err := parseDefaultParts(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse DEFAULT_PARTS: %v", err)
+		}
+		cfg.DefaultParts = m
+	}
+	if s := os.Getenv("DEFAULT_MAX_RESULTS"); s != "" {
+		m, err := parseCSVMap(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse DEFAULT_MAX_RESULTS: %v", err)
+		}
+		cfg.DefaultMaxResults = m
+	}
+	if s := os.Getenv("ALLOWED_PARTS"); s != "" {
+		m, err := parseDefaultParts(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse ALLOWED_PARTS: %v", err)
+		}
+		cfg.AllowedParts = AllowedParts(m)
+	}
+	if s := os.Getenv("API_VERSIONS"); s != "" {
+		versions, err := parseVersions(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse API_VERSIONS: %v", err)
+		}
+		cfg.Versions = versions
+	}
+	if s := os.Getenv("RESPONSE_TRANSFORMS"); s != "" {
+		m, err := parseDefaultParts(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse RESPONSE_TRANSFORMS: %v", err)
+		}
+		cfg.ResponseTransforms = ResponseTransforms(m)
+	}
 
 	// Redis
 	if redisType := os.Getenv("REDIS_TYPE"); redisType != "" {
@@ -326,8 +1423,10 @@ func loadComplexEnvVars(cfg *Conf) error {
 				return fmt.Errorf("failed to parse REDIS_ADDRESSES: %v", err)
 			}
 			cfg.Redis.Sentinel = &RedisSentinel{
-				Addrs:    addrs,
-				Password: password,
+				Addrs:            addrs,
+				MasterName:       os.Getenv("REDIS_SENTINEL_MASTER"),
+				Password:         password,
+				SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
 			}
 		case Replica:
 			writers, err := parseAddresses(os.Getenv("REDIS_ADDRESSES"))
@@ -342,6 +1441,41 @@ func loadComplexEnvVars(cfg *Conf) error {
 				MasterAddrs: writers,
 				SlaveAddrs:  readers,
 				Password:    password,
+				Routing:     RedisRouting(os.Getenv("REDIS_READER_ROUTING")),
+			}
+		case Memory:
+			memory := &RedisMemory{}
+			if s := os.Getenv("REDIS_MEMORY_MAX_ENTRIES"); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return fmt.Errorf("failed to parse REDIS_MEMORY_MAX_ENTRIES: %v", err)
+				}
+				memory.MaxEntries = n
+			}
+			if s := os.Getenv("REDIS_MEMORY_SWEEP_INTERVAL"); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return fmt.Errorf("failed to parse REDIS_MEMORY_SWEEP_INTERVAL: %v", err)
+				}
+				memory.SweepInterval = n
+			}
+			cfg.Redis.Memory = memory
+		}
+
+		for env, n := range map[string]*int{
+			"REDIS_POOL_SIZE":      &cfg.Redis.Pool.PoolSize,
+			"REDIS_MIN_IDLE_CONNS": &cfg.Redis.Pool.MinIdleConns,
+			"REDIS_MAX_RETRIES":    &cfg.Redis.Pool.MaxRetries,
+			"REDIS_DIAL_TIMEOUT":   &cfg.Redis.Pool.DialTimeout,
+			"REDIS_READ_TIMEOUT":   &cfg.Redis.Pool.ReadTimeout,
+			"REDIS_WRITE_TIMEOUT":  &cfg.Redis.Pool.WriteTimeout,
+		} {
+			if s := os.Getenv(env); s != "" {
+				v, err := strconv.Atoi(s)
+				if err != nil {
+					return fmt.Errorf("failed to parse %s: %v", env, err)
+				}
+				*n = v
 			}
 		}
 	}
@@ -351,24 +1485,135 @@ func loadComplexEnvVars(cfg *Conf) error {
 
 // Load loads configuration. When configFile is provided, it reads from the YAML file.
 // Otherwise, it reads from environment variables. Env vars always override file values
-// for simple fields (appName, apiKey, address, port, cache settings).
+// for simple fields (appName, apiKey, address, port, cache settings) and for the secrets
+// of the redis configured in the file (REDIS_PASSWORD, REDIS_SENTINEL_PASSWORD).
+// Complex fields (lists and maps) are only read from env vars without a config file.
 func Load(configFile string) (*Conf, error) {
 	v := viper.New()
 
 	// Defaults
 	v.SetDefault("address", "0.0.0.0")
 	v.SetDefault("port", 8080)
+	v.SetDefault("socketMode", "0660")
+	v.SetDefault("apiKeyCooldown", 3600)
+	v.SetDefault("autoPaginateMaxPages", 0)
+	v.SetDefault("maxPlaylistsPerRequest", 20)
+	v.SetDefault("errorFormat", ErrorFormatLegacy)
+	v.SetDefault("legacyPathMode", LegacyPathRewrite)
 	v.SetDefault("cache.isEnabled", false)
+	v.SetDefault("cache.videoCategoriesTtl", 86400)
+	v.SetDefault("cache.serializer", string(SerializeJSON))
+	v.SetDefault("cache.compressEntries", false)
+	v.SetDefault("cache.compressMinBytes", 1024)
+	v.SetDefault("cache.serveStaleOnError", false)
+	v.SetDefault("cache.staleOnErrorTtl", 86400)
+	v.SetDefault("cache.l1MaxEntries", 0)
+	v.SetDefault("cache.l1MaxTtl", 10)
+	v.SetDefault("cache.skipEmptyResults", false)
+	v.SetDefault("cache.emptyResultsTtl", 0)
+	v.SetDefault("cache.readOnly", false)
+	v.SetDefault("circuitBreaker.isEnabled", false)
+	v.SetDefault("circuitBreaker.consecutiveFailures", 5)
+	v.SetDefault("circuitBreaker.cooldown", 30)
+	v.SetDefault("circuitBreaker.halfOpenRequests", 1)
+	v.SetDefault("cms.timeout", 10)
+	v.SetDefault("cms.maxAttempts", 3)
+	v.SetDefault("cms.retryBaseDelay", 500)
+	v.SetDefault("cms.pageSize", DefaultCMSPageSize)
+	v.SetDefault("compression.isEnabled", false)
+	v.SetDefault("compression.minSize", 1024)
+	v.SetDefault("concurrency.queueTimeout", 0)
+	v.SetDefault("concurrency.retryAfter", 1)
+	v.SetDefault("health.checkCms", false)
+	v.SetDefault("whitelists.refreshInterval", 0)
+	v.SetDefault("whitelists.rejectionTtl", 0)
+	v.SetDefault("quotaBudget.isEnabled", false)
+	v.SetDefault("quotaBudget.dailyQuota", 10000)
+	v.SetDefault("quotaBudget.reserve", 0)
+	v.SetDefault("health.timeout", 2000)
+	v.SetDefault("retry.maxAttempts", 1)
+	v.SetDefault("retry.baseDelay", 200)
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", "json")
+	v.SetDefault("log.reportCaller", true)
+	v.SetDefault("tracing.isEnabled", false)
 
 	// Bind environment variables for simple fields
 	_ = v.BindEnv("appName", "APP_NAME")
 	_ = v.BindEnv("apiKey", "API_KEY")
+	_ = v.BindEnv("apiKeyCooldown", "API_KEY_COOLDOWN")
+	_ = v.BindEnv("adminToken", "ADMIN_TOKEN")
 	_ = v.BindEnv("address", "ADDRESS")
 	_ = v.BindEnv("port", "PORT")
+	_ = v.BindEnv("socketMode", "SOCKET_MODE")
 	_ = v.BindEnv("cmsUrl", "CMS_URL")
+	_ = v.BindEnv("circuitBreaker.isEnabled", "CIRCUIT_BREAKER_ENABLED")
+	_ = v.BindEnv("circuitBreaker.consecutiveFailures", "CIRCUIT_BREAKER_CONSECUTIVE_FAILURES")
+	_ = v.BindEnv("circuitBreaker.cooldown", "CIRCUIT_BREAKER_COOLDOWN")
+	_ = v.BindEnv("circuitBreaker.halfOpenRequests", "CIRCUIT_BREAKER_HALF_OPEN_REQUESTS")
+	_ = v.BindEnv("cms.timeout", "CMS_TIMEOUT")
+	_ = v.BindEnv("cms.maxAttempts", "CMS_MAX_ATTEMPTS")
+	_ = v.BindEnv("cms.retryBaseDelay", "CMS_RETRY_BASE_DELAY")
+	_ = v.BindEnv("cms.pageSize", "CMS_PAGE_SIZE")
+	_ = v.BindEnv("clampMaxResults", "CLAMP_MAX_RESULTS")
+	_ = v.BindEnv("searchVideoOnly", "SEARCH_VIDEO_ONLY")
+	_ = v.BindEnv("strictVideoLookup", "STRICT_VIDEO_LOOKUP")
+	_ = v.BindEnv("allowEmptyPlaylistWhitelist", "ALLOW_EMPTY_PLAYLIST_WHITELIST")
+	_ = v.BindEnv("whitelists.disableCmsRefresh", "WHITELIST_DISABLE_CMS_REFRESH")
+	_ = v.BindEnv("whitelists.refreshInterval", "WHITELIST_REFRESH_INTERVAL")
+	_ = v.BindEnv("whitelists.rejectionTtl", "WHITELIST_REJECTION_TTL")
+	_ = v.BindEnv("maxResponseBytes", "MAX_RESPONSE_BYTES")
+	_ = v.BindEnv("maxIdsPerRequest", "MAX_IDS_PER_REQUEST")
+	_ = v.BindEnv("maxPlaylistsPerRequest", "MAX_PLAYLISTS_PER_REQUEST")
+	_ = v.BindEnv("autoPaginateMaxPages", "AUTO_PAGINATE_MAX_PAGES")
+	_ = v.BindEnv("slowRequestThreshold", "SLOW_REQUEST_THRESHOLD")
+	_ = v.BindEnv("debugHeaders", "DEBUG_HEADERS")
+	_ = v.BindEnv("thumbnailProxyBase", "THUMBNAIL_PROXY_BASE")
+	_ = v.BindEnv("errorFormat", "ERROR_FORMAT")
+	_ = v.BindEnv("legacyPathMode", "LEGACY_PATH_MODE")
+	_ = v.BindEnv("upstreamCoalesceWindow", "UPSTREAM_COALESCE_WINDOW")
+	_ = v.BindEnv("upstreamQuotaUser", "UPSTREAM_QUOTA_USER")
+	_ = v.BindEnv("upstreamUserAgent", "UPSTREAM_USER_AGENT")
 	_ = v.BindEnv("cache.isEnabled", "CACHE_ENABLED")
 	_ = v.BindEnv("cache.ttl", "CACHE_TTL")
 	_ = v.BindEnv("cache.errorTtl", "CACHE_ERROR_TTL")
+	_ = v.BindEnv("cache.maxTtl", "CACHE_MAX_TTL")
+	_ = v.BindEnv("cache.staleWhileRevalidate", "CACHE_STALE_WHILE_REVALIDATE")
+	_ = v.BindEnv("cache.videoCategoriesTtl", "CACHE_VIDEO_CATEGORIES_TTL")
+	_ = v.BindEnv("cache.maxBodyBytes", "CACHE_MAX_BODY_BYTES")
+	_ = v.BindEnv("cache.version", "CACHE_VERSION")
+	_ = v.BindEnv("cache.keySeparator", "CACHE_KEY_SEPARATOR")
+	_ = v.BindEnv("cache.serializer", "CACHE_SERIALIZER")
+	_ = v.BindEnv("cache.compressEntries", "CACHE_COMPRESS_ENTRIES")
+	_ = v.BindEnv("cache.compressMinBytes", "CACHE_COMPRESS_MIN_BYTES")
+	_ = v.BindEnv("cache.serveStaleOnError", "CACHE_SERVE_STALE_ON_ERROR")
+	_ = v.BindEnv("cache.staleOnErrorTtl", "CACHE_STALE_ON_ERROR_TTL")
+	_ = v.BindEnv("cache.l1MaxEntries", "CACHE_L1_MAX_ENTRIES")
+	_ = v.BindEnv("cache.l1MaxTtl", "CACHE_L1_MAX_TTL")
+	_ = v.BindEnv("cache.skipEmptyResults", "CACHE_SKIP_EMPTY_RESULTS")
+	_ = v.BindEnv("cache.emptyResultsTtl", "CACHE_EMPTY_RESULTS_TTL")
+	_ = v.BindEnv("cache.readOnly", "CACHE_READ_ONLY")
+	_ = v.BindEnv("compression.isEnabled", "COMPRESSION_ENABLED")
+	_ = v.BindEnv("compression.minSize", "COMPRESSION_MIN_SIZE")
+	_ = v.BindEnv("concurrency.queueTimeout", "CONCURRENCY_QUEUE_TIMEOUT")
+	_ = v.BindEnv("concurrency.retryAfter", "CONCURRENCY_RETRY_AFTER")
+	_ = v.BindEnv("cors.allowCredentials", "CORS_ALLOW_CREDENTIALS")
+	_ = v.BindEnv("cors.maxAge", "CORS_MAX_AGE")
+	_ = v.BindEnv("health.checkCms", "HEALTH_CHECK_CMS")
+	_ = v.BindEnv("quotaBudget.isEnabled", "QUOTA_BUDGET_ENABLED")
+	_ = v.BindEnv("quotaBudget.dailyQuota", "QUOTA_BUDGET_DAILY_QUOTA")
+	_ = v.BindEnv("quotaBudget.reserve", "QUOTA_BUDGET_RESERVE")
+	_ = v.BindEnv("health.timeout", "HEALTH_TIMEOUT")
+	_ = v.BindEnv("retry.maxAttempts", "RETRY_MAX_ATTEMPTS")
+	_ = v.BindEnv("retry.baseDelay", "RETRY_BASE_DELAY")
+	_ = v.BindEnv("log.level", "LOG_LEVEL")
+	_ = v.BindEnv("log.format", "LOG_FORMAT")
+	_ = v.BindEnv("log.reportCaller", "LOG_REPORT_CALLER")
+	_ = v.BindEnv("tracing.isEnabled", "TRACING_ENABLED")
+	_ = v.BindEnv("tracing.endpoint", "TRACING_ENDPOINT")
+	_ = v.BindEnv("tls.certFile", "TLS_CERT_FILE")
+	_ = v.BindEnv("tls.keyFile", "TLS_KEY_FILE")
+	_ = v.BindEnv("tracing.insecure", "TRACING_INSECURE")
 
 	if configFile != "" {
 		log.Printf("loading configuration file from %s", configFile)
@@ -381,15 +1626,27 @@ func Load(configFile string) (*Conf, error) {
 	}
 
 	cfg := &Conf{}
-	if err := v.Unmarshal(cfg); err != nil {
+	// in addition to the default hooks of viper, times are decoded from RFC3339 strings
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+	))
+	if err := v.Unmarshal(cfg, decodeHook); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal configuration: %v", err)
 	}
+	// an empty list of health checks only checks the liveness, but it's decoded as if it's not set
+	if v.IsSet("health.checks") && cfg.Health.Checks == nil {
+		cfg.Health.Checks = []string{}
+	}
 
 	// When no config file, parse complex types from env vars
 	if configFile == "" {
 		if err := loadComplexEnvVars(cfg); err != nil {
 			return nil, err
 		}
+	} else {
+		loadSecretEnvVars(cfg)
 	}
 
 	if !cfg.Valid() {
@@ -0,0 +1,414 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsValidAPIPattern(t *testing.T) {
+	tests := []struct {
+		api  string
+		want bool
+	}{
+		{api: "/youtube/v3/search", want: true},
+		{api: "/youtube/v3/search?part=snippet", want: true},
+		{api: "/youtube/v3/*", want: true},
+		{api: "/youtube/v3/playlist*", want: true},
+		{api: "/youtube/*/search", want: false},
+		{api: "/youtube/v3/**", want: false},
+	}
+	for _, tt := range tests {
+		if got := isValidAPIPattern(tt.api); got != tt.want {
+			t.Errorf("isValidAPIPattern(%s) = %v, want %v", tt.api, got, tt.want)
+		}
+	}
+}
+
+func TestStatusTTLKeyRegex(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{status: "2xx", want: true},
+		{status: "4xx", want: true},
+		{status: "404", want: true},
+		{status: "503", want: true},
+		{status: "3xx", want: false},
+		{status: "1xx", want: false},
+		{status: "4XX", want: false},
+		{status: "40", want: false},
+		{status: "4040", want: false},
+	}
+	for _, tt := range tests {
+		if got := statusTTLKeyRegex.MatchString(tt.status); got != tt.want {
+			t.Errorf("statusTTLKeyRegex.MatchString(%s) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	addrs := []RedisAddress{{Addr: "redis", Port: 6379}}
+	tests := []struct {
+		name  string
+		redis func() *RedisService
+		want  *RedisService
+	}{
+		{
+			name:  "without redis",
+			redis: func() *RedisService { return nil },
+			want:  nil,
+		},
+		{
+			name: "cluster",
+			redis: func() *RedisService {
+				return &RedisService{Type: Cluster, Cluster: &RedisCluster{Addrs: addrs, Password: "password"}}
+			},
+			want: &RedisService{Type: Cluster, Cluster: &RedisCluster{Addrs: addrs, Password: redactedMask}},
+		},
+		{
+			name: "single",
+			redis: func() *RedisService {
+				return &RedisService{Type: Single, SingleInstance: &RedisSingleInstance{Instance: addrs[0], Password: "password"}}
+			},
+			want: &RedisService{Type: Single, SingleInstance: &RedisSingleInstance{Instance: addrs[0], Password: redactedMask}},
+		},
+		{
+			name: "sentinel",
+			redis: func() *RedisService {
+				return &RedisService{Type: Sentinel, Sentinel: &RedisSentinel{Addrs: addrs, MasterName: "master", Password: "password", SentinelPassword: "sentinel-password"}}
+			},
+			want: &RedisService{Type: Sentinel, Sentinel: &RedisSentinel{Addrs: addrs, MasterName: "master", Password: redactedMask, SentinelPassword: redactedMask}},
+		},
+		{
+			name: "sentinel without the sentinel password",
+			redis: func() *RedisService {
+				return &RedisService{Type: Sentinel, Sentinel: &RedisSentinel{Addrs: addrs, MasterName: "master", Password: "password"}}
+			},
+			want: &RedisService{Type: Sentinel, Sentinel: &RedisSentinel{Addrs: addrs, MasterName: "master", Password: redactedMask}},
+		},
+		{
+			name: "replica",
+			redis: func() *RedisService {
+				return &RedisService{Type: Replica, Replica: &RedisReplicaInstances{MasterAddrs: addrs, SlaveAddrs: addrs, Password: "password", Routing: RouteByLatency}}
+			},
+			want: &RedisService{Type: Replica, Replica: &RedisReplicaInstances{MasterAddrs: addrs, SlaveAddrs: addrs, Password: redactedMask, Routing: RouteByLatency}},
+		},
+		{
+			name: "memory",
+			redis: func() *RedisService {
+				return &RedisService{Type: Memory, Memory: &RedisMemory{MaxEntries: 10}}
+			},
+			want: &RedisService{Type: Memory, Memory: &RedisMemory{MaxEntries: 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newConf := func() Conf {
+				return Conf{
+					Address:    "0.0.0.0",
+					Port:       8080,
+					AdminToken: "admin-token",
+					ApiKey:     "api-key",
+					ApiKeys:    []string{"api-key-1", "", "api-key-2"},
+					Redis:      tt.redis(),
+				}
+			}
+			c := newConf()
+			got := c.Redacted()
+
+			if got.AdminToken != redactedMask {
+				t.Errorf("AdminToken = %q, want %q", got.AdminToken, redactedMask)
+			}
+			if got.ApiKey != redactedMask {
+				t.Errorf("ApiKey = %q, want %q", got.ApiKey, redactedMask)
+			}
+			if want := []string{redactedMask, "", redactedMask}; !reflect.DeepEqual(got.ApiKeys, want) {
+				t.Errorf("ApiKeys = %v, want %v", got.ApiKeys, want)
+			}
+			if !reflect.DeepEqual(got.Redis, tt.want) {
+				t.Errorf("Redis = %+v, want %+v", got.Redis, tt.want)
+			}
+			if got.Address != c.Address || got.Port != c.Port {
+				t.Errorf("Address = %s:%d, want %s:%d", got.Address, got.Port, c.Address, c.Port)
+			}
+			if !reflect.DeepEqual(c, newConf()) {
+				t.Errorf("Redacted changed the original config to %+v", c)
+			}
+		})
+	}
+}
+
+func TestRedactedKeepsEmptySecrets(t *testing.T) {
+	got := Conf{Redis: &RedisService{Type: Single, SingleInstance: &RedisSingleInstance{}}}.Redacted()
+	if got.AdminToken != "" || got.ApiKey != "" || got.ApiKeys != nil || got.Redis.SingleInstance.Password != "" {
+		t.Errorf("Redacted() = %+v, want the empty secrets kept empty", got)
+	}
+}
+
+// writeConfigFile writes the config file of content for Load
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setEnv sets or, when value is nil, unsets the env var key until the end of the test
+func setEnv(t *testing.T, key string, value *string) {
+	t.Helper()
+	previous, wasSet := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if wasSet {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+	if value == nil {
+		_ = os.Unsetenv(key)
+	} else {
+		_ = os.Setenv(key, *value)
+	}
+}
+
+func TestRedisSecretEnvVarsOverrideConfigFile(t *testing.T) {
+	const configFile = `
+appName: yt-relay
+apiKey: api-key
+cmsUrl: http://cms.host
+whitelists:
+  channelIds:
+    channel1: true
+redis:
+  type: %s
+  single:
+    instance:
+      address: redis.host
+      port: 6379
+    password: file-password
+  sentinel:
+    masterName: mymaster
+    addresses:
+      - address: redis.host
+        port: 26379
+    password: file-password
+    sentinelPassword: file-sentinel-password
+`
+	envPassword, envSentinelPassword, empty := "env-password", "env-sentinel-password", ""
+	tests := []struct {
+		name                 string
+		redisType            RedisType
+		password             *string
+		sentinelPassword     *string
+		wantPassword         string
+		wantSentinelPassword string
+	}{
+		{name: "file passwords without env vars", redisType: Sentinel, wantPassword: "file-password", wantSentinelPassword: "file-sentinel-password"},
+		{name: "password env var overrides file", redisType: Sentinel, password: &envPassword, wantPassword: "env-password", wantSentinelPassword: "file-sentinel-password"},
+		{name: "sentinel password env var overrides file", redisType: Sentinel, sentinelPassword: &envSentinelPassword, wantPassword: "file-password", wantSentinelPassword: "env-sentinel-password"},
+		{name: "both env vars override file", redisType: Sentinel, password: &envPassword, sentinelPassword: &envSentinelPassword, wantPassword: "env-password", wantSentinelPassword: "env-sentinel-password"},
+		{name: "empty env var clears file password", redisType: Sentinel, password: &empty, wantSentinelPassword: "file-sentinel-password"},
+		{name: "password env var overrides file of single", redisType: Single, password: &envPassword, wantPassword: "env-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, fmt.Sprintf(configFile, tt.redisType))
+			setEnv(t, "REDIS_PASSWORD", tt.password)
+			setEnv(t, "REDIS_SENTINEL_PASSWORD", tt.sentinelPassword)
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var password, sentinelPassword string
+			switch tt.redisType {
+			case Single:
+				password = cfg.Redis.SingleInstance.Password
+			case Sentinel:
+				password, sentinelPassword = cfg.Redis.Sentinel.Password, cfg.Redis.Sentinel.SentinelPassword
+			}
+			if password != tt.wantPassword || sentinelPassword != tt.wantSentinelPassword {
+				t.Errorf("passwords = %q, %q, want %q, %q", password, sentinelPassword, tt.wantPassword, tt.wantSentinelPassword)
+			}
+		})
+	}
+}
+
+func TestWhitelistWindowContains(t *testing.T) {
+	start := time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	window := WhitelistWindow{ID: "channel1", Start: start, End: end}
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{name: "before start", t: start.Add(-time.Nanosecond)},
+		{name: "at start", t: start, want: true},
+		{name: "before end", t: end.Add(-time.Nanosecond), want: true},
+		{name: "at end", t: end},
+	}
+	for _, tt := range tests {
+		if got := window.Contains(tt.t); got != tt.want {
+			t.Errorf("Contains() %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []RedisAddress
+		wantErr bool
+	}{
+		{name: "IPv4", s: "10.0.0.1:6379", want: []RedisAddress{{Addr: "10.0.0.1", Port: 6379}}},
+		{name: "bracketed IPv6", s: "[2001:db8::1]:6379", want: []RedisAddress{{Addr: "2001:db8::1", Port: 6379}}},
+		{name: "hostname", s: "redis.host:6380", want: []RedisAddress{{Addr: "redis.host", Port: 6380}}},
+		{name: "list with spaces and empty entries", s: " redis1:6379, ,[::1]:6380,", want: []RedisAddress{{Addr: "redis1", Port: 6379}, {Addr: "::1", Port: 6380}}},
+		{name: "empty list", s: ""},
+		{name: "missing port", s: "redis.host", wantErr: true},
+		{name: "non-numeric port", s: "redis.host:port", wantErr: true},
+		{name: "unbracketed IPv6", s: "2001:db8::1:6379", wantErr: true},
+		{name: "invalid entry in list", s: "redis1:6379,redis2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddresses(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAddresses(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisAddressString(t *testing.T) {
+	tests := []struct {
+		addr RedisAddress
+		want string
+	}{
+		{addr: RedisAddress{Addr: "10.0.0.1", Port: 6379}, want: "10.0.0.1:6379"},
+		{addr: RedisAddress{Addr: "2001:db8::1", Port: 6379}, want: "[2001:db8::1]:6379"},
+		{addr: RedisAddress{Addr: "redis.host", Port: 6379}, want: "redis.host:6379"},
+	}
+	for _, tt := range tests {
+		if got := tt.addr.String(); got != tt.want {
+			t.Errorf("String() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestQuotaUserHeader(t *testing.T) {
+	tests := []struct {
+		upstreamQuotaUser string
+		wantHeader        string
+		wantOK            bool
+	}{
+		{upstreamQuotaUser: ""},
+		{upstreamQuotaUser: "clientIP", wantOK: true},
+		{upstreamQuotaUser: "header:X-Client-ID", wantHeader: "X-Client-ID", wantOK: true},
+		{upstreamQuotaUser: "header:"},
+		{upstreamQuotaUser: "X-Client-ID"},
+	}
+	for _, tt := range tests {
+		c := Conf{UpstreamQuotaUser: tt.upstreamQuotaUser}
+		if header, ok := c.QuotaUserHeader(); header != tt.wantHeader || ok != tt.wantOK {
+			t.Errorf("QuotaUserHeader() of %q = %q, %v, want %q, %v", tt.upstreamQuotaUser, header, ok, tt.wantHeader, tt.wantOK)
+		}
+	}
+}
+
+// loadValidConf loads the minimal valid config with the cache enabled
+func loadValidConf(t *testing.T) *Conf {
+	t.Helper()
+	cfg, err := Load(writeConfigFile(t, `
+appName: yt-relay
+apiKey: api-key
+cmsUrl: http://cms.host
+whitelists:
+  channelIds:
+    channel1: true
+cache:
+  isEnabled: true
+  ttl: 60
+  errorTtl: 10
+redis:
+  type: memory
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMaxTTLIsValid(t *testing.T) {
+	cfg := loadValidConf(t)
+	tests := []struct {
+		maxTTL int
+		want   bool
+	}{
+		{maxTTL: 0, want: true},
+		{maxTTL: 60, want: true},
+		{maxTTL: 3600, want: true},
+		{maxTTL: 59, want: false},
+		{maxTTL: -1, want: false},
+	}
+	for _, tt := range tests {
+		c := *cfg
+		c.Cache.MaxTTL = tt.maxTTL
+		if got := c.Valid(); got != tt.want {
+			t.Errorf("Valid() of maxTtl(%d) = %v, want %v", tt.maxTTL, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedPartsDisallowed(t *testing.T) {
+	// the keys are lowercased as viper does to the config file
+	allowedParts := AllowedParts{"/youtube/v3/videos": "snippet, contentDetails"}
+	tests := []struct {
+		path string
+		part string
+		want []string
+	}{
+		{path: "/youtube/v3/videos", part: "snippet"},
+		{path: "/youtube/v3/videos", part: "contentDetails,snippet"},
+		{path: "/youtube/v3/videos", part: "snippet,statistics,status", want: []string{"statistics", "status"}},
+		{path: "/YouTube/v3/Videos", part: "statistics", want: []string{"statistics"}},
+		{path: "/youtube/v3/search", part: "statistics"},
+	}
+	for _, tt := range tests {
+		if got := allowedParts.Disallowed(tt.path, tt.part); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Disallowed(%s, %s) = %v, want %v", tt.path, tt.part, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultMaxResultsIsValid(t *testing.T) {
+	cfg := loadValidConf(t)
+	tests := []struct {
+		maxResults int
+		want       bool
+	}{
+		{maxResults: 1, want: true},
+		{maxResults: 50, want: true},
+		{maxResults: 0, want: false},
+		{maxResults: 51, want: false},
+	}
+	for _, tt := range tests {
+		c := *cfg
+		c.DefaultMaxResults = map[string]int{"/youtube/v3/search": tt.maxResults}
+		if got := c.Valid(); got != tt.want {
+			t.Errorf("Valid() of defaultMaxResults(%d) = %v, want %v", tt.maxResults, got, tt.want)
+		}
+	}
+}
@@ -3,10 +3,19 @@ module github.com/mirror-media/yt-relay
 go 1.15
 
 require (
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.7.7
 	github.com/go-redis/redis/v8 v8.8.0
+	github.com/google/uuid v1.1.2
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/sirupsen/logrus v1.8.1
+	github.com/sony/gobreaker v0.5.0
 	github.com/spf13/viper v1.7.1
+	github.com/ugorji/go/codec v1.1.7
+	go.opentelemetry.io/otel v0.19.0
+	go.opentelemetry.io/otel/exporters/otlp v0.19.0
+	go.opentelemetry.io/otel/sdk v0.19.0
+	go.opentelemetry.io/otel/trace v0.19.0
 	google.golang.org/api v0.32.0
 )
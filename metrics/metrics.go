@@ -0,0 +1,112 @@
+// Package metrics defines the prometheus metrics of the relay and the handler exposing them
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "yt_relay"
+
+// Values of CircuitBreakerState
+const (
+	CircuitBreakerClosed   = 0
+	CircuitBreakerHalfOpen = 1
+	CircuitBreakerOpen     = 2
+)
+
+// CircuitBreakerState is the state of the circuit breaker around YouTube: 0 closed, 1 half-open, 2 open
+var CircuitBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "circuit_breaker_state",
+	Help:      "State of the circuit breaker around YouTube: 0 closed, 1 half-open, 2 open",
+})
+
+// CacheSkippedTooLarge counts the responses not cached because they exceed the max body size
+var CacheSkippedTooLarge = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cache_skipped_too_large_total",
+	Help:      "Number of responses not cached because they exceed the max body size",
+})
+
+// APIKeyQuotaErrors counts the quota errors YouTube responded by the index of the API key, which isn't exposed itself
+var APIKeyQuotaErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "api_key_quota_errors_total",
+	Help:      "Number of quota errors YouTube responded by the index of the API key",
+}, []string{"key"})
+
+// QuotaUnits estimates the YouTube quota units consumed by the known costs of the calls per endpoint
+var QuotaUnits = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "quota_units_total",
+	Help:      "Estimated YouTube quota units consumed by the calls per endpoint",
+}, []string{"endpoint"})
+
+// InFlight is the number of the requests holding a slot of the concurrency limit per endpoint
+var InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "in_flight_requests",
+	Help:      "Number of the requests holding a slot of the concurrency limit per endpoint",
+}, []string{"endpoint"})
+
+// ConcurrencyRejected counts the requests rejected by the concurrency limit per endpoint
+var ConcurrencyRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "concurrency_rejected_total",
+	Help:      "Number of the requests rejected by the concurrency limit per endpoint",
+}, []string{"endpoint"})
+
+// QuotaBudgetRemaining is the quota units left of the day when the quota budget is enabled
+var QuotaBudgetRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "quota_budget_remaining",
+	Help:      "YouTube quota units left of the day when the quota budget is enabled",
+})
+
+// CacheTierLookups counts the lookups of the tiered cache per tier(l1 or l2) and result(hit or miss)
+var CacheTierLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cache_tier_lookups_total",
+	Help:      "Number of the lookups of the tiered cache per tier and result",
+}, []string{"tier", "result"})
+
+// Values of the type of WhitelistRejections
+const (
+	WhitelistChannel  = "channel"
+	WhitelistPlaylist = "playlist"
+)
+
+// WhitelistRejections counts the requests rejected by the whitelist per type(channel or playlist)
+var WhitelistRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "whitelist_rejections_total",
+	Help:      "Number of the requests rejected by the whitelist per type",
+}, []string{"type"})
+
+// WhitelistRefreshes counts the fetches of the playlist whitelist from the CMS per result(success or failure)
+var WhitelistRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "whitelist_refreshes_total",
+	Help:      "Number of the fetches of the playlist whitelist from the CMS per result",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(CircuitBreakerState)
+	prometheus.MustRegister(CacheSkippedTooLarge)
+	prometheus.MustRegister(APIKeyQuotaErrors)
+	prometheus.MustRegister(QuotaUnits)
+	prometheus.MustRegister(InFlight)
+	prometheus.MustRegister(ConcurrencyRejected)
+	prometheus.MustRegister(QuotaBudgetRemaining)
+	prometheus.MustRegister(CacheTierLookups)
+	prometheus.MustRegister(WhitelistRejections)
+	prometheus.MustRegister(WhitelistRefreshes)
+}
+
+// Handler serves the registered metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ErrorMissingToken = "bearer token is missing"
+	ErrorInvalidToken = "bearer token is invalid"
+)
+
+// WhitelistBypassKey is the key in the gin context marking the requests which skip the whitelist
+const WhitelistBypassKey = "whitelistBypass"
+
+// CacheRefreshKey is the key in the gin context marking the requests which skip the cached response and refresh it
+const CacheRefreshKey = "cacheRefresh"
+
+// HeaderBypassCache asks to refresh the cache like "Cache-Control: no-cache"
+const HeaderBypassCache = "X-Bypass-Cache"
+
+// Auth only allows requests with "Authorization: Bearer <token>". It responds 401 when the token is missing and 403 when
+// it's wrong. An empty token rejects every request.
+func Auth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, isPresenting := bearerToken(c.Request)
+		if !isPresenting {
+			log.Errorf("%s for %s", ErrorMissingToken, c.Request.URL.Path)
+			RespondError(c, http.StatusUnauthorized, api.ErrorResp{Error: ErrorMissingToken, Code: api.CodeMissingToken})
+			return
+		}
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			log.Errorf("%s for %s", ErrorInvalidToken, c.Request.URL.Path)
+			RespondError(c, http.StatusForbidden, api.ErrorResp{Error: ErrorInvalidToken, Code: api.CodeInvalidToken})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// WhitelistBypass marks the requests with "Authorization: Bearer <token>" so that the handlers skip the whitelist.
+// Requests without the token or with a wrong one are left to the whitelist. An empty token marks no request.
+// The requests with the token asking for no cache, by "Cache-Control: no-cache" or "X-Bypass-Cache: true", are marked
+// to refresh the cache instead. They're still whitelisted as the refreshed entry is served to the public requests.
+func WhitelistBypass(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, isPresenting := bearerToken(c.Request)
+		if !isPresenting || token == "" {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			Logger(c).Warnf("%s for %s, the whitelist is applied", ErrorInvalidToken, c.Request.URL.Path)
+			return
+		}
+		if isNoCache(c.Request) {
+			Logger(c).Infof("cache of %s is refreshed by the admin token", c.Request.URL.String())
+			c.Set(CacheRefreshKey, true)
+			return
+		}
+		c.Set(WhitelistBypassKey, true)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), whitelistBypassKey{}, true))
+	}
+}
+
+// isNoCache reports whether the request asks for no cache by Cache-Control or HeaderBypassCache
+func isNoCache(request *http.Request) bool {
+	if bypass, err := strconv.ParseBool(request.Header.Get(HeaderBypassCache)); err == nil && bypass {
+		return true
+	}
+	for _, directive := range strings.Split(request.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCacheRefreshed reports whether WhitelistBypass has marked the request to refresh the cache
+func IsCacheRefreshed(c *gin.Context) bool {
+	return c.GetBool(CacheRefreshKey)
+}
+
+type whitelistBypassKey struct{}
+
+// IsWhitelistBypassed reports whether WhitelistBypass has marked the request
+func IsWhitelistBypassed(c *gin.Context) bool {
+	return c.GetBool(WhitelistBypassKey)
+}
+
+// IsWhitelistBypassedContext reports whether WhitelistBypass has marked the request of ctx, for the code without the
+// gin context like the response transforms
+func IsWhitelistBypassedContext(ctx context.Context) bool {
+	bypassed, _ := ctx.Value(whitelistBypassKey{}).(bool)
+	return bypassed
+}
+
+func bearerToken(request *http.Request) (token string, isPresenting bool) {
+	const prefix = "Bearer "
+	authorization := request.Header.Get("Authorization")
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", false
+	}
+	token = strings.TrimSpace(authorization[len(prefix):])
+	return token, token != ""
+}
@@ -1,8 +1,14 @@
 package middleware
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -10,47 +16,522 @@ import (
 	"github.com/mirror-media/yt-relay/api"
 	"github.com/mirror-media/yt-relay/cache"
 	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
+	"github.com/mirror-media/yt-relay/relay"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func Cache(namespace string, cacheConf config.Cache, cacheProvider cache.Rediser) gin.HandlerFunc {
+const XCacheHeader = "X-Cache"
+
+// XCacheExpiresHeader is when a cached response turns stale
+const XCacheExpiresHeader = "X-Cache-Expires"
+
+// XCacheStaleError is the X-Cache of an expired response served as the upstream fails
+const XCacheStaleError = "STALE-ERROR"
+
+// XCacheRefresh is the X-Cache of a response fetched to refresh the cache by the request of the admin token
+const XCacheRefresh = "REFRESH"
+
+// staleCacheKey is the key of the cached response kept in the gin context for RespondWithStaleCache
+const staleCacheKey = "staleCache"
+
+// bypassURIPrefix prefixes the uri of the requests bypassing the whitelist in their cache keys
+const bypassURIPrefix = "bypass:"
+
+// skipCacheKey marks the responses which must not be cached, e.g. the ones served by RespondWithStaleCache
+const skipCacheKey = "skipCache"
+
+// AutoPaginateQuery requests the items of all the pages streamed as they're fetched, which aren't buffered to be cached
+const AutoPaginateQuery = "autoPaginate"
+
+// TTLHeader lets the client decide the ttl of the cache for a response
+const TTLHeader = "Cache-Set-TTL"
+
+// revalidationLockTTL bounds how long a single background revalidation may hold the lock of a key
+const revalidationLockTTL = 30 * time.Second
+
+// cacheWriter captures the response body written by the handlers so that it can be cached
+type cacheWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Cache is a read-through cache. It responds with the cached response if there is one, otherwise it captures the
+// response of the handlers and caches it according to its status code: successful responses are cached for the
+// (overwritten) ttl and errors are cached for the error ttl.
+// Requests marked by WhitelistBypass to refresh the cache skip the cached response, and overwrite it with the new one.
+// Stale responses are served with X-Cache: STALE while they are refreshed in the background by replaying the request
+// through revalidator. With ServeStaleOnError, successful responses are kept for another StaleOnErrorTTL after they
+// expire so that the handlers can serve them by RespondWithStaleCache when the upstream fails.
+func Cache(namespace string, cacheConf config.Cache, cacheProvider cache.Rediser, revalidator http.Handler) gin.HandlerFunc {
+	keyBuilder := cache.NewKeyBuilder(namespace, cacheConf)
+	serializer := cache.NewSerializer(cacheConf.Serializer)
+	if cacheConf.CompressEntries {
+		serializer = cache.Compress(serializer, cacheConf.CompressMinBytes)
+	}
+	indexTTL := longestTTL(cacheConf)
 	return func(c *gin.Context) {
 		url := c.Request.URL
 
 		// check blacklist
-		if isDisabled := cacheConf.DisabledAPIs[url.Path]; isDisabled {
+		if isCacheDisabled(cacheConf, c.Request) {
 			log.Infof("cache is disabled for %s", url.Path)
 			c.Next()
 			return
 		}
-		// read cache
+
+		if isAutoPaginated(c.Request) {
+			c.Next()
+			return
+		}
+
 		uri := c.Request.URL.String()
-		key, err := cache.GetCacheKey(namespace, uri)
+		// the responses bypassing the whitelist are cached apart so that they're never served to the public requests
+		if IsWhitelistBypassed(c) {
+			uri = bypassURIPrefix + uri
+		}
+		// the versions respond in their own formats, so they're cached apart
+		if name, _, ok := APIVersion(c.Request.Context()); ok {
+			uri = name + ":" + uri
+		}
+		// the variants of the key headers are cached apart, which the shared caches are told by Vary
+		if len(cacheConf.KeyHeaders) > 0 {
+			uri = keyHeadersPrefix(c.Request, cacheConf.KeyHeaders) + uri
+			for _, header := range cacheConf.KeyHeaders {
+				c.Writer.Header().Add("Vary", header)
+			}
+		}
+		key, err := keyBuilder.Key(uri)
 		if err != nil {
 			err = errors.Wrap(err, "Fail to create cache key in cache middleware")
 			log.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, api.ErrorResp{Error: err.Error()})
+			RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: err.Error(), Code: api.CodeInternal})
 			return
 		}
-		result, err := cacheProvider.Get(c.Request.Context(), key).Result()
-		if err != nil {
-			err = errors.Wrapf(err, "Fail to get cache value for %s in cache middleware", key)
-			log.Info(err)
-			c.Next()
+
+		// the refresh requested with the admin token skips the cached response and overwrites it
+		isRefreshed := IsCacheRefreshed(c)
+		var cacheResp cache.HTTP
+		var isCached bool
+		if !isRefreshed {
+			cacheResp, isCached = loadCache(c, cacheProvider, serializer, key)
+		}
+		if isCached && cacheConf.ServeStaleOnError && cacheResp.StatusCode == http.StatusOK {
+			c.Set(staleCacheKey, cacheResp)
+		}
+
+		// revalidation has to reach the relay service, and the expired entries are only kept for the upstream failures
+		isExpired := isCached && cacheResp.IsExpired(time.Now())
+		if isCached && !isExpired && !cache.IsRevalidation(c.Request.Context()) {
+			respondWithCache(c, cacheResp, cacheProvider, key, revalidator)
 			return
 		}
 
-		var cacheResp cache.HTTP
+		if isRefreshed {
+			c.Header(XCacheHeader, XCacheRefresh)
+		} else {
+			c.Header(XCacheHeader, "MISS")
+		}
+		writer := &cacheWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
 
-		err = json.Unmarshal([]byte(result), &cacheResp)
-		if err != nil {
-			err = errors.Wrap(err, "Fail to unmarshal cache in cache middleware")
-			log.Error(err)
-			c.Next()
+		if c.GetBool(skipCacheKey) {
 			return
 		}
+		// revalidation, refresh, and expired entries have to be overwritten
+		overwrite := isExpired || isRefreshed || cache.IsRevalidation(c.Request.Context())
+		if saveCache(cacheConf, cacheProvider, serializer, key, c.Request, writer.Status(), writer.body.Bytes(), overwrite) {
+			indexCache(cacheProvider, keyBuilder, key, c.Request, indexTTL)
+		}
+	}
+}
+
+// keyHeadersPrefix prefixes the uri with the values of headers in the request, e.g. "x-partner-id=a:", or it's empty if
+// none of them is present
+func keyHeadersPrefix(request *http.Request, headers []string) string {
+	values := make(url.Values)
+	for _, header := range headers {
+		if value := request.Header.Get(header); value != "" {
+			values.Set(strings.ToLower(header), value)
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values.Encode() + ":"
+}
+
+// loadCache gets the cache of key and reports if there is one
+func loadCache(c *gin.Context, cacheProvider cache.Rediser, serializer cache.Serializer, key string) (cacheResp cache.HTTP, isCached bool) {
+	result, err := cacheProvider.Get(c.Request.Context(), key).Result()
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.Bool("cache.hit", err == nil))
+	if err != nil {
+		err = errors.Wrapf(err, "Fail to get cache value for %s in cache middleware", key)
+		log.Info(err)
+		return cacheResp, false
+	}
 
+	err = serializer.Unmarshal([]byte(result), &cacheResp)
+	if err != nil {
+		err = errors.Wrap(err, "Fail to unmarshal cache in cache middleware")
+		log.Error(err)
+		return cacheResp, false
+	}
+	return cacheResp, true
+}
+
+// respondWithCache responds with the cached response of key
+func respondWithCache(c *gin.Context, cacheResp cache.HTTP, cacheProvider cache.Rediser, key string, revalidator http.Handler) {
+	uri := c.Request.URL.String()
+	now := time.Now()
+	if age, ok := cacheResp.Age(now); ok {
+		c.Header("Age", strconv.Itoa(int(age.Seconds())))
+	}
+	if cacheResp.FreshUntil != 0 {
+		c.Header(XCacheExpiresHeader, time.Unix(cacheResp.FreshUntil, 0).UTC().Format(http.TimeFormat))
+	}
+
+	if cacheResp.IsStale(now) {
+		log.Infof("respond with stale cache for %s", uri)
+		c.Header(XCacheHeader, "STALE")
+		// the replay keeps the values of the request, e.g. the api version deciding the key, but not its cancellation
+		go revalidate(revalidator, cacheProvider, key, c.Request.Clone(cache.WithRevalidation(relay.Detach(c.Request.Context()))))
+	} else {
 		log.Infof("respond with cache for %s", uri)
-		c.AbortWithStatusJSON(cacheResp.StatusCode, json.RawMessage(cacheResp.Response))
+		c.Header(XCacheHeader, "HIT")
+	}
+	// the cached response is already JSON so it's written as is
+	c.Data(cacheResp.StatusCode, cachedContentType(c, cacheResp.StatusCode), cacheResp.Response)
+	c.Abort()
+}
+
+// RespondWithStaleCache responds with the successful response cached previously, which may have expired, with
+// X-Cache: STALE-ERROR, and reports if there is one. It's for the handlers whose upstream fails, and it requires
+// ServeStaleOnError of the cache.
+func RespondWithStaleCache(c *gin.Context) bool {
+	value, ok := c.Get(staleCacheKey)
+	if !ok {
+		return false
+	}
+	cacheResp := value.(cache.HTTP)
+
+	if age, ok := cacheResp.Age(time.Now()); ok {
+		c.Header("Age", strconv.Itoa(int(age.Seconds())))
+	}
+	c.Header(XCacheHeader, XCacheStaleError)
+	c.Set(skipCacheKey, true)
+	c.Data(http.StatusOK, "application/json; charset=utf-8", cacheResp.Response)
+	c.Abort()
+	return true
+}
+
+// isAutoPaginated reports if the request asks for AutoPaginateQuery
+func isAutoPaginated(request *http.Request) bool {
+	autoPaginate, err := strconv.ParseBool(request.URL.Query().Get(AutoPaginateQuery))
+	return err == nil && autoPaginate
+}
+
+// CachePolicy reports if the responses of the api path are cached, and the ttls of its successful responses and its
+// errors without Cache-Set-TTL
+func CachePolicy(cacheConf config.Cache, path string) (isCached bool, ttl time.Duration, errorTTL time.Duration) {
+	request := &http.Request{URL: &url.URL{Path: path}, RequestURI: path, Header: make(http.Header)}
+	if !cacheConf.IsEnabled || isCacheDisabled(cacheConf, request) {
+		return false, 0, 0
+	}
+	ttl, _ = getResponseTTL(cacheConf, request, http.StatusOK)
+	errorTTL, _ = getResponseTTL(cacheConf, request, http.StatusInternalServerError)
+	return true, ttl, errorTTL
+}
+
+// isCacheDisabled checks DisabledAPIs by the path, the exact RequestURI for backward compatibility, or a "prefix*" key
+func isCacheDisabled(cacheConf config.Cache, request *http.Request) bool {
+	keys := make([]string, 0, len(cacheConf.DisabledAPIs))
+	for key := range cacheConf.DisabledAPIs {
+		keys = append(keys, key)
 	}
+	key, ok := matchAPIKey(request, keys)
+	return ok && cacheConf.DisabledAPIs[key]
 }
+
+// matchAPIKey finds the key of the api config for the request. The exact RequestURI and path keys take precedence
+// over the "prefix*" keys, among which the longest prefix wins.
+func matchAPIKey(request *http.Request, keys []string) (matched string, ok bool) {
+	for _, candidate := range []string{request.RequestURI, request.URL.Path} {
+		for _, key := range keys {
+			if key == candidate {
+				return key, true
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "*") || (ok && len(key) <= len(matched)) {
+			continue
+		}
+		prefix := strings.TrimSuffix(key, "*")
+		if strings.HasPrefix(request.URL.Path, prefix) || strings.HasPrefix(request.RequestURI, prefix) {
+			matched, ok = key, true
+		}
+	}
+	return matched, ok
+}
+
+// getResponseTTL decides the ttl by the status code. Successful responses of the 2xx family use the overwritten ttl of
+// the api and they're kept as stale for another staleTTL. Errors use the error ttl. StatusTTL of the status replaces the default
+// ttl and the error ttl. They're all overridden by the ttl requested by TTLHeader, and then capped by MaxTTL.
+func getResponseTTL(cacheConf config.Cache, request *http.Request, statusCode int) (ttl time.Duration, staleTTL time.Duration) {
+	statusTTL, hasStatusTTL := getStatusTTL(cacheConf, statusCode)
+	if statusCode/100 != 2 {
+		// some errors are known to be long-lived by the client, e.g. a deleted video
+		ttl = time.Duration(cacheConf.ErrorTTL) * time.Second
+		if hasStatusTTL {
+			ttl = statusTTL
+		}
+		if headerTTL, isPresenting, err := getHeaderTTL(request); err != nil {
+			log.Error(err)
+		} else if isPresenting {
+			ttl = headerTTL
+		}
+		return capTTL(cacheConf, request, ttl), 0
+	}
+
+	// exact RequestURI overwrites are kept for backward compatibility and take precedence over path overwrites
+	keys := make([]string, 0, len(cacheConf.OverwriteTTL))
+	for key := range cacheConf.OverwriteTTL {
+		keys = append(keys, key)
+	}
+	if key, ok := matchAPIKey(request, keys); ok {
+		ttl = time.Duration(cacheConf.OverwriteTTL[key]) * time.Second
+	} else if hasStatusTTL {
+		ttl = statusTTL
+	} else {
+		ttl = time.Duration(cacheConf.TTL) * time.Second
+	}
+
+	if headerTTL, isPresenting, err := getHeaderTTL(request); err != nil {
+		log.Error(err)
+	} else if isPresenting {
+		ttl = headerTTL
+	}
+
+	return capTTL(cacheConf, request, ttl), time.Duration(cacheConf.StaleWhileRevalidate) * time.Second
+}
+
+// getStatusTTL finds the ttl of the status code in StatusTTL, where the status code takes precedence over its family
+func getStatusTTL(cacheConf config.Cache, statusCode int) (ttl time.Duration, ok bool) {
+	seconds, ok := cacheConf.StatusTTL[strconv.Itoa(statusCode)]
+	if !ok {
+		seconds, ok = cacheConf.StatusTTL[strconv.Itoa(statusCode/100)+"xx"]
+	}
+	return time.Duration(seconds) * time.Second, ok
+}
+
+// capTTL clamps ttl to MaxTTL unless it's unlimited
+func capTTL(cacheConf config.Cache, request *http.Request, ttl time.Duration) time.Duration {
+	maxTTL := time.Duration(cacheConf.MaxTTL) * time.Second
+	if maxTTL <= 0 || ttl <= maxTTL {
+		return ttl
+	}
+	log.Infof("cache ttl(%d) of %s is clamped to maxTtl(%d)", int(ttl.Seconds()), request.URL.String(), cacheConf.MaxTTL)
+	return maxTTL
+}
+
+func getHeaderTTL(request *http.Request) (ttl time.Duration, isPresenting bool, err error) {
+	var values []string
+	if values, isPresenting = request.Header[http.CanonicalHeaderKey(TTLHeader)]; isPresenting {
+		var headerTTL string
+		if len(values) > 0 {
+			headerTTL = values[0]
+		} else {
+			return ttl, isPresenting, errors.Errorf("header(%s) has empty value", TTLHeader)
+		}
+
+		var intTTL int
+		intTTL, err = strconv.Atoi(headerTTL)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("converting %s(%s) to int encountered error", headerTTL, TTLHeader))
+		} else if intTTL <= 0 {
+			err = errors.Errorf("the value(%d) of %s is not positive", intTTL, TTLHeader)
+		} else {
+			log.Infof("client requests to set cache ttl to %d via %s", intTTL, TTLHeader)
+			ttl = time.Duration(intTTL) * time.Second
+		}
+	}
+	return ttl, isPresenting, err
+}
+
+// longestTTL is the longest configured lifetime of the entries, which is used as the ttl of the indexes
+func longestTTL(cacheConf config.Cache) time.Duration {
+	longest := cacheConf.TTL
+	ttls := append([]int{cacheConf.ErrorTTL, cacheConf.VideoCategoriesTTL}, mapValues(cacheConf.OverwriteTTL)...)
+	for _, ttl := range append(ttls, mapValues(cacheConf.StatusTTL)...) {
+		if ttl > longest {
+			longest = ttl
+		}
+	}
+	if cacheConf.ServeStaleOnError {
+		longest += cacheConf.StaleOnErrorTTL
+	}
+	return time.Duration(longest+cacheConf.StaleWhileRevalidate) * time.Second
+}
+
+func mapValues(m map[string]int) []int {
+	values := make([]int, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// indexCache indexes the key by the channel and playlists of the request so that it can be invalidated by them. A
+// key cached for longer than ttl via TTLHeader may outlive its index.
+func indexCache(cacheProvider cache.Rediser, keyBuilder cache.KeyBuilder, key string, request *http.Request, ttl time.Duration) {
+	query := request.URL.Query()
+	ids := map[cache.IndexKind][]string{}
+	if channelID := query.Get("channelId"); channelID != "" {
+		ids[cache.IndexChannel] = append(ids[cache.IndexChannel], channelID)
+	}
+	// playlistItems can list multiple playlists
+	if playlistID := query.Get("playlistId"); playlistID != "" {
+		ids[cache.IndexPlaylist] = append(ids[cache.IndexPlaylist], strings.Split(playlistID, ",")...)
+	}
+	if strings.HasSuffix(request.URL.Path, "/playlists") && query.Get("id") != "" {
+		ids[cache.IndexPlaylist] = append(ids[cache.IndexPlaylist], strings.Split(query.Get("id"), ",")...)
+	}
+
+	for kind, kindIDs := range ids {
+		for _, id := range kindIDs {
+			if err := cache.Index(request.Context(), cacheProvider, keyBuilder, kind, id, key, ttl); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// saveCache stores the response for its ttl and reports if it's stored. After ttl, successful responses are kept as
+// stale for another staleTTL, and for another StaleOnErrorTTL with ServeStaleOnError. The responses whose StatusTTL is
+// 0 are skipped. With SkipEmptyResults, the successful responses without items are skipped, or kept only for
+// EmptyResultsTTL. The existing entry is only replaced if overwrite is set.
+func saveCache(cacheConf config.Cache, cacheProvider cache.Rediser, serializer cache.Serializer, key string, request *http.Request, statusCode int, body []byte, overwrite bool) bool {
+	uri := request.URL.String()
+	if statusCode < http.StatusOK || (statusCode >= http.StatusMultipleChoices && statusCode < http.StatusBadRequest) {
+		log.Infof("response of %s with status %d is not cached", uri, statusCode)
+		return false
+	}
+	if statusTTL, ok := getStatusTTL(cacheConf, statusCode); ok && statusTTL <= 0 {
+		log.Infof("response of %s with status %d is not cached as its statusTtl is 0", uri, statusCode)
+		return false
+	}
+
+	if cacheConf.MaxBodyBytes > 0 && len(body) > cacheConf.MaxBodyBytes {
+		log.Warnf("response of %s is not cached as its size(%d bytes) exceeds maxBodyBytes(%d bytes)", uri, len(body), cacheConf.MaxBodyBytes)
+		metrics.CacheSkippedTooLarge.Inc()
+		return false
+	}
+
+	ttl, staleTTL := getResponseTTL(cacheConf, request, statusCode)
+	isEmpty := statusCode == http.StatusOK && cacheConf.SkipEmptyResults && hasNoItems(body)
+	if isEmpty {
+		if cacheConf.EmptyResultsTTL <= 0 {
+			log.Infof("response of %s is not cached as it has no items", uri)
+			return false
+		}
+		log.Infof("response of %s has no items and is cached for emptyResultsTtl(%d)", uri, cacheConf.EmptyResultsTTL)
+		ttl, staleTTL = capTTL(cacheConf, request, time.Duration(cacheConf.EmptyResultsTTL)*time.Second), 0
+	}
+	now := time.Now()
+	s, err := serializer.Marshal(cache.HTTP{
+		StatusCode: statusCode,
+		Response:   body,
+		FreshUntil: now.Add(ttl).Unix(),
+		ExpireAt:   now.Add(ttl + staleTTL).Unix(),
+		StoredAt:   now.Unix(),
+	})
+	if err != nil {
+		log.Errorf("Cannot marshal http resp cache for %s: %s", uri, err)
+		return false
+	}
+
+	keepTTL := ttl + staleTTL
+	if cacheConf.ServeStaleOnError && statusCode == http.StatusOK && !isEmpty {
+		keepTTL += time.Duration(cacheConf.StaleOnErrorTTL) * time.Second
+	}
+	if overwrite {
+		err = cacheProvider.Set(request.Context(), key, string(s), keepTTL).Err()
+	} else {
+		err = cacheProvider.SetNX(request.Context(), key, string(s), keepTTL).Err()
+	}
+	if err != nil {
+		log.Errorf("setting cache encountered error for %s: %v ", uri, err)
+		return false
+	}
+	log.Infof("cache for %s is set for ttl(%d)", uri, int(ttl.Seconds()))
+	return true
+}
+
+// hasNoItems reports whether body is a list response, or its envelope, with no items. The YouTube list responses omit
+// the empty items, so they're recognized by their kind. The other responses, e.g. the items keyed by the playlists, are
+// regarded as having items.
+func hasNoItems(body []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+	rawItems, ok := fields["items"]
+	if !ok {
+		var kind string
+		_ = json.Unmarshal(fields["kind"], &kind)
+		return strings.HasSuffix(kind, "ListResponse")
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(rawItems, &items); err != nil {
+		return false
+	}
+	return len(items) == 0
+}
+
+// revalidate replays the request so the relay path overwrites the stale entry. Only one revalidation runs per key.
+func revalidate(revalidator http.Handler, cacheProvider cache.Rediser, key string, request *http.Request) {
+	ctx := request.Context()
+	lockKey := key + ":revalidating"
+	isLocked, err := cacheProvider.SetNX(ctx, lockKey, 1, revalidationLockTTL).Result()
+	if err != nil {
+		log.Errorf("acquiring revalidation lock for %s encountered error: %v", key, err)
+		return
+	} else if !isLocked {
+		log.Infof("revalidation for %s is already in progress", key)
+		return
+	}
+	defer cacheProvider.Del(ctx, lockKey)
+
+	log.Infof("revalidating stale cache for %s", request.URL.String())
+	revalidator.ServeHTTP(&discardResponseWriter{header: http.Header{}}, request)
+}
+
+// discardResponseWriter is a http.ResponseWriter for background requests whose responses nobody reads
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
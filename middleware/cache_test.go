@@ -0,0 +1,505 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func TestMatchAPIKey(t *testing.T) {
+	keys := []string{
+		"/youtube/v3/search?part=snippet&q=news",
+		"/youtube/v3/videos",
+		"/youtube/v3/*",
+		"/youtube/v3/playlist*",
+	}
+	tests := []struct {
+		uri         string
+		wantMatched string
+		wantOK      bool
+	}{
+		{uri: "/youtube/v3/search?part=snippet&q=news", wantMatched: "/youtube/v3/search?part=snippet&q=news", wantOK: true},
+		{uri: "/youtube/v3/videos?id=video1", wantMatched: "/youtube/v3/videos", wantOK: true},
+		{uri: "/youtube/v3/search?part=snippet&q=sports", wantMatched: "/youtube/v3/*", wantOK: true},
+		{uri: "/youtube/v3/playlistItems?playlistId=playlist1", wantMatched: "/youtube/v3/playlist*", wantOK: true},
+		{uri: "/youtube/v3/playlists?id=playlist1", wantMatched: "/youtube/v3/playlist*", wantOK: true},
+		{uri: "/metrics"},
+	}
+	for _, tt := range tests {
+		matched, ok := matchAPIKey(httptest.NewRequest(http.MethodGet, tt.uri, nil), keys)
+		if matched != tt.wantMatched || ok != tt.wantOK {
+			t.Errorf("matchAPIKey(%s) = %q, %v, want %q, %v", tt.uri, matched, ok, tt.wantMatched, tt.wantOK)
+		}
+	}
+}
+
+func TestCachePolicyOfPrefixKeys(t *testing.T) {
+	cacheConf := config.Cache{
+		IsEnabled: true,
+		TTL:       60,
+		ErrorTTL:  10,
+		DisabledAPIs: map[string]bool{
+			"/youtube/v3/search*": true,
+			"/youtube/v3/search":  false,
+		},
+		OverwriteTTL: map[string]int{
+			"/youtube/v3/playlist*":      300,
+			"/youtube/v3/playlistItems*": 600,
+		},
+	}
+	tests := []struct {
+		path         string
+		wantIsCached bool
+		wantTTL      time.Duration
+	}{
+		{path: "/youtube/v3/search", wantIsCached: true, wantTTL: 60 * time.Second},
+		{path: "/youtube/v3/searchSuggestions", wantIsCached: false},
+		{path: "/youtube/v3/playlists", wantIsCached: true, wantTTL: 300 * time.Second},
+		{path: "/youtube/v3/playlistItems", wantIsCached: true, wantTTL: 600 * time.Second},
+		{path: "/youtube/v3/videos", wantIsCached: true, wantTTL: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		isCached, ttl, _ := CachePolicy(cacheConf, tt.path)
+		if isCached != tt.wantIsCached || ttl != tt.wantTTL {
+			t.Errorf("CachePolicy(%s) = %v, %s, want %v, %s", tt.path, isCached, ttl, tt.wantIsCached, tt.wantTTL)
+		}
+	}
+}
+
+func TestGetResponseTTL(t *testing.T) {
+	cacheConf := config.Cache{
+		TTL:                  60,
+		ErrorTTL:             10,
+		StaleWhileRevalidate: 30,
+		MaxTTL:               3600,
+		OverwriteTTL:         map[string]int{"/youtube/v3/playlistItems": 600},
+		StatusTTL:            map[string]int{"2xx": 120, "4xx": 300, "404": 900, "5xx": 0},
+	}
+	tests := []struct {
+		name         string
+		uri          string
+		statusCode   int
+		headerTTL    string
+		wantTTL      time.Duration
+		wantStaleTTL time.Duration
+	}{
+		{name: "statusTtl of the success family replaces ttl", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, wantTTL: 120 * time.Second, wantStaleTTL: 30 * time.Second},
+		{name: "statusTtl of the success family applies to the other 2xx", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusNoContent, wantTTL: 120 * time.Second, wantStaleTTL: 30 * time.Second},
+		{name: "overwriteTtl takes precedence over statusTtl", uri: "/youtube/v3/playlistItems?playlistId=playlist1", statusCode: http.StatusOK, wantTTL: 600 * time.Second, wantStaleTTL: 30 * time.Second},
+		{name: "statusTtl of the error family replaces errorTtl", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusForbidden, wantTTL: 300 * time.Second},
+		{name: "statusTtl of the code takes precedence over its family", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusNotFound, wantTTL: 900 * time.Second},
+		{name: "zero statusTtl is kept", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusBadGateway, wantTTL: 0},
+		{name: "header ttl overrides statusTtl", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusNotFound, headerTTL: "5", wantTTL: 5 * time.Second},
+		{name: "header ttl is capped by maxTtl", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, headerTTL: "86400", wantTTL: 3600 * time.Second, wantStaleTTL: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+			if tt.headerTTL != "" {
+				request.Header.Set(TTLHeader, tt.headerTTL)
+			}
+			ttl, staleTTL := getResponseTTL(cacheConf, request, tt.statusCode)
+			if ttl != tt.wantTTL || staleTTL != tt.wantStaleTTL {
+				t.Errorf("ttl = %s, %s, want %s, %s", ttl, staleTTL, tt.wantTTL, tt.wantStaleTTL)
+			}
+		})
+	}
+}
+
+func TestOverwriteTTLByPath(t *testing.T) {
+	cacheConf := config.Cache{
+		TTL: 60,
+		OverwriteTTL: map[string]int{
+			"/youtube/v3/search":                     300,
+			"/youtube/v3/search?part=snippet&q=news": 30,
+		},
+	}
+	tests := []struct {
+		uri     string
+		wantTTL time.Duration
+	}{
+		{uri: "/youtube/v3/search", wantTTL: 300 * time.Second},
+		{uri: "/youtube/v3/search?part=snippet&q=sports", wantTTL: 300 * time.Second},
+		{uri: "/youtube/v3/search?q=sports&part=snippet&maxResults=50&pageToken=CAUQAA", wantTTL: 300 * time.Second},
+		{uri: "/youtube/v3/search?part=snippet&q=news", wantTTL: 30 * time.Second},
+		{uri: "/youtube/v3/videos?id=video1", wantTTL: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		ttl, _ := getResponseTTL(cacheConf, httptest.NewRequest(http.MethodGet, tt.uri, nil), http.StatusOK)
+		if ttl != tt.wantTTL {
+			t.Errorf("ttl of %s = %s, want %s", tt.uri, ttl, tt.wantTTL)
+		}
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+	cacheConf := config.Cache{
+		TTL:          60,
+		ErrorTTL:     10,
+		MaxTTL:       600,
+		OverwriteTTL: map[string]int{"/youtube/v3/videoCategories": 86400},
+	}
+	tests := []struct {
+		name       string
+		uri        string
+		statusCode int
+		headerTTL  string
+		wantTTL    time.Duration
+	}{
+		{name: "header ttl below the cap is kept", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, headerTTL: "300", wantTTL: 300 * time.Second},
+		{name: "header ttl at the cap is kept", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, headerTTL: "600", wantTTL: 600 * time.Second},
+		{name: "header ttl above the cap is clamped", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, headerTTL: "86400", wantTTL: 600 * time.Second},
+		{name: "header ttl of error below the cap is kept", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusNotFound, headerTTL: "300", wantTTL: 300 * time.Second},
+		{name: "header ttl of error above the cap is clamped", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusNotFound, headerTTL: "86400", wantTTL: 600 * time.Second},
+		{name: "overwriteTtl above the cap is clamped", uri: "/youtube/v3/videoCategories?regionCode=TW", statusCode: http.StatusOK, wantTTL: 600 * time.Second},
+		{name: "default ttl below the cap is kept", uri: "/youtube/v3/videos?id=video1", statusCode: http.StatusOK, wantTTL: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+			if tt.headerTTL != "" {
+				request.Header.Set(TTLHeader, tt.headerTTL)
+			}
+			if ttl, _ := getResponseTTL(cacheConf, request, tt.statusCode); ttl != tt.wantTTL {
+				t.Errorf("ttl = %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestSaveCacheByStatus(t *testing.T) {
+	cacheConf := config.Cache{
+		TTL:       60,
+		ErrorTTL:  10,
+		StatusTTL: map[string]int{"400": 0, "4xx": 300},
+	}
+	tests := []struct {
+		name       string
+		statusCode int
+		wantSaved  bool
+		wantTTL    time.Duration
+	}{
+		{name: "success is saved for ttl", statusCode: http.StatusOK, wantSaved: true, wantTTL: 60 * time.Second},
+		{name: "error is saved for its statusTtl", statusCode: http.StatusNotFound, wantSaved: true, wantTTL: 300 * time.Second},
+		{name: "error of zero statusTtl isn't saved", statusCode: http.StatusBadRequest},
+		{name: "error without statusTtl is saved for errorTtl", statusCode: http.StatusBadGateway, wantSaved: true, wantTTL: 10 * time.Second},
+		{name: "redirection isn't saved", statusCode: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			request := httptest.NewRequest(http.MethodGet, "/youtube/v3/videos?id=video1", nil)
+			saved := saveCache(cacheConf, cacheProvider, cache.NewSerializer(config.SerializeJSON), "key", request, tt.statusCode, []byte(`{}`), true)
+			if saved != tt.wantSaved {
+				t.Fatalf("saved = %v, want %v", saved, tt.wantSaved)
+			}
+			if !tt.wantSaved {
+				return
+			}
+			if ttl := cacheProvider.TTL(context.Background(), "key").Val(); ttl <= tt.wantTTL-time.Second || ttl > tt.wantTTL {
+				t.Errorf("entry is kept for %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestSkipEmptyResults(t *testing.T) {
+	const (
+		emptyList = `{"kind":"youtube#searchListResponse","pageInfo":{"totalResults":0}}`
+		itemsList = `{"kind":"youtube#searchListResponse","items":[{"id":"video1"}]}`
+	)
+	tests := []struct {
+		name             string
+		skipEmptyResults bool
+		emptyResultsTTL  int
+		statusCode       int
+		body             string
+		wantSaved        bool
+		wantTTL          time.Duration
+	}{
+		{name: "list without items is skipped", skipEmptyResults: true, statusCode: http.StatusOK, body: emptyList},
+		{name: "list of empty items is skipped", skipEmptyResults: true, statusCode: http.StatusOK, body: `{"kind":"youtube#videoListResponse","items":[]}`},
+		{name: "envelope of empty items is skipped", skipEmptyResults: true, statusCode: http.StatusOK, body: `{"items":[],"pageInfo":{"totalResults":0}}`},
+		{name: "list with items is kept for ttl and staleOnErrorTtl", skipEmptyResults: true, statusCode: http.StatusOK, body: itemsList, wantSaved: true, wantTTL: 60*time.Second + time.Hour},
+		{name: "items keyed by the playlists are kept", skipEmptyResults: true, statusCode: http.StatusOK, body: `{"playlist1":{"items":[]}}`, wantSaved: true, wantTTL: 60*time.Second + time.Hour},
+		{name: "list without items is kept for emptyResultsTtl only", skipEmptyResults: true, emptyResultsTTL: 30, statusCode: http.StatusOK, body: emptyList, wantSaved: true, wantTTL: 30 * time.Second},
+		{name: "error is kept for errorTtl", skipEmptyResults: true, statusCode: http.StatusNotFound, body: `{"error":"not found"}`, wantSaved: true, wantTTL: 10 * time.Second},
+		{name: "list without items is kept without skipEmptyResults", statusCode: http.StatusOK, body: emptyList, wantSaved: true, wantTTL: 60*time.Second + time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheConf := config.Cache{
+				TTL:               60,
+				ErrorTTL:          10,
+				ServeStaleOnError: true,
+				StaleOnErrorTTL:   3600,
+				SkipEmptyResults:  tt.skipEmptyResults,
+				EmptyResultsTTL:   tt.emptyResultsTTL,
+			}
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			request := httptest.NewRequest(http.MethodGet, "/youtube/v3/search?channelId=channel1", nil)
+			saved := saveCache(cacheConf, cacheProvider, cache.NewSerializer(config.SerializeJSON), "key", request, tt.statusCode, []byte(tt.body), true)
+			if saved != tt.wantSaved {
+				t.Fatalf("saved = %v, want %v", saved, tt.wantSaved)
+			}
+			if exists := cacheProvider.Get(context.Background(), "key").Err() == nil; exists != tt.wantSaved {
+				t.Fatalf("entry exists = %v, want %v", exists, tt.wantSaved)
+			}
+			if !tt.wantSaved {
+				return
+			}
+			if ttl := cacheProvider.TTL(context.Background(), "key").Val(); ttl <= tt.wantTTL-time.Second || ttl > tt.wantTTL {
+				t.Errorf("entry is kept for %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestErrorCacheTTLHeader(t *testing.T) {
+	cacheConf := config.Cache{
+		IsEnabled:  true,
+		TTL:        60,
+		ErrorTTL:   10,
+		MaxTTL:     3600,
+		Serializer: config.SerializeJSON,
+	}
+	const uri = "/youtube/v3/videos?id=deleted"
+	tests := []struct {
+		name      string
+		headerTTL string
+		wantTTL   time.Duration
+	}{
+		{name: "error without header is kept for errorTtl", wantTTL: 10 * time.Second},
+		{name: "error with header is kept for its ttl", headerTTL: "600", wantTTL: 600 * time.Second},
+		{name: "header ttl of error is capped by maxTtl", headerTTL: "86400", wantTTL: 3600 * time.Second},
+		{name: "invalid header falls back to errorTtl", headerTTL: "forever", wantTTL: 10 * time.Second},
+		{name: "non-positive header falls back to errorTtl", headerTTL: "0", wantTTL: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			r := gin.New()
+			r.Use(Cache("test", cacheConf, cacheProvider, r))
+			r.GET("/youtube/v3/videos", func(c *gin.Context) {
+				c.Data(http.StatusNotFound, "application/json; charset=utf-8", []byte(`{"error":"video is not found"}`))
+			})
+
+			request := httptest.NewRequest(http.MethodGet, uri, nil)
+			if tt.headerTTL != "" {
+				request.Header.Set(TTLHeader, tt.headerTTL)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), request)
+
+			key, err := cache.NewKeyBuilder("test", cacheConf).Key(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := cacheProvider.TTL(context.Background(), key).Val(); ttl <= tt.wantTTL-time.Second || ttl > tt.wantTTL {
+				t.Errorf("error is kept for %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	cacheConf := config.Cache{
+		IsEnabled:            true,
+		TTL:                  60,
+		ErrorTTL:             10,
+		StaleWhileRevalidate: 60,
+		Serializer:           config.SerializeJSON,
+	}
+	const uri = "/youtube/v3/videos?id=video1"
+	tests := []struct {
+		name string
+		// the entry is stored before the request if it's isStored, and it's fresh for freshFor and expires in expireIn
+		isStored      bool
+		freshFor      time.Duration
+		expireIn      time.Duration
+		isRevalidated bool
+		wantXCache    string
+		wantBody      string
+		// wantCalls are the calls of the handler, including the revalidation
+		wantCalls int32
+	}{
+		{name: "miss calls the handler", wantXCache: "MISS", wantBody: `{"call":1}`, wantCalls: 1},
+		{name: "fresh entry is served", isStored: true, freshFor: time.Minute, expireIn: 2 * time.Minute, wantXCache: "HIT", wantBody: `{"cached":true}`},
+		{name: "stale entry is served and revalidated", isStored: true, freshFor: -time.Second, expireIn: time.Minute, isRevalidated: true, wantXCache: "STALE", wantBody: `{"cached":true}`, wantCalls: 1},
+		{name: "expired entry calls the handler", isStored: true, freshFor: -time.Minute, expireIn: -time.Second, wantXCache: "MISS", wantBody: `{"call":1}`, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			serializer := cache.NewSerializer(cacheConf.Serializer)
+			key, err := cache.NewKeyBuilder("test", cacheConf).Key(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.isStored {
+				now := time.Now()
+				entry := cache.HTTP{
+					StatusCode: http.StatusOK,
+					Response:   []byte(`{"cached":true}`),
+					FreshUntil: now.Add(tt.freshFor).Unix(),
+					ExpireAt:   now.Add(tt.expireIn).Unix(),
+					StoredAt:   now.Add(-time.Minute).Unix(),
+				}
+				b, err := serializer.Marshal(entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cacheProvider.Set(context.Background(), key, string(b), time.Hour)
+			}
+
+			var calls int32
+			r := gin.New()
+			r.Use(Cache("test", cacheConf, cacheProvider, r))
+			r.GET("/youtube/v3/videos", func(c *gin.Context) {
+				c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(fmt.Sprintf(`{"call":%d}`, atomic.AddInt32(&calls, 1))))
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, uri, nil))
+			if got := w.Header().Get(XCacheHeader); got != tt.wantXCache {
+				t.Errorf("X-Cache = %s, want %s", got, tt.wantXCache)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+
+			if tt.isRevalidated {
+				deadline := time.Now().Add(2 * time.Second)
+				for {
+					stored, err := cacheProvider.Get(context.Background(), key).Result()
+					var entry cache.HTTP
+					if err == nil && serializer.Unmarshal([]byte(stored), &entry) == nil && string(entry.Response) == `{"call":1}` && !entry.IsStale(time.Now()) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("stale entry isn't revalidated")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestKeyHeaders(t *testing.T) {
+	cacheConf := config.Cache{
+		IsEnabled:  true,
+		TTL:        60,
+		ErrorTTL:   10,
+		Serializer: config.SerializeJSON,
+		KeyHeaders: []string{"X-Partner-ID"},
+	}
+	const uri = "/youtube/v3/videos?id=video1"
+	tests := []struct {
+		name string
+		// headers of the requests in order, and the X-Cache each of them wants
+		headers    []http.Header
+		wantXCache []string
+	}{
+		{
+			name:       "configured header values are cached apart",
+			headers:    []http.Header{{"X-Partner-Id": {"a"}}, {"X-Partner-Id": {"b"}}, {"X-Partner-Id": {"a"}}},
+			wantXCache: []string{"MISS", "MISS", "HIT"},
+		},
+		{
+			name:       "configured header is cached apart from its absence",
+			headers:    []http.Header{{}, {"X-Partner-Id": {"a"}}, {}},
+			wantXCache: []string{"MISS", "MISS", "HIT"},
+		},
+		{
+			name:       "unconfigured header shares the entry",
+			headers:    []http.Header{{"X-Other": {"a"}}, {"X-Other": {"b"}}},
+			wantXCache: []string{"MISS", "HIT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			r := gin.New()
+			r.Use(Cache("test", cacheConf, cacheProvider, r))
+			r.GET("/youtube/v3/videos", func(c *gin.Context) {
+				c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(`{}`))
+			})
+
+			for i, header := range tt.headers {
+				request := httptest.NewRequest(http.MethodGet, uri, nil)
+				request.Header = header
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, request)
+				if got := w.Header().Get(XCacheHeader); got != tt.wantXCache[i] {
+					t.Errorf("X-Cache of request %d with %v = %s, want %s", i, header, got, tt.wantXCache[i])
+				}
+				if got := w.Header().Get("Vary"); got != "X-Partner-ID" {
+					t.Errorf("Vary = %s, want X-Partner-ID", got)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyHeadersWithoutHeadersKeepTheKey(t *testing.T) {
+	cacheConf := config.Cache{IsEnabled: true, TTL: 60, ErrorTTL: 10, Serializer: config.SerializeJSON}
+	const uri = "/youtube/v3/videos?id=video1"
+	key, err := cache.NewKeyBuilder("test", cacheConf).Key(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyHeaders := range [][]string{nil, {"X-Partner-ID"}} {
+		cacheConf.KeyHeaders = keyHeaders
+		cacheProvider := cache.NewMemory(10, time.Minute)
+		r := gin.New()
+		r.Use(Cache("test", cacheConf, cacheProvider, r))
+		r.GET("/youtube/v3/videos", func(c *gin.Context) {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(`{}`))
+		})
+
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, uri, nil))
+		if err = cacheProvider.Get(context.Background(), key).Err(); err != nil {
+			t.Errorf("request without the headers of keyHeaders(%v) isn't cached under the key without them: %v", keyHeaders, err)
+		}
+	}
+}
+
+func TestBumpingCacheVersionInvalidatesEntries(t *testing.T) {
+	cacheProvider := cache.NewMemory(10, time.Minute)
+	newEngine := func(version string) *gin.Engine {
+		r := gin.New()
+		r.Use(Cache("test", config.Cache{IsEnabled: true, TTL: 60, ErrorTTL: 10, Serializer: config.SerializeJSON, Version: version}, cacheProvider, r))
+		r.GET("/youtube/v3/videos", func(c *gin.Context) {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(`{}`))
+		})
+		return r
+	}
+
+	for i, request := range []struct {
+		version    string
+		wantXCache string
+	}{
+		{version: "v1", wantXCache: "MISS"},
+		{version: "v1", wantXCache: "HIT"},
+		{version: "v2", wantXCache: "MISS"},
+		{version: "v2", wantXCache: "HIT"},
+	} {
+		w := httptest.NewRecorder()
+		newEngine(request.version).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/youtube/v3/videos?id=video1", nil))
+		if got := w.Header().Get(XCacheHeader); got != request.wantXCache {
+			t.Errorf("X-Cache of request %d of version %s = %s, want %s", i, request.version, got, request.wantXCache)
+		}
+	}
+}
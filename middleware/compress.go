@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// compressWriter buffers the body so that the decision to compress can be made on the final size. Once it's flushed,
+// e.g. by a streamed response, the body is compressed as it's written instead.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	body     bytes.Buffer
+	// stream is where the body is written after the flush, which is compressor unless the handler encoded it itself
+	stream     io.Writer
+	compressor io.WriteCloser
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.stream != nil {
+		return w.stream.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sets Content-Encoding before the headers are sent, and then streams the buffered body and the rest through the
+// compressor
+func (w *compressWriter) Flush() {
+	if w.stream == nil {
+		header := w.ResponseWriter.Header()
+		if header.Get("Content-Encoding") != "" {
+			w.stream = w.ResponseWriter
+		} else {
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length")
+			w.compressor = newCompressor(w.ResponseWriter, w.encoding)
+			w.stream = w.compressor
+		}
+		if _, err := w.stream.Write(w.body.Bytes()); err != nil {
+			log.Errorf("streaming response with %s encountered error: %v", w.encoding, err)
+		}
+		w.body.Reset()
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			log.Errorf("flushing response with %s encountered error: %v", w.encoding, err)
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Compress compresses responses no smaller than minSize bytes with gzip or deflate according to Accept-Encoding.
+// As it only touches the response writer, cached responses are still stored uncompressed. The flushed responses are
+// streamed through the compressor regardless of their size.
+func Compress(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		originalWriter := c.Writer
+		writer := &compressWriter{ResponseWriter: originalWriter, encoding: encoding}
+		c.Writer = writer
+		defer func() {
+			c.Writer = originalWriter
+		}()
+
+		// Vary is set before a flush sends the headers
+		header := originalWriter.Header()
+		header.Add("Vary", "Accept-Encoding")
+
+		c.Next()
+
+		if writer.stream != nil {
+			if writer.compressor != nil {
+				if err := writer.compressor.Close(); err != nil {
+					log.Errorf("streaming response with %s encountered error: %v", encoding, err)
+				}
+			}
+			return
+		}
+		if writer.body.Len() < minSize || header.Get("Content-Encoding") != "" {
+			_, _ = originalWriter.Write(writer.body.Bytes())
+			return
+		}
+
+		var compressed bytes.Buffer
+		if err := compress(&compressed, encoding, writer.body.Bytes()); err != nil {
+			log.Errorf("compressing response with %s encountered error: %v", encoding, err)
+			_, _ = originalWriter.Write(writer.body.Bytes())
+			return
+		}
+		header.Set("Content-Encoding", encoding)
+		header.Set("Content-Length", strconv.Itoa(compressed.Len()))
+		_, _ = originalWriter.Write(compressed.Bytes())
+	}
+}
+
+func compress(w io.Writer, encoding string, body []byte) error {
+	compressor := newCompressor(w, encoding)
+	if _, err := compressor.Write(body); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+func newCompressor(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == encodingDeflate {
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// negotiateEncoding picks gzip over deflate unless the client refuses it with q=0. "*" accepts both.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		isAccepted := true
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q <= 0 {
+					isAccepted = false
+				}
+			}
+		}
+		accepted[name] = isAccepted
+	}
+
+	for _, encoding := range []string{encodingGzip, encodingDeflate} {
+		if isAccepted, ok := accepted[encoding]; ok {
+			if isAccepted {
+				return encoding
+			}
+		} else if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "gzip", want: encodingGzip},
+		{acceptEncoding: "deflate, gzip", want: encodingGzip},
+		{acceptEncoding: "gzip;q=0, deflate", want: encodingDeflate},
+		{acceptEncoding: "*", want: encodingGzip},
+		{acceptEncoding: "*, gzip;q=0", want: encodingDeflate},
+		{acceptEncoding: "br", want: ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+// streamingHandler writes the chunks and flushes after each of them like the streamed responses
+func streamingHandler(chunks ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Status(http.StatusOK)
+		for _, chunk := range chunks {
+			_, _ = c.Writer.WriteString(chunk)
+			c.Writer.Flush()
+		}
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body io.Reader) string {
+	t.Helper()
+	var reader io.Reader = body
+	var err error
+	switch encoding {
+	case encodingGzip:
+		reader, err = gzip.NewReader(body)
+	case encodingDeflate:
+		reader, err = zlib.NewReader(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		handler        gin.HandlerFunc
+		wantEncoding   string
+		wantBody       string
+	}{
+		{
+			name:           "small response is not compressed",
+			acceptEncoding: "gzip",
+			handler:        func(c *gin.Context) { c.String(http.StatusOK, "small") },
+			wantBody:       "small",
+		},
+		{
+			name:           "large response is compressed with gzip",
+			acceptEncoding: "gzip",
+			handler:        func(c *gin.Context) { c.String(http.StatusOK, large) },
+			wantEncoding:   encodingGzip,
+			wantBody:       large,
+		},
+		{
+			name:           "large response is compressed with deflate",
+			acceptEncoding: "deflate",
+			handler:        func(c *gin.Context) { c.String(http.StatusOK, large) },
+			wantEncoding:   encodingDeflate,
+			wantBody:       large,
+		},
+		{
+			name:           "response is not compressed without accept-encoding",
+			acceptEncoding: "",
+			handler:        func(c *gin.Context) { c.String(http.StatusOK, large) },
+			wantBody:       large,
+		},
+		{
+			name:           "streamed response is compressed as it's flushed",
+			acceptEncoding: "gzip",
+			handler:        streamingHandler("[", `{"id":1}`, ",", `{"id":2}`, "]"),
+			wantEncoding:   encodingGzip,
+			wantBody:       `[{"id":1},{"id":2}]`,
+		},
+		{
+			name:           "streamed response encoded by the handler is kept",
+			acceptEncoding: "gzip",
+			handler: func(c *gin.Context) {
+				c.Header("Content-Encoding", "identity")
+				streamingHandler("[", "]")(c)
+			},
+			wantEncoding: "identity",
+			wantBody:     "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(Compress(1024))
+			r.GET("/", tt.handler)
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			// the headers sent with the status are the ones the client sees
+			result := w.Result()
+			if got := result.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := decodeBody(t, tt.wantEncoding, result.Body); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
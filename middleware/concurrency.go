@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Concurrency limits the concurrent requests of the paths in conf.MaxConcurrent with a semaphore per path. A request
+// beyond the limit waits for a slot for conf.QueueTimeout, and it's rejected with 503 and Retry-After after that or if
+// the client disconnects. The slot is released even if the handlers panic.
+func Concurrency(conf config.Concurrency) gin.HandlerFunc {
+	// viper lowercases the keys of maps in the config file, so the paths are matched case-insensitively
+	semaphores := make(map[string]chan struct{}, len(conf.MaxConcurrent))
+	for path, maxConcurrent := range conf.MaxConcurrent {
+		semaphores[strings.ToLower(path)] = make(chan struct{}, maxConcurrent)
+	}
+	queueTimeout := time.Duration(conf.QueueTimeout) * time.Millisecond
+
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		semaphore, ok := semaphores[strings.ToLower(path)]
+		if !ok {
+			return
+		}
+
+		if !acquire(c, semaphore, queueTimeout) {
+			log.Warnf("request of %s is rejected as it exceeds the concurrency limit(%d)", path, cap(semaphore))
+			metrics.ConcurrencyRejected.WithLabelValues(path).Inc()
+			c.Header("Retry-After", strconv.Itoa(conf.RetryAfter))
+			RespondError(c, http.StatusServiceUnavailable, api.ErrorResp{
+				Error: fmt.Sprintf("too many concurrent requests of %s", path),
+				Code:  api.CodeTooManyConcurrent,
+			})
+			return
+		}
+		metrics.InFlight.WithLabelValues(path).Inc()
+		defer func() {
+			metrics.InFlight.WithLabelValues(path).Dec()
+			<-semaphore
+		}()
+
+		c.Next()
+	}
+}
+
+// acquire takes a slot of semaphore within queueTimeout, and reports false if it fails or the client disconnects
+func acquire(c *gin.Context, semaphore chan struct{}, queueTimeout time.Duration) bool {
+	select {
+	case semaphore <- struct{}{}:
+		return true
+	default:
+	}
+	if queueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case semaphore <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
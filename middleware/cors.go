@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodOptions}
+
+// CORS sets the CORS headers for allowed origins and short-circuits preflight requests with 204.
+// The matched origin is echoed back instead of "*" so that credentialed requests work as well.
+func CORS(corsConf config.CORS) gin.HandlerFunc {
+	methods := corsConf.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(corsConf.AllowedHeaders, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !isAllowedOrigin(corsConf.AllowedOrigins, origin) {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		if corsConf.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		// preflight
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				c.Header("Access-Control-Allow-Headers", allowHeaders)
+			}
+			if corsConf.MaxAge > 0 {
+				c.Header("Access-Control-Max-Age", strconv.Itoa(corsConf.MaxAge))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func isAllowedOrigin(patterns []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matchOrigin(pattern, u.Scheme, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches the origin against patterns like "*", "https://www.mirrormedia.mg", or "*.mirrormedia.mg".
+// Scheme is only compared when the pattern has one, and "*." matches any subdomain but not the domain itself.
+func matchOrigin(pattern string, scheme string, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], scheme) {
+			return false
+		}
+		pattern = pattern[i+len("://"):]
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+// errorFormatKey is the key of the format of the error responses in the gin context
+const errorFormatKey = "errorFormat"
+
+// ProblemContentType is the Content-Type of the RFC 7807 error responses
+const ProblemContentType = "application/problem+json"
+
+// ErrorFormat sets the format of the error responses written by RespondError, which is overridden by the errorFormat of
+// the API version of the request. It has to be used before the handlers and the middlewares responding errors.
+func ErrorFormat(format string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, version, ok := APIVersion(c.Request.Context()); ok && version.ErrorFormat != "" {
+			c.Set(errorFormatKey, version.ErrorFormat)
+			return
+		}
+		c.Set(errorFormatKey, format)
+	}
+}
+
+// RespondError aborts with resp in the format set by ErrorFormat, which is api.ErrorResp unless it's
+// config.ErrorFormatProblem
+func RespondError(c *gin.Context, statusCode int, resp api.ErrorResp) {
+	if c.GetString(errorFormatKey) != config.ErrorFormatProblem {
+		c.AbortWithStatusJSON(statusCode, resp)
+		return
+	}
+	// gin keeps the Content-Type set before rendering
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatusJSON(statusCode, api.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(statusCode),
+		Status: statusCode,
+		Detail: resp.Error,
+		Code:   resp.Code,
+	})
+}
+
+// cachedContentType is the Content-Type of the cached response of statusCode in the format set by ErrorFormat
+func cachedContentType(c *gin.Context, statusCode int) string {
+	if statusCode >= http.StatusBadRequest && c.GetString(errorFormatKey) == config.ErrorFormatProblem {
+		return ProblemContentType
+	}
+	return "application/json; charset=utf-8"
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+)
+
+// maxCallbackLength bounds the callback names as no legitimate widget needs a long one
+const maxCallbackLength = 128
+
+// callbackRegex matches JavaScript identifiers optionally separated by dots, e.g. widget.onVideos
+var callbackRegex = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// jsonpWriter buffers the body so that it can be wrapped by the callback. Once it's flushed, e.g. by a streamed
+// response, the body is written after the opening of the call as it's written instead.
+type jsonpWriter struct {
+	gin.ResponseWriter
+	callback    string
+	body        bytes.Buffer
+	isStreaming bool
+}
+
+func (w *jsonpWriter) Write(b []byte) (int, error) {
+	if w.isStreaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *jsonpWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sets the JavaScript headers before they're sent, and then streams the opening of the call and the body
+func (w *jsonpWriter) Flush() {
+	if !w.isStreaming {
+		setJSONPHeaders(w.ResponseWriter.Header())
+		w.ResponseWriter.Header().Del("Content-Length")
+		_, _ = w.ResponseWriter.WriteString(jsonpOpening(w.callback))
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+		w.isStreaming = true
+	}
+	w.ResponseWriter.Flush()
+}
+
+// jsonpOpening is the call of the callback up to its argument. The leading comment guards against the content sniffing
+// attacks on the callback.
+func jsonpOpening(callback string) string {
+	return fmt.Sprintf("/**/ typeof %s === 'function' && %s(", callback, callback)
+}
+
+// jsonpClosing ends the call opened by jsonpOpening
+const jsonpClosing = ");"
+
+func setJSONPHeaders(header http.Header) {
+	header.Set("Content-Type", "application/javascript; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+}
+
+// JSONP wraps the responses in the function of the callback parameter for the legacy widgets. The callback is removed
+// from the query before the following handlers, so the cache stores and serves the raw JSON which is wrapped here.
+// Invalid callback names are rejected with 400 to prevent XSS.
+func JSONP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		callback, isPresenting := query["callback"]
+		if !isPresenting {
+			return
+		}
+		if len(callback) != 1 || len(callback[0]) > maxCallbackLength || !callbackRegex.MatchString(callback[0]) {
+			RespondError(c, http.StatusBadRequest, api.ErrorResp{
+				Error: fmt.Sprintf("callback(%s) has to be a javascript identifier", query.Get("callback")),
+				Code:  api.CodeInvalidCallback,
+			})
+			return
+		}
+
+		query.Del("callback")
+		c.Request.URL.RawQuery = query.Encode()
+
+		originalWriter := c.Writer
+		writer := &jsonpWriter{ResponseWriter: originalWriter, callback: callback[0]}
+		c.Writer = writer
+		defer func() {
+			c.Writer = originalWriter
+		}()
+
+		c.Next()
+
+		if writer.isStreaming {
+			_, _ = originalWriter.WriteString(jsonpClosing)
+			return
+		}
+		wrapped := jsonpOpening(callback[0]) + writer.body.String() + jsonpClosing
+		header := originalWriter.Header()
+		setJSONPHeaders(header)
+		header.Set("Content-Length", strconv.Itoa(len(wrapped)))
+		_, _ = originalWriter.WriteString(wrapped)
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestJSONP(t *testing.T) {
+	tests := []struct {
+		name            string
+		uri             string
+		handler         gin.HandlerFunc
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "response without callback is kept",
+			uri:             "/",
+			handler:         func(c *gin.Context) { c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(`{"a":1}`)) },
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"a":1}`,
+		},
+		{
+			name:            "response is wrapped by the callback",
+			uri:             "/?callback=widget.onVideos",
+			handler:         func(c *gin.Context) { c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(`{"a":1}`)) },
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/javascript; charset=utf-8",
+			wantBody:        `/**/ typeof widget.onVideos === 'function' && widget.onVideos({"a":1});`,
+		},
+		{
+			name:            "streamed response is wrapped by the callback",
+			uri:             "/?callback=onItems",
+			handler:         streamingHandler("[", `{"id":1}`, "]"),
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/javascript; charset=utf-8",
+			wantBody:        `/**/ typeof onItems === 'function' && onItems([{"id":1}]);`,
+		},
+		{
+			name:       "invalid callback is rejected",
+			uri:        "/?callback=alert(1)",
+			handler:    func(c *gin.Context) { c.String(http.StatusOK, "unreachable") },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(JSONP())
+			r.GET("/", tt.handler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.uri, nil))
+
+			result := w.Result()
+			if result.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", result.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := result.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPart adds the configured part of the api to the query when the request omits it. The query is rewritten so
+// that the handlers and the cache key see the same part as an explicit request.
+func DefaultPart(defaultParts config.DefaultParts) gin.HandlerFunc {
+	// viper lowercases the keys of maps in the config file, so the paths are matched case-insensitively
+	parts := make(map[string]string, len(defaultParts))
+	for path, part := range defaultParts {
+		parts[strings.ToLower(path)] = part
+	}
+
+	return func(c *gin.Context) {
+		part, ok := parts[strings.ToLower(c.Request.URL.Path)]
+		if !ok {
+			return
+		}
+
+		query := c.Request.URL.Query()
+		if query.Get("part") != "" {
+			return
+		}
+
+		log.Infof("part is omitted and the default part(%s) is applied for %s", part, c.Request.URL.Path)
+		query.Set("part", part)
+		c.Request.URL.RawQuery = query.Encode()
+	}
+}
+
+// DefaultMaxResults adds the configured maxResults of the api to the query when the request omits it. Like DefaultPart,
+// the query is rewritten so that the handlers and the cache key see the same maxResults as an explicit request.
+func DefaultMaxResults(defaultMaxResults map[string]int) gin.HandlerFunc {
+	// viper lowercases the keys of maps in the config file, so the paths are matched case-insensitively
+	maxResults := make(map[string]int, len(defaultMaxResults))
+	for path, value := range defaultMaxResults {
+		maxResults[strings.ToLower(path)] = value
+	}
+
+	return func(c *gin.Context) {
+		value, ok := maxResults[strings.ToLower(c.Request.URL.Path)]
+		if !ok {
+			return
+		}
+
+		query := c.Request.URL.Query()
+		if _, isPresenting := query["maxResults"]; isPresenting {
+			return
+		}
+
+		query.Set("maxResults", strconv.Itoa(value))
+		c.Request.URL.RawQuery = query.Encode()
+	}
+}
+
+// AllowedParts rejects the requests with 400 if their part has any value out of the allowed parts of the api. The apis
+// not in allowedParts allow any part.
+func AllowedParts(allowedParts config.AllowedParts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		disallowed := allowedParts.Disallowed(c.Request.URL.Path, c.Query("part"))
+		if len(disallowed) == 0 {
+			return
+		}
+		err := fmt.Errorf("part(%s) is not allowed for %s", strings.Join(disallowed, ","), c.Request.URL.Path)
+		Logger(c).Error(err)
+		RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodePartNotAllowed})
+	}
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/quota"
+	"github.com/mirror-media/yt-relay/relay"
+	log "github.com/sirupsen/logrus"
+)
+
+// QuotaBudget rejects the requests with 429 if the quota they're estimated to cost would leave less than the reserve
+// of the budget, and counts the quota used by the upstream calls of the requests into the budget. It has to be used
+// after Cache so that the cache hits cost nothing. The background revalidations are never rejected.
+func QuotaBudget(budget *quota.Budget) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, usage := quota.WithUsage(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+
+		if cost := relay.EstimateQuotaCost(c.Request.URL.Path, c.Request.URL.Query()); cost > 0 && !cache.IsRevalidation(ctx) {
+			remaining, err := budget.Remaining(ctx)
+			if err != nil {
+				// failing to read the budget shouldn't fail the relay
+				Logger(c).Error(err)
+			} else if remaining-cost < budget.Reserve() {
+				err = fmt.Errorf("the request costing %d quota units is rejected as only %d units are left", cost, remaining)
+				Logger(c).Warn(err)
+				c.Set(skipCacheKey, true)
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(relay.UntilQuotaReset(time.Now()).Seconds()))))
+				RespondError(c, http.StatusTooManyRequests, api.ErrorResp{Error: err.Error(), Code: api.CodeQuotaBudget})
+				return
+			}
+		}
+
+		c.Next()
+
+		if units := usage.Units(); units > 0 {
+			if err := budget.Use(ctx, units); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/quota"
+)
+
+func TestQuotaBudget(t *testing.T) {
+	tests := []struct {
+		name          string
+		uri           string
+		used          int64
+		isRevalidated bool
+		wantStatus    int
+		wantRemaining int64
+	}{
+		{name: "request within the budget uses its units", uri: "/youtube/v3/search?q=news", used: 0, wantStatus: http.StatusOK, wantRemaining: 1000 - 100},
+		{name: "request leaving the reserve is accepted", uri: "/youtube/v3/search?q=news", used: 400, wantStatus: http.StatusOK, wantRemaining: 1000 - 400 - 100},
+		{name: "request eating into the reserve is rejected", uri: "/youtube/v3/search?q=news", used: 401, wantStatus: http.StatusTooManyRequests, wantRemaining: 1000 - 401},
+		{name: "revalidation isn't rejected", uri: "/youtube/v3/search?q=news", used: 900, isRevalidated: true, wantStatus: http.StatusOK, wantRemaining: 1000 - 900 - 100},
+		{name: "free path isn't rejected", uri: "/health", used: 1000, wantStatus: http.StatusOK, wantRemaining: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := quota.NewBudget(cache.NewMemory(10, time.Minute), cache.NewKeyBuilder("test", config.Cache{}), config.QuotaBudget{IsEnabled: true, DailyQuota: 1000, Reserve: 500})
+			if tt.used > 0 {
+				if err := budget.Use(context.Background(), tt.used); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := gin.New()
+			r.Use(QuotaBudget(budget))
+			r.GET("/*path", func(c *gin.Context) {
+				// the upstream calls count their units into the request
+				if c.Param("path") != "/health" {
+					quota.Add(c.Request.Context(), 100)
+				}
+				c.String(http.StatusOK, "ok")
+			})
+
+			request := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+			if tt.isRevalidated {
+				request = request.WithContext(cache.WithRevalidation(request.Context()))
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests {
+				if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter <= 0 || retryAfter > 25*60*60 {
+					t.Errorf("Retry-After = %s, want the seconds until the quota reset", w.Header().Get("Retry-After"))
+				}
+			}
+			remaining, err := budget.Remaining(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining != tt.wantRemaining {
+				t.Errorf("remaining = %d, want %d", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/relay"
+)
+
+// QuotaUser attributes the YouTube calls of the request to the client by quotaUser, so that YouTube applies its
+// per-user limits to the clients separately. quotaUser is the header if it's set, or the client IP otherwise. Requests
+// without the header aren't attributed.
+func QuotaUser(header string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		quotaUser := c.ClientIP()
+		if header != "" {
+			quotaUser = c.GetHeader(header)
+		}
+		if quotaUser != "" {
+			c.Request = c.Request.WithContext(relay.WithQuotaUser(c.Request.Context(), quotaUser))
+		}
+	}
+}
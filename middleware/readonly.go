@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadOnlySwitch turns the read-only mode of the cache on and off at runtime. It's kept by each instance.
+type ReadOnlySwitch struct {
+	enabled int32
+}
+
+func NewReadOnlySwitch(enabled bool) *ReadOnlySwitch {
+	s := &ReadOnlySwitch{}
+	s.Set(enabled)
+	return s
+}
+
+func (s *ReadOnlySwitch) Set(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&s.enabled, value)
+}
+
+func (s *ReadOnlySwitch) IsEnabled() bool {
+	return atomic.LoadInt32(&s.enabled) == 1
+}
+
+// ReadOnly rejects the requests with 503 while the switch is on, so that YouTube is never called. It has to be used
+// after Cache, which serves the hits, so that only the misses and the revalidations reach it. The expired responses kept
+// for ServeStaleOnError are served instead if there is one, and the rejections aren't cached.
+func ReadOnly(s *ReadOnlySwitch) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.IsEnabled() {
+			return
+		}
+		c.Set(skipCacheKey, true)
+		if RespondWithStaleCache(c) {
+			log.Infof("respond with stale cache for %s in read-only mode", c.Request.URL.String())
+			return
+		}
+		RespondError(c, http.StatusServiceUnavailable, api.ErrorResp{
+			Error: "service is in cache-only mode and the response isn't cached",
+			Code:  api.CodeReadOnly,
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recovery responds 500 with api.ErrorResp to the requests whose handlers panic, and logs the panic with its stack. The
+// response isn't cached, and a response already partially written, e.g. a streamed one, is left as is. It has to be
+// used first so that it covers all the other middlewares.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// the server aborts the response silently for it
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			Logger(c).WithFields(log.Fields{
+				"panic": fmt.Sprint(recovered),
+				"stack": string(debug.Stack()),
+			}).Errorf("request of %s panicked", c.Request.URL.Path)
+			c.Set(skipCacheKey, true)
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: "internal error", Code: api.CodeInternal})
+		}()
+
+		c.Next()
+	}
+}
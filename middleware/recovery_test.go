@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantCode   string
+		wantCached bool
+	}{
+		{
+			name:       "response is cached without panic",
+			handler:    func(c *gin.Context) { c.String(http.StatusOK, "ok") },
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+			wantCached: true,
+		},
+		{
+			name:       "panic responds the internal error",
+			handler:    func(c *gin.Context) { panic("handler panicked") },
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   api.CodeInternal,
+		},
+		{
+			name: "partially written response is left as is",
+			handler: func(c *gin.Context) {
+				c.String(http.StatusOK, "[")
+				panic("handler panicked")
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "[",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheConf := config.Cache{IsEnabled: true, TTL: 60, ErrorTTL: 60, Serializer: config.SerializeJSON}
+			cacheProvider := cache.NewMemory(10, time.Minute)
+			r := gin.New()
+			r.Use(Recovery(), Cache("test", cacheConf, cacheProvider, r))
+			r.GET("/", tt.handler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				var resp api.ErrorResp
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != tt.wantCode {
+					t.Errorf("body = %s, want the error of code %s", w.Body.String(), tt.wantCode)
+				}
+			} else if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+
+			key, err := cache.NewKeyBuilder("test", cacheConf).Key("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isCached := cacheProvider.Get(context.Background(), key).Err() == nil; isCached != tt.wantCached {
+				t.Errorf("response is cached = %v, want %v", isCached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestRecoveryRepanicsAbortHandler(t *testing.T) {
+	r := gin.New()
+	r.Use(Recovery())
+	r.GET("/", func(c *gin.Context) { panic(http.ErrAbortHandler) })
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want %v", recovered, http.ErrAbortHandler)
+		}
+	}()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HeaderRequestID is the header of the request ID in both the request and the response
+	HeaderRequestID = "X-Request-ID"
+	// RequestIDKey is the key of the request ID in the gin context
+	RequestIDKey = "requestID"
+	// loggerKey is the key of the logrus entry with the request ID in the gin context
+	loggerKey = "logger"
+	// maxRequestIDLength limits the incoming request ID, which is written to the logs as is
+	maxRequestIDLength = 128
+)
+
+// RequestID takes the incoming X-Request-ID or generates a UUID when it's absent. The ID is stored in the gin context
+// with a logrus entry carrying it, and is echoed back in the X-Request-ID response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(HeaderRequestID)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.New().String()
+		}
+
+		c.Set(RequestIDKey, requestID)
+		c.Set(loggerKey, log.WithField(RequestIDKey, requestID))
+		c.Header(HeaderRequestID, requestID)
+
+		c.Next()
+	}
+}
+
+// Logger returns the logrus entry with the request ID of the request, or the standard logger's entry if RequestID isn't
+// used
+func Logger(c *gin.Context) *log.Entry {
+	if logger, ok := c.Value(loggerKey).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/relay"
+	log "github.com/sirupsen/logrus"
+)
+
+// SlowRequest logs the requests taking longer than threshold at warn level with the time spent on YouTube, so that the
+// slowness of YouTube can be told from ours. The other requests are left to the access log.
+func SlowRequest(threshold time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, upstreamTime := relay.WithUpstreamTime(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		start := time.Now()
+
+		c.Next()
+
+		duration := time.Since(start)
+		if duration <= threshold {
+			return
+		}
+		Logger(c).WithFields(log.Fields{
+			"path":             c.Request.URL.Path,
+			"status":           c.Writer.Status(),
+			"cache":            c.Writer.Header().Get(XCacheHeader),
+			"duration":         duration.Milliseconds(),
+			"upstreamDuration": upstreamTime.Duration().Milliseconds(),
+		}).Warnf("request takes longer than %s", threshold)
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSlowRequest(t *testing.T) {
+	const threshold = 20 * time.Millisecond
+	tests := []struct {
+		name     string
+		duration time.Duration
+		wantWarn bool
+	}{
+		{name: "fast request isn't logged", duration: 0},
+		{name: "slow request is warned", duration: 2 * threshold, wantWarn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			r := gin.New()
+			r.Use(func(c *gin.Context) { c.Set(loggerKey, log.NewEntry(logger)) }, SlowRequest(threshold))
+			r.GET("/youtube/v3/videos", func(c *gin.Context) {
+				time.Sleep(tt.duration)
+				c.Header(XCacheHeader, "MISS")
+				c.String(http.StatusOK, "{}")
+			})
+
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/youtube/v3/videos?id=video1", nil))
+
+			if !tt.wantWarn {
+				if len(hook.AllEntries()) != 0 {
+					t.Errorf("logged %v, want nothing", hook.AllEntries())
+				}
+				return
+			}
+			entry := hook.LastEntry()
+			if entry == nil || entry.Level != log.WarnLevel || len(hook.AllEntries()) != 1 {
+				t.Fatalf("logged %v, want a warning", hook.AllEntries())
+			}
+			if entry.Data["path"] != "/youtube/v3/videos" || entry.Data["status"] != http.StatusOK || entry.Data["cache"] != "MISS" {
+				t.Errorf("fields = %v, want the path, the status, and the cache status", entry.Data)
+			}
+			if duration, _ := entry.Data["duration"].(int64); duration < tt.duration.Milliseconds() {
+				t.Errorf("duration = %v, want at least %d", entry.Data["duration"], tt.duration.Milliseconds())
+			}
+			if _, ok := entry.Data["upstreamDuration"]; !ok {
+				t.Errorf("fields = %v, want upstreamDuration", entry.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace starts a server span per request, continuing the trace of the incoming traceparent header
+func Trace() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracing.Tracer().Start(ctx, fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPTargetKey.String(c.Request.URL.String()),
+			),
+		)
+		defer span.End()
+		// slicing traces by show requires the ids even when the response comes from cache
+		if channelID := c.Query("channelId"); channelID != "" {
+			span.SetAttributes(attribute.String("youtube.channelId", channelID))
+		}
+		if playlistID := c.Query("playlistId"); playlistID != "" {
+			span.SetAttributes(attribute.String("youtube.playlistId", playlistID))
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("responded with status %d", status))
+		}
+	}
+}
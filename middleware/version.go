@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/mirror-media/yt-relay/config"
+)
+
+// apiVersion is the version of a request served under a version prefix
+type apiVersion struct {
+	name string
+	conf config.APIVersion
+}
+
+type apiVersionKey struct{}
+
+// WithAPIVersion marks the request of ctx as served under the prefix of the version name. It's kept in the request
+// context, which survives the gin context reset by the rewrite.
+func WithAPIVersion(ctx context.Context, name string, conf config.APIVersion) context.Context {
+	return context.WithValue(ctx, apiVersionKey{}, apiVersion{name: name, conf: conf})
+}
+
+// APIVersion reports the version of the request of ctx, and false if it's not under a version prefix
+func APIVersion(ctx context.Context) (name string, conf config.APIVersion, ok bool) {
+	version, ok := ctx.Value(apiVersionKey{}).(apiVersion)
+	return version.name, version.conf, ok
+}
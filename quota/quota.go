@@ -0,0 +1,131 @@
+// Package quota keeps the daily budget of the YouTube quota shared by the instances in the cache redis
+package quota
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+	// alpine images have no time zone database
+	_ "time/tzdata"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
+	"github.com/pkg/errors"
+)
+
+// pacific is where YouTube resets the quota at midnight
+var pacific = mustLoadLocation("America/Los_Angeles")
+
+// usedKeyTTL keeps the count of a day a bit longer than the day in case of clock skew
+const usedKeyTTL = 48 * time.Hour
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// NextReset is when YouTube resets the quota after now
+func NextReset(now time.Time) time.Time {
+	now = now.In(pacific)
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, pacific)
+}
+
+// Budget counts the quota used on the day in redis
+type Budget struct {
+	rdb        cache.Rediser
+	keyBuilder cache.KeyBuilder
+	conf       config.QuotaBudget
+}
+
+func NewBudget(rdb cache.Rediser, keyBuilder cache.KeyBuilder, conf config.QuotaBudget) *Budget {
+	return &Budget{
+		rdb:        rdb,
+		keyBuilder: keyBuilder,
+		conf:       conf,
+	}
+}
+
+// Reserve is the units the requests cannot use
+func (b *Budget) Reserve() int64 {
+	return b.conf.Reserve
+}
+
+func (b *Budget) usedKey(now time.Time) (string, error) {
+	return b.keyBuilder.QuotaKey(now.In(pacific).Format("2006-01-02"))
+}
+
+// Remaining is the units left of the day
+func (b *Budget) Remaining(ctx context.Context) (int64, error) {
+	key, err := b.usedKey(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	result, err := b.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		result = "0"
+	} else if err != nil {
+		return 0, errors.Wrap(err, "getting quota used encountered error")
+	}
+	used, err := strconv.ParseInt(result, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "quota used(%s) is invalid", result)
+	}
+	return b.remaining(used), nil
+}
+
+// Use adds the units used to the day
+func (b *Budget) Use(ctx context.Context, units int64) error {
+	key, err := b.usedKey(time.Now())
+	if err != nil {
+		return err
+	}
+	used, err := b.rdb.IncrBy(ctx, key, units).Result()
+	if err != nil {
+		return errors.Wrap(err, "counting quota used encountered error")
+	}
+	if used == units {
+		if err = b.rdb.Expire(ctx, key, usedKeyTTL).Err(); err != nil {
+			return errors.Wrap(err, "setting ttl of quota used encountered error")
+		}
+	}
+	b.remaining(used)
+	return nil
+}
+
+// remaining converts the units used to the units remaining and updates the metric
+func (b *Budget) remaining(used int64) int64 {
+	remaining := b.conf.DailyQuota - used
+	metrics.QuotaBudgetRemaining.Set(float64(remaining))
+	return remaining
+}
+
+// Usage accumulates the units used by the upstream calls of a request
+type Usage struct {
+	units int64
+}
+
+// Units is the units used so far
+func (u *Usage) Units() int64 {
+	return atomic.LoadInt64(&u.units)
+}
+
+type usageKey struct{}
+
+// WithUsage attaches a Usage to ctx so that the upstream calls with ctx are counted into it
+func WithUsage(ctx context.Context) (context.Context, *Usage) {
+	usage := &Usage{}
+	return context.WithValue(ctx, usageKey{}, usage), usage
+}
+
+// Add counts the units into the Usage of ctx if there's one. It's safe for the concurrent calls of a request.
+func Add(ctx context.Context, units int64) {
+	if usage, ok := ctx.Value(usageKey{}).(*Usage); ok {
+		atomic.AddInt64(&usage.units, units)
+	}
+}
@@ -0,0 +1,93 @@
+package quota
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func TestNextReset(t *testing.T) {
+	tests := []struct {
+		name string
+		now  string
+		want string
+	}{
+		{name: "standard time", now: "2026-01-15T12:00:00Z", want: "2026-01-16T08:00:00Z"},
+		{name: "daylight saving time", now: "2026-07-15T12:00:00Z", want: "2026-07-16T07:00:00Z"},
+		{name: "before the midnight of pacific time", now: "2026-07-15T06:59:59Z", want: "2026-07-15T07:00:00Z"},
+		{name: "at the midnight of pacific time", now: "2026-07-15T07:00:00Z", want: "2026-07-16T07:00:00Z"},
+		{name: "day switching to daylight saving time", now: "2026-03-08T08:00:00Z", want: "2026-03-09T07:00:00Z"},
+	}
+	for _, tt := range tests {
+		now, err := time.Parse(time.RFC3339, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := NextReset(now).UTC().Format(time.RFC3339); got != tt.want {
+			t.Errorf("%s: NextReset(%s) = %s, want %s", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	tests := []struct {
+		name          string
+		uses          []int64
+		wantRemaining int64
+	}{
+		{name: "unused", wantRemaining: 10000},
+		{name: "used", uses: []int64{1, 100}, wantRemaining: 9899},
+		{name: "overused", uses: []int64{9000, 2000}, wantRemaining: -1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdb := cache.NewMemory(10, time.Minute)
+			budget := NewBudget(rdb, cache.NewKeyBuilder("test", config.Cache{}), config.QuotaBudget{IsEnabled: true, DailyQuota: 10000, Reserve: 500})
+			for _, units := range tt.uses {
+				if err := budget.Use(context.Background(), units); err != nil {
+					t.Fatal(err)
+				}
+			}
+			remaining, err := budget.Remaining(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining != tt.wantRemaining {
+				t.Errorf("remaining = %d, want %d", remaining, tt.wantRemaining)
+			}
+
+			if len(tt.uses) > 0 {
+				key, err := budget.usedKey(time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ttl := rdb.TTL(context.Background(), key).Val(); ttl <= 0 || ttl > usedKeyTTL {
+					t.Errorf("ttl of the units used = %s, want up to %s", ttl, usedKeyTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx, usage := WithUsage(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Add(ctx, 2)
+		}()
+	}
+	wg.Wait()
+	if units := usage.Units(); units != 200 {
+		t.Errorf("units = %d, want 200", units)
+	}
+
+	// the calls without Usage aren't counted
+	Add(context.Background(), 1)
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+)
+
+// CircuitOpenError is returned without calling YouTube while the circuit breaker is open
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("YouTube is unavailable as the circuit breaker is open, retry after %s", e.RetryAfter)
+}
+
+var breakerStates = map[gobreaker.State]float64{
+	gobreaker.StateClosed:   metrics.CircuitBreakerClosed,
+	gobreaker.StateHalfOpen: metrics.CircuitBreakerHalfOpen,
+	gobreaker.StateOpen:     metrics.CircuitBreakerOpen,
+}
+
+// newBreaker creates the circuit breaker which opens after conf.ConsecutiveFailures upstream failures in a row
+func newBreaker(conf config.CircuitBreaker) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        "youtube",
+		MaxRequests: uint32(conf.HalfOpenRequests),
+		Timeout:     time.Duration(conf.Cooldown) * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(conf.ConsecutiveFailures)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			log.Warnf("circuit breaker(%s) changed from %s to %s", name, from, to)
+			metrics.CircuitBreakerState.Set(breakerStates[to])
+		},
+		IsSuccessful: func(err error) bool {
+			return !isUpstreamFailure(err)
+		},
+	})
+}
+
+// isUpstreamFailure reports if err means YouTube is unhealthy. Errors caused by the requests, e.g. invalid parameters
+// or exceeded quota, and requests cancelled by the clients don't count.
+func isUpstreamFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if upstreamErr, ok := errors.Cause(err).(*UpstreamError); ok {
+		return upstreamErr.StatusCode >= http.StatusInternalServerError
+	}
+	return HTTPStatusCode(err) == http.StatusInternalServerError
+}
@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	log "github.com/sirupsen/logrus"
+)
+
+// coalescedCall is a relay call shared by the identical requests. done is closed once resp and err are set.
+type coalescedCall struct {
+	done chan struct{}
+	resp interface{}
+	err  error
+}
+
+// coalescer shares a relay call among the identical requests arriving while it's in flight, and its successful result
+// for window after it finishes. The shared responses are read by all of the requests, so they must not be modified.
+type coalescer struct {
+	ytrelay.VideoRelay
+	window time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// Coalesce shares the calls of relay among the identical requests within window, regardless of the cache. It returns
+// relay as is if window isn't positive.
+func Coalesce(relay ytrelay.VideoRelay, window time.Duration) ytrelay.VideoRelay {
+	if window <= 0 {
+		return relay
+	}
+	return &coalescer{
+		VideoRelay: relay,
+		window:     window,
+		calls:      make(map[string]*coalescedCall),
+	}
+}
+
+func (c *coalescer) Search(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointSearch, options, c.VideoRelay.Search)
+}
+
+func (c *coalescer) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointVideos, options, c.VideoRelay.ListByVideoIDs)
+}
+
+func (c *coalescer) ListPlaylistVideos(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointPlaylistItems, options, c.VideoRelay.ListPlaylistVideos)
+}
+
+func (c *coalescer) ListPlaylists(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointPlaylists, options, c.VideoRelay.ListPlaylists)
+}
+
+func (c *coalescer) ListVideoCategories(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointVideoCategories, options, c.VideoRelay.ListVideoCategories)
+}
+
+func (c *coalescer) ListChannelSections(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return c.do(ctx, endpointChannelSections, options, c.VideoRelay.ListChannelSections)
+}
+
+// do joins the call of the same endpoint and options if there's one, or starts it. The call isn't cancelled by the
+// request starting it, as the others are waiting for it, but it keeps the deadline of the request. Each request stops
+// waiting once its own ctx is done.
+func (c *coalescer) do(ctx context.Context, endpoint string, options ytrelay.Options, call func(ctx context.Context, options ytrelay.Options) (interface{}, error)) (interface{}, error) {
+	b, err := json.Marshal(options)
+	if err != nil {
+		return call(ctx, options)
+	}
+	key := endpoint + ":" + string(b)
+
+	c.mu.Lock()
+	shared, ok := c.calls[key]
+	if !ok {
+		shared = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = shared
+		go c.run(ctx, key, shared, func(ctx context.Context) (interface{}, error) {
+			return call(ctx, options)
+		})
+	} else {
+		log.Debugf("%s call of %s is coalesced", endpoint, string(b))
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-shared.done:
+		return shared.resp, shared.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run calls with the values and the deadline of ctx, and keeps the successful result for the window
+func (c *coalescer) run(ctx context.Context, key string, shared *coalescedCall, call func(ctx context.Context) (interface{}, error)) {
+	callCtx, cancel := context.WithCancel(detachedContext{ctx})
+	if deadline, ok := ctx.Deadline(); ok {
+		callCtx, cancel = context.WithDeadline(detachedContext{ctx}, deadline)
+	}
+	defer cancel()
+
+	shared.resp, shared.err = call(callCtx)
+	close(shared.done)
+
+	if shared.err != nil {
+		c.forget(key)
+		return
+	}
+	time.AfterFunc(c.window, func() { c.forget(key) })
+}
+
+func (c *coalescer) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.calls, key)
+}
+
+// Detach keeps the values of ctx without its cancellation and deadline for the work outliving the request of ctx
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+// detachedContext keeps the values of the context, e.g. the trace and the quota usage, without its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"google.golang.org/api/youtube/v3"
+)
+
+// countingRelay counts the videos calls, which wait for release if it's set and fail with err
+type countingRelay struct {
+	*FakeRelay
+	calls   int32
+	release chan struct{}
+	err     error
+}
+
+func (r *countingRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	atomic.AddInt32(&r.calls, 1)
+	if r.release != nil {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &youtube.VideoListResponse{Items: []*youtube.Video{{Id: options.IDs}}}, nil
+}
+
+func TestCoalesceSequentialCalls(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		second    ytrelay.Options
+		err       error
+		interval  time.Duration
+		wantCalls int32
+	}{
+		{name: "result is shared within the window", window: time.Second, second: ytrelay.Options{IDs: "video1"}, wantCalls: 1},
+		{name: "different options aren't coalesced", window: time.Second, second: ytrelay.Options{IDs: "video2"}, wantCalls: 2},
+		{name: "result isn't shared after the window", window: 10 * time.Millisecond, second: ytrelay.Options{IDs: "video1"}, interval: 50 * time.Millisecond, wantCalls: 2},
+		{name: "error isn't shared", window: time.Second, second: ytrelay.Options{IDs: "video1"}, err: errors.New("failed"), wantCalls: 2},
+		{name: "disabled coalescing calls every time", window: 0, second: ytrelay.Options{IDs: "video1"}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := &countingRelay{FakeRelay: NewFake(""), err: tt.err}
+			coalesced := Coalesce(relay, tt.window)
+
+			if _, err := coalesced.ListByVideoIDs(context.Background(), ytrelay.Options{IDs: "video1"}); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			time.Sleep(tt.interval)
+			resp, err := coalesced.ListByVideoIDs(context.Background(), tt.second)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil {
+				if id := resp.(*youtube.VideoListResponse).Items[0].Id; id != tt.second.IDs {
+					t.Errorf("response is of %s, want %s", id, tt.second.IDs)
+				}
+			}
+			if calls := atomic.LoadInt32(&relay.calls); calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCoalesceConcurrentCalls(t *testing.T) {
+	relay := &countingRelay{FakeRelay: NewFake(""), release: make(chan struct{})}
+	coalesced := Coalesce(relay, time.Second)
+
+	// the request starting the call is canceled, but the call goes on for the others
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := coalesced.ListByVideoIDs(firstCtx, ytrelay.Options{IDs: "video1"})
+		firstErr <- err
+	}()
+	for atomic.LoadInt32(&relay.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	const waiters = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := coalesced.ListByVideoIDs(context.Background(), ytrelay.Options{IDs: "video1"})
+			errs <- err
+		}()
+	}
+
+	cancelFirst()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("err of the canceled request = %v, want %v", err, context.Canceled)
+	}
+	close(relay.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("err of the waiting request = %v, want nil", err)
+		}
+	}
+	if calls := atomic.LoadInt32(&relay.calls); calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
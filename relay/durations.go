@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/pkg/errors"
+)
+
+// playlistItemKind is the kind of the playlist items in the responses of ListPlaylistVideos
+const playlistItemKind = "youtube#playlistItem"
+
+// AddDurations looks up the contentDetails of the videos of the playlist items in resp, the response of
+// ListPlaylistVideos, by relay, and sets contentDetails.duration of each item to the duration of its video. The videos
+// are looked up in a single ListByVideoIDs, which calls YouTube in chunks of maxIDsPerCall ids. The items whose video
+// isn't found, e.g. a private one, are left without the duration.
+func AddDurations(ctx context.Context, relay ytrelay.VideoRelay, resp interface{}) (interface{}, error) {
+	v, err := decodeJSON(resp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "adding durations failed")
+	}
+
+	var items []map[string]interface{}
+	collectPlaylistItems(v, &items)
+	seen := make(map[string]bool, len(items))
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if id := playlistItemVideoID(item); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return v, nil
+	}
+
+	videosResp, err := relay.ListByVideoIDs(ctx, ytrelay.Options{Part: "contentDetails", IDs: strings.Join(ids, ",")})
+	if err != nil {
+		return nil, errors.WithMessage(err, "looking up the durations of the playlist items failed")
+	}
+	var videos struct {
+		Items []struct {
+			ID             string `json:"id"`
+			ContentDetails struct {
+				Duration string `json:"duration"`
+			} `json:"contentDetails"`
+		} `json:"items"`
+	}
+	b, err := json.Marshal(videosResp)
+	if err == nil {
+		err = json.Unmarshal(b, &videos)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the durations of the playlist items encountered error")
+	}
+	durations := make(map[string]string, len(videos.Items))
+	for _, video := range videos.Items {
+		durations[video.ID] = video.ContentDetails.Duration
+	}
+
+	for _, item := range items {
+		duration, ok := durations[playlistItemVideoID(item)]
+		if !ok || duration == "" {
+			continue
+		}
+		contentDetails, ok := item["contentDetails"].(map[string]interface{})
+		if !ok {
+			contentDetails = make(map[string]interface{})
+			item["contentDetails"] = contentDetails
+		}
+		contentDetails["duration"] = duration
+	}
+	return v, nil
+}
+
+// collectPlaylistItems walks v for the playlist items, which are in the items of the list responses or of the
+// responses keyed by the playlists
+func collectPlaylistItems(v interface{}, items *[]map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if value["kind"] == playlistItemKind {
+			*items = append(*items, value)
+			return
+		}
+		for _, fieldValue := range value {
+			collectPlaylistItems(fieldValue, items)
+		}
+	case []interface{}:
+		for _, element := range value {
+			collectPlaylistItems(element, items)
+		}
+	}
+}
+
+// playlistItemVideoID is the video of the playlist item in either contentDetails or snippet.resourceId
+func playlistItemVideoID(item map[string]interface{}) string {
+	if contentDetails, ok := item["contentDetails"].(map[string]interface{}); ok {
+		if id, ok := contentDetails["videoId"].(string); ok && id != "" {
+			return id
+		}
+	}
+	if snippet, ok := item["snippet"].(map[string]interface{}); ok {
+		if resourceID, ok := snippet["resourceId"].(map[string]interface{}); ok {
+			if id, ok := resourceID["videoId"].(string); ok {
+				return id
+			}
+		}
+	}
+	return ""
+}
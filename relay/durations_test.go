@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"google.golang.org/api/youtube/v3"
+)
+
+// durationsRelay responds to ListByVideoIDs with the durations of the known videos, and records the options of the
+// calls
+type durationsRelay struct {
+	*FakeRelay
+	durations map[string]string
+	options   []ytrelay.Options
+}
+
+func (d *durationsRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	d.options = append(d.options, options)
+	resp := &youtube.VideoListResponse{Kind: "youtube#videoListResponse"}
+	for id, duration := range d.durations {
+		resp.Items = append(resp.Items, &youtube.Video{Id: id, ContentDetails: &youtube.VideoContentDetails{Duration: duration}})
+	}
+	return resp, nil
+}
+
+func TestAddDurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    string
+		want    string
+		wantIDs string
+	}{
+		{
+			name:    "durations are added by contentDetails.videoId",
+			resp:    `{"items":[{"kind":"youtube#playlistItem","contentDetails":{"videoId":"video1"}},{"kind":"youtube#playlistItem","contentDetails":{"videoId":"video2"}}]}`,
+			want:    `{"items":[{"contentDetails":{"duration":"PT1M","videoId":"video1"},"kind":"youtube#playlistItem"},{"contentDetails":{"duration":"PT2M","videoId":"video2"},"kind":"youtube#playlistItem"}]}`,
+			wantIDs: "video1,video2",
+		},
+		{
+			name:    "durations are added by snippet.resourceId without contentDetails",
+			resp:    `{"items":[{"kind":"youtube#playlistItem","snippet":{"resourceId":{"videoId":"video1"}}}]}`,
+			want:    `{"items":[{"contentDetails":{"duration":"PT1M"},"kind":"youtube#playlistItem","snippet":{"resourceId":{"videoId":"video1"}}}]}`,
+			wantIDs: "video1",
+		},
+		{
+			name:    "video not found is left without duration",
+			resp:    `{"items":[{"kind":"youtube#playlistItem","contentDetails":{"videoId":"private"}}]}`,
+			want:    `{"items":[{"contentDetails":{"videoId":"private"},"kind":"youtube#playlistItem"}]}`,
+			wantIDs: "private",
+		},
+		{
+			name:    "videos of the playlists are looked up once",
+			resp:    `{"playlist1":{"items":[{"kind":"youtube#playlistItem","contentDetails":{"videoId":"video1"}}]},"playlist2":{"items":[{"kind":"youtube#playlistItem","contentDetails":{"videoId":"video1"}}]}}`,
+			want:    `{"playlist1":{"items":[{"contentDetails":{"duration":"PT1M","videoId":"video1"},"kind":"youtube#playlistItem"}]},"playlist2":{"items":[{"contentDetails":{"duration":"PT1M","videoId":"video1"},"kind":"youtube#playlistItem"}]}}`,
+			wantIDs: "video1",
+		},
+		{
+			name: "response without items isn't looked up",
+			resp: `{"kind":"youtube#playlistItemListResponse"}`,
+			want: `{"kind":"youtube#playlistItemListResponse"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayService := &durationsRelay{FakeRelay: NewFake(""), durations: map[string]string{"video1": "PT1M", "video2": "PT2M"}}
+			resp, err := AddDurations(context.Background(), relayService, json.RawMessage(tt.resp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("response = %s, want %s", b, tt.want)
+			}
+
+			if tt.wantIDs == "" {
+				if len(relayService.options) != 0 {
+					t.Errorf("videos are looked up with %v, want no lookup", relayService.options)
+				}
+				return
+			}
+			if len(relayService.options) != 1 || relayService.options[0].IDs != tt.wantIDs || relayService.options[0].Part != "contentDetails" {
+				t.Errorf("videos are looked up with %v, want a lookup of contentDetails of %s", relayService.options, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestEstimateQuotaCostOfDurations(t *testing.T) {
+	itemsCost, videosCost := quotaCosts[endpointPlaylistItems], quotaCosts[endpointVideos]
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{query: "playlistId=playlist1", want: itemsCost},
+		{query: "playlistId=playlist1&includeDurations=true", want: itemsCost + videosCost},
+		{query: "playlistId=playlist1,playlist2&includeDurations=true", want: 2 * (itemsCost + videosCost)},
+		{query: "playlistId=playlist1&includeDurations=false", want: itemsCost},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := EstimateQuotaCost("/youtube/v3/playlistItems", query); got != tt.want {
+			t.Errorf("EstimateQuotaCost of %s = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
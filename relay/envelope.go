@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Envelope is the list response in the same shape regardless of the endpoint
+type Envelope struct {
+	Items    []json.RawMessage `json:"items"`
+	PageInfo EnvelopePageInfo  `json:"pageInfo"`
+	Etag     string            `json:"etag,omitempty"`
+}
+
+// EnvelopePageInfo gathers the page tokens, which are at the top level of the YouTube responses, with the total
+type EnvelopePageInfo struct {
+	NextPageToken string `json:"nextPageToken,omitempty"`
+	PrevPageToken string `json:"prevPageToken,omitempty"`
+	TotalResults  int64  `json:"totalResults"`
+}
+
+// listResponse is what the YouTube list responses have in common. Some of them, e.g. the channel sections, have
+// neither the page tokens nor pageInfo.
+type listResponse struct {
+	Items         []json.RawMessage `json:"items"`
+	NextPageToken string            `json:"nextPageToken"`
+	PrevPageToken string            `json:"prevPageToken"`
+	Etag          string            `json:"etag"`
+	PageInfo      *struct {
+		TotalResults int64 `json:"totalResults"`
+	} `json:"pageInfo"`
+}
+
+// Wrap converts the list response resp into an Envelope. The items are kept as they are, and totalResults falls back
+// to the number of items when resp has no pageInfo.
+func Wrap(resp interface{}) (Envelope, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return Envelope{}, errors.Wrap(err, "marshalling response for envelope encountered error")
+	}
+	var list listResponse
+	if err = json.Unmarshal(b, &list); err != nil {
+		return Envelope{}, errors.Wrap(err, "unmarshalling response for envelope encountered error")
+	}
+
+	envelope := Envelope{
+		Items: list.Items,
+		PageInfo: EnvelopePageInfo{
+			NextPageToken: list.NextPageToken,
+			PrevPageToken: list.PrevPageToken,
+			TotalResults:  int64(len(list.Items)),
+		},
+		Etag: list.Etag,
+	}
+	if envelope.Items == nil {
+		envelope.Items = []json.RawMessage{}
+	}
+	if list.PageInfo != nil {
+		envelope.PageInfo.TotalResults = list.PageInfo.TotalResults
+	}
+	return envelope, nil
+}
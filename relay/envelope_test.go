@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/api/youtube/v3"
+)
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name string
+		resp interface{}
+		want string
+	}{
+		{
+			name: "search",
+			resp: &youtube.SearchListResponse{
+				Etag:          "etag1",
+				NextPageToken: "CAUQAA",
+				PrevPageToken: "CAUQAQ",
+				PageInfo:      &youtube.PageInfo{TotalResults: 1000000, ResultsPerPage: 5},
+				RegionCode:    "TW",
+				Items:         []*youtube.SearchResult{{Id: &youtube.ResourceId{Kind: "youtube#video", VideoId: "video1"}}},
+			},
+			want: `{"items":[{"id":{"kind":"youtube#video","videoId":"video1"}}],"pageInfo":{"nextPageToken":"CAUQAA","prevPageToken":"CAUQAQ","totalResults":1000000},"etag":"etag1"}`,
+		},
+		{
+			name: "videos",
+			resp: &youtube.VideoListResponse{
+				Etag:     "etag2",
+				PageInfo: &youtube.PageInfo{TotalResults: 2, ResultsPerPage: 2},
+				Items:    []*youtube.Video{{Id: "video1"}, {Id: "video2"}},
+			},
+			want: `{"items":[{"id":"video1"},{"id":"video2"}],"pageInfo":{"totalResults":2},"etag":"etag2"}`,
+		},
+		{
+			name: "playlistItems",
+			resp: &youtube.PlaylistItemListResponse{
+				NextPageToken: "CAoQAA",
+				PageInfo:      &youtube.PageInfo{TotalResults: 30, ResultsPerPage: 1},
+				Items:         []*youtube.PlaylistItem{{Id: "item1", Snippet: &youtube.PlaylistItemSnippet{PlaylistId: "playlist1"}}},
+			},
+			want: `{"items":[{"id":"item1","snippet":{"playlistId":"playlist1"}}],"pageInfo":{"nextPageToken":"CAoQAA","totalResults":30}}`,
+		},
+		{
+			name: "channelSections without pageInfo counts the items",
+			resp: &youtube.ChannelSectionListResponse{
+				Etag:  "etag3",
+				Items: []*youtube.ChannelSection{{Id: "channel1.section1"}, {Id: "channel1.section2"}},
+			},
+			want: `{"items":[{"id":"channel1.section1"},{"id":"channel1.section2"}],"pageInfo":{"totalResults":2},"etag":"etag3"}`,
+		},
+		{
+			name: "empty response",
+			resp: &youtube.VideoListResponse{},
+			want: `{"items":[],"pageInfo":{"totalResults":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := Wrap(tt.resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("Wrap() = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrQuotaExceeded is returned when YouTube rejects the call because the quota or the rate limit is exceeded
+var ErrQuotaExceeded = errors.New("YouTube quota is exceeded")
+
+var quotaReasons = map[string]bool{
+	"dailyLimitExceeded":    true,
+	"quotaExceeded":         true,
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// dailyQuotaReasons are the quota reasons lasting until YouTube resets the quota, unlike the rate limits
+var dailyQuotaReasons = map[string]bool{
+	"dailyLimitExceeded": true,
+	"quotaExceeded":      true,
+}
+
+// quotaError keeps the reason YouTube responded for ErrQuotaExceeded, which is its cause
+type quotaError struct {
+	reason string
+}
+
+func (e *quotaError) Error() string {
+	return "YouTube responded " + e.reason + ": " + ErrQuotaExceeded.Error()
+}
+
+func (e *quotaError) Cause() error {
+	return ErrQuotaExceeded
+}
+
+// IsDailyQuotaExceeded reports if err is ErrQuotaExceeded for the daily quota, which isn't restored until the reset
+func IsDailyQuotaExceeded(err error) bool {
+	for err != nil {
+		if quotaErr, ok := err.(*quotaError); ok {
+			return dailyQuotaReasons[quotaErr.reason]
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+// UpstreamError is a failed YouTube call with the status code YouTube responded
+type UpstreamError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+// wrapError converts googleapi errors into the errors known by the handlers
+func wrapError(err error) error {
+	gErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
+	}
+	for _, item := range gErr.Errors {
+		if quotaReasons[item.Reason] {
+			return errors.WithStack(&quotaError{reason: item.Reason})
+		}
+		if item.Reason == "invalidPageToken" {
+			return errors.Wrap(ErrInvalidPageToken, "YouTube rejected pageToken")
+		}
+	}
+	return &UpstreamError{StatusCode: gErr.Code, Err: gErr}
+}
+
+// HTTPStatusCode maps the error returned by the relay service to the status code to respond with
+func HTTPStatusCode(err error) int {
+	if _, ok := errors.Cause(err).(*CircuitOpenError); ok {
+		return http.StatusServiceUnavailable
+	}
+
+	switch cause := errors.Cause(err); cause {
+	case ErrInvalidPageToken:
+		return http.StatusBadRequest
+	case ErrQuotaExceeded:
+		return http.StatusTooManyRequests
+	}
+
+	upstreamErr, ok := errors.Cause(err).(*UpstreamError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch code := upstreamErr.StatusCode; {
+	case code == http.StatusBadRequest, code == http.StatusForbidden, code == http.StatusNotFound:
+		return code
+	case code >= http.StatusInternalServerError:
+		return http.StatusBadGateway
+	default:
+		// other failures, e.g. 401, are caused by the relay itself rather than the client
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/pkg/errors"
+	"google.golang.org/api/youtube/v3"
+)
+
+// FakeRelay implements the VideoRelay interface with the fixtures in FixtureDir rather than calling YouTube, so that the
+// routing can be exercised offline. Each api responds with the content of its fixture regardless of the options:
+//
+//	search.json, videos.json, playlistItems.json, playlists.json, videoCategories.json, channelSections.json
+//
+// The fixtures are decoded into the responses of the YouTube sdk.
+type FakeRelay struct {
+	FixtureDir string
+	// ChannelValidation makes the videos being validated against the channel whitelist like the YouTube relay
+	ChannelValidation bool
+}
+
+func NewFake(fixtureDir string) *FakeRelay {
+	return &FakeRelay{FixtureDir: fixtureDir}
+}
+
+func (f *FakeRelay) Search(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.SearchListResponse{}
+	return resp, f.load("search.json", resp)
+}
+
+func (f *FakeRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.VideoListResponse{}
+	return resp, f.load("videos.json", resp)
+}
+
+func (f *FakeRelay) ListPlaylistVideos(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.PlaylistItemListResponse{}
+	return resp, f.load("playlistItems.json", resp)
+}
+
+func (f *FakeRelay) ListPlaylists(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.PlaylistListResponse{}
+	return resp, f.load("playlists.json", resp)
+}
+
+func (f *FakeRelay) ListVideoCategories(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.VideoCategoryListResponse{}
+	return resp, f.load("videoCategories.json", resp)
+}
+
+func (f *FakeRelay) ListChannelSections(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	resp = &youtube.ChannelSectionListResponse{}
+	return resp, f.load("channelSections.json", resp)
+}
+
+func (f *FakeRelay) NeedsChannelValidation() bool {
+	return f.ChannelValidation
+}
+
+func (f *FakeRelay) load(fixture string, resp interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(f.FixtureDir, fixture))
+	if err != nil {
+		return errors.Wrapf(err, "reading fixture(%s) encountered error", fixture)
+	}
+	return errors.Wrapf(json.Unmarshal(b, resp), "decoding fixture(%s) encountered error", fixture)
+}
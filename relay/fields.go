@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fieldTree is the parsed form of the fields parameter. A node without children keeps the whole value.
+type fieldTree map[string]fieldTree
+
+func parseFields(fields string) fieldTree {
+	tree := fieldTree{}
+	for _, path := range strings.Split(fields, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		node := tree
+		for _, name := range strings.Split(path, ".") {
+			child, ok := node[name]
+			if !ok {
+				child = fieldTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// FilterFields trims resp to the comma-separated dot paths in fields, e.g. "items.id,items.snippet.title,nextPageToken".
+// Paths through arrays apply to every element. Numbers are kept as json.Number so they survive exactly.
+func FilterFields(resp interface{}, fields string) (interface{}, error) {
+	tree := parseFields(fields)
+	if len(tree) == 0 {
+		return resp, nil
+	}
+
+	v, err := decodeJSON(resp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "field filtering failed")
+	}
+
+	return tree.filter(v), nil
+}
+
+func (tree fieldTree) filter(v interface{}) interface{} {
+	if len(tree) == 0 {
+		return v
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		filtered := make(map[string]interface{}, len(tree))
+		for name, child := range tree {
+			if fieldValue, ok := value[name]; ok {
+				filtered[name] = child.filter(fieldValue)
+			}
+		}
+		return filtered
+	case []interface{}:
+		filtered := make([]interface{}, 0, len(value))
+		for _, element := range value {
+			filtered = append(filtered, tree.filter(element))
+		}
+		return filtered
+	default:
+		return v
+	}
+}
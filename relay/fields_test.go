@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/api/youtube/v3"
+)
+
+func TestFilterFields(t *testing.T) {
+	resp := &youtube.VideoListResponse{
+		Kind:          "youtube#videoListResponse",
+		NextPageToken: "CAUQAA",
+		Items: []*youtube.Video{
+			{Id: "video1", Snippet: &youtube.VideoSnippet{Title: "title1", ChannelId: "channel1", Thumbnails: &youtube.ThumbnailDetails{Default: &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/video1/default.jpg", Width: 120}}}},
+			{Id: "video2", Snippet: &youtube.VideoSnippet{Title: "title2", ChannelId: "channel1"}},
+		},
+	}
+	tests := []struct {
+		name   string
+		fields string
+		want   string
+	}{
+		{name: "top-level field", fields: "nextPageToken", want: `{"nextPageToken":"CAUQAA"}`},
+		{name: "field of every item", fields: "items.id", want: `{"items":[{"id":"video1"},{"id":"video2"}]}`},
+		{name: "nested fields of every item", fields: "items.id,items.snippet.title", want: `{"items":[{"id":"video1","snippet":{"title":"title1"}},{"id":"video2","snippet":{"title":"title2"}}]}`},
+		{name: "deeply nested field is kept where it's present", fields: "items.snippet.thumbnails.default.url", want: `{"items":[{"snippet":{"thumbnails":{"default":{"url":"https://i.ytimg.com/vi/video1/default.jpg"}}}},{"snippet":{}}]}`},
+		{name: "parent field keeps its children", fields: "items.snippet.thumbnails", want: `{"items":[{"snippet":{"thumbnails":{"default":{"url":"https://i.ytimg.com/vi/video1/default.jpg","width":120}}}},{"snippet":{}}]}`},
+		{name: "spaces and empty paths are ignored", fields: " kind , ,items.id", want: `{"items":[{"id":"video1"},{"id":"video2"}],"kind":"youtube#videoListResponse"}`},
+		{name: "unknown field is dropped", fields: "kind,items.unknown", want: `{"items":[{},{}],"kind":"youtube#videoListResponse"}`},
+		{name: "field through a string is kept as is", fields: "kind.unknown", want: `{"kind":"youtube#videoListResponse"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := FilterFields(resp, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(filtered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("FilterFields(%s) = %s, want %s", tt.fields, b, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterFieldsWithoutFieldsKeepsResponse(t *testing.T) {
+	resp := &youtube.VideoListResponse{Kind: "youtube#videoListResponse"}
+	for _, fields := range []string{"", " , "} {
+		filtered, err := FilterFields(resp, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filtered != resp {
+			t.Errorf("FilterFields(%q) = %v, want the response as is", fields, filtered)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirror-media/yt-relay/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type apiKeyIndexKey struct{}
+
+// withAPIKey sets the index of the API key used by the YouTube calls with ctx
+func withAPIKey(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, apiKeyIndexKey{}, index)
+}
+
+type quotaUserKey struct{}
+
+// maxQuotaUserLength is the max length of quotaUser YouTube accepts
+const maxQuotaUserLength = 40
+
+// WithQuotaUser attributes the YouTube calls with ctx to quotaUser, which is truncated to the length YouTube accepts
+func WithQuotaUser(ctx context.Context, quotaUser string) context.Context {
+	if len(quotaUser) > maxQuotaUserLength {
+		quotaUser = quotaUser[:maxQuotaUserLength]
+	}
+	return context.WithValue(ctx, quotaUserKey{}, quotaUser)
+}
+
+// keyRing rotates the API keys round-robin and skips the keys cooling down after YouTube responds they exceed the quota
+type keyRing struct {
+	keys     []string
+	count    uint32
+	cooldown time.Duration
+	// coolUntil are the unix nanoseconds until which the keys are skipped
+	coolUntil []int64
+}
+
+func newKeyRing(keys []string, cooldown time.Duration) *keyRing {
+	return &keyRing{
+		keys:      keys,
+		cooldown:  cooldown,
+		coolUntil: make([]int64, len(keys)),
+	}
+}
+
+// next picks the index of the next key which isn't cooling down, or the one recovering the earliest if all of them are
+func (r *keyRing) next() int {
+	start := int(atomic.AddUint32(&r.count, 1))
+	now := time.Now().UnixNano()
+	earliest := start % len(r.keys)
+	for i := range r.keys {
+		index := (start + i) % len(r.keys)
+		coolUntil := atomic.LoadInt64(&r.coolUntil[index])
+		if coolUntil <= now {
+			return index
+		}
+		if coolUntil < atomic.LoadInt64(&r.coolUntil[earliest]) {
+			earliest = index
+		}
+	}
+	return earliest
+}
+
+// coolDown skips the key of index for the cooldown
+func (r *keyRing) coolDown(index int) {
+	atomic.StoreInt64(&r.coolUntil[index], time.Now().Add(r.cooldown).UnixNano())
+	metrics.APIKeyQuotaErrors.WithLabelValues(strconv.Itoa(index)).Inc()
+	log.Warnf("api key #%d exceeds the quota and is skipped for %s", index, r.cooldown)
+}
+
+// isAvailable reports if any key isn't cooling down
+func (r *keyRing) isAvailable() bool {
+	now := time.Now().UnixNano()
+	for i := range r.coolUntil {
+		if atomic.LoadInt64(&r.coolUntil[i]) <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// RoundTrip sets the key picked for the request, or the first key if none is picked, and the quotaUser of the request
+func (r *keyRing) RoundTrip(request *http.Request) (*http.Response, error) {
+	index, _ := request.Context().Value(apiKeyIndexKey{}).(int)
+	request = request.Clone(request.Context())
+	query := request.URL.Query()
+	query.Set("key", r.keys[index])
+	if quotaUser, ok := request.Context().Value(quotaUserKey{}).(string); ok && quotaUser != "" {
+		query.Set("quotaUser", quotaUser)
+	}
+	request.URL.RawQuery = query.Encode()
+	return http.DefaultTransport.RoundTrip(request)
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/config"
+	"google.golang.org/api/googleapi"
+)
+
+func TestKeyRingNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		coolingKey []int
+		// rounds are the number of picks in a row, and every pick has to be one of wantKeys
+		rounds   int
+		wantKeys map[int]bool
+	}{
+		{name: "keys are rotated", rounds: 6, wantKeys: map[int]bool{0: true, 1: true, 2: true}},
+		{name: "cooling key is skipped", coolingKey: []int{1}, rounds: 6, wantKeys: map[int]bool{0: true, 2: true}},
+		{name: "only the available key is picked", coolingKey: []int{0, 2}, rounds: 6, wantKeys: map[int]bool{1: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newKeyRing([]string{"key0", "key1", "key2"}, time.Hour)
+			for _, index := range tt.coolingKey {
+				ring.coolDown(index)
+			}
+			picked := map[int]bool{}
+			for i := 0; i < tt.rounds; i++ {
+				index := ring.next()
+				if !tt.wantKeys[index] {
+					t.Fatalf("key #%d is picked, want one of %v", index, tt.wantKeys)
+				}
+				picked[index] = true
+			}
+			if len(picked) != len(tt.wantKeys) {
+				t.Errorf("picked keys = %v, want all of %v", picked, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestKeyRingAllCooling(t *testing.T) {
+	ring := newKeyRing([]string{"key0", "key1", "key2"}, time.Hour)
+	ring.coolDown(2)
+	ring.coolDown(0)
+	ring.coolDown(1)
+	if ring.isAvailable() {
+		t.Error("keys are available while all of them are cooling down")
+	}
+	if index := ring.next(); index != 2 {
+		t.Errorf("key #%d is picked, want #2 recovering the earliest", index)
+	}
+
+	ring.cooldown = -time.Second
+	ring.coolDown(1)
+	if !ring.isAvailable() {
+		t.Error("key is unavailable after its cooldown")
+	}
+	if index := ring.next(); index != 1 {
+		t.Errorf("key #%d is picked, want #1 after its cooldown", index)
+	}
+}
+
+func TestKeyRingRoundTrip(t *testing.T) {
+	var gotQuery map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+	}))
+	defer server.Close()
+
+	ring := newKeyRing([]string{"key0", "key1"}, time.Hour)
+	ctx := WithQuotaUser(withAPIKey(context.Background(), 1), "user")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?part=id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ring.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for param, want := range map[string]string{"key": "key1", "quotaUser": "user", "part": "id"} {
+		if got := gotQuery[param]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s = %v, want %s", param, got, want)
+		}
+	}
+}
+
+func quotaErr(reason string) error {
+	return &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: reason}}}
+}
+
+func TestDoRotatesKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		// errs are returned by the calls in order, and the calls after them succeed
+		errs []error
+		// wantStatus is the status the handlers respond to the error with, or zero for no error
+		wantStatus  int
+		wantKeys    []int
+		wantCooling []int
+	}{
+		{name: "success", wantKeys: []int{0}},
+		{name: "daily quota retries another key", errs: []error{quotaErr("quotaExceeded")}, wantKeys: []int{0, 1}, wantCooling: []int{0}},
+		{name: "daily quota of every key fails", errs: []error{quotaErr("dailyLimitExceeded"), quotaErr("dailyLimitExceeded")}, wantStatus: http.StatusTooManyRequests, wantKeys: []int{0, 1}, wantCooling: []int{0, 1}},
+		{name: "rate limit backs off without cooldown", errs: []error{quotaErr("rateLimitExceeded")}, wantKeys: []int{0, 1}},
+		{name: "rate limit stops at max attempts", errs: []error{quotaErr("userRateLimitExceeded"), quotaErr("userRateLimitExceeded"), quotaErr("userRateLimitExceeded")}, wantStatus: http.StatusTooManyRequests, wantKeys: []int{0, 1, 0}},
+		{name: "client error isn't retried", errs: []error{&googleapi.Error{Code: http.StatusBadRequest}}, wantStatus: http.StatusBadRequest, wantKeys: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &YouTubeServiceV3{
+				keys:  newKeyRing([]string{"key0", "key1"}, time.Hour),
+				retry: config.Retry{MaxAttempts: 3, BaseDelay: 1},
+			}
+			// the first call uses key #0
+			s.keys.count = 1
+
+			var usedKeys []int
+			_, err := s.do(context.Background(), endpointVideos, func(ctx context.Context) (interface{}, error) {
+				index, _ := ctx.Value(apiKeyIndexKey{}).(int)
+				usedKeys = append(usedKeys, index)
+				if len(usedKeys) <= len(tt.errs) {
+					return nil, tt.errs[len(usedKeys)-1]
+				}
+				return "ok", nil
+			})
+			if err == nil && tt.wantStatus != 0 {
+				t.Errorf("err = nil, want the error of status %d", tt.wantStatus)
+			}
+			if err != nil && HTTPStatusCode(err) != tt.wantStatus {
+				t.Errorf("err = %v of status %d, want status %d", err, HTTPStatusCode(err), tt.wantStatus)
+			}
+			if fmt.Sprint(usedKeys) != fmt.Sprint(tt.wantKeys) {
+				t.Errorf("keys of the calls = %v, want %v", usedKeys, tt.wantKeys)
+			}
+
+			now := time.Now().UnixNano()
+			cooling := map[int]bool{}
+			for _, index := range tt.wantCooling {
+				cooling[index] = true
+			}
+			for index, coolUntil := range s.keys.coolUntil {
+				if isCooling := coolUntil > now; isCooling != cooling[index] {
+					t.Errorf("key #%d is cooling down = %v, want %v", index, isCooling, cooling[index])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/pkg/errors"
+)
+
+type addedPartsKey struct{}
+
+// RequirePart adds part to the part of options if the request didn't ask for it, e.g. snippet for validating the
+// channels, and marks it in ctx for TrimPartsTransform to remove it from the response
+func RequirePart(ctx context.Context, options ytrelay.Options, part string) (context.Context, ytrelay.Options) {
+	if hasPart(options.Part, part) {
+		return ctx, options
+	}
+	options.Part += "," + part
+	added, _ := ctx.Value(addedPartsKey{}).([]string)
+	return context.WithValue(ctx, addedPartsKey{}, append(added[:len(added):len(added)], part)), options
+}
+
+// TrimPartsTransform removes the parts added by RequirePart from the items, so the parts added for the internal use
+// never reach the clients or the cache. The responses of the requests without any added part are returned as is.
+var TrimPartsTransform ResponseTransform = TransformFunc(func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+	added, _ := ctx.Value(addedPartsKey{}).([]string)
+	if len(added) == 0 {
+		return resp, nil
+	}
+	return TrimParts(resp, added)
+})
+
+// TrimParts removes the parts from the items in resp. The items are in the items of the list responses or of the
+// responses keyed by the playlists.
+func TrimParts(resp interface{}, parts []string) (interface{}, error) {
+	v, err := decodeJSON(resp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "trimming parts failed")
+	}
+
+	var items []map[string]interface{}
+	collectItems(v, &items)
+	for _, item := range items {
+		for _, part := range parts {
+			delete(item, part)
+		}
+	}
+	return v, nil
+}
+
+// collectItems walks v for the elements of the items
+func collectItems(v interface{}, items *[]map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range value {
+			elements, ok := fieldValue.([]interface{})
+			if name != "items" || !ok {
+				collectItems(fieldValue, items)
+				continue
+			}
+			for _, element := range elements {
+				if item, ok := element.(map[string]interface{}); ok {
+					*items = append(*items, item)
+				}
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			collectItems(element, items)
+		}
+	}
+}
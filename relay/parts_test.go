@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"google.golang.org/api/youtube/v3"
+)
+
+func TestRequirePart(t *testing.T) {
+	tests := []struct {
+		name      string
+		part      string
+		require   string
+		wantPart  string
+		wantAdded []string
+	}{
+		{name: "missing part is added", part: "contentDetails", require: "snippet", wantPart: "contentDetails,snippet", wantAdded: []string{"snippet"}},
+		{name: "requested part is kept", part: "snippet,contentDetails", require: "snippet", wantPart: "snippet,contentDetails"},
+		{name: "spaced part is recognized", part: "contentDetails, snippet", require: "snippet", wantPart: "contentDetails, snippet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, options := RequirePart(context.Background(), ytrelay.Options{Part: tt.part}, tt.require)
+			if options.Part != tt.wantPart {
+				t.Errorf("part = %q, want %q", options.Part, tt.wantPart)
+			}
+			added, _ := ctx.Value(addedPartsKey{}).([]string)
+			if len(added) != len(tt.wantAdded) || (len(added) > 0 && added[0] != tt.wantAdded[0]) {
+				t.Errorf("added parts = %v, want %v", added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestTrimPartsTransform(t *testing.T) {
+	newResp := func() *youtube.VideoListResponse {
+		return &youtube.VideoListResponse{
+			Kind: "youtube#videoListResponse",
+			Items: []*youtube.Video{{
+				Id:             "video1",
+				Snippet:        &youtube.VideoSnippet{ChannelId: "channel1"},
+				ContentDetails: &youtube.VideoContentDetails{Duration: "PT1M"},
+			}},
+		}
+	}
+
+	t.Run("response without added parts is returned as is", func(t *testing.T) {
+		resp := newResp()
+		got, err := TrimPartsTransform.Apply(context.Background(), ytrelay.Options{Part: "contentDetails"}, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != interface{}(resp) {
+			t.Errorf("response = %#v, want the untouched %#v", got, resp)
+		}
+	})
+
+	t.Run("added parts are removed", func(t *testing.T) {
+		ctx, options := RequirePart(context.Background(), ytrelay.Options{Part: "contentDetails"}, "snippet")
+		got, err := TrimPartsTransform.Apply(ctx, options, newResp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"items":[{"contentDetails":{"duration":"PT1M"},"id":"video1"}],"kind":"youtube#videoListResponse"}`
+		if string(b) != want {
+			t.Errorf("response = %s, want %s", b, want)
+		}
+	})
+}
+
+func TestTrimParts(t *testing.T) {
+	tests := []struct {
+		name  string
+		resp  string
+		parts []string
+		want  string
+	}{
+		{
+			name:  "items of list response",
+			resp:  `{"items":[{"id":"a","snippet":{},"status":{}}],"kind":"youtube#videoListResponse"}`,
+			parts: []string{"status"},
+			want:  `{"items":[{"id":"a","snippet":{}}],"kind":"youtube#videoListResponse"}`,
+		},
+		{
+			name:  "items keyed by playlists",
+			resp:  `{"PL1":{"items":[{"id":"a","snippet":{}}]},"PL2":{"items":[{"id":"b","snippet":{}}]}}`,
+			parts: []string{"snippet"},
+			want:  `{"PL1":{"items":[{"id":"a"}]},"PL2":{"items":[{"id":"b"}]}}`,
+		},
+		{
+			name:  "fields out of items are kept",
+			resp:  `{"items":[],"snippet":{}}`,
+			parts: []string{"snippet"},
+			want:  `{"items":[],"snippet":{}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TrimParts(json.RawMessage(tt.resp), tt.parts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("response = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
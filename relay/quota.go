@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mirror-media/yt-relay/metrics"
+	"github.com/mirror-media/yt-relay/quota"
+)
+
+// The YouTube endpoints called by the relay
+const (
+	endpointSearch          = "search.list"
+	endpointVideos          = "videos.list"
+	endpointPlaylistItems   = "playlistItems.list"
+	endpointPlaylists       = "playlists.list"
+	endpointVideoCategories = "videoCategories.list"
+	endpointChannelSections = "channelSections.list"
+)
+
+// quotaCosts are the quota units YouTube charges per call of the endpoints, see
+// https://developers.google.com/youtube/v3/determine_quota_cost
+var quotaCosts = map[string]int64{
+	endpointSearch:          100,
+	endpointVideos:          1,
+	endpointPlaylistItems:   1,
+	endpointPlaylists:       1,
+	endpointVideoCategories: 1,
+	endpointChannelSections: 1,
+}
+
+// pathEndpoints maps the relay api paths to the YouTube endpoints they call
+var pathEndpoints = map[string]string{
+	"/youtube/v3/search":          endpointSearch,
+	"/youtube/v3/videos":          endpointVideos,
+	"/youtube/v3/playlistItems":   endpointPlaylistItems,
+	"/youtube/v3/playlists":       endpointPlaylists,
+	"/youtube/v3/videoCategories": endpointVideoCategories,
+	"/youtube/v3/channelSections": endpointChannelSections,
+}
+
+// countQuota adds the quota cost of a call of the endpoint, which is charged whether the call succeeds or not, to the
+// metric and the quota.Usage of ctx
+func countQuota(ctx context.Context, endpoint string) {
+	metrics.QuotaUnits.WithLabelValues(endpoint).Add(float64(quotaCosts[endpoint]))
+	quota.Add(ctx, quotaCosts[endpoint])
+}
+
+// EstimateQuotaCost estimates the quota units a request of the api path with query costs without retries. Videos of
+// more than maxIDsPerCall ids are looked up in multiple calls, and so are the items of multiple playlists and their
+// durations. Unknown paths cost nothing.
+func EstimateQuotaCost(path string, query url.Values) int64 {
+	endpoint, ok := pathEndpoints[path]
+	if !ok {
+		return 0
+	}
+	switch endpoint {
+	case endpointVideos:
+		ids := len(strings.Split(query.Get("id"), ","))
+		return int64((ids+maxIDsPerCall-1)/maxIDsPerCall) * quotaCosts[endpoint]
+	case endpointPlaylistItems:
+		playlists := int64(len(strings.Split(query.Get("playlistId"), ",")))
+		cost := playlists * quotaCosts[endpoint]
+		// a playlist has at most maxIDsPerCall items in a page, whose durations are looked up in a call
+		if includeDurations, _ := strconv.ParseBool(query.Get("includeDurations")); includeDurations {
+			cost += playlists * quotaCosts[endpointVideos]
+		}
+		return cost
+	default:
+		return quotaCosts[endpoint]
+	}
+}
+
+// UntilQuotaReset is the time from now until YouTube resets the quota at the next midnight of America/Los_Angeles,
+// whose offset follows the daylight saving time on the day
+func UntilQuotaReset(now time.Time) time.Duration {
+	return quota.NextReset(now).Sub(now)
+}
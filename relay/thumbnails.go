@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RewriteThumbnails points the url of every resolution in snippet.thumbnails of resp to proxyBase, keeping the host and
+// the path of the original url for the proxy, e.g. https://i.ytimg.com/vi/ID/default.jpg becomes
+// <proxyBase>/i.ytimg.com/vi/ID/default.jpg. resp is returned as is if proxyBase is empty. Numbers are kept as
+// json.Number so they survive exactly.
+func RewriteThumbnails(resp interface{}, proxyBase string) (interface{}, error) {
+	if proxyBase == "" {
+		return resp, nil
+	}
+
+	v, err := decodeJSON(resp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "thumbnail rewriting failed")
+	}
+
+	rewriteThumbnails(v, strings.TrimSuffix(proxyBase, "/"))
+	return v, nil
+}
+
+// rewriteThumbnails walks v for the snippets, which are in the items of the list responses or nested deeper like the
+// items keyed by the playlists
+func rewriteThumbnails(v interface{}, proxyBase string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range value {
+			if snippet, ok := fieldValue.(map[string]interface{}); ok && name == "snippet" {
+				rewriteThumbnailURLs(snippet["thumbnails"], proxyBase)
+				continue
+			}
+			rewriteThumbnails(fieldValue, proxyBase)
+		}
+	case []interface{}:
+		for _, element := range value {
+			rewriteThumbnails(element, proxyBase)
+		}
+	}
+}
+
+// rewriteThumbnailURLs rewrites the url of each resolution, e.g. default, medium, high, standard, and maxres
+func rewriteThumbnailURLs(thumbnails interface{}, proxyBase string) {
+	resolutions, ok := thumbnails.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, resolution := range resolutions {
+		thumbnail, ok := resolution.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rawURL, ok := thumbnail["url"].(string)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		thumbnail["url"] = proxyBase + "/" + u.Host + u.RequestURI()
+	}
+}
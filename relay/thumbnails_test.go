@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/api/youtube/v3"
+)
+
+func newTestThumbnails(id string) *youtube.ThumbnailDetails {
+	return &youtube.ThumbnailDetails{
+		Default:  &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/default.jpg", Width: 120, Height: 90},
+		Medium:   &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/mqdefault.jpg", Width: 320, Height: 180},
+		High:     &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/hqdefault.jpg", Width: 480, Height: 360},
+		Standard: &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/sddefault.jpg", Width: 640, Height: 480},
+		Maxres:   &youtube.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/maxresdefault.jpg?v=1", Width: 1280, Height: 720},
+	}
+}
+
+func TestRewriteThumbnails(t *testing.T) {
+	const proxyBase = "https://img.example.com/yt/"
+	tests := []struct {
+		name string
+		resp interface{}
+	}{
+		{
+			name: "search",
+			resp: &youtube.SearchListResponse{Items: []*youtube.SearchResult{
+				{Id: &youtube.ResourceId{VideoId: "video1"}, Snippet: &youtube.SearchResultSnippet{Title: "title", Thumbnails: newTestThumbnails("video1")}},
+			}},
+		},
+		{
+			name: "videos",
+			resp: &youtube.VideoListResponse{Items: []*youtube.Video{
+				{Id: "video1", Snippet: &youtube.VideoSnippet{Title: "title", Thumbnails: newTestThumbnails("video1")}},
+			}},
+		},
+		{
+			name: "playlistItems",
+			resp: &youtube.PlaylistItemListResponse{Items: []*youtube.PlaylistItem{
+				{Id: "item1", Snippet: &youtube.PlaylistItemSnippet{Title: "title", Thumbnails: newTestThumbnails("video1")}},
+			}},
+		},
+	}
+	want := map[string]string{
+		"default":  "https://img.example.com/yt/i.ytimg.com/vi/video1/default.jpg",
+		"medium":   "https://img.example.com/yt/i.ytimg.com/vi/video1/mqdefault.jpg",
+		"high":     "https://img.example.com/yt/i.ytimg.com/vi/video1/hqdefault.jpg",
+		"standard": "https://img.example.com/yt/i.ytimg.com/vi/video1/sddefault.jpg",
+		"maxres":   "https://img.example.com/yt/i.ytimg.com/vi/video1/maxresdefault.jpg?v=1",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewritten, err := RewriteThumbnails(tt.resp, proxyBase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(rewritten)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp struct {
+				Items []struct {
+					Snippet struct {
+						Title      string `json:"title"`
+						Thumbnails map[string]struct {
+							URL   string `json:"url"`
+							Width int    `json:"width"`
+						} `json:"thumbnails"`
+					} `json:"snippet"`
+				} `json:"items"`
+			}
+			if err = json.Unmarshal(b, &resp); err != nil || len(resp.Items) != 1 {
+				t.Fatalf("rewritten response = %s, want an item: %v", b, err)
+			}
+			snippet := resp.Items[0].Snippet
+			if snippet.Title != "title" {
+				t.Errorf("title = %q, want it kept", snippet.Title)
+			}
+			if len(snippet.Thumbnails) != len(want) {
+				t.Errorf("thumbnails = %v, want %d resolutions", snippet.Thumbnails, len(want))
+			}
+			for resolution, wantURL := range want {
+				thumbnail := snippet.Thumbnails[resolution]
+				if thumbnail.URL != wantURL || thumbnail.Width == 0 {
+					t.Errorf("thumbnail of %s = %+v, want url %s with its width", resolution, thumbnail, wantURL)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteThumbnailsWithoutProxyBase(t *testing.T) {
+	resp := &youtube.VideoListResponse{Items: []*youtube.Video{{Id: "video1", Snippet: &youtube.VideoSnippet{Thumbnails: newTestThumbnails("video1")}}}}
+	rewritten, err := RewriteThumbnails(resp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != resp || resp.Items[0].Snippet.Thumbnails.Default.Url != "https://i.ytimg.com/vi/video1/default.jpg" {
+		t.Errorf("RewriteThumbnails() = %v, want the response untouched", rewritten)
+	}
+}
@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamTime accumulates the time spent on the YouTube calls of a request, including the retries
+type UpstreamTime struct {
+	nanoseconds int64
+}
+
+// Duration is the time spent so far
+func (t *UpstreamTime) Duration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.nanoseconds))
+}
+
+type upstreamTimeKey struct{}
+
+// WithUpstreamTime attaches an UpstreamTime to ctx so that the YouTube calls with ctx are timed into it
+func WithUpstreamTime(ctx context.Context) (context.Context, *UpstreamTime) {
+	upstreamTime := &UpstreamTime{}
+	return context.WithValue(ctx, upstreamTimeKey{}, upstreamTime), upstreamTime
+}
+
+// addUpstreamTime adds the time since start to the UpstreamTime of ctx if there's one
+func addUpstreamTime(ctx context.Context, start time.Time) {
+	if upstreamTime, ok := ctx.Value(upstreamTimeKey{}).(*UpstreamTime); ok {
+		atomic.AddInt64(&upstreamTime.nanoseconds, int64(time.Since(start)))
+	}
+}
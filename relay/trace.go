@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"context"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts a client span of the upstream call with the requested channel and playlist as attributes
+func startSpan(ctx context.Context, name string, options ytrelay.Options) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{attribute.String("youtube.part", options.Part)}
+	if options.ChannelID != "" {
+		attributes = append(attributes, attribute.String("youtube.channelId", options.ChannelID))
+	}
+	if options.PlaylistID != "" {
+		attributes = append(attributes, attribute.String("youtube.playlistId", options.PlaylistID))
+	}
+	if options.IDs != "" {
+		attributes = append(attributes, attribute.String("youtube.id", options.IDs))
+	}
+	return tracing.Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
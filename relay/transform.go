@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/pkg/errors"
+)
+
+// ResponseTransform changes the response of a successful relay call for the request of options before it's responded
+type ResponseTransform interface {
+	Apply(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error)
+}
+
+// TransformFunc adapts a function to ResponseTransform
+type TransformFunc func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error)
+
+// Apply calls f
+func (f TransformFunc) Apply(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+	return f(ctx, options, resp)
+}
+
+// Pipeline applies the transforms in order and stops at the first error. An empty Pipeline returns resp as is.
+type Pipeline []ResponseTransform
+
+// Apply passes the response returned by each transform to the next one
+func (p Pipeline) Apply(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+	var err error
+	for _, transform := range p {
+		if resp, err = transform.Apply(ctx, options, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// The names of the built-in transforms
+const (
+	TransformThumbnails = "thumbnails"
+	TransformFields     = "fields"
+	TransformEnvelope   = "envelope"
+)
+
+// DefaultTransforms are the built-in transforms in the order applied when an endpoint configures none
+var DefaultTransforms = []string{TransformThumbnails, TransformFields, TransformEnvelope}
+
+// NewTransform creates the built-in transform of name. thumbnailProxyBase is only used by TransformThumbnails.
+func NewTransform(name string, thumbnailProxyBase string) (ResponseTransform, error) {
+	switch name {
+	case TransformThumbnails:
+		return TransformFunc(func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+			return RewriteThumbnails(resp, thumbnailProxyBase)
+		}), nil
+	case TransformFields:
+		return TransformFunc(func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+			return FilterFields(resp, options.Fields)
+		}), nil
+	case TransformEnvelope:
+		return TransformFunc(func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+			if !options.Envelope {
+				return resp, nil
+			}
+			return Wrap(resp)
+		}), nil
+	}
+	return nil, errors.Errorf("response transform(%s) is unknown", name)
+}
+
+// decodeJSON converts resp into the generic JSON values for the transforms walking it. Numbers are decoded as
+// json.Number rather than float64, so the large integers, e.g. the counts and the numeric ids, survive exactly. The
+// transforms which don't walk the values keep them as json.RawMessage instead, like Wrap.
+func decodeJSON(resp interface{}) (interface{}, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling response encountered error")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var v interface{}
+	if err = decoder.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling response encountered error")
+	}
+	return v, nil
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+)
+
+func TestTransformsKeepNumbers(t *testing.T) {
+	// 9007199254740993 is 2^53+1, which float64 rounds to 9007199254740992
+	resp := json.RawMessage(`{"kind":"youtube#videoListResponse","items":[{"id":"video1","viewCount":9007199254740993,"ratio":0.1,"large":1e+30,` +
+		`"snippet":{"thumbnails":{"default":{"url":"https://i.ytimg.com/vi/video1/default.jpg","width":120}}}}]}`)
+	options := ytrelay.Options{Fields: "items.viewCount,items.ratio,items.large", Envelope: true}
+	tests := []struct {
+		name       string
+		transforms []string
+	}{
+		{name: "thumbnails", transforms: []string{TransformThumbnails}},
+		{name: "fields", transforms: []string{TransformFields}},
+		{name: "envelope", transforms: []string{TransformEnvelope}},
+		{name: "default transforms", transforms: DefaultTransforms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transformed interface{} = resp
+			for _, name := range tt.transforms {
+				transform, err := NewTransform(name, "https://proxy.host")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if transformed, err = transform.Apply(context.Background(), options, transformed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := json.Marshal(transformed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, number := range []string{`"viewCount":9007199254740993`, `"ratio":0.1`, `"large":1e+30`} {
+				if !strings.Contains(string(b), number) {
+					t.Errorf("response = %s, want %s kept", b, number)
+				}
+			}
+		})
+	}
+}
@@ -2,32 +2,135 @@ package relay
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
 	"google.golang.org/api/option"
 	"google.golang.org/api/youtube/v3"
 )
 
+// ErrInvalidPageToken is returned when the pageToken is malformed or rejected by YouTube
+var ErrInvalidPageToken = errors.New("pageToken is invalid")
+
+// pageTokenRegex matches the url-safe characters YouTube uses in page tokens
+var pageTokenRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // YouTubeServiceV3 implements the VideoRelay interface and provides api for searching videos with youtube sdk v3
 type YouTubeServiceV3 struct {
 	youtubeService *youtube.Service
+	// keys sets the API key of each call
+	keys *keyRing
+	// breaker short-circuits the calls while YouTube keeps failing. It's nil if the circuit breaker is disabled.
+	breaker         *gobreaker.CircuitBreaker
+	breakerCooldown time.Duration
+	retry           config.Retry
 }
 
-func New(apiKey string) (*YouTubeServiceV3, error) {
-	if apiKey == "" {
+// New creates the YouTube relay rotating the apiKeys. A key is skipped for keyCooldown after it exceeds the quota, and
+// userAgent is appended to the User-Agent of the calls to identify the application.
+func New(apiKeys []string, keyCooldown time.Duration, userAgent string, breakerConf config.CircuitBreaker, retryConf config.Retry) (*YouTubeServiceV3, error) {
+	if len(apiKeys) == 0 {
 		return nil, fmt.Errorf("apikey is empty for youtube service")
 	}
-	s, err := youtube.NewService(context.Background(), option.WithAPIKey(apiKey))
-	return &YouTubeServiceV3{
+	keys := newKeyRing(apiKeys, keyCooldown)
+	s, err := youtube.NewService(context.Background(), option.WithHTTPClient(&http.Client{Transport: keys}))
+	if err == nil {
+		s.UserAgent = userAgent
+	}
+	service := &YouTubeServiceV3{
 		youtubeService: s,
-	}, err
+		keys:           keys,
+		retry:          retryConf,
+	}
+	if breakerConf.IsEnabled {
+		service.breaker = newBreaker(breakerConf)
+		service.breakerCooldown = time.Duration(breakerConf.Cooldown) * time.Second
+	}
+	return service, err
 }
 
-// Search supports the following parameters: part, channelId, eventType, q, maxResults, pageToken, order, safeSearch, type
-func (s *YouTubeServiceV3) Search(options ytrelay.Options) (resp interface{}, err error) {
+// do calls YouTube with the next API key and retries the upstream failures and the rate limits with exponential backoff
+// until ctx is done. The retries stop once the circuit breaker opens. A call exceeding the daily quota cools its key
+// down and is retried immediately with another key if there's any available. The rate limits only last for seconds,
+// so they don't cool the key down.
+func (s *YouTubeServiceV3) do(ctx context.Context, endpoint string, call func(ctx context.Context) (interface{}, error)) (resp interface{}, err error) {
+	defer addUpstreamTime(ctx, time.Now())
+
+	maxAttempts := s.retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		key := s.keys.next()
+		resp, err = s.doOnce(func() (interface{}, error) {
+			countQuota(ctx, endpoint)
+			return call(withAPIKey(ctx, key))
+		})
+		if IsDailyQuotaExceeded(err) {
+			s.keys.coolDown(key)
+			if !s.keys.isAvailable() {
+				return resp, err
+			}
+			attempt--
+			continue
+		}
+		isRateLimited := errors.Cause(err) == ErrQuotaExceeded
+		if !(isUpstreamFailure(err) || isRateLimited) || attempt >= maxAttempts {
+			return resp, err
+		}
+
+		delay := time.Duration(s.retry.BaseDelay) * time.Millisecond << uint(attempt-1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			log.Debugf("not retrying YouTube as the deadline is before the next attempt: %v", err)
+			return resp, err
+		}
+		log.Debugf("attempt %d/%d to call YouTube failed, retrying in %s: %v", attempt, maxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// doOnce calls YouTube through the circuit breaker if it's enabled and wraps the error
+func (s *YouTubeServiceV3) doOnce(call func() (interface{}, error)) (interface{}, error) {
+	wrappedCall := func() (interface{}, error) {
+		resp, err := call()
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		return resp, nil
+	}
+	if s.breaker == nil {
+		return wrappedCall()
+	}
+
+	resp, err := s.breaker.Execute(wrappedCall)
+	if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+		return nil, &CircuitOpenError{RetryAfter: s.breakerCooldown}
+	}
+	return resp, err
+}
+
+// Search supports the following parameters: part, channelId, eventType, q, maxResults, pageToken, order, safeSearch, type,
+// embeddableOnly, publishedAfter, publishedBefore
+func (s *YouTubeServiceV3) Search(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.search.list", options)
+	defer func() { endSpan(span, err) }()
+
 	yt := s.youtubeService
 	call := yt.Search.List(strings.Split(options.Part, ","))
 	if !isZero(options.ChannelID) {
@@ -42,8 +145,12 @@ func (s *YouTubeServiceV3) Search(options ytrelay.Options) (resp interface{}, er
 	if !isZero(options.MaxResults) {
 		call.MaxResults(options.MaxResults)
 	}
-	if !isZero(options.PageToken) {
-		call.PageToken(options.PageToken)
+	pageToken, err := sanitizePageToken(options.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	if !isZero(pageToken) {
+		call.PageToken(pageToken)
 	}
 	if !isZero(options.Order) {
 		call.Order(options.Order)
@@ -54,18 +161,104 @@ func (s *YouTubeServiceV3) Search(options ytrelay.Options) (resp interface{}, er
 	if !isZero(options.Type) {
 		call.Type(options.Type)
 	}
+	if !isZero(options.PublishedAfter) {
+		call.PublishedAfter(options.PublishedAfter)
+	}
+	if !isZero(options.PublishedBefore) {
+		call.PublishedBefore(options.PublishedBefore)
+	}
+	// YouTube only accepts videoEmbeddable for videos. The other types are rejected by the handler.
+	if options.EmbeddableOnly {
+		call.Type("video")
+		call.VideoEmbeddable("true")
+	}
 
-	return call.Do()
+	// nextPageToken and prevPageToken are returned as is in the SearchListResponse
+	return s.do(ctx, endpointSearch, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
 }
 
-// ListByVideoIDs supports the following parameters: part, id, maxResults, pageToken
-func (s *YouTubeServiceV3) ListByVideoIDs(options ytrelay.Options) (resp interface{}, err error) {
+// maxIDsPerCall is the max number of ids YouTube accepts in a call
+const maxIDsPerCall = 50
+
+// videoLookupConcurrency bounds the concurrent calls of a lookup of more than maxIDsPerCall videos
+const videoLookupConcurrency = 4
+
+// ListByVideoIDs supports the following parameters: part, id, maxResults, pageToken, embeddableOnly, hl
+// More than maxIDsPerCall ids are looked up in chunks concurrently, and the items are merged in the order of the ids.
+func (s *YouTubeServiceV3) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.videos.list", options)
+	defer func() { endSpan(span, err) }()
+
+	if isZero(options.IDs) {
+		return nil, fmt.Errorf("parameter \"id\" is mandantory")
+	}
+
+	if !options.EmbeddableOnly {
+		return s.listVideosInChunks(ctx, options)
+	}
+
+	// the status part is needed to filter the videos, but it's only responded if the client asks for it
+	hasStatus := hasPart(options.Part, "status")
+	if !hasStatus {
+		options.Part += ",status"
+	}
+	resp, err = s.listVideosInChunks(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return filterEmbeddableVideos(resp.(*youtube.VideoListResponse), hasStatus), nil
+}
+
+// listVideosInChunks looks up the videos in calls of at most maxIDsPerCall ids
+func (s *YouTubeServiceV3) listVideosInChunks(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	ids := strings.Split(options.IDs, ",")
+	if len(ids) <= maxIDsPerCall {
+		return s.listVideos(ctx, options, ids)
+	}
+
+	var chunks [][]string
+	for len(ids) > maxIDsPerCall {
+		chunks = append(chunks, ids[:maxIDsPerCall])
+		ids = ids[maxIDsPerCall:]
+	}
+	chunks = append(chunks, ids)
+
+	responses := make([]*youtube.VideoListResponse, len(chunks))
+	err := fanOut(ctx, len(chunks), videoLookupConcurrency, func(ctx context.Context, i int) error {
+		chunkResp, err := s.listVideos(ctx, options, chunks[i])
+		if err != nil {
+			return err
+		}
+		responses[i] = chunkResp.(*youtube.VideoListResponse)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *responses[0]
+	merged.Items = nil
+	for _, chunkResp := range responses {
+		merged.Items = append(merged.Items, chunkResp.Items...)
+	}
+	merged.NextPageToken = ""
+	merged.PrevPageToken = ""
+	merged.PageInfo = &youtube.PageInfo{
+		TotalResults:   int64(len(merged.Items)),
+		ResultsPerPage: int64(len(merged.Items)),
+	}
+	return &merged, nil
+}
+
+// listVideos looks up the videos of ids in a single call
+func (s *YouTubeServiceV3) listVideos(ctx context.Context, options ytrelay.Options, ids []string) (interface{}, error) {
 	yt := s.youtubeService
 	call := yt.Videos.List(strings.Split(options.Part, ","))
-	if !isZero(options.IDs) {
-		call.Id(strings.Split(options.IDs, ",")...)
-	} else {
-		return nil, fmt.Errorf("parameter \"id\" is mandantory")
+	call.Id(ids...)
+	if !isZero(options.Language) {
+		call.Hl(options.Language)
 	}
 	if !isZero(options.PageToken) {
 		call.PageToken(options.PageToken)
@@ -73,18 +266,205 @@ func (s *YouTubeServiceV3) ListByVideoIDs(options ytrelay.Options) (resp interfa
 	if !isZero(options.MaxResults) {
 		call.MaxResults(options.MaxResults)
 	}
-	return call.Do()
+	return s.do(ctx, endpointVideos, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
+}
+
+// hasPart reports if the comma-separated parts include part
+func hasPart(parts string, part string) bool {
+	for _, p := range strings.Split(parts, ",") {
+		if strings.TrimSpace(p) == part {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEmbeddableVideos removes the videos which can't be embedded. The status of the videos is removed as well unless
+// keepStatus is set.
+func filterEmbeddableVideos(resp *youtube.VideoListResponse, keepStatus bool) *youtube.VideoListResponse {
+	items := make([]*youtube.Video, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		if item.Status == nil || !item.Status.Embeddable {
+			continue
+		}
+		if !keepStatus {
+			item.Status = nil
+		}
+		items = append(items, item)
+	}
+	if resp.PageInfo != nil {
+		resp.PageInfo.TotalResults -= int64(len(resp.Items) - len(items))
+	}
+	resp.Items = items
+	return resp
+}
+
+// playlistLookupConcurrency bounds the concurrent calls of a lookup of multiple playlists
+const playlistLookupConcurrency = 4
+
+// PlaylistItemsByPlaylist is the items of multiple playlists keyed by the playlist IDs
+type PlaylistItemsByPlaylist map[string]*youtube.PlaylistItemListResponse
+
+// SourcedPlaylistItem is an item of multiple merged playlists, which is responded with sourcePlaylistId of its playlist
+type SourcedPlaylistItem struct {
+	SourcePlaylistID string
+	Item             *youtube.PlaylistItem
 }
 
-// ListPlaylistVideos supports the following parameters: part, playlistId, maxResults, pageToken
-func (s *YouTubeServiceV3) ListPlaylistVideos(options ytrelay.Options) (resp interface{}, err error) {
+func (i SourcedPlaylistItem) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(i.Item)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if fields["sourcePlaylistId"], err = json.Marshal(i.SourcePlaylistID); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// MergedPlaylistItemListResponse is the items of multiple playlists in the order of the playlists
+type MergedPlaylistItemListResponse struct {
+	Kind     string                `json:"kind"`
+	Items    []SourcedPlaylistItem `json:"items"`
+	PageInfo *youtube.PageInfo     `json:"pageInfo"`
+}
+
+// ListPlaylistVideos supports the following parameters: part, playlistId, maxResults, pageToken, merge
+// The items of comma-separated playlistId are looked up concurrently, and they're responded as
+// PlaylistItemsByPlaylist, or MergedPlaylistItemListResponse if merge is set. maxResults applies to each playlist, and
+// pageToken isn't supported as it's specific to a playlist.
+func (s *YouTubeServiceV3) ListPlaylistVideos(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.playlistItems.list", options)
+	defer func() { endSpan(span, err) }()
+
+	playlistIDs := strings.Split(options.PlaylistID, ",")
+	if len(playlistIDs) == 1 {
+		return s.listPlaylistVideos(ctx, options, options.PlaylistID)
+	}
+	if !isZero(options.PageToken) {
+		return nil, errors.Wrap(ErrInvalidPageToken, "pageToken cannot be used with multiple playlists")
+	}
+
+	responses := make([]*youtube.PlaylistItemListResponse, len(playlistIDs))
+	err = fanOut(ctx, len(playlistIDs), playlistLookupConcurrency, func(ctx context.Context, i int) error {
+		playlistResp, err := s.listPlaylistVideos(ctx, options, playlistIDs[i])
+		if err != nil {
+			return errors.WithMessagef(err, "listing items of playlist(%s) failed", playlistIDs[i])
+		}
+		responses[i] = playlistResp.(*youtube.PlaylistItemListResponse)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !options.Merge {
+		byPlaylist := make(PlaylistItemsByPlaylist, len(playlistIDs))
+		for i, playlistID := range playlistIDs {
+			byPlaylist[playlistID] = responses[i]
+		}
+		return byPlaylist, nil
+	}
+
+	merged := &MergedPlaylistItemListResponse{Kind: "youtube#playlistItemListResponse"}
+	for i, playlistResp := range responses {
+		for _, item := range playlistResp.Items {
+			merged.Items = append(merged.Items, SourcedPlaylistItem{SourcePlaylistID: playlistIDs[i], Item: item})
+		}
+	}
+	merged.PageInfo = &youtube.PageInfo{
+		TotalResults:   int64(len(merged.Items)),
+		ResultsPerPage: int64(len(merged.Items)),
+	}
+	return merged, nil
+}
+
+// listPlaylistVideos lists the items of a playlist in a single call
+func (s *YouTubeServiceV3) listPlaylistVideos(ctx context.Context, options ytrelay.Options, playlistID string) (interface{}, error) {
 	yt := s.youtubeService
 	call := yt.PlaylistItems.List(strings.Split(options.Part, ","))
-	if !isZero(options.Fields) {
-		call.PlaylistId(options.Fields)
+	if !isZero(playlistID) {
+		call.PlaylistId(playlistID)
+	}
+	if !isZero(options.PageToken) {
+		call.PageToken(options.PageToken)
+	}
+	if !isZero(options.MaxResults) {
+		call.MaxResults(options.MaxResults)
+	}
+	return s.do(ctx, endpointPlaylistItems, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
+}
+
+// fanOut calls call for 0 to n-1 with at most concurrency calls at a time. The other calls are abandoned once a call
+// fails, and the error of the earliest failed call is returned rather than the cancellations it caused.
+func fanOut(ctx context.Context, n int, concurrency int, call func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, n)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if errs[i] = call(ctx, i); errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizePageToken trims the token and verifies it only contains characters YouTube would issue
+func sanitizePageToken(pageToken string) (string, error) {
+	pageToken = strings.TrimSpace(pageToken)
+	if pageToken == "" {
+		return "", nil
+	}
+	if !pageTokenRegex.MatchString(pageToken) {
+		return "", errors.Wrapf(ErrInvalidPageToken, "pageToken(%s) contains invalid characters", pageToken)
+	}
+	return pageToken, nil
+}
+
+// ListPlaylists supports the following parameters: part, id, maxResults, pageToken, hl
+func (s *YouTubeServiceV3) ListPlaylists(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.playlists.list", options)
+	defer func() { endSpan(span, err) }()
+
+	yt := s.youtubeService
+	call := yt.Playlists.List(strings.Split(options.Part, ","))
+	if !isZero(options.IDs) {
+		call.Id(strings.Split(options.IDs, ",")...)
+	} else {
+		return nil, fmt.Errorf("parameter \"id\" is mandantory")
 	}
-	if !isZero(options.PlaylistID) {
-		call.PlaylistId(options.PlaylistID)
+	if !isZero(options.Language) {
+		call.Hl(options.Language)
 	}
 	if !isZero(options.PageToken) {
 		call.PageToken(options.PageToken)
@@ -92,7 +472,54 @@ func (s *YouTubeServiceV3) ListPlaylistVideos(options ytrelay.Options) (resp int
 	if !isZero(options.MaxResults) {
 		call.MaxResults(options.MaxResults)
 	}
-	return call.Do()
+	return s.do(ctx, endpointPlaylists, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
+}
+
+// ListVideoCategories supports the following parameters: part, id, regionCode, hl
+func (s *YouTubeServiceV3) ListVideoCategories(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.videoCategories.list", options)
+	defer func() { endSpan(span, err) }()
+
+	yt := s.youtubeService
+	call := yt.VideoCategories.List(strings.Split(options.Part, ","))
+	if !isZero(options.IDs) {
+		call.Id(strings.Split(options.IDs, ",")...)
+	}
+	if !isZero(options.RegionCode) {
+		call.RegionCode(options.RegionCode)
+	}
+	if !isZero(options.Language) {
+		call.Hl(options.Language)
+	}
+	return s.do(ctx, endpointVideoCategories, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
+}
+
+// ListChannelSections supports the following parameters: part, channelId, id
+func (s *YouTubeServiceV3) ListChannelSections(ctx context.Context, options ytrelay.Options) (resp interface{}, err error) {
+	ctx, span := startSpan(ctx, "youtube.channelSections.list", options)
+	defer func() { endSpan(span, err) }()
+
+	yt := s.youtubeService
+	call := yt.ChannelSections.List(strings.Split(options.Part, ","))
+	if !isZero(options.ChannelID) {
+		call.ChannelId(options.ChannelID)
+	} else if !isZero(options.IDs) {
+		call.Id(strings.Split(options.IDs, ",")...)
+	} else {
+		return nil, fmt.Errorf("parameter \"channelId\" or \"id\" is mandantory")
+	}
+	return s.do(ctx, endpointChannelSections, func(ctx context.Context) (interface{}, error) {
+		return call.Context(ctx).Do()
+	})
+}
+
+// NeedsChannelValidation is true as any public video can be looked up by id on YouTube
+func (s *YouTubeServiceV3) NeedsChannelValidation() bool {
+	return true
 }
 
 func isZero(i interface{}) bool {
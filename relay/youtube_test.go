@@ -0,0 +1,517 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/pkg/errors"
+	"google.golang.org/api/youtube/v3"
+)
+
+// newTestService creates the relay calling the fake YouTube of handler
+func newTestService(t *testing.T, handler http.HandlerFunc) *YouTubeServiceV3 {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	s, err := New([]string{"key0"}, time.Minute, "yt-relay-test", config.CircuitBreaker{}, config.Retry{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.youtubeService.BasePath = server.URL + "/"
+	return s
+}
+
+func TestCanceledContextAbortsTheCall(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(s *YouTubeServiceV3, ctx context.Context) (interface{}, error)
+	}{
+		{name: "search", call: func(s *YouTubeServiceV3, ctx context.Context) (interface{}, error) {
+			return s.Search(ctx, ytrelay.Options{Part: "snippet", ChannelID: "channel1"})
+		}},
+		{name: "videos", call: func(s *YouTubeServiceV3, ctx context.Context) (interface{}, error) {
+			return s.ListByVideoIDs(ctx, ytrelay.Options{Part: "snippet", IDs: "video1"})
+		}},
+		{name: "playlistItems", call: func(s *YouTubeServiceV3, ctx context.Context) (interface{}, error) {
+			return s.ListPlaylistVideos(ctx, ytrelay.Options{Part: "snippet", PlaylistID: "playlist1"})
+		}},
+		{name: "playlists", call: func(s *YouTubeServiceV3, ctx context.Context) (interface{}, error) {
+			return s.ListPlaylists(ctx, ytrelay.Options{Part: "snippet", IDs: "playlist1"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aborted := make(chan struct{})
+			s := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				close(aborted)
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 1)
+			go func() {
+				_, err := tt.call(s, ctx)
+				errs <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			select {
+			case err := <-errs:
+				if err == nil {
+					t.Error("canceled call succeeds")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("canceled call doesn't return")
+			}
+			select {
+			case <-aborted:
+			case <-time.After(time.Second):
+				t.Error("YouTube call isn't aborted")
+			}
+		})
+	}
+}
+
+// videosHandler responds to the videos calls with the items of the ids, and the later chunks respond earlier
+func videosHandler(t *testing.T, mu *sync.Mutex, calls *[][]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ids []string
+		for _, id := range r.URL.Query()["id"] {
+			ids = append(ids, strings.Split(id, ",")...)
+		}
+		mu.Lock()
+		*calls = append(*calls, ids)
+		mu.Unlock()
+		if len(ids) == maxIDsPerCall {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		resp := &youtube.VideoListResponse{Kind: "youtube#videoListResponse", PageInfo: &youtube.PageInfo{TotalResults: int64(len(ids))}}
+		for _, id := range ids {
+			resp.Items = append(resp.Items, &youtube.Video{Id: id})
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestListByVideoIDsInChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		ids       int
+		wantCalls int
+	}{
+		{name: "single id", ids: 1, wantCalls: 1},
+		{name: "ids of a call", ids: maxIDsPerCall, wantCalls: 1},
+		{name: "ids over a call", ids: maxIDsPerCall + 1, wantCalls: 2},
+		{name: "ids of many calls", ids: 5*maxIDsPerCall + 7, wantCalls: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls [][]string
+			s := newTestService(t, videosHandler(t, &mu, &calls))
+
+			ids := make([]string, tt.ids)
+			for i := range ids {
+				ids[i] = fmt.Sprintf("video%d", i)
+			}
+			resp, err := s.ListByVideoIDs(context.Background(), ytrelay.Options{Part: "id", IDs: strings.Join(ids, ",")})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(calls) != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", len(calls), tt.wantCalls)
+			}
+			for _, call := range calls {
+				if len(call) > maxIDsPerCall {
+					t.Errorf("call has %d ids, more than %d", len(call), maxIDsPerCall)
+				}
+			}
+			videos := resp.(*youtube.VideoListResponse)
+			gotIDs := make([]string, 0, len(videos.Items))
+			for _, item := range videos.Items {
+				gotIDs = append(gotIDs, item.Id)
+			}
+			if strings.Join(gotIDs, ",") != strings.Join(ids, ",") {
+				t.Errorf("items = %v, want the order of the ids %v", gotIDs, ids)
+			}
+			if videos.PageInfo == nil || videos.PageInfo.TotalResults != int64(tt.ids) {
+				t.Errorf("pageInfo = %+v, want totalResults %d", videos.PageInfo, tt.ids)
+			}
+		})
+	}
+}
+
+// playlistItemsHandler responds to the playlistItems calls with an item of the playlist, or 404 to playlist404
+func playlistItemsHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		playlistID := r.URL.Query().Get("playlistId")
+		if playlistID == "playlist404" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":404,"message":"playlist not found"}}`))
+			return
+		}
+		resp := &youtube.PlaylistItemListResponse{
+			Kind:  "youtube#playlistItemListResponse",
+			Items: []*youtube.PlaylistItem{{Id: playlistID + "-item"}},
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestListPlaylistVideosOfMultiplePlaylists(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ytrelay.Options
+		// wantItems are the ids of the items, keyed by the playlists unless they're merged
+		wantItems string
+		wantErr   bool
+	}{
+		{name: "single playlist", options: ytrelay.Options{PlaylistID: "playlist1"}, wantItems: "playlist1-item"},
+		{name: "playlists are keyed", options: ytrelay.Options{PlaylistID: "playlist1,playlist2"}, wantItems: "playlist1:playlist1-item,playlist2:playlist2-item"},
+		{name: "playlists are merged in order", options: ytrelay.Options{PlaylistID: "playlist2,playlist1", Merge: true}, wantItems: "playlist2:playlist2-item,playlist1:playlist1-item"},
+		{name: "pageToken of multiple playlists is rejected", options: ytrelay.Options{PlaylistID: "playlist1,playlist2", PageToken: "page2"}, wantErr: true},
+		{name: "failure of a playlist fails all", options: ytrelay.Options{PlaylistID: "playlist1,playlist404"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, playlistItemsHandler(t))
+			tt.options.Part = "snippet"
+			resp, err := s.ListPlaylistVideos(context.Background(), tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var items []string
+			switch resp := resp.(type) {
+			case *youtube.PlaylistItemListResponse:
+				for _, item := range resp.Items {
+					items = append(items, item.Id)
+				}
+			case PlaylistItemsByPlaylist:
+				for _, playlistID := range strings.Split(tt.options.PlaylistID, ",") {
+					for _, item := range resp[playlistID].Items {
+						items = append(items, playlistID+":"+item.Id)
+					}
+				}
+			case *MergedPlaylistItemListResponse:
+				for _, item := range resp.Items {
+					items = append(items, item.SourcePlaylistID+":"+item.Item.Id)
+				}
+			default:
+				t.Fatalf("response is %T", resp)
+			}
+			if got := strings.Join(items, ","); got != tt.wantItems {
+				t.Errorf("items = %s, want %s", got, tt.wantItems)
+			}
+		})
+	}
+}
+
+func TestLanguageIsForwarded(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(s *YouTubeServiceV3, options ytrelay.Options) (interface{}, error)
+	}{
+		{name: "videos", call: func(s *YouTubeServiceV3, options ytrelay.Options) (interface{}, error) {
+			options.IDs = "video1"
+			return s.ListByVideoIDs(context.Background(), options)
+		}},
+		{name: "playlists", call: func(s *YouTubeServiceV3, options ytrelay.Options) (interface{}, error) {
+			options.IDs = "playlist1"
+			return s.ListPlaylists(context.Background(), options)
+		}},
+		{name: "videoCategories", call: func(s *YouTubeServiceV3, options ytrelay.Options) (interface{}, error) {
+			options.RegionCode = "TW"
+			return s.ListVideoCategories(context.Background(), options)
+		}},
+	}
+	for _, tt := range tests {
+		for _, language := range []string{"zh-TW", ""} {
+			t.Run(tt.name+"/"+language, func(t *testing.T) {
+				var hl []string
+				s := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+					hl = r.URL.Query()["hl"]
+					_, _ = w.Write([]byte(`{}`))
+				})
+				if _, err := tt.call(s, ytrelay.Options{Part: "snippet", Language: language}); err != nil {
+					t.Fatal(err)
+				}
+				if language == "" && len(hl) != 0 {
+					t.Errorf("hl = %v, want none", hl)
+				} else if language != "" && (len(hl) != 1 || hl[0] != language) {
+					t.Errorf("hl = %v, want %s", hl, language)
+				}
+			})
+		}
+	}
+}
+
+func TestSanitizePageToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		pageToken string
+		want      string
+		wantErr   bool
+	}{
+		{name: "empty", pageToken: "", want: ""},
+		{name: "blank", pageToken: "  ", want: ""},
+		{name: "valid", pageToken: "CAUQAA", want: "CAUQAA"},
+		{name: "url-safe characters", pageToken: "Cg_-AQ", want: "Cg_-AQ"},
+		{name: "spaces are trimmed", pageToken: " CAUQAA\n", want: "CAUQAA"},
+		{name: "padding is malformed", pageToken: "CAUQAA==", wantErr: true},
+		{name: "slash is malformed", pageToken: "CAUQ/AA", wantErr: true},
+		{name: "inner space is malformed", pageToken: "CAU QAA", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizePageToken(tt.pageToken)
+		if tt.wantErr {
+			if errors.Cause(err) != ErrInvalidPageToken {
+				t.Errorf("%s: sanitizePageToken(%q) err = %v, want %v", tt.name, tt.pageToken, err, ErrInvalidPageToken)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: sanitizePageToken(%q) = %q, %v, want %q", tt.name, tt.pageToken, got, err, tt.want)
+		}
+	}
+}
+
+func TestSearchPageToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		pageToken string
+		// rejected makes YouTube reject the page token
+		rejected      bool
+		wantPageToken string
+		wantCalls     int
+		wantStatus    int
+	}{
+		{name: "without pageToken", wantCalls: 1, wantStatus: http.StatusOK},
+		{name: "valid pageToken is forwarded", pageToken: " CAUQAA ", wantPageToken: "CAUQAA", wantCalls: 1, wantStatus: http.StatusOK},
+		{name: "malformed pageToken isn't forwarded", pageToken: "CAUQ/AA", wantCalls: 0, wantStatus: http.StatusBadRequest},
+		{name: "pageToken rejected by YouTube", pageToken: "CAUQAA", rejected: true, wantPageToken: "CAUQAA", wantCalls: 1, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var pageToken string
+			s := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				pageToken = r.URL.Query().Get("pageToken")
+				if tt.rejected {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"error":{"code":400,"message":"invalid page token","errors":[{"reason":"invalidPageToken"}]}}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"kind":"youtube#searchListResponse"}`))
+			})
+
+			_, err := s.Search(context.Background(), ytrelay.Options{Part: "snippet", ChannelID: "channel1", PageToken: tt.pageToken})
+			status := http.StatusOK
+			if err != nil {
+				status = HTTPStatusCode(err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %v", status, tt.wantStatus, err)
+			}
+			if calls != tt.wantCalls || pageToken != tt.wantPageToken {
+				t.Errorf("YouTube calls = %d with pageToken %q, want %d with %q", calls, pageToken, tt.wantCalls, tt.wantPageToken)
+			}
+		})
+	}
+}
+
+// dropConnection is the fake status of sequenceHandler which drops the connection without a response
+const dropConnection = 0
+
+// sequenceHandler responds the statuses in order, repeating the last one, and counts the calls
+func sequenceHandler(t *testing.T, calls *int, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if *calls < len(statuses) {
+			status = statuses[*calls]
+		}
+		*calls++
+
+		switch status {
+		case dropConnection:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = conn.Close()
+		case http.StatusOK:
+			_, _ = w.Write([]byte(`{"kind":"youtube#videoListResponse"}`))
+		case http.StatusTooManyRequests:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":{"code":403,"message":"rate limit exceeded","errors":[{"reason":"rateLimitExceeded"}]}}`))
+		default:
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"error":{"code":%d,"message":"failed"}}`, status)))
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		statuses    []int
+		wantCalls   int
+		wantStatus  int
+	}{
+		{name: "5xx is retried until success", maxAttempts: 3, statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK}, wantCalls: 3, wantStatus: http.StatusOK},
+		{name: "5xx is retried up to max attempts", maxAttempts: 3, statuses: []int{http.StatusServiceUnavailable}, wantCalls: 3, wantStatus: http.StatusBadGateway},
+		{name: "connection error is retried", maxAttempts: 3, statuses: []int{dropConnection, http.StatusOK}, wantCalls: 2, wantStatus: http.StatusOK},
+		{name: "rate limit is retried", maxAttempts: 3, statuses: []int{http.StatusTooManyRequests, http.StatusOK}, wantCalls: 2, wantStatus: http.StatusOK},
+		{name: "4xx isn't retried", maxAttempts: 3, statuses: []int{http.StatusNotFound, http.StatusOK}, wantCalls: 1, wantStatus: http.StatusNotFound},
+		{name: "single attempt isn't retried", maxAttempts: 1, statuses: []int{http.StatusInternalServerError, http.StatusOK}, wantCalls: 1, wantStatus: http.StatusBadGateway},
+		{name: "zero max attempts calls once", statuses: []int{http.StatusInternalServerError, http.StatusOK}, wantCalls: 1, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			s := newTestService(t, sequenceHandler(t, &calls, tt.statuses...))
+			s.retry = config.Retry{MaxAttempts: tt.maxAttempts, BaseDelay: 1}
+
+			_, err := s.ListByVideoIDs(context.Background(), ytrelay.Options{Part: "snippet", IDs: "video1"})
+			status := http.StatusOK
+			if err != nil {
+				status = HTTPStatusCode(err)
+			}
+			if status != tt.wantStatus || calls != tt.wantCalls {
+				t.Errorf("status = %d after %d calls, want %d after %d: %v", status, calls, tt.wantStatus, tt.wantCalls, err)
+			}
+		})
+	}
+}
+
+func TestRetryStopsAtDeadline(t *testing.T) {
+	var calls int
+	s := newTestService(t, sequenceHandler(t, &calls, http.StatusInternalServerError, http.StatusOK))
+	s.retry = config.Retry{MaxAttempts: 3, BaseDelay: 1000}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := s.ListByVideoIDs(ctx, ytrelay.Options{Part: "snippet", IDs: "video1"})
+	if status := HTTPStatusCode(err); status != http.StatusBadGateway || calls != 1 {
+		t.Errorf("status = %d after %d calls, want 502 after 1: %v", status, calls, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("call took %s, want it to return without waiting for the backoff", elapsed)
+	}
+}
+
+func TestRetryStopsWhenCircuitOpens(t *testing.T) {
+	var calls int
+	s := newTestService(t, sequenceHandler(t, &calls, http.StatusInternalServerError))
+	s.retry = config.Retry{MaxAttempts: 5, BaseDelay: 1}
+	s.breaker = newBreaker(config.CircuitBreaker{IsEnabled: true, ConsecutiveFailures: 2, Cooldown: 30, HalfOpenRequests: 1})
+	s.breakerCooldown = 30 * time.Second
+
+	_, err := s.ListByVideoIDs(context.Background(), ytrelay.Options{Part: "snippet", IDs: "video1"})
+	if _, ok := errors.Cause(err).(*CircuitOpenError); !ok || calls != 2 {
+		t.Errorf("err = %v after %d calls, want the circuit open after 2", err, calls)
+	}
+
+	// the open circuit doesn't call YouTube
+	_, err = s.ListByVideoIDs(context.Background(), ytrelay.Options{Part: "snippet", IDs: "video1"})
+	if status := HTTPStatusCode(err); status != http.StatusServiceUnavailable || calls != 2 {
+		t.Errorf("status = %d after %d calls, want 503 after 2", status, calls)
+	}
+}
+
+func TestRequestAttribution(t *testing.T) {
+	tests := []struct {
+		name          string
+		quotaUser     string
+		wantQuotaUser []string
+	}{
+		{name: "call without quotaUser isn't attributed"},
+		{name: "quotaUser is forwarded", quotaUser: "203.0.113.1", wantQuotaUser: []string{"203.0.113.1"}},
+		{name: "long quotaUser is truncated", quotaUser: strings.Repeat("a", 50), wantQuotaUser: []string{strings.Repeat("a", 40)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var userAgent string
+			var quotaUser []string
+			s := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				userAgent = r.UserAgent()
+				quotaUser = r.URL.Query()["quotaUser"]
+				_, _ = w.Write([]byte(`{"kind":"youtube#videoListResponse"}`))
+			})
+
+			ctx := context.Background()
+			if tt.quotaUser != "" {
+				ctx = WithQuotaUser(ctx, tt.quotaUser)
+			}
+			if _, err := s.ListByVideoIDs(ctx, ytrelay.Options{Part: "snippet", IDs: "video1"}); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(userAgent, "yt-relay-test") {
+				t.Errorf("User-Agent = %q, want it to contain yt-relay-test", userAgent)
+			}
+			if fmt.Sprint(quotaUser) != fmt.Sprint(tt.wantQuotaUser) {
+				t.Errorf("quotaUser = %v, want %v", quotaUser, tt.wantQuotaUser)
+			}
+		})
+	}
+}
+
+func TestPublishedRangeIsForwarded(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ytrelay.Options
+		want    map[string][]string
+	}{
+		{name: "without range", want: map[string][]string{}},
+		{
+			name:    "range",
+			options: ytrelay.Options{PublishedAfter: "2021-01-01T00:00:00Z", PublishedBefore: "2021-01-08T00:00:00Z"},
+			want:    map[string][]string{"publishedAfter": {"2021-01-01T00:00:00Z"}, "publishedBefore": {"2021-01-08T00:00:00Z"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string][]string{}
+			s := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				for _, param := range []string{"publishedAfter", "publishedBefore"} {
+					if values, ok := r.URL.Query()[param]; ok {
+						got[param] = values
+					}
+				}
+				_, _ = w.Write([]byte(`{}`))
+			})
+			options := tt.options
+			options.Part, options.ChannelID = "snippet", "channel1"
+			if _, err := s.Search(context.Background(), options); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("params = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
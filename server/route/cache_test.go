@@ -0,0 +1,276 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/pkg/errors"
+	"google.golang.org/api/youtube/v3"
+)
+
+// newTestCacheConf is the cache of the routes without the optional behaviors
+func newTestCacheConf() config.Cache {
+	return config.Cache{IsEnabled: true, TTL: 60, ErrorTTL: 10, VideoCategoriesTTL: 60, Serializer: config.SerializeJSON}
+}
+
+// storeEntry stores the successful response of uri as if it's cached by the routes of cfg. The entry is fresh for
+// freshFor and expires in expireIn, and it's removed from the cache after keepFor.
+func storeEntry(t *testing.T, cfg config.Conf, cacheProvider cache.Rediser, uri string, body string, freshFor, expireIn, keepFor time.Duration) {
+	t.Helper()
+	key, err := cache.NewKeyBuilder(cfg.AppName, cfg.Cache).Key(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	b, err := cache.NewSerializer(cfg.Cache.Serializer).Marshal(cache.HTTP{
+		StatusCode: http.StatusOK,
+		Response:   []byte(body),
+		FreshUntil: now.Add(freshFor).Unix(),
+		ExpireAt:   now.Add(expireIn).Unix(),
+		StoredAt:   now.Add(-time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cacheProvider.Set(context.Background(), key, string(b), keepFor).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCode decodes the code of the error response
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp api.ErrorResp
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("body %s isn't an error: %v", body, err)
+	}
+	return resp.Code
+}
+
+// failingRelay fails the videos calls with err
+type failingRelay struct {
+	*relay.FakeRelay
+	err error
+}
+
+func (f *failingRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	return nil, f.err
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	const uri = "/youtube/v3/videos?id=video1&part=snippet"
+	upstreamFailure := &relay.UpstreamError{StatusCode: http.StatusServiceUnavailable, Err: errors.New("backend error")}
+	tests := []struct {
+		name              string
+		serveStaleOnError bool
+		err               error
+		// the expired entry is stored before the request if it's isStored, and removed from the cache after keepFor
+		isStored   bool
+		keepFor    time.Duration
+		wantStatus int
+		wantXCache string
+		wantCode   string
+	}{
+		{name: "expired entry is served as the upstream fails", serveStaleOnError: true, err: upstreamFailure, isStored: true, keepFor: time.Hour, wantStatus: http.StatusOK, wantXCache: middleware.XCacheStaleError},
+		{name: "expired entry is served as the quota is exceeded", serveStaleOnError: true, err: relay.ErrQuotaExceeded, isStored: true, keepFor: time.Hour, wantStatus: http.StatusOK, wantXCache: middleware.XCacheStaleError},
+		{name: "upstream failure is passed through without entry", serveStaleOnError: true, err: upstreamFailure, wantStatus: http.StatusBadGateway, wantXCache: "MISS", wantCode: api.CodeUpstreamFailure},
+		{name: "entry past staleOnErrorTtl is gone", serveStaleOnError: true, err: upstreamFailure, isStored: true, keepFor: 10 * time.Millisecond, wantStatus: http.StatusBadGateway, wantXCache: "MISS", wantCode: api.CodeUpstreamFailure},
+		{name: "expired entry isn't served without serveStaleOnError", err: upstreamFailure, isStored: true, keepFor: time.Hour, wantStatus: http.StatusBadGateway, wantXCache: "MISS", wantCode: api.CodeUpstreamFailure},
+		{name: "client error isn't replaced by the entry", serveStaleOnError: true, err: &relay.UpstreamError{StatusCode: http.StatusNotFound, Err: errors.New("not found")}, isStored: true, keepFor: time.Hour, wantStatus: http.StatusNotFound, wantXCache: "MISS", wantCode: api.CodeUpstreamRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = newTestCacheConf()
+			cfg.Cache.ServeStaleOnError = tt.serveStaleOnError
+			cfg.Cache.StaleOnErrorTTL = 3600
+			cacheProvider := cache.NewMemory(100, time.Minute)
+			r := newTestEngine(t, cfg, &failingRelay{FakeRelay: relay.NewFake(""), err: tt.err}, cacheProvider)
+
+			if tt.isStored {
+				storeEntry(t, cfg, cacheProvider, uri, `{"cached":true}`, -2*time.Minute, -time.Minute, tt.keepFor)
+				// the entries kept shortly are removed as if they're past staleOnErrorTtl
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			w := serve(r, uri)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get(middleware.XCacheHeader); got != tt.wantXCache {
+				t.Errorf("X-Cache = %s, want %s", got, tt.wantXCache)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(t, w.Body.Bytes()); code != tt.wantCode {
+					t.Errorf("code = %s, want %s", code, tt.wantCode)
+				}
+			} else if got := w.Body.String(); got != `{"cached":true}` {
+				t.Errorf("body = %s, want the stale entry", got)
+			}
+		})
+	}
+}
+
+// countingRelay responds to the videos calls with the number of the calls as the etag
+type countingRelay struct {
+	*relay.FakeRelay
+	calls int
+}
+
+func (c *countingRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	c.calls++
+	return &youtube.VideoListResponse{Etag: strconv.Itoa(c.calls)}, nil
+}
+
+func TestNoCacheRefresh(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantXCache string
+		wantEtag   string
+	}{
+		{name: "no-cache with admin token refreshes", header: http.Header{"Authorization": {"Bearer admin-token"}, "Cache-Control": {"no-cache"}}, wantXCache: "REFRESH", wantEtag: "2"},
+		{name: "bypass header with admin token refreshes", header: http.Header{"Authorization": {"Bearer admin-token"}, "X-Bypass-Cache": {"true"}}, wantXCache: "REFRESH", wantEtag: "2"},
+		{name: "no-cache without token is ignored", header: http.Header{"Cache-Control": {"no-cache"}}, wantXCache: "HIT", wantEtag: "1"},
+		{name: "no-cache with invalid token is ignored", header: http.Header{"Authorization": {"Bearer wrong-token"}, "Cache-Control": {"no-cache"}}, wantXCache: "HIT", wantEtag: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = newTestCacheConf()
+			relayService := &countingRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, cfg, relayService, cache.NewMemory(100, time.Minute))
+			const uri = "/youtube/v3/videos?part=snippet&id=video1"
+			if w := serve(r, uri); w.Header().Get(middleware.XCacheHeader) != "MISS" {
+				t.Fatalf("X-Cache of the first request = %s, want MISS", w.Header().Get(middleware.XCacheHeader))
+			}
+
+			w := serveWithHeader(r, uri, tt.header)
+			if got := w.Header().Get(middleware.XCacheHeader); w.Code != http.StatusOK || got != tt.wantXCache {
+				t.Errorf("response = %d %s, want 200 %s", w.Code, got, tt.wantXCache)
+			}
+			if got := etag(t, w.Body.Bytes()); got != tt.wantEtag {
+				t.Errorf("etag = %s, want %s", got, tt.wantEtag)
+			}
+
+			// the public requests are served with the refreshed entry
+			w = serve(r, uri)
+			if got := w.Header().Get(middleware.XCacheHeader); got != "HIT" || etag(t, w.Body.Bytes()) != tt.wantEtag {
+				t.Errorf("public response = %s %s, want HIT %s", got, w.Body.String(), tt.wantEtag)
+			}
+		})
+	}
+}
+
+func etag(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Etag string `json:"etag"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("body %s isn't json: %v", body, err)
+	}
+	return resp.Etag
+}
+
+func TestReadOnly(t *testing.T) {
+	const uri = "/youtube/v3/videos?part=snippet&id=video1"
+	tests := []struct {
+		name              string
+		serveStaleOnError bool
+		// the entry is stored fresh before the requests if it's isFresh, or expired if it's isExpired
+		isFresh    bool
+		isExpired  bool
+		wantStatus int
+		wantXCache string
+	}{
+		{name: "hit is served", isFresh: true, wantStatus: http.StatusOK, wantXCache: "HIT"},
+		{name: "expired entry is served with serveStaleOnError", serveStaleOnError: true, isExpired: true, wantStatus: http.StatusOK, wantXCache: middleware.XCacheStaleError},
+		{name: "expired entry isn't served without serveStaleOnError", isExpired: true, wantStatus: http.StatusServiceUnavailable, wantXCache: "MISS"},
+		{name: "miss is rejected", wantStatus: http.StatusServiceUnavailable, wantXCache: "MISS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = newTestCacheConf()
+			cfg.Cache.ReadOnly = true
+			cfg.Cache.ServeStaleOnError = tt.serveStaleOnError
+			cfg.Cache.StaleOnErrorTTL = 3600
+			cacheProvider := cache.NewMemory(100, time.Minute)
+			relayService := &countingRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, cfg, relayService, cacheProvider)
+			if tt.isFresh {
+				storeEntry(t, cfg, cacheProvider, uri, `{"etag":"cached"}`, time.Minute, 2*time.Minute, time.Hour)
+			}
+			if tt.isExpired {
+				storeEntry(t, cfg, cacheProvider, uri, `{"etag":"cached"}`, -2*time.Minute, -time.Minute, time.Hour)
+			}
+
+			// the rejections aren't cached
+			for i := 0; i < 2; i++ {
+				w := serve(r, uri)
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+				}
+				if got := w.Header().Get(middleware.XCacheHeader); got != tt.wantXCache {
+					t.Errorf("X-Cache = %s, want %s", got, tt.wantXCache)
+				}
+				if tt.wantStatus != http.StatusOK {
+					if code := errorCode(t, w.Body.Bytes()); code != api.CodeReadOnly {
+						t.Errorf("code = %s, want %s", code, api.CodeReadOnly)
+					}
+				} else if got := etag(t, w.Body.Bytes()); got != "cached" {
+					t.Errorf("etag = %s, want the cached one", got)
+				}
+			}
+			if relayService.calls != 0 {
+				t.Errorf("upstream calls = %d, want none in read-only mode", relayService.calls)
+			}
+		})
+	}
+}
+
+func TestReadOnlySwitch(t *testing.T) {
+	const uri = "/youtube/v3/videos?part=snippet&id=video1"
+	cfg := newTestConf()
+	cfg.Cache = newTestCacheConf()
+	r := newTestEngine(t, cfg, &countingRelay{FakeRelay: newEmptyFake(t)}, cache.NewMemory(100, time.Minute))
+
+	tests := []struct {
+		body       string
+		wantStatus int
+		// wantMiss is the status of the next miss
+		wantMiss int
+	}{
+		{body: `{"readOnly": true}`, wantStatus: http.StatusOK, wantMiss: http.StatusServiceUnavailable},
+		{body: `{}`, wantStatus: http.StatusBadRequest, wantMiss: http.StatusServiceUnavailable},
+		{body: `{"readOnly": false}`, wantStatus: http.StatusOK, wantMiss: http.StatusOK},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, "/admin/cache/readonly", strings.NewReader(tt.body))
+		request.Header.Set("Authorization", "Bearer admin-token")
+		request.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, request)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("status of switching with %s = %d, want %d: %s", tt.body, w.Code, tt.wantStatus, w.Body.String())
+		}
+
+		// every miss is a different video
+		if w := serve(r, uri+strconv.Itoa(i)); w.Code != tt.wantMiss {
+			t.Errorf("status of the miss after switching with %s = %d, want %d", tt.body, w.Code, tt.wantMiss)
+		}
+	}
+}
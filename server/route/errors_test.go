@@ -0,0 +1,126 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/pkg/errors"
+)
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		token  string
+		// relayErr fails the videos calls
+		relayErr   error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "missing part", uri: "/youtube/v3/videos?id=video1", wantStatus: http.StatusBadRequest, wantCode: api.CodeEmptyPart},
+		{name: "missing id", uri: "/youtube/v3/videos?part=snippet", wantStatus: http.StatusBadRequest, wantCode: api.CodeEmptyID},
+		{name: "invalid parameter", uri: "/youtube/v3/videos?part=snippet&id=video1&maxResults=abc", wantStatus: http.StatusBadRequest, wantCode: api.CodeInvalidParameter},
+		{name: "channel not whitelisted", uri: "/youtube/v3/search?part=snippet&channelId=channel2", wantStatus: http.StatusBadRequest, wantCode: api.CodeChannelNotWhitelisted},
+		{name: "playlist not whitelisted", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist9", wantStatus: http.StatusBadRequest, wantCode: api.CodePlaylistNotWhitelisted},
+		{name: "upstream quota", uri: "/youtube/v3/videos?part=snippet&id=video1", relayErr: errors.Wrap(relay.ErrQuotaExceeded, "listing videos"), wantStatus: http.StatusTooManyRequests, wantCode: api.CodeUpstreamQuota},
+		{name: "upstream failure", uri: "/youtube/v3/videos?part=snippet&id=video1", relayErr: &relay.UpstreamError{StatusCode: http.StatusInternalServerError, Err: errors.New("backend error")}, wantStatus: http.StatusBadGateway, wantCode: api.CodeUpstreamFailure},
+		{name: "upstream rejection", uri: "/youtube/v3/videos?part=snippet&id=video1", relayErr: &relay.UpstreamError{StatusCode: http.StatusForbidden, Err: errors.New("forbidden")}, wantStatus: http.StatusForbidden, wantCode: api.CodeUpstreamRejected},
+		{name: "upstream unavailable", uri: "/youtube/v3/videos?part=snippet&id=video1", relayErr: &relay.CircuitOpenError{RetryAfter: time.Second}, wantStatus: http.StatusServiceUnavailable, wantCode: api.CodeUpstreamUnavailable},
+		{name: "internal error", uri: "/youtube/v3/videos?part=snippet&id=video1", relayErr: errors.New("unexpected"), wantStatus: http.StatusInternalServerError, wantCode: api.CodeInternal},
+		{name: "missing token", uri: "/admin/whitelist", wantStatus: http.StatusUnauthorized, wantCode: api.CodeMissingToken},
+		{name: "invalid token", uri: "/admin/whitelist", token: "wrong-token", wantStatus: http.StatusForbidden, wantCode: api.CodeInvalidToken},
+		{name: "cache disabled", uri: "/admin/cache/entry?uri=/youtube/v3/videos", token: "admin-token", wantStatus: http.StatusBadRequest, wantCode: api.CodeCacheDisabled},
+		{name: "whitelist refresh", method: http.MethodPost, uri: "/admin/whitelist/refresh", token: "admin-token", wantStatus: http.StatusBadGateway, wantCode: api.CodeWhitelistRefresh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestEngine(t, newTestConf(), &failingRelay{FakeRelay: newEmptyFake(t), err: tt.relayErr}, nil)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			request := httptest.NewRequest(method, tt.uri, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := errorCode(t, w.Body.Bytes()); got != tt.wantCode {
+				t.Errorf("code = %s, want %s", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	tests := []struct {
+		name            string
+		errorFormat     string
+		uri             string
+		wantContentType string
+		wantBody        string
+		// wantCached makes the second response served from the cache
+		wantCached bool
+	}{
+		{
+			name:            "legacy error",
+			errorFormat:     config.ErrorFormatLegacy,
+			uri:             "/youtube/v3/videos?id=video1",
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"` + ErrorEmptyPart + `","code":"` + api.CodeEmptyPart + `"}`,
+			wantCached:      true,
+		},
+		{
+			name:            "problem error",
+			errorFormat:     config.ErrorFormatProblem,
+			uri:             "/youtube/v3/videos?id=video1",
+			wantContentType: middleware.ProblemContentType,
+			wantBody:        `{"type":"about:blank","title":"Bad Request","status":400,"detail":"` + ErrorEmptyPart + `","code":"` + api.CodeEmptyPart + `"}`,
+			wantCached:      true,
+		},
+		{
+			name:            "problem error of the middleware",
+			errorFormat:     config.ErrorFormatProblem,
+			uri:             "/admin/whitelist",
+			wantContentType: middleware.ProblemContentType,
+			wantBody:        `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"` + middleware.ErrorMissingToken + `","code":"` + api.CodeMissingToken + `"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.ErrorFormat = tt.errorFormat
+			cfg.Cache = newTestCacheConf()
+			r := newTestEngine(t, cfg, newEmptyFake(t), cache.NewMemory(100, time.Minute))
+
+			// the cached error is responded in the same format
+			xCaches := []string{"MISS", "HIT"}
+			for i := range xCaches {
+				w := serve(r, tt.uri)
+				if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+					t.Errorf("Content-Type = %s, want %s", got, tt.wantContentType)
+				}
+				if got := strings.TrimSpace(w.Body.String()); got != tt.wantBody {
+					t.Errorf("body = %s, want %s", got, tt.wantBody)
+				}
+				if got := w.Header().Get(middleware.XCacheHeader); tt.wantCached && got != xCaches[i] {
+					t.Errorf("X-Cache of response %d = %s, want %s", i, got, xCaches[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/cms"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/quota"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+type dependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessResp struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+	// QuotaRemaining is the quota units left of the day if the quota budget is enabled
+	QuotaRemaining *int64 `json:"quotaRemaining,omitempty"`
+}
+
+// HealthCheck is a dependency probed by the readiness check
+type HealthCheck interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type redisCheck struct {
+	cacheProvider cache.Rediser
+}
+
+func (redisCheck) Name() string {
+	return config.HealthCheckRedis
+}
+
+func (r redisCheck) Check(ctx context.Context) error {
+	return r.cacheProvider.Ping(ctx).Err()
+}
+
+type cmsCheck struct {
+	cmsURLs []string
+}
+
+func (cmsCheck) Name() string {
+	return config.HealthCheckCMS
+}
+
+func (c cmsCheck) Check(ctx context.Context) error {
+	return cms.Ping(ctx, c.cmsURLs)
+}
+
+// healthChecks creates the checks of cfg.Health.Checks, or the checks of redis if there's cacheProvider and of the CMS
+// by CheckCMS if it isn't set
+func healthChecks(cfg config.Conf, cacheProvider cache.Rediser) []HealthCheck {
+	names := cfg.Health.Checks
+	if names == nil {
+		if cacheProvider != nil {
+			names = append(names, config.HealthCheckRedis)
+		}
+		if cfg.Health.CheckCMS {
+			names = append(names, config.HealthCheckCMS)
+		}
+	}
+
+	checks := make([]HealthCheck, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case config.HealthCheckRedis:
+			checks = append(checks, redisCheck{cacheProvider: cacheProvider})
+		case config.HealthCheckCMS:
+			checks = append(checks, cmsCheck{cmsURLs: cfg.CMSURLs()})
+		}
+	}
+	return checks
+}
+
+// readinessHandler checks the dependencies concurrently within the configured timeout and responds 503 if any of them
+// fails. The remaining quota of budget is reported if it's not nil, but running out of it doesn't fail the check.
+func readinessHandler(cfg config.Conf, cacheProvider cache.Rediser, budget *quota.Budget) gin.HandlerFunc {
+	checks := healthChecks(cfg, cacheProvider)
+
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(cfg.Health.Timeout)*time.Millisecond)
+		defer cancel()
+
+		resp := readinessResp{
+			Status:       StatusOK,
+			Dependencies: make(map[string]dependencyStatus, len(checks)),
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check HealthCheck) {
+				defer wg.Done()
+				name := check.Name()
+				status := dependencyStatus{Status: StatusOK}
+				if err := check.Check(ctx); err != nil {
+					log.Errorf("readiness check of %s failed: %v", name, err)
+					status = dependencyStatus{Status: StatusUnavailable, Error: err.Error()}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				resp.Dependencies[name] = status
+				if status.Status != StatusOK {
+					resp.Status = StatusUnavailable
+				}
+			}(check)
+		}
+		wg.Wait()
+
+		if budget != nil {
+			if remaining, err := budget.Remaining(ctx); err != nil {
+				log.Errorf("getting remaining quota failed: %v", err)
+			} else {
+				resp.QuotaRemaining = &remaining
+			}
+		}
+
+		if resp.Status != StatusOK {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, resp)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
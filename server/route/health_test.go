@@ -0,0 +1,89 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/pkg/errors"
+)
+
+// unreachableRedis is the cache whose pings fail
+type unreachableRedis struct {
+	cache.Rediser
+}
+
+func (unreachableRedis) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("", errors.New("connection refused"))
+}
+
+func TestReadiness(t *testing.T) {
+	cmsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"__typename":"Query"}}`))
+	}))
+	defer cmsServer.Close()
+	failingCMSServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingCMSServer.Close()
+
+	tests := []struct {
+		name             string
+		checks           []string
+		isRedisReachable bool
+		cmsURL           string
+		wantStatus       int
+		wantDependencies map[string]string
+	}{
+		{name: "all checks pass", checks: []string{config.HealthCheckRedis, config.HealthCheckCMS}, isRedisReachable: true, cmsURL: cmsServer.URL, wantStatus: http.StatusOK, wantDependencies: map[string]string{"redis": StatusOK, "cms": StatusOK}},
+		{name: "failing redis fails the readiness", checks: []string{config.HealthCheckRedis, config.HealthCheckCMS}, cmsURL: cmsServer.URL, wantStatus: http.StatusServiceUnavailable, wantDependencies: map[string]string{"redis": StatusUnavailable, "cms": StatusOK}},
+		{name: "failing CMS fails the readiness", checks: []string{config.HealthCheckRedis, config.HealthCheckCMS}, isRedisReachable: true, cmsURL: failingCMSServer.URL, wantStatus: http.StatusServiceUnavailable, wantDependencies: map[string]string{"redis": StatusOK, "cms": StatusUnavailable}},
+		{name: "unlisted failing dependency isn't checked", checks: []string{config.HealthCheckCMS}, cmsURL: cmsServer.URL, wantStatus: http.StatusOK, wantDependencies: map[string]string{"cms": StatusOK}},
+		{name: "empty list only checks the liveness", checks: []string{}, cmsURL: failingCMSServer.URL, wantStatus: http.StatusOK, wantDependencies: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.CmsURL = tt.cmsURL
+			cfg.Health = config.Health{Checks: tt.checks, Timeout: 1000}
+			var cacheProvider cache.Rediser = unreachableRedis{cache.NewMemory(10, time.Minute)}
+			if tt.isRedisReachable {
+				cacheProvider = cache.NewMemory(10, time.Minute)
+			}
+			r := newTestEngine(t, cfg, newEmptyFake(t), cacheProvider)
+
+			w := serve(r, "/health/ready")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			var resp readinessResp
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			dependencies := make(map[string]string, len(resp.Dependencies))
+			for name, status := range resp.Dependencies {
+				dependencies[name] = status.Status
+				if (status.Status == StatusOK) != (status.Error == "") {
+					t.Errorf("%s is %s with error %q", name, status.Status, status.Error)
+				}
+			}
+			if !reflect.DeepEqual(dependencies, tt.wantDependencies) {
+				t.Errorf("dependencies = %v, want %v", dependencies, tt.wantDependencies)
+			}
+			wantReadiness := StatusOK
+			if tt.wantStatus != http.StatusOK {
+				wantReadiness = StatusUnavailable
+			}
+			if resp.Status != wantReadiness {
+				t.Errorf("readiness = %s, want %s", resp.Status, wantReadiness)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+func TestMetaConfig(t *testing.T) {
+	cachedAPI := func(ttl int, quotaCost int64) api.MetaAPIConfig {
+		return api.MetaAPIConfig{Cached: true, TTL: ttl, ErrorTTL: 10, QuotaCost: quotaCost}
+	}
+	tests := []struct {
+		name  string
+		cache config.Cache
+		want  api.MetaConfigResp
+	}{
+		{
+			name: "cache policy of each api",
+			cache: config.Cache{
+				IsEnabled:            true,
+				TTL:                  60,
+				ErrorTTL:             10,
+				VideoCategoriesTTL:   86400,
+				StaleWhileRevalidate: 30,
+				Serializer:           config.SerializeJSON,
+				DisabledAPIs:         map[string]bool{"/youtube/v3/playlistItems": true},
+				OverwriteTTL:         map[string]int{"/youtube/v3/videoCategories": 86400},
+			},
+			want: api.MetaConfigResp{
+				CacheEnabled:         true,
+				StaleWhileRevalidate: 30,
+				APIs: map[string]api.MetaAPIConfig{
+					"/youtube/v3/search":          cachedAPI(60, 100),
+					"/youtube/v3/videos":          cachedAPI(60, 1),
+					"/youtube/v3/playlistItems":   {QuotaCost: 1},
+					"/youtube/v3/playlists":       cachedAPI(60, 1),
+					"/youtube/v3/videoCategories": cachedAPI(86400, 1),
+					"/youtube/v3/channelSections": cachedAPI(60, 1),
+				},
+			},
+		},
+		{
+			name: "cache disabled",
+			// staleWhileRevalidate is left out as nothing is cached
+			cache: config.Cache{StaleWhileRevalidate: 30},
+			want: api.MetaConfigResp{
+				APIs: map[string]api.MetaAPIConfig{
+					"/youtube/v3/search":          {QuotaCost: 100},
+					"/youtube/v3/videos":          {QuotaCost: 1},
+					"/youtube/v3/playlistItems":   {QuotaCost: 1},
+					"/youtube/v3/playlists":       {QuotaCost: 1},
+					"/youtube/v3/videoCategories": {QuotaCost: 1},
+					"/youtube/v3/channelSections": {QuotaCost: 1},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = tt.cache
+			cfg.Redis = &config.RedisService{Type: config.Single, SingleInstance: &config.RedisSingleInstance{Password: "redis-password"}}
+			r := newTestEngine(t, cfg, newEmptyFake(t), cache.NewMemory(100, time.Minute))
+
+			w := serve(r, "/meta/config")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+			}
+			for _, secret := range []string{cfg.AdminToken, cfg.ApiKey, "redis-password"} {
+				if strings.Contains(w.Body.String(), secret) {
+					t.Errorf("body = %s, want no secret", w.Body.String())
+				}
+			}
+
+			// the shape is fixed for the clients
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := keys(fields), []string{"apis", "cacheEnabled", "staleWhileRevalidate"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("fields = %v, want %v", got, want)
+			}
+			var apis map[string]map[string]json.RawMessage
+			if err := json.Unmarshal(fields["apis"], &apis); err != nil {
+				t.Fatal(err)
+			}
+			for path, apiFields := range apis {
+				if got, want := keys(apiFields), []string{"cached", "errorTtl", "quotaCost", "ttl"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("fields of %s = %v, want %v", path, got, want)
+				}
+			}
+
+			var resp api.MetaConfigResp
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp, tt.want) {
+				t.Errorf("meta config = %+v, want %+v", resp, tt.want)
+			}
+		})
+	}
+}
+
+// keys are the sorted keys of fields
+func keys(fields map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/quota"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkAutoPaginate rejects autoPaginate if it's disabled, or if the items can't be concatenated into an array
+func checkAutoPaginate(queries ytrelay.Options, playlistIDs []string, maxPages int) error {
+	switch {
+	case maxPages <= 0:
+		return errors.New("autoPaginate is disabled")
+	case len(playlistIDs) > 1:
+		return errors.New("autoPaginate only supports a single playlist")
+	case queries.Envelope:
+		return errors.New("autoPaginate cannot be used with envelope as the items are responded as an array")
+	}
+	return nil
+}
+
+// playlistItemsPage is the part of a page of playlistItems needed to concatenate the pages
+type playlistItemsPage struct {
+	Items         []json.RawMessage `json:"items"`
+	NextPageToken string            `json:"nextPageToken"`
+}
+
+// pageItems returns the items of resp after the transforms and the token of the next page. The token is read before
+// the transforms as fields may drop it.
+func pageItems(c *gin.Context, transforms pipelines, queries ytrelay.Options, resp interface{}) (items []json.RawMessage, nextPageToken string, err error) {
+	var page playlistItemsPage
+	if err = remarshal(resp, &page); err != nil {
+		return nil, "", errors.Wrap(err, "reading nextPageToken of playlistItems encountered error")
+	}
+	nextPageToken = page.NextPageToken
+
+	resp, err = transforms.apply(c, queries, resp)
+	if err != nil {
+		return nil, "", err
+	}
+	page = playlistItemsPage{}
+	if err = remarshal(resp, &page); err != nil {
+		return nil, "", errors.Wrap(err, "reading items of playlistItems encountered error")
+	}
+	return page.Items, nextPageToken, nil
+}
+
+func remarshal(from interface{}, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+// streamPlaylistItems responds with the items of the pages of playlistItems starting from resp, the page of queries, as
+// a single JSON array. The items are encoded to the response page by page instead of being buffered, so maxResponseBytes
+// doesn't apply and the size is bounded by maxPages instead. It follows nextPageToken for at most maxPages pages, and
+// stops early once the request is cancelled or the budget can't afford the next page. The errors after the status is
+// sent can only be logged, and they leave the array unterminated for the client to notice the truncation.
+func streamPlaylistItems(c *gin.Context, apiLogger *log.Entry, relayService ytrelay.VideoRelay, transforms pipelines, budget *quota.Budget, queries ytrelay.Options, resp interface{}, maxPages int) {
+	ctx := c.Request.Context()
+
+	items, nextPageToken, err := pageItems(c, transforms, queries, resp)
+	if err != nil {
+		respondTransformError(c, apiLogger, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	if _, err = c.Writer.WriteString("["); err != nil {
+		apiLogger.Error(errors.Wrap(err, "streaming playlistItems encountered error"))
+		return
+	}
+
+	// the units of the calls of the request aren't counted into the budget until it finishes
+	cost := relay.EstimateQuotaCost(playlistItemsPath, c.Request.URL.Query())
+	isFirstItem := true
+	for pages := 1; ; pages++ {
+		for _, item := range items {
+			if !isFirstItem {
+				_, err = c.Writer.WriteString(",")
+			}
+			if err == nil {
+				err = encoder.Encode(item)
+			}
+			if err != nil {
+				apiLogger.Error(errors.Wrap(err, "streaming playlistItems encountered error"))
+				return
+			}
+			isFirstItem = false
+		}
+		c.Writer.Flush()
+
+		if nextPageToken == "" {
+			break
+		}
+		if pages >= maxPages {
+			apiLogger.Infof("autoPaginate of playlistId(%s) stops at the max of %d pages", queries.PlaylistID, maxPages)
+			break
+		}
+		if ctx.Err() != nil {
+			apiLogger.Warnf("autoPaginate of playlistId(%s) is cancelled after %d pages: %v", queries.PlaylistID, pages, ctx.Err())
+			return
+		}
+		if budget != nil {
+			remaining, err := budget.Remaining(ctx)
+			if err != nil {
+				// failing to read the budget shouldn't fail the relay
+				apiLogger.Error(err)
+			} else if remaining-int64(pages)*cost-cost < budget.Reserve() {
+				apiLogger.Warnf("autoPaginate of playlistId(%s) stops after %d pages as only %d quota units are left", queries.PlaylistID, pages, remaining)
+				break
+			}
+		}
+
+		queries.PageToken = nextPageToken
+		resp, err = listPlaylistVideos(ctx, relayService, queries)
+		if err == nil {
+			items, nextPageToken, err = pageItems(c, transforms, queries, resp)
+		}
+		if err != nil {
+			apiLogger.Error(errors.WithMessagef(err, "autoPaginate of playlistId(%s) failed after %d pages", queries.PlaylistID, pages))
+			return
+		}
+	}
+
+	if _, err = c.Writer.WriteString("]"); err != nil {
+		apiLogger.Error(errors.Wrap(err, "streaming playlistItems encountered error"))
+	}
+}
@@ -0,0 +1,148 @@
+package route
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/relay"
+	"google.golang.org/api/youtube/v3"
+)
+
+// pagedRelay lists the playlist items in pages keyed by their page tokens
+type pagedRelay struct {
+	*relay.FakeRelay
+	pages map[string]*youtube.PlaylistItemListResponse
+	calls int
+}
+
+func newPagedRelay() *pagedRelay {
+	page := func(nextPageToken string, ids ...string) *youtube.PlaylistItemListResponse {
+		resp := &youtube.PlaylistItemListResponse{Kind: "youtube#playlistItemListResponse", NextPageToken: nextPageToken}
+		for _, id := range ids {
+			resp.Items = append(resp.Items, &youtube.PlaylistItem{Kind: "youtube#playlistItem", Id: id})
+		}
+		return resp
+	}
+	return &pagedRelay{
+		FakeRelay: relay.NewFake(""),
+		pages: map[string]*youtube.PlaylistItemListResponse{
+			"":      page("page2", "item1", "item2"),
+			"page2": page("page3", "item3"),
+			"page3": page("", "item4"),
+		},
+	}
+}
+
+func (p *pagedRelay) ListPlaylistVideos(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	p.calls++
+	return p.pages[options.PageToken], nil
+}
+
+func itemIDs(t *testing.T, body []byte) []string {
+	t.Helper()
+	var items []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &items); err != nil {
+		t.Fatalf("body %s isn't an array of items: %v", body, err)
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestAutoPaginate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxPages   int
+		query      string
+		wantStatus int
+		wantIDs    []string
+		wantCalls  int
+	}{
+		{name: "all the pages are streamed", maxPages: 10, query: "playlistId=playlist1", wantStatus: http.StatusOK, wantIDs: []string{"item1", "item2", "item3", "item4"}, wantCalls: 3},
+		{name: "pages stop at maxPages", maxPages: 2, query: "playlistId=playlist1", wantStatus: http.StatusOK, wantIDs: []string{"item1", "item2", "item3"}, wantCalls: 2},
+		{name: "disabled autoPaginate is rejected", maxPages: 0, query: "playlistId=playlist1", wantStatus: http.StatusBadRequest},
+		{name: "multiple playlists are rejected", maxPages: 10, query: "playlistId=playlist1,playlist2", wantStatus: http.StatusBadRequest},
+		{name: "envelope is rejected", maxPages: 10, query: "playlistId=playlist1&envelope=true", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.AutoPaginateMaxPages = tt.maxPages
+			relayService := newPagedRelay()
+			r := newTestEngine(t, cfg, relayService, nil)
+
+			w := serve(r, "/youtube/v3/playlistItems?part=snippet&autoPaginate=true&"+tt.query)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := strings.Join(itemIDs(t, w.Body.Bytes()), ","); got != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("items = %s, want %s", got, strings.Join(tt.wantIDs, ","))
+			}
+			if relayService.calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", relayService.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAutoPaginateThroughBufferingWriters(t *testing.T) {
+	cfg := newTestConf()
+	cfg.AutoPaginateMaxPages = 10
+	cfg.Compression = config.Compression{IsEnabled: true, MinSize: 1024}
+	r := newTestEngine(t, cfg, newPagedRelay(), nil)
+
+	t.Run("gzip", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/youtube/v3/playlistItems?part=snippet&autoPaginate=true&playlistId=playlist1", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+
+		result := w.Result()
+		if got := result.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", got)
+		}
+		reader, err := gzip.NewReader(result.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(itemIDs(t, body), ","); got != "item1,item2,item3,item4" {
+			t.Errorf("items = %s, want item1,item2,item3,item4", got)
+		}
+	})
+
+	t.Run("jsonp", func(t *testing.T) {
+		w := serve(r, "/youtube/v3/playlistItems?part=snippet&autoPaginate=true&playlistId=playlist1&callback=onItems")
+		result := w.Result()
+		if got := result.Header.Get("Content-Type"); got != "application/javascript; charset=utf-8" {
+			t.Errorf("Content-Type = %q, want application/javascript", got)
+		}
+		body := w.Body.String()
+		const opening = "/**/ typeof onItems === 'function' && onItems("
+		if !strings.HasPrefix(body, opening) || !strings.HasSuffix(body, ");") {
+			t.Fatalf("body %s isn't wrapped by the callback", body)
+		}
+		array := strings.TrimSuffix(strings.TrimPrefix(body, opening), ");")
+		if got := strings.Join(itemIDs(t, []byte(array)), ","); got != "item1,item2,item3,item4" {
+			t.Errorf("items = %s, want item1,item2,item3,item4", got)
+		}
+	})
+}
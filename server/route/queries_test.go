@@ -0,0 +1,573 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/pkg/errors"
+)
+
+// newEmptyFake responds every api with an empty response
+func newEmptyFake(t *testing.T) *relay.FakeRelay {
+	t.Helper()
+	dir := t.TempDir()
+	for _, fixture := range []string{"search.json", "videos.json", "playlistItems.json", "playlists.json", "videoCategories.json", "channelSections.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fixture), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return relay.NewFake(dir)
+}
+
+// optionsRelay records the options of the playlistItems calls
+type optionsRelay struct {
+	*relay.FakeRelay
+	options []ytrelay.Options
+}
+
+func (o *optionsRelay) ListPlaylistVideos(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	o.options = append(o.options, options)
+	return o.FakeRelay.ListPlaylistVideos(ctx, options)
+}
+
+func TestMaxResults(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxResults     string
+		clamp          bool
+		wantStatus     int
+		wantMaxResults int64
+	}{
+		{name: "lower bound", maxResults: "1", wantStatus: http.StatusOK, wantMaxResults: 1},
+		{name: "upper bound", maxResults: "50", wantStatus: http.StatusOK, wantMaxResults: 50},
+		{name: "zero is rejected", maxResults: "0", wantStatus: http.StatusBadRequest},
+		{name: "over the upper bound is rejected", maxResults: "51", wantStatus: http.StatusBadRequest},
+		{name: "negative is rejected", maxResults: "-1", wantStatus: http.StatusBadRequest},
+		{name: "zero is clamped", maxResults: "0", clamp: true, wantStatus: http.StatusOK, wantMaxResults: 1},
+		{name: "over the upper bound is clamped", maxResults: "100", clamp: true, wantStatus: http.StatusOK, wantMaxResults: 50},
+		{name: "absent maxResults is left to YouTube", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.ClampMaxResults = tt.clamp
+			relayService := &optionsRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, cfg, relayService, nil)
+
+			uri := "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1"
+			if tt.maxResults != "" {
+				uri += "&maxResults=" + tt.maxResults
+			}
+			w := serve(r, uri)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(relayService.options) != 0 {
+					t.Error("rejected request calls the relay")
+				}
+				return
+			}
+			if len(relayService.options) != 1 || relayService.options[0].MaxResults != tt.wantMaxResults {
+				t.Errorf("relay options = %+v, want maxResults %d", relayService.options, tt.wantMaxResults)
+			}
+		})
+	}
+}
+
+func TestMaxIDsPerRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		param string
+		// the playlists are repeated as they have to be whitelisted
+		ids        string
+		maxIDs     int
+		wantStatus int
+	}{
+		{name: "videos at the limit", path: "/youtube/v3/videos", param: "id", ids: "video0,video1,video2", maxIDs: 3, wantStatus: http.StatusOK},
+		{name: "videos over the limit", path: "/youtube/v3/videos", param: "id", ids: "video0,video1,video2,video3", maxIDs: 3, wantStatus: http.StatusBadRequest},
+		{name: "videos without limit", path: "/youtube/v3/videos", param: "id", ids: "video0,video1,video2,video3", maxIDs: 0, wantStatus: http.StatusOK},
+		{name: "playlistItems at the limit", path: "/youtube/v3/playlistItems", param: "playlistId", ids: "playlist1,playlist1,playlist1", maxIDs: 3, wantStatus: http.StatusOK},
+		{name: "playlistItems over the limit", path: "/youtube/v3/playlistItems", param: "playlistId", ids: "playlist1,playlist1,playlist1,playlist1", maxIDs: 3, wantStatus: http.StatusBadRequest},
+		{name: "playlists at the limit", path: "/youtube/v3/playlists", param: "id", ids: "playlist1,playlist1,playlist1", maxIDs: 3, wantStatus: http.StatusOK},
+		{name: "playlists over the limit", path: "/youtube/v3/playlists", param: "id", ids: "playlist1,playlist1,playlist1,playlist1", maxIDs: 3, wantStatus: http.StatusBadRequest},
+		{name: "channelSections at the limit", path: "/youtube/v3/channelSections", param: "id", ids: "section0,section1,section2", maxIDs: 3, wantStatus: http.StatusOK},
+		{name: "channelSections over the limit", path: "/youtube/v3/channelSections", param: "id", ids: "section0,section1,section2,section3", maxIDs: 3, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.MaxIDsPerRequest = tt.maxIDs
+			r := newTestEngine(t, cfg, newEmptyFake(t), nil)
+
+			w := serve(r, tt.path+"?part=snippet&"+tt.param+"="+tt.ids)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if isRejected := strings.Contains(w.Body.String(), "maxIdsPerRequest"); isRejected != (tt.wantStatus == http.StatusBadRequest) {
+				t.Errorf("body = %s, want it rejected by maxIdsPerRequest = %v", w.Body.String(), tt.wantStatus == http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestMultiplePlaylists(t *testing.T) {
+	tests := []struct {
+		name         string
+		playlistID   string
+		maxPlaylists int
+		wantStatus   int
+	}{
+		{name: "single playlist", playlistID: "playlist1", maxPlaylists: 2, wantStatus: http.StatusOK},
+		{name: "multiple playlists", playlistID: "playlist1,playlist2", maxPlaylists: 2, wantStatus: http.StatusOK},
+		{name: "partially invalid playlists are rejected", playlistID: "playlist1,playlist3", maxPlaylists: 2, wantStatus: http.StatusBadRequest},
+		{name: "playlists over maxPlaylistsPerRequest are rejected", playlistID: "playlist1,playlist2,playlist1", maxPlaylists: 2, wantStatus: http.StatusBadRequest},
+		{name: "playlists without maxPlaylistsPerRequest", playlistID: "playlist1,playlist2,playlist1", maxPlaylists: 0, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.MaxPlaylistsPerRequest = tt.maxPlaylists
+			relayService := &optionsRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, cfg, relayService, nil)
+
+			w := serve(r, "/youtube/v3/playlistItems?part=snippet&playlistId="+tt.playlistID)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			wantCalls := 0
+			if tt.wantStatus == http.StatusOK {
+				wantCalls = 1
+			}
+			if len(relayService.options) != wantCalls {
+				t.Fatalf("relay calls = %d, want %d", len(relayService.options), wantCalls)
+			}
+			if wantCalls > 0 && relayService.options[0].PlaylistID != tt.playlistID {
+				t.Errorf("relayed playlistId = %s, want %s", relayService.options[0].PlaylistID, tt.playlistID)
+			}
+		})
+	}
+}
+
+func TestIDCharacters(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		wantStatus int
+	}{
+		{name: "video id", uri: "/youtube/v3/videos?part=snippet&id=dQw4w9WgXcQ", wantStatus: http.StatusOK},
+		{name: "video ids", uri: "/youtube/v3/videos?part=snippet&id=video_1,video-2", wantStatus: http.StatusOK},
+		{name: "video id with a dot", uri: "/youtube/v3/videos?part=snippet&id=video.1", wantStatus: http.StatusBadRequest},
+		{name: "video id with a newline", uri: "/youtube/v3/videos?part=snippet&id=video1%0Avideo2", wantStatus: http.StatusBadRequest},
+		{name: "video id with an encoded payload", uri: "/youtube/v3/videos?part=snippet&id=%3Cscript%3E", wantStatus: http.StatusBadRequest},
+		{name: "channel id", uri: "/youtube/v3/search?part=snippet&channelId=channel1", wantStatus: http.StatusOK},
+		{name: "channel id with a dot", uri: "/youtube/v3/search?part=snippet&channelId=channel1.", wantStatus: http.StatusBadRequest},
+		{name: "channel id with a space", uri: "/youtube/v3/search?part=snippet&channelId=channel1%20", wantStatus: http.StatusBadRequest},
+		{name: "playlist ids", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1,playlist2", wantStatus: http.StatusOK},
+		{name: "playlist id with a dot", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1.playlist2", wantStatus: http.StatusBadRequest},
+		{name: "channel section ids with dots", uri: "/youtube/v3/channelSections?part=snippet&id=channel1.section1,channel1.section2", wantStatus: http.StatusOK},
+		{name: "channel section id with a slash", uri: "/youtube/v3/channelSections?part=snippet&id=channel1/section1", wantStatus: http.StatusBadRequest},
+		{name: "channel id of channel sections with a dot", uri: "/youtube/v3/channelSections?part=snippet&channelId=channel1.section1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestEngine(t, newTestConf(), newEmptyFake(t), nil)
+			w := serve(r, tt.uri)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if isRejected := strings.Contains(w.Body.String(), "can only contain"); isRejected != (tt.wantStatus == http.StatusBadRequest) {
+				t.Errorf("body = %s, want it rejected by the characters = %v", w.Body.String(), tt.wantStatus == http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// languageRelay records the hl of the calls of the apis localizing the snippets
+type languageRelay struct {
+	*relay.FakeRelay
+	languages []string
+}
+
+func (l *languageRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	l.languages = append(l.languages, options.Language)
+	return l.FakeRelay.ListByVideoIDs(ctx, options)
+}
+
+func (l *languageRelay) ListPlaylists(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	l.languages = append(l.languages, options.Language)
+	return l.FakeRelay.ListPlaylists(ctx, options)
+}
+
+func (l *languageRelay) ListVideoCategories(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	l.languages = append(l.languages, options.Language)
+	return l.FakeRelay.ListVideoCategories(ctx, options)
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		name          string
+		uri           string
+		wantStatus    int
+		wantLanguages []string
+	}{
+		{name: "videos forward hl", uri: "/youtube/v3/videos?part=snippet&id=video1&hl=zh-TW", wantStatus: http.StatusOK, wantLanguages: []string{"zh-TW"}},
+		{name: "playlists forward hl", uri: "/youtube/v3/playlists?part=snippet&id=playlist1&hl=zh-Hant-TW", wantStatus: http.StatusOK, wantLanguages: []string{"zh-Hant-TW"}},
+		{name: "videoCategories forward hl", uri: "/youtube/v3/videoCategories?part=snippet&regionCode=TW&hl=en", wantStatus: http.StatusOK, wantLanguages: []string{"en"}},
+		{name: "videos without hl", uri: "/youtube/v3/videos?part=snippet&id=video1", wantStatus: http.StatusOK, wantLanguages: []string{""}},
+		{name: "invalid hl is rejected", uri: "/youtube/v3/videos?part=snippet&id=video1&hl=zh_TW", wantStatus: http.StatusBadRequest},
+		{name: "search rejects hl", uri: "/youtube/v3/search?part=snippet&channelId=channel1&hl=zh-TW", wantStatus: http.StatusBadRequest},
+		{name: "playlistItems rejects hl", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1&hl=zh-TW", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayService := &languageRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, newTestConf(), relayService, nil)
+
+			w := serve(r, tt.uri)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !reflect.DeepEqual(relayService.languages, tt.wantLanguages) {
+				t.Errorf("relayed hl = %q, want %q", relayService.languages, tt.wantLanguages)
+			}
+		})
+	}
+}
+
+func TestLanguageIsCachedApart(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Cache = config.Cache{IsEnabled: true, TTL: 60, ErrorTTL: 10, VideoCategoriesTTL: 60, Serializer: config.SerializeJSON}
+	relayService := &languageRelay{FakeRelay: newEmptyFake(t)}
+	r := newTestEngine(t, cfg, relayService, cache.NewMemory(100, time.Minute))
+
+	for _, request := range []struct {
+		hl         string
+		wantXCache string
+	}{
+		{hl: "zh-TW", wantXCache: "MISS"},
+		{hl: "en", wantXCache: "MISS"},
+		{hl: "zh-TW", wantXCache: "HIT"},
+		{hl: "en", wantXCache: "HIT"},
+	} {
+		w := serve(r, "/youtube/v3/videos?part=snippet&id=video1&hl="+request.hl)
+		if got := w.Header().Get(middleware.XCacheHeader); w.Code != http.StatusOK || got != request.wantXCache {
+			t.Errorf("response of hl(%s) = %d %s, want 200 %s", request.hl, w.Code, got, request.wantXCache)
+		}
+	}
+	if want := []string{"zh-TW", "en"}; !reflect.DeepEqual(relayService.languages, want) {
+		t.Errorf("relayed hl = %q, want %q", relayService.languages, want)
+	}
+}
+
+// pageTokenRelay rejects the page tokens of search like YouTube does
+type pageTokenRelay struct {
+	*relay.FakeRelay
+}
+
+func (p *pageTokenRelay) Search(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	if options.PageToken == "expired" {
+		return nil, errors.Wrap(relay.ErrInvalidPageToken, "YouTube rejected pageToken")
+	}
+	return p.FakeRelay.Search(ctx, options)
+}
+
+func TestInvalidPageToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		pageToken  string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "without pageToken", wantStatus: http.StatusOK},
+		{name: "valid pageToken", pageToken: "CAUQAA", wantStatus: http.StatusOK},
+		{name: "rejected pageToken", pageToken: "expired", wantStatus: http.StatusBadRequest, wantCode: api.CodeInvalidPageToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestEngine(t, newTestConf(), &pageTokenRelay{FakeRelay: newEmptyFake(t)}, nil)
+			w := serve(r, "/youtube/v3/search?part=snippet&channelId=channel1&pageToken="+tt.pageToken)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantCode != "" {
+				var resp api.ErrorResp
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != tt.wantCode {
+					t.Errorf("body = %s, want the error of code %s", w.Body.String(), tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestFieldsAreCachedApart(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Cache = newTestCacheConf()
+	relayService := &videosRelay{FakeRelay: newEmptyFake(t)}
+	r := newTestEngine(t, cfg, relayService, cache.NewMemory(100, time.Minute))
+
+	for _, request := range []struct {
+		fields     string
+		wantXCache string
+		wantBody   string
+	}{
+		{fields: "items.id", wantXCache: "MISS", wantBody: `{"items":[{"id":"video1"}]}`},
+		{fields: "items.snippet.title", wantXCache: "MISS", wantBody: `{"items":[{"snippet":{"title":"title"}}]}`},
+		{fields: "items.id", wantXCache: "HIT", wantBody: `{"items":[{"id":"video1"}]}`},
+		{fields: "items.snippet.title", wantXCache: "HIT", wantBody: `{"items":[{"snippet":{"title":"title"}}]}`},
+	} {
+		w := serve(r, "/youtube/v3/videos?part=snippet&id=video1&fields="+request.fields)
+		if got := w.Header().Get(middleware.XCacheHeader); w.Code != http.StatusOK || got != request.wantXCache {
+			t.Errorf("response of fields(%s) = %d %s, want 200 %s", request.fields, w.Code, got, request.wantXCache)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != request.wantBody {
+			t.Errorf("body of fields(%s) = %s, want %s", request.fields, got, request.wantBody)
+		}
+	}
+	if len(relayService.parts) != 2 {
+		t.Errorf("relay calls = %d, want 2", len(relayService.parts))
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	uris := []string{
+		"/youtube/v3/search?part=snippet&channelId=channel1",
+		"/youtube/v3/videos?part=snippet&id=video1",
+		"/youtube/v3/playlistItems?part=snippet&playlistId=playlist1",
+		"/youtube/v3/playlists?part=snippet&id=playlist1",
+		"/youtube/v3/videoCategories?part=snippet&regionCode=TW",
+		"/youtube/v3/channelSections?part=snippet&channelId=channel1",
+	}
+	const envelope = `{"items":[],"pageInfo":{"totalResults":0}}`
+	for _, uri := range uris {
+		t.Run(uri, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = newTestCacheConf()
+			r := newTestEngine(t, cfg, newEmptyFake(t), cache.NewMemory(100, time.Minute))
+
+			for _, request := range []struct {
+				envelope   string
+				wantXCache string
+				wantBody   string
+			}{
+				{wantXCache: "MISS", wantBody: `{}`},
+				{envelope: "true", wantXCache: "MISS", wantBody: envelope},
+				{wantXCache: "HIT", wantBody: `{}`},
+				{envelope: "true", wantXCache: "HIT", wantBody: envelope},
+			} {
+				requestURI := uri
+				if request.envelope != "" {
+					requestURI += "&envelope=" + request.envelope
+				}
+				w := serve(r, requestURI)
+				if got := w.Header().Get(middleware.XCacheHeader); w.Code != http.StatusOK || got != request.wantXCache {
+					t.Errorf("response of envelope(%s) = %d %s, want 200 %s: %s", request.envelope, w.Code, got, request.wantXCache, w.Body.String())
+				}
+				if got := strings.TrimSpace(w.Body.String()); got != request.wantBody {
+					t.Errorf("body of envelope(%s) = %s, want %s", request.envelope, got, request.wantBody)
+				}
+			}
+		})
+	}
+}
+
+// searchRelay records the options of the search calls
+type searchRelay struct {
+	*relay.FakeRelay
+	options []ytrelay.Options
+}
+
+func (s *searchRelay) Search(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	s.options = append(s.options, options)
+	return s.FakeRelay.Search(ctx, options)
+}
+
+func TestPublishedRange(t *testing.T) {
+	tests := []struct {
+		name                string
+		query               string
+		wantStatus          int
+		wantPublishedAfter  string
+		wantPublishedBefore string
+	}{
+		{name: "without range", wantStatus: http.StatusOK},
+		{name: "publishedAfter", query: "&publishedAfter=2021-01-01T00:00:00Z", wantStatus: http.StatusOK, wantPublishedAfter: "2021-01-01T00:00:00Z"},
+		{name: "publishedBefore with offset", query: "&publishedBefore=2021-01-08T00:00:00%2B08:00", wantStatus: http.StatusOK, wantPublishedBefore: "2021-01-08T00:00:00+08:00"},
+		{name: "range", query: "&publishedAfter=2021-01-01T00:00:00Z&publishedBefore=2021-01-08T00:00:00Z", wantStatus: http.StatusOK, wantPublishedAfter: "2021-01-01T00:00:00Z", wantPublishedBefore: "2021-01-08T00:00:00Z"},
+		{name: "date without time", query: "&publishedAfter=2021-01-01", wantStatus: http.StatusBadRequest},
+		{name: "unix time", query: "&publishedBefore=1609459200", wantStatus: http.StatusBadRequest},
+		{name: "inverted range", query: "&publishedAfter=2021-01-08T00:00:00Z&publishedBefore=2021-01-01T00:00:00Z", wantStatus: http.StatusBadRequest},
+		{name: "inverted range across offsets", query: "&publishedAfter=2021-01-01T09:00:00%2B08:00&publishedBefore=2021-01-01T00:30:00Z", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayService := &searchRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, newTestConf(), relayService, nil)
+
+			w := serve(r, "/youtube/v3/search?part=snippet&channelId=channel1"+tt.query)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if code := errorCode(t, w.Body.Bytes()); code != api.CodeInvalidParameter || len(relayService.options) != 0 {
+					t.Errorf("code = %s with %d relay calls, want %s without relay calls", code, len(relayService.options), api.CodeInvalidParameter)
+				}
+				return
+			}
+			options := relayService.options[0]
+			if options.PublishedAfter != tt.wantPublishedAfter || options.PublishedBefore != tt.wantPublishedBefore {
+				t.Errorf("relayed range = %q, %q, want %q, %q", options.PublishedAfter, options.PublishedBefore, tt.wantPublishedAfter, tt.wantPublishedBefore)
+			}
+		})
+	}
+}
+
+func TestPublishedRangeIsCachedApart(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Cache = newTestCacheConf()
+	relayService := &searchRelay{FakeRelay: newEmptyFake(t)}
+	r := newTestEngine(t, cfg, relayService, cache.NewMemory(100, time.Minute))
+
+	for _, request := range []struct {
+		publishedAfter string
+		wantXCache     string
+	}{
+		{publishedAfter: "2021-01-01T00:00:00Z", wantXCache: "MISS"},
+		{publishedAfter: "2021-01-08T00:00:00Z", wantXCache: "MISS"},
+		{publishedAfter: "2021-01-01T00:00:00Z", wantXCache: "HIT"},
+	} {
+		w := serve(r, "/youtube/v3/search?part=snippet&channelId=channel1&publishedAfter="+request.publishedAfter)
+		if got := w.Header().Get(middleware.XCacheHeader); w.Code != http.StatusOK || got != request.wantXCache {
+			t.Errorf("response of publishedAfter(%s) = %d %s, want 200 %s", request.publishedAfter, w.Code, got, request.wantXCache)
+		}
+	}
+}
+
+func TestAllowedParts(t *testing.T) {
+	tests := []struct {
+		name         string
+		uri          string
+		wantStatus   int
+		wantUpstream []string
+	}{
+		{name: "allowed parts are relayed", uri: "/youtube/v3/videos?id=video1&part=snippet,contentDetails", wantStatus: http.StatusOK, wantUpstream: []string{"snippet,contentDetails"}},
+		{name: "default part is checked and allowed", uri: "/youtube/v3/videos?id=video1", wantStatus: http.StatusOK, wantUpstream: []string{"snippet"}},
+		{name: "disallowed part is rejected", uri: "/youtube/v3/videos?id=video1&part=snippet,statistics", wantStatus: http.StatusBadRequest},
+		{name: "api without allowedParts allows any part", uri: "/youtube/v3/search?channelId=channel1&part=statistics", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.Cache = newTestCacheConf()
+			cfg.DefaultParts = config.DefaultParts{"/youtube/v3/videos": "snippet"}
+			cfg.AllowedParts = config.AllowedParts{"/youtube/v3/videos": "snippet,contentDetails"}
+			relayService := &videosRelay{FakeRelay: newEmptyFake(t), channelID: "channel1"}
+			r := newTestEngine(t, cfg, relayService, cache.NewMemory(100, time.Minute))
+
+			// the rejections aren't cached
+			for i := 0; i < 2; i++ {
+				w := serve(r, tt.uri)
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+				}
+				if tt.wantStatus != http.StatusBadRequest {
+					continue
+				}
+				if code := errorCode(t, w.Body.Bytes()); code != api.CodePartNotAllowed {
+					t.Errorf("code = %s, want %s", code, api.CodePartNotAllowed)
+				}
+				if xCache := w.Header().Get(middleware.XCacheHeader); xCache != "" {
+					t.Errorf("X-Cache = %s, want the rejection not cached", xCache)
+				}
+			}
+			if !reflect.DeepEqual(relayService.parts, tt.wantUpstream) {
+				t.Errorf("upstream parts = %v, want %v", relayService.parts, tt.wantUpstream)
+			}
+		})
+	}
+}
+
+func TestIncludeDurations(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{query: "", want: false},
+		{query: "&includeDurations=true", want: true},
+		{query: "&includeDurations=false", want: false},
+	}
+	for _, tt := range tests {
+		relayService := &optionsRelay{FakeRelay: newEmptyFake(t)}
+		r := newTestEngine(t, newTestConf(), relayService, nil)
+
+		w := serve(r, "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status of %q = %d, want 200: %s", tt.query, w.Code, w.Body.String())
+		}
+		if len(relayService.options) != 1 || relayService.options[0].IncludeDurations != tt.want {
+			t.Errorf("includeDurations of %q = %v, want %v", tt.query, relayService.options, tt.want)
+		}
+	}
+}
+
+func TestDefaultMaxResults(t *testing.T) {
+	tests := []struct {
+		name           string
+		uri            string
+		wantMaxResults int64
+	}{
+		{name: "omitted maxResults is defaulted", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1", wantMaxResults: 20},
+		{name: "explicit maxResults is kept", uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1&maxResults=10", wantMaxResults: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			// the keys are lowercased as viper does to the config file
+			cfg.DefaultMaxResults = map[string]int{"/youtube/v3/playlistitems": 20}
+			relayService := &optionsRelay{FakeRelay: newEmptyFake(t)}
+			r := newTestEngine(t, cfg, relayService, nil)
+
+			if w := serve(r, tt.uri); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+			}
+			if len(relayService.options) != 1 || relayService.options[0].MaxResults != tt.wantMaxResults {
+				t.Errorf("relay options = %+v, want maxResults %d", relayService.options, tt.wantMaxResults)
+			}
+		})
+	}
+}
+
+func TestDefaultMaxResultsIsCachedAsExplicit(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Cache = newTestCacheConf()
+	cfg.DefaultMaxResults = map[string]int{"/youtube/v3/playlistItems": 20}
+	r := newTestEngine(t, cfg, &optionsRelay{FakeRelay: newEmptyFake(t)}, cache.NewMemory(100, time.Minute))
+
+	// the query is rewritten in the encoded order, which the explicit requests share
+	for _, tt := range []struct {
+		uri        string
+		wantXCache string
+	}{
+		{uri: "/youtube/v3/playlistItems?part=snippet&playlistId=playlist1", wantXCache: "MISS"},
+		{uri: "/youtube/v3/playlistItems?maxResults=20&part=snippet&playlistId=playlist1", wantXCache: "HIT"},
+		{uri: "/youtube/v3/playlistItems?maxResults=10&part=snippet&playlistId=playlist1", wantXCache: "MISS"},
+	} {
+		if got := serve(r, tt.uri).Header().Get(middleware.XCacheHeader); got != tt.wantXCache {
+			t.Errorf("X-Cache of %s = %s, want %s", tt.uri, got, tt.wantXCache)
+		}
+	}
+}
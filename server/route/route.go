@@ -1,19 +1,26 @@
 package route
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
 	ytrelay "github.com/mirror-media/yt-relay"
 	"github.com/mirror-media/yt-relay/api"
 	"github.com/mirror-media/yt-relay/cache"
 	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
 	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/quota"
 	"github.com/mirror-media/yt-relay/relay"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -21,294 +28,1172 @@ import (
 )
 
 const (
-	ErrorEmptyPart = "part cannot be empty"
-	ErrorEmptyID   = "id cannot be empty"
+	ErrorEmptyPart           = "part cannot be empty"
+	ErrorEmptyID             = "id cannot be empty"
+	ErrorEmptyChannelIDAndID = "channelId and id cannot be both empty"
+	// ErrorUnsupportedLanguage is for search and playlistItems, whose snippets YouTube doesn't localize, so hl is
+	// rejected rather than being cached apart for nothing
+	ErrorUnsupportedLanguage = "hl is only supported by videos, playlists, and videoCategories"
 )
 
-const TTLHeader = "Cache-Set-TTL"
+// MinMaxResults and MaxMaxResults are the range of maxResults YouTube accepts
+const (
+	MinMaxResults = 1
+	MaxMaxResults = 50
+)
 
-func getResponseCacheTTL(apiLogger *log.Entry, cacheConf config.Cache, request http.Request) (ttl time.Duration, isDisabled bool) {
+const (
+	searchPath          = "/youtube/v3/search"
+	videosPath          = "/youtube/v3/videos"
+	playlistItemsPath   = "/youtube/v3/playlistItems"
+	playlistsPath       = "/youtube/v3/playlists"
+	videoCategoriesPath = "/youtube/v3/videoCategories"
+	channelSectionsPath = "/youtube/v3/channelSections"
+)
 
-	seconds, ok := cacheConf.OverwriteTTL[request.RequestURI]
-	if ok {
-		ttl = time.Duration(seconds) * time.Second
-	} else {
-		ttl = time.Duration(cacheConf.TTL) * time.Second
-	}
+// transformedPaths are the api paths whose responses go through the response transforms
+var transformedPaths = []string{searchPath, videosPath, playlistItemsPath, playlistsPath, videoCategoriesPath, channelSectionsPath}
 
-	if headerTTL, isPresenting, err := getHeaderTTL(apiLogger, request); err != nil {
-		apiLogger.Error(err)
-	} else if isPresenting {
-		ttl = headerTTL
-	}
+// HeaderWhitelistSource tells where the approval of the playlists comes from when debugHeaders is set
+const HeaderWhitelistSource = "X-Whitelist-Source"
 
-	return ttl, cacheConf.DisabledAPIs[request.RequestURI]
-}
+// searchOrders and searchTypes are the values of order and type YouTube recognizes for search
+var (
+	searchOrders = []string{"date", "rating", "relevance", "title", "videoCount", "viewCount"}
+	searchTypes  = []string{"video", "channel", "playlist"}
+)
 
-func getHeaderTTL(apiLogger *log.Entry, request http.Request) (ttl time.Duration, isPresenting bool, err error) {
-	var values []string
-	if values, isPresenting = request.Header[http.CanonicalHeaderKey(TTLHeader)]; isPresenting {
-		var headerTTL string
-		if len(values) > 0 {
-			headerTTL = values[0]
-		} else {
-			return ttl, isPresenting, errors.Errorf("header(%s) has empty value", TTLHeader)
-		}
+// languageRegex matches the BCP-47 language tags like en, zh-TW, and zh-Hant-TW
+var languageRegex = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
 
-		var intTTL int
-		intTTL, err = strconv.Atoi(headerTTL)
-		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("converting %s(%s) to int encountered error", headerTTL, TTLHeader))
-		} else if intTTL <= 0 {
-			err = errors.Errorf("the value(%d) of %s is not positive", intTTL, TTLHeader)
-		} else {
-			apiLogger.Infof("client requests to set cache ttl to %d via %s", intTTL, TTLHeader)
-			ttl = time.Duration(intTTL) * time.Second
-		}
-	}
-	return ttl, isPresenting, err
-}
+// idListRegex matches the YouTube IDs, or the comma-separated lists of them. sectionIDListRegex also allows the dot the
+// IDs of the channel sections have between the channel and the section.
+var (
+	idListRegex        = regexp.MustCompile(`^[A-Za-z0-9_,-]+$`)
+	sectionIDListRegex = regexp.MustCompile(`^[A-Za-z0-9_.,-]+$`)
+)
 
-func saveOKCache(isEnabled bool, cacheConf config.Cache, cacheProvider cache.Rediser, apiLogger *log.Entry, appName string, request http.Request, resp interface{}) {
+// QuotaRetryAfter is the Retry-After hint in seconds when YouTube rate limit is exceeded
+const QuotaRetryAfter = 600
 
-	if cacheConf.IsEnabled {
-		ttl, isCacheDisabledForAPI := getResponseCacheTTL(apiLogger, cacheConf, request)
-		if !isCacheDisabledForAPI {
-			saveCache(cacheConf, cacheProvider, apiLogger, appName, request, http.StatusOK, resp, ttl)
-		} else {
-			apiLogger.Infof("cache is disabled for %s", request.URL.String())
+// relayErrorStatusCode maps the relay error to the response status code and sets Retry-After for quota errors and the
+// open circuit breaker. The daily quota is retried after YouTube resets it.
+func relayErrorStatusCode(c *gin.Context, err error) int {
+	statusCode := relay.HTTPStatusCode(err)
+	if statusCode == http.StatusTooManyRequests {
+		retryAfter := QuotaRetryAfter
+		if relay.IsDailyQuotaExceeded(err) {
+			retryAfter = int(math.Ceil(relay.UntilQuotaReset(time.Now()).Seconds()))
 		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
 	}
+	if circuitOpenErr, ok := errors.Cause(err).(*relay.CircuitOpenError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(circuitOpenErr.RetryAfter.Seconds()))))
+	}
+	return statusCode
 }
-func saveErrCache(isEnabled bool, cacheConf config.Cache, cacheProvider cache.Rediser, apiLogger *log.Entry, appName string, request http.Request, httpResponseCode uint, resp interface{}) {
 
-	if cacheConf.IsEnabled {
-		_, isCacheDisabledForAPI := getResponseCacheTTL(apiLogger, cacheConf, request)
-		if !isCacheDisabledForAPI {
-			ttl := time.Duration(cacheConf.ErrorTTL) * time.Second
-			saveCache(cacheConf, cacheProvider, apiLogger, appName, request, http.StatusOK, resp, ttl)
-		} else {
-			apiLogger.Infof("cache is disabled for %s", request.URL.String())
+// respondRelayError responds with the error of the relay service. Upstream failures are responded with the previously
+// cached response instead if there's one kept for them.
+func respondRelayError(c *gin.Context, apiLogger *log.Entry, err error) {
+	apiLogger.Error(err)
+	if statusCode := relay.HTTPStatusCode(err); statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests {
+		if middleware.RespondWithStaleCache(c) {
+			apiLogger.Warn("responded with the stale cache as the upstream fails")
+			return
 		}
 	}
+	middleware.RespondError(c, relayErrorStatusCode(c, err), api.ErrorResp{Error: err.Error(), Code: relayErrorCode(err)})
 }
 
-func saveCache(cacheConf config.Cache, cacheProvider cache.Rediser, apiLogger *log.Entry, appName string, request http.Request, respCode int, resp interface{}, ttl time.Duration) {
-	s, err := json.Marshal(resp)
-	if err != nil {
-		apiLogger.Errorf("Cannot marshal resp for %s: %s", request.URL.String(), err)
-		return
+// relayErrorCode maps the relay error to the code of the error response
+func relayErrorCode(err error) string {
+	if _, ok := errors.Cause(err).(*relay.CircuitOpenError); ok {
+		return api.CodeUpstreamUnavailable
 	}
-	s, err = json.Marshal(cache.HTTP{
-		StatusCode: respCode,
-		Response:   s,
-	})
-	if err != nil {
-		apiLogger.Errorf("Cannot marshal http resp cache for %s: %s", request.URL.String(), err)
-		return
+	switch errors.Cause(err) {
+	case relay.ErrInvalidPageToken:
+		return api.CodeInvalidPageToken
+	case relay.ErrQuotaExceeded:
+		return api.CodeUpstreamQuota
 	}
-	key, err := cache.GetCacheKey(appName, request.URL.String())
-	if err != nil {
-		apiLogger.Errorf("GetCacheKey for %s encounter error:%v", request.URL.String(), err)
-	}
-	err = cacheProvider.SetNX(request.Context(), key, string(s), ttl).Err()
-	if err != nil {
-		apiLogger.Errorf("setting cache encountered error for %s: %v ", request.URL.String(), err)
-		return
-	} else {
-		apiLogger.Infof("cache for %s is set for ttl(%d)", request.URL.String(), int(ttl.Seconds()))
+	if upstreamErr, ok := errors.Cause(err).(*relay.UpstreamError); ok {
+		if upstreamErr.StatusCode >= http.StatusInternalServerError {
+			return api.CodeUpstreamFailure
+		}
+		return api.CodeUpstreamRejected
 	}
+	return api.CodeInternal
 }
 
 // Set sets the routing for the gin engine
 // TODO move whitelist to YouTube relay service
-func Set(r *gin.Engine, appName string, relayService ytrelay.VideoRelay, whitelist ytrelay.APIWhitelist, cacheConf config.Cache, cacheProvider cache.Rediser) error {
+func Set(r *gin.Engine, cfg config.Conf, relayService ytrelay.VideoRelay, whitelist ytrelay.APIWhitelist, cacheProvider cache.Rediser) error {
 
-	// rewrite /api/youtube/* to /youtube/v3/*
-	r.Use(func(c *gin.Context) {
-		if strings.HasPrefix(c.Request.URL.Path, "/api/youtube/") {
-			c.Request.URL.Path = strings.Replace(c.Request.URL.Path, "/api/youtube/", "/youtube/v3/", 1)
-			r.HandleContext(c)
-			c.Abort()
-		}
-	})
+	appName := cfg.AppName
+	cacheConf := cfg.Cache
+
+	// the panics of all the middlewares and the handlers are recovered, and the format is set next so that all of them
+	// respond the errors in it
+	r.Use(middleware.Recovery())
+	r.Use(middleware.ErrorFormat(cfg.ErrorFormat))
+
+	// rewrite /api/youtube/*, or redirect it, and /<version>/youtube/v3/* to /youtube/v3/*
+	r.Use(rewriteVersions(r, cfg.Versions, cfg.LegacyPathMode == config.LegacyPathRedirect))
+
+	// the request ID is set after the rewrite, which handles the context again from the start
+	r.Use(middleware.RequestID())
+
+	if cfg.SlowRequestThreshold > 0 {
+		r.Use(middleware.SlowRequest(time.Duration(cfg.SlowRequestThreshold) * time.Millisecond))
+	}
+
+	if cfg.Tracing.IsEnabled {
+		r.Use(middleware.Trace())
+	}
+
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		r.Use(middleware.CORS(cfg.CORS))
+	}
+
+	if cfg.Compression.IsEnabled {
+		r.Use(middleware.Compress(cfg.Compression.MinSize))
+	}
 
-	// health check api
-	// As more resources and component are used, they should be checked in the api
+	// health check api for liveness
 	r.GET("/health", func(c *gin.Context) {
 		c.AbortWithStatus(http.StatusOK)
 	})
 
+	// metrics api in the prometheus format
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	var budget *quota.Budget
+	if cfg.QuotaBudget.IsEnabled {
+		budget = quota.NewBudget(cacheProvider, cache.NewKeyBuilder(appName, cacheConf), cfg.QuotaBudget)
+	}
+
+	// readiness check api verifying the dependencies
+	r.GET("/health/ready", readinessHandler(cfg, cacheProvider, budget))
+
+	if cfg.AdminToken == "" {
+		log.Warn("adminToken is empty, all the admin apis will be rejected")
+	}
+	adminRouter := r.Group("/admin", middleware.Auth(cfg.AdminToken))
+
+	// channel and playlist IDs accepted at the moment
+	adminRouter.GET("/whitelist", func(c *gin.Context) {
+		c.JSON(http.StatusOK, whitelist.Effective())
+	})
+
+	// status of the playlist whitelist fetched from the CMS
+	adminRouter.GET("/whitelist/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, whitelist.Status())
+	})
+
+	// force to refresh the playlist whitelist from the CMS
+	adminRouter.POST("/whitelist/refresh", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		count, err := whitelist.Refresh()
+		if err != nil {
+			err = errors.Wrap(err, "refreshing playlist whitelist encountered error")
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadGateway, api.ErrorResp{Error: err.Error(), Code: api.CodeWhitelistRefresh})
+			return
+		}
+		apiLogger.Infof("playlist whitelist is refreshed with %d playlist IDs", count)
+		c.JSON(http.StatusOK, gin.H{"playlistCount": count})
+	})
+
+	// invalidate the cached responses of a channel or a playlist
+	adminRouter.DELETE("/cache", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		if !cacheConf.IsEnabled {
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: "cache is disabled", Code: api.CodeCacheDisabled})
+			return
+		}
+
+		var kind cache.IndexKind
+		var id string
+		channelID, playlistID := c.Query("channelId"), c.Query("playlistId")
+		switch {
+		case channelID != "" && playlistID == "":
+			kind, id = cache.IndexChannel, channelID
+		case playlistID != "" && channelID == "":
+			kind, id = cache.IndexPlaylist, playlistID
+		default:
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: "either channelId or playlistId is required", Code: api.CodeInvalidParameter})
+			return
+		}
+
+		deleted, err := cache.Invalidate(c.Request.Context(), cacheProvider, cache.NewKeyBuilder(appName, cacheConf), kind, id)
+		if err != nil {
+			err = errors.Wrapf(err, "invalidating cache of %s(%s) encountered error", kind, id)
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: err.Error(), Code: api.CodeInternal})
+			return
+		}
+		apiLogger.Infof("%d cache entries of %s(%s) are invalidated", deleted, kind, id)
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+	})
+
+	// switch the read-only mode of the instance, in which the cache misses are rejected instead of calling YouTube
+	readOnly := middleware.NewReadOnlySwitch(cacheConf.ReadOnly)
+	adminRouter.GET("/cache/readonly", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"readOnly": readOnly.IsEnabled()})
+	})
+	adminRouter.PUT("/cache/readonly", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		if !cacheConf.IsEnabled {
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: "cache is disabled", Code: api.CodeCacheDisabled})
+			return
+		}
+
+		var body struct {
+			ReadOnly *bool `json:"readOnly"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.ReadOnly == nil {
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: `the body has to be {"readOnly": true} or {"readOnly": false}`, Code: api.CodeInvalidParameter})
+			return
+		}
+		readOnly.Set(*body.ReadOnly)
+		apiLogger.Warnf("read-only mode of the cache is switched to %t", *body.ReadOnly)
+		c.JSON(http.StatusOK, gin.H{"readOnly": *body.ReadOnly})
+	})
+
+	// inspect the cache entry of a uri, which is the request uri after the rewrite, e.g. /youtube/v3/search?part=snippet
+	adminRouter.GET("/cache/entry", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		if !cacheConf.IsEnabled {
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: "cache is disabled", Code: api.CodeCacheDisabled})
+			return
+		}
+
+		uri := c.Query("uri")
+		if uri == "" {
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: "uri is required", Code: api.CodeInvalidParameter})
+			return
+		}
+
+		entry, err := inspectCacheEntry(c.Request.Context(), cacheProvider, cache.NewKeyBuilder(appName, cacheConf), uri)
+		if err == redis.Nil {
+			middleware.RespondError(c, http.StatusNotFound, api.ErrorResp{Error: fmt.Sprintf("cache of %s is not found", uri), Code: api.CodeCacheEntryNotFound})
+			return
+		} else if err != nil {
+			err = errors.Wrapf(err, "inspecting cache of %s encountered error", uri)
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: err.Error(), Code: api.CodeInternal})
+			return
+		}
+		c.JSON(http.StatusOK, entry)
+	})
+
+	transforms, err := newPipelines(cfg, relayService, whitelist)
+	if err != nil {
+		return err
+	}
+
 	ytRouter := r.Group("/youtube/v3")
 
+	if header, ok := cfg.QuotaUserHeader(); ok {
+		ytRouter.Use(middleware.QuotaUser(header))
+	}
+
+	// JSONP is applied before the cache so that the cache only stores the raw JSON
+	ytRouter.Use(middleware.JSONP())
+
+	// the default part is applied before the cache so that it's reflected in the cache key
+	if len(cfg.DefaultParts) > 0 {
+		ytRouter.Use(middleware.DefaultPart(cfg.DefaultParts))
+	}
+
+	// the default maxResults is applied before the cache so that it's reflected in the cache key
+	if len(cfg.DefaultMaxResults) > 0 {
+		ytRouter.Use(middleware.DefaultMaxResults(cfg.DefaultMaxResults))
+	}
+
+	// the parts are checked after the default part is applied, and before the cache so that the rejections aren't cached
+	if len(cfg.AllowedParts) > 0 {
+		ytRouter.Use(middleware.AllowedParts(cfg.AllowedParts))
+	}
+
+	// the limit is applied before the cache so that the rejections aren't cached
+	if len(cfg.Concurrency.MaxConcurrent) > 0 {
+		ytRouter.Use(middleware.Concurrency(cfg.Concurrency))
+	}
+
+	// the bypass is marked before the cache so that the bypassed responses are cached apart, and the refresh skips the cache
+	if cfg.AdminToken != "" {
+		ytRouter.Use(middleware.WhitelistBypass(cfg.AdminToken))
+	}
+
 	if cacheConf.IsEnabled {
-		ytRouter.Use(middleware.Cache(appName, cacheConf, cacheProvider))
+		// categories rarely change so they're cached for longer unless the ttl is overwritten
+		overwriteTTL := make(map[string]int, len(cacheConf.OverwriteTTL)+1)
+		overwriteTTL[videoCategoriesPath] = cacheConf.VideoCategoriesTTL
+		for api, ttl := range cacheConf.OverwriteTTL {
+			overwriteTTL[api] = ttl
+		}
+		cacheConf.OverwriteTTL = overwriteTTL
+
+		// only the cache middleware reads through l1, as the other users like the quota budget need the latest values
+		responseCache := cacheProvider
+		if cacheConf.L1MaxEntries > 0 {
+			responseCache = cache.NewTiered(cacheProvider, cacheConf.L1MaxEntries, time.Duration(cacheConf.L1MaxTTL)*time.Second)
+		}
+		ytRouter.Use(middleware.Cache(appName, cacheConf, responseCache, r))
+
+		// the misses are rejected after the cache serves the hits
+		ytRouter.Use(middleware.ReadOnly(readOnly))
+	}
+
+	// the cache policy and the quota costs of the apis for the clients, which has no secret
+	meta := metaConfig(cacheConf)
+	r.GET("/meta/config", func(c *gin.Context) {
+		c.JSON(http.StatusOK, meta)
+	})
+
+	// the budget is applied after the cache as the cache hits cost no quota
+	if budget != nil {
+		ytRouter.Use(middleware.QuotaBudget(budget))
 	}
 
 	// search videos. ChannelID is required
 	ytRouter.GET("/search", func(c *gin.Context) {
 
-		apiLogger := log.WithFields(log.Fields{
-			"path": c.FullPath(),
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
 		})
 
-		queries, err := parseQueries(c)
+		queries, err := parseQueries(c, cfg)
 		if err != nil {
 			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 
 		// Check the mandatory parameters
 		if queries.Part == "" {
 			apiLogger.Error(ErrorEmptyPart)
-			resp := api.ErrorResp{Error: ErrorEmptyPart}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 
-		// Check whitelist
-		if !whitelist.ValidateChannelID(queries.ChannelID) {
+		if queries.Language != "" {
+			apiLogger.Error(ErrorUnsupportedLanguage)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: ErrorUnsupportedLanguage, Code: api.CodeInvalidParameter})
+			return
+		}
+
+		if queries, err = checkSearchQueries(queries, cfg.SearchVideoOnly); err != nil {
+			apiLogger.Error(err)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		// Check whitelist unless the admin token bypasses it
+		if middleware.IsWhitelistBypassed(c) {
+			apiLogger.Infof("whitelist is bypassed for channelId(%s)", queries.ChannelID)
+		} else if !whitelist.ValidateChannelID(queries.ChannelID) {
 			err = fmt.Errorf("channelId(%s) is invalid", queries.ChannelID)
 			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			metrics.WhitelistRejections.WithLabelValues(metrics.WhitelistChannel).Inc()
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeChannelNotWhitelisted}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 
-		resp, err := relayService.Search(queries)
+		resp, err := relayService.Search(c.Request.Context(), queries)
 		if err != nil {
-			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusInternalServerError, resp)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, api.ErrorResp{Error: err.Error()})
+			respondRelayError(c, apiLogger, err)
+			return
+		}
+
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
 			return
 		}
-		saveOKCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, resp)
-		c.JSON(http.StatusOK, resp)
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
 	})
 
 	// list video by video id
 	// IDs of videos is required
 	ytRouter.GET("/videos", func(c *gin.Context) {
 
-		apiLogger := log.WithFields(log.Fields{
-			"path": c.FullPath(),
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
 		})
 
-		queries, err := parseQueries(c)
+		queries, err := parseQueries(c, cfg)
 		if err != nil {
 			apiLogger.Error(err)
-			c.AbortWithStatusJSON(http.StatusBadRequest, api.ErrorResp{Error: err.Error()})
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
 			return
 		}
 
 		// Check the mandatory parameters
 		if queries.Part == "" {
 			apiLogger.Error(ErrorEmptyPart)
-			resp := api.ErrorResp{Error: ErrorEmptyPart}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 		if queries.IDs == "" {
 			apiLogger.Error(ErrorEmptyID)
-			resp := api.ErrorResp{Error: ErrorEmptyID}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: ErrorEmptyID, Code: api.CodeEmptyID}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+		if err = checkIDCount("id", queries.IDs, cfg.MaxIDsPerRequest); err != nil {
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
 			return
 		}
 
-		resp, err := relayService.ListByVideoIDs(queries)
+		// the channels of the videos are validated by their snippets, which are trimmed if the request didn't ask for them
+		relayQueries := queries
+		if relayService.NeedsChannelValidation() && !middleware.IsWhitelistBypassed(c) {
+			var ctx context.Context
+			ctx, relayQueries = relay.RequirePart(c.Request.Context(), queries, "snippet")
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		resp, err := relayService.ListByVideoIDs(c.Request.Context(), relayQueries)
 		if err != nil {
-			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusInternalServerError, resp)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, resp)
+			respondRelayError(c, apiLogger, err)
 			return
 		}
 
-		// verify channel id for YouTube
-		_, isYouTube := relayService.(*relay.YouTubeServiceV3)
-		if isYouTube {
-			if err = validateYouTubeVideoListResponse(whitelist, resp); err != nil {
-				err = errors.Wrap(err, "some video's channel id is invalid")
+		// the channels are verified by the pipeline for the providers serving videos of any channel
+		if middleware.IsWhitelistBypassed(c) {
+			apiLogger.Infof("whitelist is bypassed for videos(%s)", queries.IDs)
+		}
+
+		if cfg.StrictVideoLookup {
+			if missingIDs, ok := missingVideoIDs(queries.IDs, resp); ok && len(missingIDs) == len(strings.Split(queries.IDs, ",")) {
+				err = fmt.Errorf("none of the videos(%s) is found", strings.Join(missingIDs, ","))
 				apiLogger.Error(err)
-				resp := api.ErrorResp{Error: err.Error()}
-				saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-				c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+				middleware.RespondError(c, http.StatusNotFound, api.ErrorResp{Error: err.Error(), Code: api.CodeVideoNotFound})
 				return
 			}
 		}
 
-		saveOKCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, resp)
-		c.JSON(http.StatusOK, resp)
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
+			return
+		}
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
 	})
 
 	// list video by playlistID
 	ytRouter.GET("/playlistItems", func(c *gin.Context) {
 
-		apiLogger := log.WithFields(log.Fields{
-			"path": c.FullPath(),
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		queries, err := parseQueries(c, cfg)
+		if err != nil {
+			apiLogger.Error(err)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		// Check the mandatory parameters
+		if queries.Part == "" {
+			apiLogger.Error(ErrorEmptyPart)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		if queries.Language != "" {
+			apiLogger.Error(ErrorUnsupportedLanguage)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: ErrorUnsupportedLanguage, Code: api.CodeInvalidParameter})
+			return
+		}
+
+		playlistIDs := strings.Split(queries.PlaylistID, ",")
+		if cfg.MaxPlaylistsPerRequest > 0 && len(playlistIDs) > cfg.MaxPlaylistsPerRequest {
+			err = fmt.Errorf("playlistId has %d playlists, which cannot be more than maxPlaylistsPerRequest(%d)", len(playlistIDs), cfg.MaxPlaylistsPerRequest)
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
+			return
+		}
+		if err = checkIDCount("playlistId", queries.PlaylistID, cfg.MaxIDsPerRequest); err != nil {
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
+			return
+		}
+		// the items keyed by the playlists have no list to wrap
+		if len(playlistIDs) > 1 && queries.Envelope && !queries.Merge {
+			err = errors.New("envelope of multiple playlists requires merge")
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
+			return
+		}
+		if queries.AutoPaginate {
+			if err = checkAutoPaginate(queries, playlistIDs, cfg.AutoPaginateMaxPages); err != nil {
+				apiLogger.Error(err)
+				middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
+				return
+			}
+		}
+
+		// Check whitelist unless the admin token bypasses it. The sources are in the order of the IDs.
+		if middleware.IsWhitelistBypassed(c) {
+			apiLogger.Infof("whitelist is bypassed for playlistId(%s)", queries.PlaylistID)
+		} else {
+			sources := make([]string, 0, len(playlistIDs))
+			for _, playlistID := range playlistIDs {
+				isValid, source := whitelist.ValidatePlaylistIDs(playlistID)
+				if !isValid {
+					err = fmt.Errorf("playlistId(%s) is invalid", playlistID)
+					apiLogger.Error(err)
+					metrics.WhitelistRejections.WithLabelValues(metrics.WhitelistPlaylist).Inc()
+					resp := api.ErrorResp{Error: err.Error(), Code: api.CodePlaylistNotWhitelisted}
+					middleware.RespondError(c, http.StatusBadRequest, resp)
+					return
+				}
+				sources = append(sources, string(source))
+			}
+			if cfg.DebugHeaders {
+				c.Header(HeaderWhitelistSource, strings.Join(sources, ","))
+			}
+		}
+
+		resp, err := listPlaylistVideos(c.Request.Context(), relayService, queries)
+		if err != nil {
+			respondRelayError(c, apiLogger, err)
+			return
+		}
+
+		// the pages are streamed as they're fetched, and the cache skips them
+		if queries.AutoPaginate {
+			streamPlaylistItems(c, apiLogger, relayService, transforms, budget, queries, resp, cfg.AutoPaginateMaxPages)
+			return
+		}
+
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
+			return
+		}
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
+	})
+
+	// list playlists by playlist ids
+	// IDs of playlists is required and each of them has to be whitelisted
+	ytRouter.GET("/playlists", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
 		})
 
-		queries, err := parseQueries(c)
+		queries, err := parseQueries(c, cfg)
 		if err != nil {
 			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 
 		// Check the mandatory parameters
 		if queries.Part == "" {
 			apiLogger.Error(ErrorEmptyPart)
-			resp := api.ErrorResp{Error: ErrorEmptyPart}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+		if queries.IDs == "" {
+			apiLogger.Error(ErrorEmptyID)
+			resp := api.ErrorResp{Error: ErrorEmptyID, Code: api.CodeEmptyID}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+		if err = checkIDCount("id", queries.IDs, cfg.MaxIDsPerRequest); err != nil {
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
 			return
 		}
 
 		// Check whitelist
-		if !whitelist.ValidatePlaylistIDs(queries.PlaylistID) {
-			err = fmt.Errorf("playlistId(%s) is invalid", queries.PlaylistID)
+		playlistIDs := strings.Split(queries.IDs, ",")
+		sources := make([]string, 0, len(playlistIDs))
+		for _, playlistID := range playlistIDs {
+			isValid, source := whitelist.ValidatePlaylistIDs(playlistID)
+			if !isValid {
+				err = fmt.Errorf("playlistId(%s) is invalid", playlistID)
+				apiLogger.Error(err)
+				metrics.WhitelistRejections.WithLabelValues(metrics.WhitelistPlaylist).Inc()
+				resp := api.ErrorResp{Error: err.Error(), Code: api.CodePlaylistNotWhitelisted}
+				middleware.RespondError(c, http.StatusBadRequest, resp)
+				return
+			}
+			sources = append(sources, string(source))
+		}
+		// the sources are in the order of the IDs
+		if cfg.DebugHeaders {
+			c.Header(HeaderWhitelistSource, strings.Join(sources, ","))
+		}
+
+		resp, err := relayService.ListPlaylists(c.Request.Context(), queries)
+		if err != nil {
+			respondRelayError(c, apiLogger, err)
+			return
+		}
+
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
+			return
+		}
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
+	})
+
+	// list video categories. They're regional rather than channel specific, so they're not validated by the whitelist
+	ytRouter.GET("/videoCategories", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		queries, err := parseQueries(c, cfg)
+		if err != nil {
 			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusBadRequest, resp)
-			c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
 			return
 		}
 
-		resp, err := relayService.ListPlaylistVideos(queries)
+		// Check the mandatory parameters
+		if queries.Part == "" {
+			apiLogger.Error(ErrorEmptyPart)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		resp, err := relayService.ListVideoCategories(c.Request.Context(), queries)
+		if err != nil {
+			respondRelayError(c, apiLogger, err)
+			return
+		}
+
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
+			return
+		}
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
+	})
+
+	// list channel sections by channel id or section ids
+	// The channel has to be whitelisted, and so do the channels of the listed sections if they're listed by ids
+	ytRouter.GET("/channelSections", func(c *gin.Context) {
+
+		apiLogger := middleware.Logger(c).WithFields(log.Fields{
+			"path":     c.FullPath(),
+			"clientIP": c.ClientIP(),
+		})
+
+		queries, err := parseQueries(c, cfg)
 		if err != nil {
 			apiLogger.Error(err)
-			resp := api.ErrorResp{Error: err.Error()}
-			saveErrCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, http.StatusInternalServerError, resp)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, resp)
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		// Check the mandatory parameters
+		if queries.Part == "" {
+			apiLogger.Error(ErrorEmptyPart)
+			resp := api.ErrorResp{Error: ErrorEmptyPart, Code: api.CodeEmptyPart}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+		if queries.ChannelID == "" && queries.IDs == "" {
+			apiLogger.Error(ErrorEmptyChannelIDAndID)
+			resp := api.ErrorResp{Error: ErrorEmptyChannelIDAndID, Code: api.CodeEmptyID}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+		if err = checkIDCount("id", queries.IDs, cfg.MaxIDsPerRequest); err != nil {
+			apiLogger.Error(err)
+			middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeInvalidParameter})
+			return
+		}
+
+		// Check whitelist
+		if queries.ChannelID != "" && !whitelist.ValidateChannelID(queries.ChannelID) {
+			err = fmt.Errorf("channelId(%s) is invalid", queries.ChannelID)
+			apiLogger.Error(err)
+			metrics.WhitelistRejections.WithLabelValues(metrics.WhitelistChannel).Inc()
+			resp := api.ErrorResp{Error: err.Error(), Code: api.CodeChannelNotWhitelisted}
+			middleware.RespondError(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		// the channels of the sections listed by ids are validated by their snippets, which are trimmed if the request
+		// didn't ask for them
+		relayQueries := queries
+		if queries.ChannelID == "" && relayService.NeedsChannelValidation() && !middleware.IsWhitelistBypassed(c) {
+			var ctx context.Context
+			ctx, relayQueries = relay.RequirePart(c.Request.Context(), queries, "snippet")
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		resp, err := relayService.ListChannelSections(c.Request.Context(), relayQueries)
+		if err != nil {
+			respondRelayError(c, apiLogger, err)
 			return
 		}
 
-		saveOKCache(cacheConf.IsEnabled, cacheConf, cacheProvider, apiLogger, appName, *c.Request, resp)
-		c.JSON(http.StatusOK, resp)
+		resp, err = transforms.apply(c, queries, resp)
+		if err != nil {
+			respondTransformError(c, apiLogger, err)
+			return
+		}
+
+		respondJSON(c, cfg.MaxResponseBytes, resp)
 	})
 
 	return nil
 }
 
-func parseQueries(c *gin.Context) (ytrelay.Options, error) {
+// metaConfig describes the cache policy and the quota cost of each api with cacheConf, whose overwriteTtl has the
+// default ttl of videoCategories
+func metaConfig(cacheConf config.Cache) api.MetaConfigResp {
+	meta := api.MetaConfigResp{
+		CacheEnabled: cacheConf.IsEnabled,
+		APIs:         make(map[string]api.MetaAPIConfig, len(transformedPaths)),
+	}
+	if cacheConf.IsEnabled {
+		meta.StaleWhileRevalidate = cacheConf.StaleWhileRevalidate
+	}
+	for _, path := range transformedPaths {
+		isCached, ttl, errorTTL := middleware.CachePolicy(cacheConf, path)
+		meta.APIs[path] = api.MetaAPIConfig{
+			Cached:    isCached,
+			TTL:       int(ttl.Seconds()),
+			ErrorTTL:  int(errorTTL.Seconds()),
+			QuotaCost: relay.EstimateQuotaCost(path, url.Values{}),
+		}
+	}
+	return meta
+}
+
+// legacyPrefix is the prefix of the YouTube apis before /youtube/v3, which keeps the behaviors without a version
+const legacyPrefix = "/api/youtube/"
+
+// rewriteVersions rewrites the legacy prefix and the prefixes of versions to /youtube/v3/ and handles the request
+// again. The requests of a version are marked with it, and envelope is added to their queries if the version wraps the
+// responses so that the handlers and the cache key see it as an explicit request. With redirectLegacy, the legacy
+// prefix is redirected to /youtube/v3/ with 308 instead, which keeps the query and the method.
+func rewriteVersions(r *gin.Engine, versions map[string]config.APIVersion, redirectLegacy bool) gin.HandlerFunc {
+	const ytPrefix = "/youtube/v3/"
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, legacyPrefix) {
+			c.Request.URL.Path = ytPrefix + strings.TrimPrefix(path, legacyPrefix)
+			if redirectLegacy {
+				c.Request.URL.RawPath = ""
+				c.Redirect(http.StatusPermanentRedirect, c.Request.URL.RequestURI())
+				c.Abort()
+				return
+			}
+			r.HandleContext(c)
+			c.Abort()
+			return
+		}
+
+		for name, version := range versions {
+			prefix := "/" + name + ytPrefix
+			if !strings.HasPrefix(path, prefix) {
+				continue
+			}
+			c.Request = c.Request.WithContext(middleware.WithAPIVersion(c.Request.Context(), name, version))
+			c.Request.URL.Path = ytPrefix + strings.TrimPrefix(path, prefix)
+			if query := c.Request.URL.Query(); version.Envelope && query.Get("envelope") == "" {
+				query.Set("envelope", "true")
+				c.Request.URL.RawQuery = query.Encode()
+			}
+			r.HandleContext(c)
+			c.Abort()
+			return
+		}
+	}
+}
+
+// inspectCacheEntry decodes the cache entry of uri. It returns redis.Nil if there's no entry.
+func inspectCacheEntry(ctx context.Context, cacheProvider cache.Rediser, keyBuilder cache.KeyBuilder, uri string) (entry api.CacheEntryResp, err error) {
+	key, err := keyBuilder.Key(uri)
+	if err != nil {
+		return entry, err
+	}
+	stored, err := cacheProvider.Get(ctx, key).Result()
+	if err != nil {
+		return entry, err
+	}
+	// redis responds -2 if the key is gone and -1 if it never expires
+	ttl, err := cacheProvider.TTL(ctx, key).Result()
+	if err != nil {
+		return entry, err
+	} else if ttl == -2 {
+		return entry, redis.Nil
+	}
+
+	var cached cache.HTTP
+	if err = cache.Unmarshal([]byte(stored), &cached); err != nil {
+		return entry, err
+	}
+
+	entry = api.CacheEntryResp{
+		Key:        key,
+		StatusCode: cached.StatusCode,
+		TTL:        int64(ttl.Seconds()),
+		Body:       string(cached.Response),
+	}
+	if ttl < 0 {
+		entry.TTL = -1
+	}
+	if json.Valid(cached.Response) {
+		entry.Body = json.RawMessage(cached.Response)
+	}
+	if cached.StoredAt != 0 {
+		storedAt := time.Unix(cached.StoredAt, 0).UTC()
+		entry.StoredAt = &storedAt
+	}
+	if cached.FreshUntil != 0 {
+		freshUntil := time.Unix(cached.FreshUntil, 0).UTC()
+		entry.FreshUntil = &freshUntil
+	}
+	return entry, nil
+}
+
+// listPlaylistVideos lists the items of the playlists of queries, and adds the durations of their videos if
+// includeDurations is requested
+func listPlaylistVideos(ctx context.Context, relayService ytrelay.VideoRelay, queries ytrelay.Options) (interface{}, error) {
+	resp, err := relayService.ListPlaylistVideos(ctx, queries)
+	if err != nil || !queries.IncludeDurations {
+		return resp, err
+	}
+	return relay.AddDurations(ctx, relayService, resp)
+}
+
+// respondJSON responds with resp, or 502 if it's larger than maxResponseBytes, which is unlimited if it's not positive
+func respondJSON(c *gin.Context, maxResponseBytes int, resp interface{}) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "marshaling response encountered error")
+		middleware.Logger(c).Error(err)
+		middleware.RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: err.Error(), Code: api.CodeInternal})
+		return
+	}
+
+	if maxResponseBytes > 0 && len(body) > maxResponseBytes {
+		err = errors.Errorf("response size(%d bytes) exceeds the limit(%d bytes)", len(body), maxResponseBytes)
+		middleware.Logger(c).WithFields(log.Fields{"uri": c.Request.URL.String()}).Error(err)
+		middleware.RespondError(c, http.StatusBadGateway, api.ErrorResp{Error: err.Error(), Code: api.CodeResponseTooLarge})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+func parseQueries(c *gin.Context, cfg config.Conf) (ytrelay.Options, error) {
 	var queries ytrelay.Options
 	err := c.BindQuery(&queries)
+	if err != nil {
+		return queries, err
+	}
+
+	// the IDs are checked before they reach YouTube and the cache keys. Only the IDs of the channel sections have dots.
+	idRegex, idChars := idListRegex, "letters, digits, _, -, and commas"
+	if c.FullPath() == channelSectionsPath {
+		idRegex, idChars = sectionIDListRegex, "letters, digits, _, -, ., and commas"
+	}
+	if queries.IDs != "" && !idRegex.MatchString(queries.IDs) {
+		return queries, errors.Errorf("id(%q) can only contain %s", queries.IDs, idChars)
+	}
+	for _, id := range []struct{ name, value string }{
+		{"channelId", queries.ChannelID},
+		{"playlistId", queries.PlaylistID},
+	} {
+		if id.value != "" && !idListRegex.MatchString(id.value) {
+			return queries, errors.Errorf("%s(%q) can only contain letters, digits, _, -, and commas", id.name, id.value)
+		}
+	}
+
+	if queries.Language != "" && !languageRegex.MatchString(queries.Language) {
+		return queries, errors.Errorf("hl(%s) has to be a BCP-47 language tag, e.g. zh-TW", queries.Language)
+	}
+
+	if _, isPresenting := c.GetQuery("maxResults"); isPresenting {
+		queries.MaxResults, err = checkMaxResults(queries.MaxResults, cfg.ClampMaxResults)
+	}
 
 	return queries, err
 }
 
+// pipelines are the response transforms of the api paths
+type pipelines map[string]relay.Pipeline
+
+// newPipelines builds the pipeline of each api path. The videos and the channel sections are validated against the
+// channel whitelist first if the relay service needs it, the parts added for the validation are trimmed, and then
+// the transforms in cfg.ResponseTransforms, or all the built-in ones if the path isn't configured, are applied.
+func newPipelines(cfg config.Conf, relayService ytrelay.VideoRelay, whitelist ytrelay.APIWhitelist) (pipelines, error) {
+	// viper lowercases the keys of maps in the config file, so the paths are matched case-insensitively
+	configured := make(map[string]string, len(cfg.ResponseTransforms))
+	for path, names := range cfg.ResponseTransforms {
+		configured[strings.ToLower(path)] = names
+	}
+
+	p := make(pipelines, len(transformedPaths))
+	for _, path := range transformedPaths {
+		var pipeline relay.Pipeline
+		if (path == videosPath || path == channelSectionsPath) && relayService.NeedsChannelValidation() {
+			pipeline = append(pipeline, channelWhitelistTransform(whitelist))
+		}
+		// the parts added by relay.RequirePart never reach the clients or the cache
+		pipeline = append(pipeline, relay.TrimPartsTransform)
+
+		names := relay.DefaultTransforms
+		if s, ok := configured[strings.ToLower(path)]; ok {
+			names = parseTransformNames(s)
+		}
+		for _, name := range names {
+			transform, err := relay.NewTransform(name, cfg.ThumbnailProxyBase)
+			if err != nil {
+				return nil, errors.Wrapf(err, "building response transforms of %s encountered error", path)
+			}
+			pipeline = append(pipeline, transform)
+		}
+		p[strings.ToLower(path)] = pipeline
+	}
+	return p, nil
+}
+
+func parseTransformNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// apply runs the pipeline of the path of c on resp
+func (p pipelines) apply(c *gin.Context, queries ytrelay.Options, resp interface{}) (interface{}, error) {
+	return p[strings.ToLower(c.FullPath())].Apply(c.Request.Context(), queries, resp)
+}
+
+// whitelistError rejects the response of a channel out of the whitelist
+type whitelistError struct {
+	error
+}
+
+// channelWhitelistTransform rejects the videos and the channel sections of the channels out of the whitelist unless
+// the admin token bypasses it. The sections of a requested channelId are left as the channel has been validated.
+func channelWhitelistTransform(whitelist ytrelay.APIWhitelist) relay.ResponseTransform {
+	return relay.TransformFunc(func(ctx context.Context, options ytrelay.Options, resp interface{}) (interface{}, error) {
+		if middleware.IsWhitelistBypassedContext(ctx) {
+			return resp, nil
+		}
+		switch resp.(type) {
+		case *youtube.VideoListResponse:
+			if err := validateYouTubeVideoListResponse(whitelist, resp); err != nil {
+				return nil, &whitelistError{errors.Wrap(err, "some video's channel id is invalid")}
+			}
+		case *youtube.ChannelSectionListResponse:
+			if options.ChannelID != "" {
+				break
+			}
+			if err := validateYouTubeChannelSectionListResponse(whitelist, resp); err != nil {
+				return nil, &whitelistError{errors.Wrap(err, "some channel section's channel id is invalid")}
+			}
+		}
+		return resp, nil
+	})
+}
+
+// respondTransformError responds 400 to the responses rejected by the whitelist and 500 to the other errors of the
+// response transforms
+func respondTransformError(c *gin.Context, apiLogger *log.Entry, err error) {
+	apiLogger.Error(err)
+	if _, ok := errors.Cause(err).(*whitelistError); ok {
+		metrics.WhitelistRejections.WithLabelValues(metrics.WhitelistChannel).Inc()
+		middleware.RespondError(c, http.StatusBadRequest, api.ErrorResp{Error: err.Error(), Code: api.CodeChannelNotWhitelisted})
+		return
+	}
+	middleware.RespondError(c, http.StatusInternalServerError, api.ErrorResp{Error: err.Error(), Code: api.CodeInternal})
+}
+
+// checkSearchQueries rejects the order and the types YouTube doesn't recognize, and the publish time range which isn't
+// RFC3339 or is inverted. If videoOnly is set, type can only be video, which is also the default. embeddableOnly only
+// lists videos, so it rejects the other types rather than replacing them.
+func checkSearchQueries(queries ytrelay.Options, videoOnly bool) (ytrelay.Options, error) {
+	if queries.Order != "" && !contains(searchOrders, queries.Order) {
+		return queries, errors.Errorf("order(%s) has to be one of %s", queries.Order, strings.Join(searchOrders, ", "))
+	}
+	if queries.EmbeddableOnly && queries.Type != "" && queries.Type != "video" {
+		return queries, errors.Errorf("type(%s) cannot be used with embeddableOnly, which only lists videos", queries.Type)
+	}
+	if err := checkPublishedRange(queries.PublishedAfter, queries.PublishedBefore); err != nil {
+		return queries, err
+	}
+
+	if videoOnly {
+		if queries.Type != "" && queries.Type != "video" {
+			return queries, errors.Errorf("type(%s) can only be video", queries.Type)
+		}
+		queries.Type = "video"
+		return queries, nil
+	}
+	if queries.Type != "" {
+		for _, searchType := range strings.Split(queries.Type, ",") {
+			if !contains(searchTypes, searchType) {
+				return queries, errors.Errorf("type(%s) has to be one or more of %s", queries.Type, strings.Join(searchTypes, ", "))
+			}
+		}
+	}
+	return queries, nil
+}
+
+// checkIDCount rejects more than maxIDs comma-separated ids in the param, unless maxIDs is 0
+func checkIDCount(param, ids string, maxIDs int) error {
+	if maxIDs <= 0 || ids == "" {
+		return nil
+	}
+	if count := strings.Count(ids, ",") + 1; count > maxIDs {
+		return errors.Errorf("%s has %d ids, which cannot be more than maxIdsPerRequest(%d)", param, count, maxIDs)
+	}
+	return nil
+}
+
+// checkPublishedRange rejects publishedAfter and publishedBefore which aren't RFC3339, or publishedAfter later than
+// publishedBefore
+func checkPublishedRange(publishedAfter, publishedBefore string) error {
+	var after, before time.Time
+	var err error
+	if publishedAfter != "" {
+		if after, err = time.Parse(time.RFC3339, publishedAfter); err != nil {
+			return errors.Errorf("publishedAfter(%s) has to be an RFC3339 time, e.g. 2006-01-02T15:04:05Z", publishedAfter)
+		}
+	}
+	if publishedBefore != "" {
+		if before, err = time.Parse(time.RFC3339, publishedBefore); err != nil {
+			return errors.Errorf("publishedBefore(%s) has to be an RFC3339 time, e.g. 2006-01-02T15:04:05Z", publishedBefore)
+		}
+	}
+	if publishedAfter != "" && publishedBefore != "" && after.After(before) {
+		return errors.Errorf("publishedAfter(%s) cannot be later than publishedBefore(%s)", publishedAfter, publishedBefore)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMaxResults rejects maxResults out of the range YouTube allows, or clamps it into the range if clamp is set
+func checkMaxResults(maxResults int64, clamp bool) (int64, error) {
+	if maxResults >= MinMaxResults && maxResults <= MaxMaxResults {
+		return maxResults, nil
+	}
+	if !clamp {
+		return maxResults, errors.Errorf("maxResults(%d) has to be between %d and %d", maxResults, MinMaxResults, MaxMaxResults)
+	}
+
+	clamped := int64(MinMaxResults)
+	if maxResults > MaxMaxResults {
+		clamped = MaxMaxResults
+	}
+	log.Warnf("maxResults(%d) is out of range and is clamped to %d", maxResults, clamped)
+	return clamped, nil
+}
+
+// missingVideoIDs lists the ids not in resp in the order requested, and reports false if resp isn't a
+// *youtube.VideoListResponse. The videos filtered out by embeddableOnly are missing as well.
+func missingVideoIDs(ids string, resp interface{}) (missingIDs []string, ok bool) {
+	videos, ok := resp.(*youtube.VideoListResponse)
+	if !ok {
+		return nil, false
+	}
+	found := make(map[string]bool, len(videos.Items))
+	for _, item := range videos.Items {
+		found[item.Id] = true
+	}
+	for _, id := range strings.Split(ids, ",") {
+		if !found[id] {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	return missingIDs, true
+}
+
+// validateYouTubeVideoListResponse validates the channels of the videos, which requires the snippet part
 func validateYouTubeVideoListResponse(whitelist ytrelay.APIWhitelist, resp interface{}) (err error) {
 	for _, item := range resp.(*youtube.VideoListResponse).Items {
+		if item.Snippet == nil {
+			return fmt.Errorf("part has to include snippet to validate the channel of video(%s)", item.Id)
+		}
+		if !whitelist.ValidateChannelID(item.Snippet.ChannelId) {
+			err = fmt.Errorf("channelId(%s) is invalid", item.Snippet.ChannelId)
+			return err
+		}
+	}
+	return nil
+}
+
+// validateYouTubeChannelSectionListResponse validates the channels of the sections, which requires the snippet part
+func validateYouTubeChannelSectionListResponse(whitelist ytrelay.APIWhitelist, resp interface{}) (err error) {
+	for _, item := range resp.(*youtube.ChannelSectionListResponse).Items {
+		if item.Snippet == nil {
+			return fmt.Errorf("part has to include snippet to validate the channel of section(%s)", item.Id)
+		}
 		if !whitelist.ValidateChannelID(item.Snippet.ChannelId) {
 			err = fmt.Errorf("channelId(%s) is invalid", item.Snippet.ChannelId)
 			return err
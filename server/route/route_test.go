@@ -0,0 +1,381 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/api"
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/relay"
+	"github.com/mirror-media/yt-relay/whitelist"
+	"google.golang.org/api/youtube/v3"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestConf is the minimal valid config of the routes
+func newTestConf() config.Conf {
+	return config.Conf{
+		AppName:     "yt-relay-test",
+		AdminToken:  "admin-token",
+		ApiKey:      "api-key",
+		ErrorFormat: config.ErrorFormatLegacy,
+	}
+}
+
+// newTestWhitelist accepts channel1, playlist1, and playlist2 without calling the CMS
+func newTestWhitelist() ytrelay.APIWhitelist {
+	return whitelist.New(config.Whitelists{
+		ChannelIDs:        map[string]bool{"channel1": true},
+		PlaylistIDs:       map[string]bool{"playlist1": true, "playlist2": true},
+		DisableCMSRefresh: true,
+	}, nil, config.CMS{})
+}
+
+func newTestEngine(t *testing.T, cfg config.Conf, relayService ytrelay.VideoRelay, cacheProvider cache.Rediser) *gin.Engine {
+	t.Helper()
+	r := gin.New()
+	if err := Set(r, cfg, relayService, newTestWhitelist(), cacheProvider); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func serve(r http.Handler, uri string) *httptest.ResponseRecorder {
+	return serveWithHeader(r, uri, nil)
+}
+
+func serveWithHeader(r http.Handler, uri string, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, uri, nil)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	r.ServeHTTP(w, request)
+	return w
+}
+
+// videosRelay responds to ListByVideoIDs with the parts asked for, and records the parts of the calls
+type videosRelay struct {
+	*relay.FakeRelay
+	channelID string
+
+	mu    sync.Mutex
+	parts []string
+}
+
+func (v *videosRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	v.mu.Lock()
+	v.parts = append(v.parts, options.Part)
+	v.mu.Unlock()
+
+	video := &youtube.Video{Id: "video1"}
+	for _, part := range strings.Split(options.Part, ",") {
+		switch strings.TrimSpace(part) {
+		case "snippet":
+			video.Snippet = &youtube.VideoSnippet{ChannelId: v.channelID, Title: "title"}
+		case "contentDetails":
+			video.ContentDetails = &youtube.VideoContentDetails{Duration: "PT1M"}
+		}
+	}
+	return &youtube.VideoListResponse{Kind: "youtube#videoListResponse", Items: []*youtube.Video{video}}, nil
+}
+
+func TestVideosChannelValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		channelID    string
+		part         string
+		wantStatus   int
+		wantPart     string
+		wantSnippet  bool
+		wantDuration bool
+	}{
+		{name: "snippet is required upstream and trimmed", channelID: "channel1", part: "contentDetails", wantStatus: http.StatusOK, wantPart: "contentDetails,snippet", wantDuration: true},
+		{name: "requested snippet is kept", channelID: "channel1", part: "snippet,contentDetails", wantStatus: http.StatusOK, wantPart: "snippet,contentDetails", wantSnippet: true, wantDuration: true},
+		{name: "channel out of whitelist is rejected without snippet", channelID: "channel2", part: "contentDetails", wantStatus: http.StatusBadRequest, wantPart: "contentDetails,snippet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := relay.NewFake("")
+			fake.ChannelValidation = true
+			relayService := &videosRelay{FakeRelay: fake, channelID: tt.channelID}
+			r := newTestEngine(t, newTestConf(), relayService, nil)
+
+			w := serve(r, "/youtube/v3/videos?id=video1&part="+tt.part)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if len(relayService.parts) != 1 || relayService.parts[0] != tt.wantPart {
+				t.Errorf("upstream parts = %v, want [%s]", relayService.parts, tt.wantPart)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Items []map[string]json.RawMessage `json:"items"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Items) != 1 {
+				t.Fatalf("items = %s, want a video", w.Body.String())
+			}
+			if _, ok := resp.Items[0]["snippet"]; ok != tt.wantSnippet {
+				t.Errorf("has snippet = %v, want %v: %s", ok, tt.wantSnippet, w.Body.String())
+			}
+			if _, ok := resp.Items[0]["contentDetails"]; ok != tt.wantDuration {
+				t.Errorf("has contentDetails = %v, want %v: %s", ok, tt.wantDuration, w.Body.String())
+			}
+		})
+	}
+}
+
+// missingVideosRelay responds to ListByVideoIDs with video1 only if it's asked for
+type missingVideosRelay struct {
+	videosRelay
+}
+
+func (m *missingVideosRelay) ListByVideoIDs(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	resp, err := m.videosRelay.ListByVideoIDs(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range strings.Split(options.IDs, ",") {
+		if id == "video1" {
+			return resp, nil
+		}
+	}
+	return &youtube.VideoListResponse{Kind: "youtube#videoListResponse"}, nil
+}
+
+func TestStrictVideoLookup(t *testing.T) {
+	tests := []struct {
+		name              string
+		strictVideoLookup bool
+		ids               string
+		wantStatus        int
+		wantItems         int
+		wantError         string
+	}{
+		{name: "all found are responded", strictVideoLookup: true, ids: "video1", wantStatus: http.StatusOK, wantItems: 1},
+		{name: "some missing are responded as found", strictVideoLookup: true, ids: "video1,video2", wantStatus: http.StatusOK, wantItems: 1},
+		{name: "all missing are not found", strictVideoLookup: true, ids: "video3,video2", wantStatus: http.StatusNotFound, wantError: "none of the videos(video3,video2) is found"},
+		{name: "all missing are an empty list without strictVideoLookup", ids: "video3,video2", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := relay.NewFake("")
+			fake.ChannelValidation = true
+			cfg := newTestConf()
+			cfg.StrictVideoLookup = tt.strictVideoLookup
+			r := newTestEngine(t, cfg, &missingVideosRelay{videosRelay{FakeRelay: fake, channelID: "channel1"}}, nil)
+
+			w := serve(r, "/youtube/v3/videos?part=snippet&id="+tt.ids)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				var resp api.ErrorResp
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code != api.CodeVideoNotFound || resp.Error != tt.wantError {
+					t.Errorf("error = %s(%s), want %s(%s)", resp.Error, resp.Code, tt.wantError, api.CodeVideoNotFound)
+				}
+				return
+			}
+			var resp struct {
+				Items []json.RawMessage `json:"items"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Items) != tt.wantItems {
+				t.Errorf("items = %s, want %d of them", w.Body.String(), tt.wantItems)
+			}
+		})
+	}
+}
+
+// sectionsRelay responds to ListChannelSections with the parts asked for, and records the parts of the calls
+type sectionsRelay struct {
+	*relay.FakeRelay
+	channelID string
+	parts     []string
+}
+
+func (s *sectionsRelay) ListChannelSections(ctx context.Context, options ytrelay.Options) (interface{}, error) {
+	s.parts = append(s.parts, options.Part)
+
+	section := &youtube.ChannelSection{Id: s.channelID + ".section1"}
+	for _, part := range strings.Split(options.Part, ",") {
+		switch strings.TrimSpace(part) {
+		case "snippet":
+			section.Snippet = &youtube.ChannelSectionSnippet{ChannelId: s.channelID, Type: "singlePlaylist"}
+		case "contentDetails":
+			section.ContentDetails = &youtube.ChannelSectionContentDetails{Playlists: []string{"playlist1"}}
+		}
+	}
+	return &youtube.ChannelSectionListResponse{Kind: "youtube#channelSectionListResponse", Items: []*youtube.ChannelSection{section}}, nil
+}
+
+func TestChannelSectionsChannelValidation(t *testing.T) {
+	tests := []struct {
+		name          string
+		channelID     string
+		query         string
+		wantStatus    int
+		wantPart      string
+		wantSnippet   bool
+		wantPlaylists bool
+	}{
+		{name: "snippet is required upstream and trimmed", channelID: "channel1", query: "part=contentDetails&id=channel1.section1", wantStatus: http.StatusOK, wantPart: "contentDetails,snippet", wantPlaylists: true},
+		{name: "requested snippet is kept", channelID: "channel1", query: "part=snippet,contentDetails&id=channel1.section1", wantStatus: http.StatusOK, wantPart: "snippet,contentDetails", wantSnippet: true, wantPlaylists: true},
+		{name: "channel out of whitelist is rejected without snippet", channelID: "channel2", query: "part=contentDetails&id=channel2.section1", wantStatus: http.StatusBadRequest, wantPart: "contentDetails,snippet"},
+		{name: "sections of a validated channelId don't require snippet", channelID: "channel1", query: "part=contentDetails&channelId=channel1", wantStatus: http.StatusOK, wantPart: "contentDetails", wantPlaylists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := relay.NewFake("")
+			fake.ChannelValidation = true
+			relayService := &sectionsRelay{FakeRelay: fake, channelID: tt.channelID}
+			r := newTestEngine(t, newTestConf(), relayService, nil)
+
+			w := serve(r, "/youtube/v3/channelSections?"+tt.query)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if len(relayService.parts) != 1 || relayService.parts[0] != tt.wantPart {
+				t.Errorf("upstream parts = %v, want [%s]", relayService.parts, tt.wantPart)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Items []map[string]json.RawMessage `json:"items"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Items) != 1 {
+				t.Fatalf("items = %s, want a section", w.Body.String())
+			}
+			if _, ok := resp.Items[0]["snippet"]; ok != tt.wantSnippet {
+				t.Errorf("has snippet = %v, want %v: %s", ok, tt.wantSnippet, w.Body.String())
+			}
+			if _, ok := resp.Items[0]["contentDetails"]; ok != tt.wantPlaylists {
+				t.Errorf("has contentDetails = %v, want %v: %s", ok, tt.wantPlaylists, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWhitelistBypass(t *testing.T) {
+	uris := []string{
+		"/youtube/v3/search?part=snippet&channelId=channel2",
+		"/youtube/v3/videos?part=snippet&id=video1",
+		"/youtube/v3/playlistItems?part=snippet&playlistId=playlist9",
+	}
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "public request keeps the whitelist", adminToken: "admin-token", wantStatus: http.StatusBadRequest},
+		{name: "invalid token keeps the whitelist", adminToken: "admin-token", authorization: "Bearer wrong-token", wantStatus: http.StatusBadRequest},
+		{name: "token of another scheme keeps the whitelist", adminToken: "admin-token", authorization: "Basic admin-token", wantStatus: http.StatusBadRequest},
+		{name: "any token keeps the whitelist without adminToken", authorization: "Bearer ", wantStatus: http.StatusBadRequest},
+		{name: "valid token bypasses the whitelist", adminToken: "admin-token", authorization: "Bearer admin-token", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newEmptyFake(t)
+			fake.ChannelValidation = true
+			cfg := newTestConf()
+			cfg.AdminToken = tt.adminToken
+			r := newTestEngine(t, cfg, &videosRelay{FakeRelay: fake, channelID: "channel2"}, nil)
+
+			for _, uri := range uris {
+				w := serveWithHeader(r, uri, http.Header{"Authorization": {tt.authorization}})
+				if w.Code != tt.wantStatus {
+					t.Errorf("status of %s = %d, want %d: %s", uri, w.Code, tt.wantStatus, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBypassedResponseIsCachedApart(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Cache = newTestCacheConf()
+	fake := newEmptyFake(t)
+	fake.ChannelValidation = true
+	r := newTestEngine(t, cfg, &videosRelay{FakeRelay: fake, channelID: "channel2"}, cache.NewMemory(100, time.Minute))
+
+	const uri = "/youtube/v3/videos?part=snippet&id=video1"
+	admin := http.Header{"Authorization": {"Bearer admin-token"}}
+	for i, request := range []struct {
+		header     http.Header
+		wantStatus int
+		wantXCache string
+	}{
+		{header: admin, wantStatus: http.StatusOK, wantXCache: "MISS"},
+		{header: nil, wantStatus: http.StatusBadRequest, wantXCache: "MISS"},
+		{header: admin, wantStatus: http.StatusOK, wantXCache: "HIT"},
+	} {
+		w := serveWithHeader(r, uri, request.header)
+		if got := w.Header().Get(middleware.XCacheHeader); w.Code != request.wantStatus || got != request.wantXCache {
+			t.Errorf("response %d = %d %s, want %d %s", i, w.Code, got, request.wantStatus, request.wantXCache)
+		}
+	}
+}
+
+func TestLegacyPathMode(t *testing.T) {
+	tests := []struct {
+		name           string
+		legacyPathMode string
+		uri            string
+		wantStatus     int
+		wantLocation   string
+		wantUpstream   bool
+	}{
+		{name: "legacy path is rewritten", legacyPathMode: config.LegacyPathRewrite, uri: "/api/youtube/videos?id=video1&part=snippet", wantStatus: http.StatusOK, wantUpstream: true},
+		{name: "legacy path is redirected with the query", legacyPathMode: config.LegacyPathRedirect, uri: "/api/youtube/videos?id=video1&part=snippet", wantStatus: http.StatusPermanentRedirect, wantLocation: "/youtube/v3/videos?id=video1&part=snippet"},
+		{name: "current path isn't redirected", legacyPathMode: config.LegacyPathRedirect, uri: "/youtube/v3/videos?id=video1&part=snippet", wantStatus: http.StatusOK, wantUpstream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConf()
+			cfg.LegacyPathMode = tt.legacyPathMode
+			relayService := &videosRelay{FakeRelay: relay.NewFake(""), channelID: "channel1"}
+			r := newTestEngine(t, cfg, relayService, nil)
+
+			w := serve(r, tt.uri)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %s, want %s", got, tt.wantLocation)
+			}
+			if isCalled := len(relayService.parts) > 0; isCalled != tt.wantUpstream {
+				t.Errorf("upstream is called = %v, want %v", isCalled, tt.wantUpstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/yt-relay/cache"
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/middleware"
+	"github.com/mirror-media/yt-relay/relay"
+)
+
+func TestVersionedStaleCacheIsRevalidatedUnderItsKey(t *testing.T) {
+	cfg := newTestConf()
+	cfg.Versions = map[string]config.APIVersion{"v2": {Envelope: true}}
+	cfg.Cache = config.Cache{
+		IsEnabled:            true,
+		TTL:                  60,
+		ErrorTTL:             10,
+		VideoCategoriesTTL:   60,
+		StaleWhileRevalidate: 60,
+		Serializer:           config.SerializeJSON,
+	}
+	cacheProvider := cache.NewMemory(100, time.Minute)
+	relayService := &videosRelay{FakeRelay: relay.NewFake(""), channelID: "channel1"}
+	r := newTestEngine(t, cfg, relayService, cacheProvider)
+
+	keyBuilder := cache.NewKeyBuilder(cfg.AppName, cfg.Cache)
+	versionedKey, err := keyBuilder.Key("v2:/youtube/v3/videos?envelope=true&id=video1&part=snippet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unversionedKey, err := keyBuilder.Key("/youtube/v3/videos?envelope=true&id=video1&part=snippet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializer := cache.NewSerializer(cfg.Cache.Serializer)
+	load := func(key string) (cache.HTTP, bool) {
+		stored, err := cacheProvider.Get(context.Background(), key).Result()
+		if err != nil {
+			return cache.HTTP{}, false
+		}
+		var entry cache.HTTP
+		if err = serializer.Unmarshal([]byte(stored), &entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry, true
+	}
+
+	uri := "/v2/youtube/v3/videos?id=video1&part=snippet"
+	if w := serve(r, uri); w.Code != http.StatusOK || w.Header().Get(middleware.XCacheHeader) != "MISS" {
+		t.Fatalf("first response = %d %s, want 200 MISS", w.Code, w.Header().Get(middleware.XCacheHeader))
+	}
+	entry, ok := load(versionedKey)
+	if !ok {
+		t.Fatal("response isn't cached under the versioned key")
+	}
+
+	// turn the entry stale
+	now := time.Now()
+	entry.FreshUntil = now.Add(-time.Second).Unix()
+	entry.ExpireAt = now.Add(time.Minute).Unix()
+	stored, err := serializer.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheProvider.Set(context.Background(), versionedKey, string(stored), time.Minute)
+
+	if w := serve(r, uri); w.Header().Get(middleware.XCacheHeader) != "STALE" {
+		t.Fatalf("second response is %s, want STALE", w.Header().Get(middleware.XCacheHeader))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if entry, ok = load(versionedKey); ok && !entry.IsStale(time.Now()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the versioned entry isn't revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok = load(unversionedKey); ok {
+		t.Error("the revalidation is cached under the unversioned key")
+	}
+}
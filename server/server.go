@@ -1,7 +1,15 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	ytrelay "github.com/mirror-media/yt-relay"
 	"github.com/mirror-media/yt-relay/cache"
@@ -19,18 +27,138 @@ type Server struct {
 	Engine       *gin.Engine
 }
 
-func init() {
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetReportCaller(true)
+// setLogger applies the log config to the standard logger of logrus
+func setLogger(c config.Log) {
+	switch c.Format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.SetFormatter(&log.JSONFormatter{})
+		log.Warnf("log format(%s) is invalid and falls back to json", c.Format)
+	}
+
+	log.SetReportCaller(c.ReportCaller)
+
+	switch c.Level {
+	case "debug", "info", "warn", "error":
+		level, _ := log.ParseLevel(c.Level)
+		log.SetLevel(level)
+	default:
+		log.SetLevel(log.InfoLevel)
+		log.Warnf("log level(%s) is invalid and falls back to info", c.Level)
+	}
 }
 
+// Run serves on the tcp address and port, or on the unix socket if the address is unix:/path/to/socket, until SIGINT
+// or SIGTERM. It serves HTTPS with HTTP/2 instead if TLS is enabled.
 func (s *Server) Run() error {
-	return s.Engine.Run(fmt.Sprintf("%s:%d", s.conf.Address, s.conf.Port))
+	socketPath, isUnixSocket := s.conf.UnixSocketPath()
+	if isUnixSocket {
+		return s.runUnixSocket(socketPath)
+	}
+
+	address := fmt.Sprintf("%s:%d", s.conf.Address, s.conf.Port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	return s.serve(listener, address)
+}
+
+// runUnixSocket serves on the unix socket, and then the socket file is removed
+func (s *Server) runUnixSocket(socketPath string) error {
+	mode, err := s.conf.UnixSocketMode()
+	if err != nil {
+		return err
+	}
+
+	// a socket file left by a crashed process would fail the listen
+	if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the stale unix socket(%s): %v", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on unix socket(%s): %v", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+
+	if err = os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to chmod unix socket(%s) to %s: %v", socketPath, mode, err)
+	}
+
+	return s.serve(listener, "unix socket "+socketPath)
+}
+
+// serve serves on listener until SIGINT or SIGTERM, and then waits for the in-flight requests
+func (s *Server) serve(listener net.Listener, name string) error {
+	httpServer := &http.Server{Handler: s.Engine}
+
+	tlsConf := s.conf.TLS
+	if tlsConf.IsEnabled() {
+		reloader, err := newCertReloader(tlsConf.CertFile, tlsConf.KeyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer reloader.reloadOnSIGHUP()()
+		httpServer.TLSConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+
+	// the playlists added to the CMS are whitelisted even if no one requests them
+	if interval := s.conf.Whitelists.RefreshInterval; interval > 0 {
+		if api, ok := s.APIWhitelist.(*whitelist.YouTubeAPI); ok {
+			defer api.RefreshEvery(time.Duration(interval) * time.Second)()
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := <-signals
+		log.Infof("shutting down the server on %s by %s", name, sig)
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			log.Errorf("shutting down the server encountered error: %v", err)
+		}
+	}()
+
+	var err error
+	if httpServer.TLSConfig != nil {
+		log.Infof("listening and serving HTTPS on %s", name)
+		// the certificate is from GetCertificate rather than the files
+		err = httpServer.ServeTLS(listener, "", "")
+	} else {
+		log.Infof("listening and serving HTTP on %s", name)
+		err = httpServer.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	// wait for the in-flight requests
+	<-shutdownDone
+	return nil
 }
 
 func New(c config.Conf) (s *Server, err error) {
 
-	engine := gin.Default()
+	setLogger(c.Log)
+
+	// the panics are recovered by route.Set to respond api.ErrorResp
+	engine := gin.New()
+	engine.Use(gin.Logger())
+	// the client IP is the remote address unless it's one of the trusted proxies, which is used by the logs
+	if err = engine.SetTrustedProxies(c.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("failed to set trusted proxies: %v", err)
+	}
 
 	var redis cache.Rediser
 
@@ -39,6 +167,9 @@ func New(c config.Conf) (s *Server, err error) {
 		if err != nil {
 			return nil, err
 		}
+		if c.Tracing.IsEnabled {
+			redis = cache.NewTraced(redis)
+		}
 	}
 
 	var cache cache.Rediser
@@ -50,13 +181,10 @@ func New(c config.Conf) (s *Server, err error) {
 	}
 
 	s = &Server{
-		APIWhitelist: &whitelist.YouTubeAPI{
-			Whitelist: c.Whitelists,
-			CmsURL:    c.CmsURL,
-		},
-		Cache:  cache,
-		conf:   &c,
-		Engine: engine,
+		APIWhitelist: whitelist.New(c.Whitelists, c.CMSURLs(), c.CMS),
+		Cache:        cache,
+		conf:         &c,
+		Engine:       engine,
 	}
 	return s, nil
 }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate of commonName and its key into the files
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, r); name != "first" {
+		t.Errorf("certificate = %s, want first", name)
+	}
+
+	tests := []struct {
+		name    string
+		write   func()
+		wantErr bool
+		want    string
+	}{
+		{name: "rotated certificate is loaded", write: func() { writeCert(t, certFile, keyFile, "second") }, want: "second"},
+		{name: "invalid certificate keeps the current one", write: func() {
+			if err := ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: true, want: "second"},
+	}
+	for _, tt := range tests {
+		tt.write()
+		if err = r.reload(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: reload err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if name := commonName(t, r); name != tt.want {
+			t.Errorf("%s: certificate = %s, want %s", tt.name, name, tt.want)
+		}
+	}
+}
+
+func TestNewCertReloaderWithoutFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")); err == nil {
+		t.Error("reloader is created without the certificate")
+	}
+}
@@ -0,0 +1,49 @@
+// Package tracing sets up OpenTelemetry to export the traces via OTLP
+package tracing
+
+import (
+	"context"
+
+	"github.com/mirror-media/yt-relay/config"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the tracer used across yt-relay
+const InstrumentationName = "github.com/mirror-media/yt-relay"
+
+// Tracer returns the tracer of yt-relay. It's a no-op tracer until Init is called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Init registers the global tracer provider exporting to the OTLP endpoint and the W3C traceparent propagator.
+// The returned shutdown flushes the remaining spans.
+func Init(ctx context.Context, appName string, tracingConf config.Tracing) (shutdown func(context.Context) error, err error) {
+	var opts []otlpgrpc.Option
+	opts = append(opts, otlpgrpc.WithEndpoint(tracingConf.Endpoint))
+	if tracingConf.Insecure {
+		opts = append(opts, otlpgrpc.WithInsecure())
+	}
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating otlp exporter encountered error")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(appName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,65 @@
+package whitelist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is the playlist whitelist frozen in a file, e.g. while the CMS is being migrated
+type Snapshot struct {
+	FetchedAt   time.Time `json:"fetchedAt"`
+	PlaylistIDs []string  `json:"playlistIds"`
+}
+
+// WriteSnapshot writes the effective playlist IDs to path. The file is replaced at once so that a server reading it
+// never sees a partial one.
+func WriteSnapshot(path string, playlistIDs map[string]bool, fetchedAt time.Time) error {
+	snapshot := Snapshot{FetchedAt: fetchedAt, PlaylistIDs: make([]string, 0, len(playlistIDs))}
+	for id, effective := range playlistIDs {
+		if effective {
+			snapshot.PlaylistIDs = append(snapshot.PlaylistIDs, id)
+		}
+	}
+	sort.Strings(snapshot.PlaylistIDs)
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling whitelist snapshot encountered error")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "creating whitelist snapshot encountered error")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing whitelist snapshot encountered error")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing whitelist snapshot encountered error")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "replacing whitelist snapshot encountered error")
+}
+
+// ReadSnapshot reads the playlist IDs written by WriteSnapshot
+func ReadSnapshot(path string) (playlistIDs map[string]bool, fetchedAt time.Time, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "reading whitelist snapshot encountered error")
+	}
+	var snapshot Snapshot
+	if err = json.Unmarshal(b, &snapshot); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "whitelist snapshot(%s) is invalid", path)
+	}
+	playlistIDs = make(map[string]bool, len(snapshot.PlaylistIDs))
+	for _, id := range snapshot.PlaylistIDs {
+		playlistIDs[id] = true
+	}
+	return playlistIDs, snapshot.FetchedAt, nil
+}
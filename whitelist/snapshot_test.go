@@ -0,0 +1,58 @@
+package whitelist
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name        string
+		playlistIDs map[string]bool
+		wantIDs     map[string]bool
+	}{
+		{name: "effective playlists", playlistIDs: map[string]bool{"b": true, "a": true}, wantIDs: map[string]bool{"a": true, "b": true}},
+		{name: "ineffective playlists are dropped", playlistIDs: map[string]bool{"a": true, "b": false}, wantIDs: map[string]bool{"a": true}},
+		{name: "no playlists", playlistIDs: map[string]bool{}, wantIDs: map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "whitelist.json")
+			fetchedAt := time.Date(2026, 10, 15, 8, 0, 0, 0, time.UTC)
+			if err := WriteSnapshot(path, tt.playlistIDs, fetchedAt); err != nil {
+				t.Fatal(err)
+			}
+			// the temporary file is renamed to the snapshot
+			if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+				t.Errorf("files = %d, want only the snapshot", len(files))
+			}
+
+			playlistIDs, gotFetchedAt, err := ReadSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(playlistIDs, tt.wantIDs) {
+				t.Errorf("playlist IDs = %v, want %v", playlistIDs, tt.wantIDs)
+			}
+			if !gotFetchedAt.Equal(fetchedAt) {
+				t.Errorf("fetchedAt = %s, want %s", gotFetchedAt, fetchedAt)
+			}
+		})
+	}
+}
+
+func TestReadInvalidSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte("playlist1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{invalid, filepath.Join(dir, "missing.json")} {
+		if _, _, err := ReadSnapshot(path); err == nil {
+			t.Errorf("snapshot %s is read without error", path)
+		}
+	}
+}
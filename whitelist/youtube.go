@@ -1,64 +1,290 @@
 package whitelist
 
 import (
+	"context"
+	"errors"
+	"sort"
 	"sync"
 	"time"
 
+	ytrelay "github.com/mirror-media/yt-relay"
 	"github.com/mirror-media/yt-relay/cms"
 	"github.com/mirror-media/yt-relay/config"
+	"github.com/mirror-media/yt-relay/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 const refreshCooldown = 1 * time.Minute
 
+// maxRejectedIDs caps the recently rejected playlist IDs kept, so spamming random IDs can't grow it without bound
+const maxRejectedIDs = 10000
+
+// ErrRefreshDisabled is returned by Refresh when the playlist whitelist is frozen to a snapshot
+var ErrRefreshDisabled = errors.New("refreshing playlist whitelist from CMS is disabled")
+
 // YouTubeAPI implements the Whitelist interface
 type YouTubeAPI struct {
-	Whitelist config.Whitelists
-	CmsURL    string
-	mu        sync.RWMutex
-	lastFetch time.Time
+	Whitelist   config.Whitelists
+	windows     map[string][]config.WhitelistWindow
+	CmsURLs     []string
+	CMS         config.CMS
+	mu          sync.RWMutex
+	lastFetch   time.Time
+	lastSuccess time.Time
+	lastErr     error
+
+	// refreshMu serializes the refreshes, so a burst of unknown playlists fetches from the CMS once. mu only guards the
+	// swap of the fetched whitelist, so the validations aren't blocked by a slow CMS.
+	refreshMu sync.Mutex
+
+	rejectionTTL time.Duration
+	rejectedMu   sync.Mutex
+	// rejected are the expiry times of the recently rejected playlist IDs
+	rejected map[string]time.Time
+}
+
+// New creates the whitelist. The playlist IDs in whitelists are regarded as freshly fetched from the CMS.
+func New(whitelists config.Whitelists, cmsURLs []string, cmsConf config.CMS) *YouTubeAPI {
+	windows := make(map[string][]config.WhitelistWindow)
+	for _, window := range whitelists.Windows {
+		windows[window.ID] = append(windows[window.ID], window)
+	}
+	return &YouTubeAPI{
+		Whitelist:   whitelists,
+		windows:     windows,
+		CmsURLs:     cmsURLs,
+		CMS:         cmsConf,
+		lastSuccess: time.Now(),
+
+		rejectionTTL: time.Duration(whitelists.RejectionTTL) * time.Second,
+		rejected:     make(map[string]time.Time),
+	}
 }
 
 func (api *YouTubeAPI) ValidateChannelID(channelID string) bool {
 	effective, present := api.Whitelist.ChannelIDs[channelID]
-	return present && effective
+	return present && effective && api.isInWindow(channelID, time.Now())
+}
+
+// isInWindow reports if the id is in any of its windows, or true if it has no window
+func (api *YouTubeAPI) isInWindow(id string, now time.Time) bool {
+	windows, present := api.windows[id]
+	if !present {
+		return true
+	}
+	for _, window := range windows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
 }
 
-func (api *YouTubeAPI) ValidatePlaylistIDs(playlistID string) bool {
+func (api *YouTubeAPI) ValidatePlaylistIDs(playlistID string) (isValid bool, source ytrelay.WhitelistSource) {
+	// refreshing doesn't change the windows
+	if !api.isInWindow(playlistID, time.Now()) {
+		return false, ""
+	}
+
 	api.mu.RLock()
 	effective, present := api.Whitelist.PlaylistIDs[playlistID]
 	api.mu.RUnlock()
 
 	if present && effective {
-		return true
+		return true, api.cachedSource()
+	}
+
+	if api.isRecentlyRejected(playlistID, time.Now()) {
+		return false, ""
 	}
 
 	return api.refreshAndValidatePlaylist(playlistID)
 }
 
-func (api *YouTubeAPI) refreshAndValidatePlaylist(playlistID string) bool {
-	api.mu.Lock()
-	defer api.mu.Unlock()
+// isRecentlyRejected reports if playlistID was rejected within the rejection ttl
+func (api *YouTubeAPI) isRecentlyRejected(playlistID string, now time.Time) bool {
+	if api.rejectionTTL <= 0 {
+		return false
+	}
+	api.rejectedMu.Lock()
+	defer api.rejectedMu.Unlock()
+
+	expiry, present := api.rejected[playlistID]
+	if present && !now.Before(expiry) {
+		delete(api.rejected, playlistID)
+		return false
+	}
+	return present
+}
 
+// reject keeps playlistID as rejected for the rejection ttl. The caller must hold refreshMu, so it can't be kept after a
+// refresh which may have added it.
+func (api *YouTubeAPI) reject(playlistID string) {
+	if api.rejectionTTL <= 0 {
+		return
+	}
+	api.rejectedMu.Lock()
+	defer api.rejectedMu.Unlock()
+
+	now := time.Now()
+	if len(api.rejected) >= maxRejectedIDs {
+		for id, expiry := range api.rejected {
+			if !now.Before(expiry) {
+				delete(api.rejected, id)
+			}
+		}
+		if len(api.rejected) >= maxRejectedIDs {
+			return
+		}
+	}
+	api.rejected[playlistID] = now.Add(api.rejectionTTL)
+}
+
+// forgetRejections clears the rejected playlist IDs once the whitelist changes
+func (api *YouTubeAPI) forgetRejections() {
+	api.rejectedMu.Lock()
+	defer api.rejectedMu.Unlock()
+	api.rejected = make(map[string]time.Time)
+}
+
+// cachedSource is the source of the playlists in the whitelist before any refresh
+func (api *YouTubeAPI) cachedSource() ytrelay.WhitelistSource {
+	if api.Whitelist.DisableCMSRefresh {
+		return ytrelay.WhitelistSourceStatic
+	}
+	return ytrelay.WhitelistSourceCMSCached
+}
+
+func (api *YouTubeAPI) refreshAndValidatePlaylist(playlistID string) (isValid bool, source ytrelay.WhitelistSource) {
+	api.refreshMu.Lock()
+	defer api.refreshMu.Unlock()
+
+	// another request may have refreshed it while waiting for the lock
+	api.mu.RLock()
 	effective, present := api.Whitelist.PlaylistIDs[playlistID]
+	lastFetch := api.lastFetch
+	api.mu.RUnlock()
 	if present && effective {
-		return true
+		return true, api.cachedSource()
 	}
 
-	if time.Since(api.lastFetch) < refreshCooldown {
-		return false
+	if time.Since(lastFetch) < refreshCooldown {
+		api.reject(playlistID)
+		return false, ""
+	}
+
+	if _, err := api.refresh(); err != nil {
+		api.reject(playlistID)
+		return false, ""
+	}
+
+	api.mu.RLock()
+	effective, present = api.Whitelist.PlaylistIDs[playlistID]
+	api.mu.RUnlock()
+	if present && effective {
+		return true, ytrelay.WhitelistSourceCMSFresh
+	}
+	api.reject(playlistID)
+	return false, ""
+}
+
+// Refresh fetches the playlist IDs from the CMS immediately regardless of refreshCooldown
+func (api *YouTubeAPI) Refresh() (count int, err error) {
+	api.refreshMu.Lock()
+	defer api.refreshMu.Unlock()
+
+	return api.refresh()
+}
+
+// RefreshEvery refreshes the playlist whitelist from the CMS every interval in the background regardless of the
+// requests until stop is called. The lazy refresh of the unknown playlists is kept as a fallback.
+func (api *YouTubeAPI) RefreshEvery(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				// the failures are logged by refresh
+				if count, err := api.Refresh(); err == nil {
+					log.Infof("playlist whitelist is refreshed in the background with %d playlist IDs", count)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// refresh replaces the playlist whitelist with the one from the CMS. The caller must hold refreshMu. The CMS is fetched
+// without the write lock, which is only taken to swap the whitelist.
+func (api *YouTubeAPI) refresh() (count int, err error) {
+	if api.Whitelist.DisableCMSRefresh {
+		return 0, ErrRefreshDisabled
 	}
 
-	newIDs, err := cms.FetchPlaylistIDs(api.CmsURL)
+	newIDs, err := cms.FetchPlaylistIDs(context.Background(), api.CmsURLs, api.CMS)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
 	if err != nil {
 		log.Errorf("failed to refresh playlist whitelist from CMS: %v", err)
+		metrics.WhitelistRefreshes.WithLabelValues("failure").Inc()
 		api.lastFetch = time.Now()
-		return false
+		api.lastErr = err
+		return 0, err
 	}
 
+	metrics.WhitelistRefreshes.WithLabelValues("success").Inc()
 	api.Whitelist.PlaylistIDs = newIDs
+	api.forgetRejections()
 	api.lastFetch = time.Now()
+	api.lastSuccess = api.lastFetch
+	api.lastErr = nil
+	return len(newIDs), nil
+}
 
-	effective, present = api.Whitelist.PlaylistIDs[playlistID]
-	return present && effective
+// Effective lists the effective channel and playlist IDs in their windows
+func (api *YouTubeAPI) Effective() ytrelay.EffectiveWhitelist {
+	now := time.Now()
+	effective := ytrelay.EffectiveWhitelist{
+		ChannelIDs: api.effectiveIDs(api.Whitelist.ChannelIDs, now),
+	}
+
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	effective.PlaylistIDs = api.effectiveIDs(api.Whitelist.PlaylistIDs, now)
+	effective.LastFetch = api.lastSuccess
+	return effective
+}
+
+func (api *YouTubeAPI) effectiveIDs(whitelist map[string]bool, now time.Time) []string {
+	ids := make([]string, 0, len(whitelist))
+	for id, effective := range whitelist {
+		if effective && api.isInWindow(id, now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Status reports the last CMS fetch results of the playlist whitelist
+func (api *YouTubeAPI) Status() ytrelay.WhitelistStatus {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+
+	status := ytrelay.WhitelistStatus{
+		LastSuccess:   api.lastSuccess,
+		LastAttempt:   api.lastFetch,
+		PlaylistCount: len(api.Whitelist.PlaylistIDs),
+	}
+	if api.lastErr != nil {
+		status.LastError = api.lastErr.Error()
+	}
+	return status
 }
@@ -0,0 +1,268 @@
+package whitelist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ytrelay "github.com/mirror-media/yt-relay"
+	"github.com/mirror-media/yt-relay/config"
+)
+
+// newTestCMS responds the shows with the playlist NEW and counts the fetches. The responses of the blocking CMS wait
+// for release, which is called at the end of the test at the latest so that the server isn't stuck closing.
+func newTestCMS(t *testing.T, statusCode int, isBlocking bool) (url string, fetches *int32, release func()) {
+	t.Helper()
+	fetches = new(int32)
+	released := make(chan struct{})
+	var once sync.Once
+	release = func() { once.Do(func() { close(released) }) }
+	if !isBlocking {
+		release()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		<-released
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(`{"data":{"shows":[{"playList01":"https://youtube.com/playlist?list=NEW"}]}}`))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(release)
+	return server.URL, fetches, release
+}
+
+func TestValidatePlaylistIDs(t *testing.T) {
+	tests := []struct {
+		name              string
+		playlistID        string
+		disableCMSRefresh bool
+		cmsStatus         int
+		// fetchedRecently marks the whitelist as fetched within refreshCooldown
+		fetchedRecently bool
+		wantValid       bool
+		wantSource      ytrelay.WhitelistSource
+		wantFetches     int32
+	}{
+		{name: "known playlist", playlistID: "playlist1", cmsStatus: http.StatusOK, wantValid: true, wantSource: ytrelay.WhitelistSourceCMSCached},
+		{name: "known playlist of frozen whitelist", playlistID: "playlist1", disableCMSRefresh: true, cmsStatus: http.StatusOK, wantValid: true, wantSource: ytrelay.WhitelistSourceStatic},
+		{name: "unknown playlist is fetched", playlistID: "NEW", cmsStatus: http.StatusOK, wantValid: true, wantSource: ytrelay.WhitelistSourceCMSFresh, wantFetches: 1},
+		{name: "unknown playlist out of CMS", playlistID: "OTHER", cmsStatus: http.StatusOK, wantFetches: 1},
+		{name: "unknown playlist within cooldown isn't fetched", playlistID: "NEW", cmsStatus: http.StatusOK, fetchedRecently: true},
+		{name: "unknown playlist of frozen whitelist isn't fetched", playlistID: "NEW", disableCMSRefresh: true, cmsStatus: http.StatusOK},
+		{name: "CMS failure rejects unknown playlist", playlistID: "NEW", cmsStatus: http.StatusBadRequest, wantFetches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmsURL, fetches, _ := newTestCMS(t, tt.cmsStatus, false)
+			api := New(config.Whitelists{
+				PlaylistIDs:       map[string]bool{"playlist1": true},
+				DisableCMSRefresh: tt.disableCMSRefresh,
+			}, []string{cmsURL}, config.CMS{Timeout: 1})
+			if tt.fetchedRecently {
+				api.lastFetch = time.Now()
+			}
+
+			isValid, source := api.ValidatePlaylistIDs(tt.playlistID)
+			if isValid != tt.wantValid || source != tt.wantSource {
+				t.Errorf("ValidatePlaylistIDs(%s) = %v, %q, want %v, %q", tt.playlistID, isValid, source, tt.wantValid, tt.wantSource)
+			}
+			if got := atomic.LoadInt32(fetches); got != tt.wantFetches {
+				t.Errorf("fetches = %d, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestSlowCMSDoesNotBlockValidations(t *testing.T) {
+	cmsURL, fetches, release := newTestCMS(t, http.StatusOK, true)
+	api := New(config.Whitelists{PlaylistIDs: map[string]bool{"playlist1": true}}, []string{cmsURL}, config.CMS{Timeout: 5})
+
+	// a burst of the unknown playlist waits for a single fetch
+	const burst = 10
+	var wg sync.WaitGroup
+	results := make(chan bool, burst)
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isValid, _ := api.ValidatePlaylistIDs("NEW")
+			results <- isValid
+		}()
+	}
+	for atomic.LoadInt32(fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	validated := make(chan bool, 1)
+	go func() {
+		isValid, _ := api.ValidatePlaylistIDs("playlist1")
+		api.Status()
+		api.Effective()
+		validated <- isValid
+	}()
+	select {
+	case isValid := <-validated:
+		if !isValid {
+			t.Error("known playlist is rejected during the fetch")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known playlist is blocked by the fetch")
+	}
+
+	release()
+	wg.Wait()
+	close(results)
+	for isValid := range results {
+		if !isValid {
+			t.Error("fetched playlist is rejected")
+		}
+	}
+	if got := atomic.LoadInt32(fetches); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+}
+
+func TestRejectionTTL(t *testing.T) {
+	tests := []struct {
+		name         string
+		rejectionTTL int
+		cmsStatus    int
+		// expire lets the rejection expire before the playlist is validated again
+		expire      bool
+		wantFetches int32
+	}{
+		{name: "rejected playlist isn't fetched again", rejectionTTL: 60, cmsStatus: http.StatusOK, wantFetches: 1},
+		{name: "rejected playlist by CMS failure isn't fetched again", rejectionTTL: 60, cmsStatus: http.StatusBadRequest, wantFetches: 1},
+		{name: "expired rejection is fetched again", rejectionTTL: 60, cmsStatus: http.StatusOK, expire: true, wantFetches: 2},
+		{name: "rejections aren't kept without ttl", cmsStatus: http.StatusOK, wantFetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmsURL, fetches, _ := newTestCMS(t, tt.cmsStatus, false)
+			api := New(config.Whitelists{
+				PlaylistIDs:  map[string]bool{"playlist1": true},
+				RejectionTTL: tt.rejectionTTL,
+			}, []string{cmsURL}, config.CMS{Timeout: 1})
+
+			for i := 0; i < 2; i++ {
+				if i > 0 && tt.expire {
+					api.rejectedMu.Lock()
+					api.rejected["OTHER"] = time.Now()
+					api.rejectedMu.Unlock()
+				}
+				// skip refreshCooldown so that only the rejection keeps the playlist from being fetched
+				api.lastFetch = time.Time{}
+
+				if isValid, _ := api.ValidatePlaylistIDs("OTHER"); isValid {
+					t.Fatal("unknown playlist is valid")
+				}
+			}
+			if got := atomic.LoadInt32(fetches); got != tt.wantFetches {
+				t.Errorf("fetches = %d, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestRefreshEvery(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	tests := []struct {
+		name      string
+		cmsStatus int
+		wantNew   bool
+	}{
+		{name: "whitelist is refreshed in the background", cmsStatus: http.StatusOK, wantNew: true},
+		{name: "failed refreshes keep the whitelist", cmsStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmsURL, fetches, _ := newTestCMS(t, tt.cmsStatus, false)
+			api := New(config.Whitelists{
+				PlaylistIDs: map[string]bool{"playlist1": true},
+			}, []string{cmsURL}, config.CMS{Timeout: 1})
+
+			stop := api.RefreshEvery(interval)
+			// the refreshes don't wait for the requests
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(fetches) < 2 {
+				if time.Now().After(deadline) {
+					stop()
+					t.Fatalf("fetches = %d in a second, want at least 2", atomic.LoadInt32(fetches))
+				}
+				time.Sleep(interval / 4)
+			}
+			stop()
+
+			api.mu.RLock()
+			isNew, isKept := api.Whitelist.PlaylistIDs["NEW"], api.Whitelist.PlaylistIDs["playlist1"]
+			api.mu.RUnlock()
+			if isNew != tt.wantNew {
+				t.Errorf("NEW is whitelisted = %v, want %v", isNew, tt.wantNew)
+			}
+			if !tt.wantNew && !isKept {
+				t.Error("playlist1 is removed by the failed refreshes")
+			}
+
+			// no refresh is started after stop, and the one in flight may still finish
+			stopped := atomic.LoadInt32(fetches)
+			time.Sleep(5 * interval)
+			if got := atomic.LoadInt32(fetches); got > stopped+1 {
+				t.Errorf("fetches = %d after stop, want at most %d", got, stopped+1)
+			}
+		})
+	}
+}
+
+func TestWindows(t *testing.T) {
+	now := time.Now()
+	hour := time.Hour
+	tests := []struct {
+		name      string
+		effective bool
+		windows   []config.WhitelistWindow
+		wantValid bool
+	}{
+		{name: "without window", effective: true, wantValid: true},
+		{name: "ineffective without window", effective: false},
+		{name: "before window", effective: true, windows: []config.WhitelistWindow{{Start: now.Add(hour), End: now.Add(2 * hour)}}},
+		{name: "in window", effective: true, windows: []config.WhitelistWindow{{Start: now.Add(-hour), End: now.Add(hour)}}, wantValid: true},
+		{name: "after window", effective: true, windows: []config.WhitelistWindow{{Start: now.Add(-2 * hour), End: now.Add(-hour)}}},
+		{name: "after start of open-ended window", effective: true, windows: []config.WhitelistWindow{{Start: now.Add(-hour)}}, wantValid: true},
+		{name: "before end of window without start", effective: true, windows: []config.WhitelistWindow{{End: now.Add(hour)}}, wantValid: true},
+		{name: "in any of windows", effective: true, windows: []config.WhitelistWindow{{End: now.Add(-hour)}, {Start: now.Add(-hour), End: now.Add(hour)}}, wantValid: true},
+		{name: "ineffective in window", effective: false, windows: []config.WhitelistWindow{{Start: now.Add(-hour), End: now.Add(hour)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var windows []config.WhitelistWindow
+			for _, id := range []string{"channel1", "playlist1"} {
+				for _, window := range tt.windows {
+					window.ID = id
+					windows = append(windows, window)
+				}
+			}
+			api := New(config.Whitelists{
+				ChannelIDs:        map[string]bool{"channel1": tt.effective},
+				PlaylistIDs:       map[string]bool{"playlist1": tt.effective},
+				Windows:           windows,
+				DisableCMSRefresh: true,
+			}, nil, config.CMS{})
+
+			if got := api.ValidateChannelID("channel1"); got != tt.wantValid {
+				t.Errorf("ValidateChannelID() = %v, want %v", got, tt.wantValid)
+			}
+			if got, _ := api.ValidatePlaylistIDs("playlist1"); got != tt.wantValid {
+				t.Errorf("ValidatePlaylistIDs() = %v, want %v", got, tt.wantValid)
+			}
+			effective := api.Effective()
+			if got := len(effective.ChannelIDs) == 1 && len(effective.PlaylistIDs) == 1; got != tt.wantValid {
+				t.Errorf("Effective() = %+v, want the IDs effective %v", effective, tt.wantValid)
+			}
+		})
+	}
+}
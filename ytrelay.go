@@ -1,31 +1,86 @@
 package ytrelay
 
+import (
+	"context"
+	"time"
+)
+
 // Options are used to store the supported parsed queries and passed to VideoRelay service
 type Options struct {
-	ChannelID  string `form:"channelId"`  // For YouTube
-	EventType  string `form:"eventType"`  // For YouTube
-	Fields     string `form:"fields"`     // For YouTube
-	IDs        string `form:"id"`         // For YouTube
-	MaxResults int64  `form:"maxResults"` // For YouTube
-	Order      string `form:"order"`      // For YouTube
-	PageToken  string `form:"pageToken"`  // For YouTube
-	Part       string `form:"part"`       // For YouTube
-	PlaylistID string `form:"playlistId"` // For YouTube
-	Query      string `form:"q"`          // For YouTube
-	SafeSearch string `form:"safeSearch"` // For YouTube
-	Type       string `form:"type"`       // For YouTube
+	AutoPaginate     bool   `form:"autoPaginate"`     // Streams the items of all the pages of playlistItems as a single array
+	ChannelID        string `form:"channelId"`        // For YouTube
+	EmbeddableOnly   bool   `form:"embeddableOnly"`   // Only the embeddable videos are listed by search and videos
+	Envelope         bool   `form:"envelope"`         // Wraps the list response in relay.Envelope
+	EventType        string `form:"eventType"`        // For YouTube
+	Fields           string `form:"fields"`           // Comma-separated dot paths to keep in the response
+	IDs              string `form:"id"`               // For YouTube
+	IncludeDurations bool   `form:"includeDurations"` // Adds the durations of the videos to the contentDetails of playlistItems
+	Language         string `form:"hl"`               // Language of the localized snippets of videos, playlists, and videoCategories, rejected by search and playlistItems
+	MaxResults       int64  `form:"maxResults"`       // For YouTube
+	Merge            bool   `form:"merge"`            // Merges the items of multiple playlists instead of keying them by the playlists
+	Order            string `form:"order"`            // For YouTube
+	PageToken        string `form:"pageToken"`        // For YouTube
+	Part             string `form:"part"`             // For YouTube
+	PlaylistID       string `form:"playlistId"`       // For YouTube
+	PublishedAfter   string `form:"publishedAfter"`   // RFC3339 lower bound of the publish time of search results
+	PublishedBefore  string `form:"publishedBefore"`  // RFC3339 upper bound of the publish time of search results
+	Query            string `form:"q"`                // For YouTube
+	RegionCode       string `form:"regionCode"`       // For YouTube
+	SafeSearch       string `form:"safeSearch"`       // For YouTube
+	Type             string `form:"type"`             // For YouTube
 }
 
-// VideoRelay is responsible to bypass the api request to the video service
+// VideoRelay is responsible to bypass the api request to the video service. The upstream call is cancelled with ctx.
 type VideoRelay interface {
-	Search(options Options) (resp interface{}, err error)
-	ListByVideoIDs(options Options) (resp interface{}, err error)
-	ListPlaylistVideos(options Options) (resp interface{}, err error)
+	Search(ctx context.Context, options Options) (resp interface{}, err error)
+	ListByVideoIDs(ctx context.Context, options Options) (resp interface{}, err error)
+	ListPlaylistVideos(ctx context.Context, options Options) (resp interface{}, err error)
+	ListPlaylists(ctx context.Context, options Options) (resp interface{}, err error)
+	ListVideoCategories(ctx context.Context, options Options) (resp interface{}, err error)
+	ListChannelSections(ctx context.Context, options Options) (resp interface{}, err error)
+	// NeedsChannelValidation reports if the channels of the videos listed by ListByVideoIDs have to be validated with
+	// the whitelist. If so, ListByVideoIDs responds with *youtube.VideoListResponse, and ListChannelSections responds
+	// with *youtube.ChannelSectionListResponse.
+	NeedsChannelValidation() bool
 }
 
 // APIWhitelist is responsible to validate some options to prevent abusive requests
 type APIWhitelist interface {
 	// ValidateParameters(options Options) bool
 	ValidateChannelID(channelID string) bool
-	ValidatePlaylistIDs(playlistID string) bool
+	// ValidatePlaylistIDs also reports where the approval comes from, which is empty if it's rejected
+	ValidatePlaylistIDs(playlistID string) (isValid bool, source WhitelistSource)
+	Status() WhitelistStatus
+	// Effective lists the IDs accepted at the moment
+	Effective() EffectiveWhitelist
+	// Refresh reloads the whitelist immediately and returns the number of playlist IDs loaded
+	Refresh() (count int, err error)
+}
+
+// WhitelistSource is where the approval of a playlist comes from
+type WhitelistSource string
+
+const (
+	// WhitelistSourceStatic is the playlists frozen by disableCmsRefresh
+	WhitelistSourceStatic WhitelistSource = "static"
+	// WhitelistSourceCMSCached is the playlists fetched from the CMS before the request
+	WhitelistSourceCMSCached WhitelistSource = "cms-cached"
+	// WhitelistSourceCMSFresh is the playlists fetched from the CMS by the request
+	WhitelistSourceCMSFresh WhitelistSource = "cms-fresh"
+)
+
+// EffectiveWhitelist is the sorted IDs accepted at the moment. LastFetch is when the playlist IDs were fetched from the
+// CMS.
+type EffectiveWhitelist struct {
+	ChannelIDs  []string  `json:"channelIDs"`
+	PlaylistIDs []string  `json:"playlistIDs"`
+	LastFetch   time.Time `json:"lastFetch"`
+}
+
+// WhitelistStatus describes how fresh the whitelist fetched from the CMS is
+type WhitelistStatus struct {
+	LastSuccess   time.Time `json:"lastSuccess"`
+	LastAttempt   time.Time `json:"lastAttempt"`
+	LastError     string    `json:"lastError,omitempty"`
+	PlaylistCount int       `json:"playlistCount"`
 }